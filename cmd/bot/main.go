@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"log"
+	_ "time/tzdata" // the runtime image has no zoneinfo for /timezone
 
 	"github.com/ilinovom/summary-tasks-bot/internal/app"
 	"github.com/ilinovom/summary-tasks-bot/internal/config"
@@ -22,6 +23,8 @@ func main() {
 	}
 
 	application := app.New(cfg, repo)
+	application.SetOutbox(repo.Outbox())
+	application.SetState(repo.State())
 	log.Println("bot running")
 	if err := application.Run(context.Background()); err != nil {
 		log.Fatal(err)
@@ -2,15 +2,23 @@ package app
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"html"
 	"log"
 	"os"
 	"os/signal"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/ilinovom/summary-tasks-bot/internal/config"
 	"github.com/ilinovom/summary-tasks-bot/internal/model"
@@ -36,9 +44,159 @@ const (
 	stageChooseCategoryCount
 	stageSetTariffUser
 	stageSetTariffChoice
+	stageConfirmOverwrite
+	stageSelectManyNew
+	stageRetrySave
+	stageStyleTone
+	stageStyleVolume
+	stageEmptyCategory
+	stageSnoozeCategory
+	stageSnoozeDuration
+	stageFormat
+	stageSharedInfoTypes
+	stageUndoConfirm
+	stageToneCategory
+	stageCategoryTone
+	stageLength
+	stageCloneCategory
+	stageCloneName
+	stageInterests
+	stageInterestsConfirm
+	stageStyleTemplate
+	stageRate
+	stageCategoriesPerSend
 )
 
+// stageNames are the human-readable stage names reported by /conv.
+var stageNames = map[convStage]string{
+	stageUpdateChoice:        "update_choice",
+	stageCategory:            "category",
+	stageCustomCategory:      "custom_category",
+	stageInfoTypes:           "info_types",
+	stageWelcome:             "welcome",
+	stageGetNewsCategory:     "get_news_category",
+	stageGetLast24hCategory:  "get_last_24h_category",
+	stageSelectManyExisting:  "select_many_existing",
+	stageDeleteChoice:        "delete_choice",
+	stageSelectDelete:        "select_delete",
+	stageChooseCategoryCount: "choose_category_count",
+	stageSetTariffUser:       "set_tariff_user",
+	stageSetTariffChoice:     "set_tariff_choice",
+	stageConfirmOverwrite:    "confirm_overwrite",
+	stageSelectManyNew:       "select_many_new",
+	stageRetrySave:           "retry_save",
+	stageStyleTone:           "style_tone",
+	stageStyleVolume:         "style_volume",
+	stageEmptyCategory:       "empty_category",
+	stageSnoozeCategory:      "snooze_category",
+	stageSnoozeDuration:      "snooze_duration",
+	stageFormat:              "format",
+	stageSharedInfoTypes:     "shared_info_types",
+	stageUndoConfirm:         "undo_confirm",
+	stageToneCategory:        "tone_category",
+	stageCategoryTone:        "category_tone",
+	stageLength:              "length",
+	stageCloneCategory:       "clone_category",
+	stageCloneName:           "clone_name",
+	stageInterests:           "interests",
+	stageInterestsConfirm:    "interests_confirm",
+	stageStyleTemplate:       "style_template",
+	stageRate:                "rate",
+	stageCategoriesPerSend:   "categories_per_send",
+}
+
+// stageName returns the human-readable name of a conversation stage.
+func stageName(s convStage) string {
+	if s == 0 {
+		return "none"
+	}
+	if name, ok := stageNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("stage(%d)", int(s))
+}
+
+const (
+	// morePage is the keyboard button that shows the next page of options.
+	morePage = "ещё →"
+	// retrySave is the button that repeats a failed save of the topics.
+	retrySave = "Повторить"
+	// pickInfos and dropCategory resolve a category left without info types.
+	pickInfos    = "Выбрать типы"
+	dropCategory = "Удалить категорию"
+	// categoryStatsTop is how many categories /categories_stats lists.
+	categoryStatsTop = 10
+	// styleDefault resets the tone or volume to the tariff default.
+	styleDefault = "По умолчанию"
+	// snoozeResume lifts the pause of a snoozed category.
+	snoozeResume = "Возобновить"
+	// undoApply confirms restoring the previous topics.
+	undoApply = "Вернуть"
+	// rateUp and rateDown are the answers to /rate.
+	rateUp   = "👍"
+	rateDown = "👎"
+	// maxProfiles caps how many topic profiles a user may keep and
+	// maxProfileName the length of a profile name in characters.
+	maxProfiles    = 10
+	maxProfileName = 32
+	// sameInfos switches a batch of new categories to info types chosen once
+	// for all of them.
+	sameInfos = "Одни типы для всех"
+	// continueOnboarding is the button under the welcome message.
+	continueOnboarding = "Продолжить"
+	// describeInterests lets a new user describe their interests instead of
+	// picking categories; acceptSuggested and pickManually answer the
+	// categories suggested for them.
+	describeInterests = "✍️ Описать интересы"
+	acceptSuggested   = "Подтвердить"
+	pickManually      = "Выбрать вручную"
+	// maxSuggestAttempts bounds the AI suggestions one onboarding dialog may
+	// ask for; afterwards the categories are picked manually.
+	maxSuggestAttempts = 3
+	// defaultKeyboardPageSize is used when options.json does not set
+	// keyboard_page_size.
+	defaultKeyboardPageSize = 10
+)
+
+// defaultOptOutKeywords stop the scheduled digests when options.json does not
+// define opt_out_keywords.
+var defaultOptOutKeywords = []string{"стоп", "отписаться", "stop", "unsubscribe"}
+
+// digestFormats are the digest formats offered by /format with their button
+// labels.
+var digestFormats = []struct {
+	Value string
+	Label string
+}{
+	{model.FormatProse, "Связный текст"},
+	{model.FormatBullets, "Тезисы списком"},
+}
+
+// digestLengths are the digest lengths offered by /length with the token
+// limits they map to; the tariff's min_tokens and max_tokens still apply.
+var digestLengths = []struct {
+	Value  string
+	Label  string
+	Tokens int
+}{
+	{"short", "Короткие", 512},
+	{"medium", "Средние", 1024},
+	{"long", "Длинные", 2048},
+}
+
+// snoozeDurations are the pause lengths offered by /snooze_topic.
+var snoozeDurations = []struct {
+	Label string
+	Days  int
+}{
+	{"1 день", 1},
+	{"3 дня", 3},
+	{"Неделя", 7},
+	{"Месяц", 30},
+}
+
 type conversationState struct {
+	Command             string
 	Stage               convStage
 	PrevStage           convStage
 	Step                int
@@ -53,10 +211,51 @@ type conversationState struct {
 	AvailableCats       []string
 	Settings            *model.UserSettings
 	AllowCustomCategory bool
+	MaxCustomCategories int
+	TotalInfoLimit      int
 	SelectedInfos       []string
 	SelectedCats        []string
+	PendingCats         []string
+	Suggested           []string
+	SuggestAttempts     int
 	TargetUser          string
 	NewTariff           string
+	ConfirmOverwrite    bool
+	Page                int
+}
+
+// conversations holds the active dialog of every chat. Chats are handled by
+// several workers at once, so access goes through a mutex.
+type conversations struct {
+	mu    sync.Mutex
+	chats map[int64]*conversationState
+}
+
+// newConversations returns an empty conversation table.
+func newConversations() *conversations {
+	return &conversations{chats: map[int64]*conversationState{}}
+}
+
+// get returns the chat's active conversation.
+func (c *conversations) get(chatID int64) (*conversationState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conv, ok := c.chats[chatID]
+	return conv, ok
+}
+
+// set makes conv the chat's active conversation.
+func (c *conversations) set(chatID int64, conv *conversationState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.chats[chatID] = conv
+}
+
+// delete ends the chat's conversation.
+func (c *conversations) delete(chatID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.chats, chatID)
 }
 
 // formatOptions turns the list of options into numbered lines suitable for a
@@ -69,6 +268,59 @@ func formatOptions(opts []string) string {
 	return strings.Join(lines, "\n")
 }
 
+// formatInfoOptions lists the info options for a prompt, split into titled
+// sections when options.json defines info_groups. Numbers run continuously
+// across sections and match the positions in a.ui().infoOptions.
+func (a *App) formatInfoOptions() string {
+	groups := a.config().Options.InfoGroups
+	if len(groups) == 0 {
+		return formatOptions(a.ui().infoOptions)
+	}
+	return formatGroupedOptions(groups)
+}
+
+// formatGroupedOptions renders numbered options under bold group titles.
+func formatGroupedOptions(groups []config.OptionGroup) string {
+	sections := make([]string, 0, len(groups))
+	n := 0
+	for _, g := range groups {
+		lines := []string{"<b>" + g.Title + "</b>"}
+		for _, o := range g.Options {
+			n++
+			lines = append(lines, fmt.Sprintf("%d. %s", n, o))
+		}
+		sections = append(sections, strings.Join(lines, "\n"))
+	}
+	return strings.Join(sections, "\n\n")
+}
+
+// formatTopics renders categories with their info types, one category per line.
+func formatTopics(topics map[string][]string) string {
+	parts := []string{}
+	for _, cat := range sortedCategories(topics) {
+		parts = append(parts, fmt.Sprintf("%s: %s", cat, strings.Join(topics[cat], ", ")))
+	}
+	return strings.Join(parts, "\n")
+}
+
+// sortedCategories returns the topic categories in a stable order so that the
+// numbers shown to the user do not change between prompts.
+func sortedCategories(topics map[string][]string) []string {
+	cats := make([]string, 0, len(topics))
+	for cat := range topics {
+		cats = append(cats, cat)
+	}
+	sort.Strings(cats)
+	return cats
+}
+
+// activeCategories is sortedCategories without the categories snoozed at now.
+func activeCategories(u *model.UserSettings, now time.Time) []string {
+	return slices.DeleteFunc(sortedCategories(u.Topics), func(cat string) bool {
+		return u.CategorySnoozed(cat, now)
+	})
+}
+
 // addCustomOption adds the "custom" option to the provided slice if the user
 // is allowed to specify their own category.
 func addCustomOption(opts []string, allow bool) []string {
@@ -84,12 +336,18 @@ func addCustomOption(opts []string, allow bool) []string {
 // parseSelection parses comma or space separated option indexes from the user
 // input and returns the corresponding option values up to the provided limit.
 func parseSelection(text string, opts []string, limit int) []string {
+	return parseSelectionRange(text, opts, 0, len(opts), limit)
+}
+
+// parseSelectionRange works like parseSelection but only accepts indexes of
+// options in opts[start:end]; the numbering still starts from the first option.
+func parseSelectionRange(text string, opts []string, start, end, limit int) []string {
 	fields := strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == ' ' })
 	out := []string{}
 	seen := map[int]bool{}
 	for _, f := range fields {
 		idx, err := strconv.Atoi(f)
-		if err != nil || idx < 1 || idx > len(opts) || seen[idx] {
+		if err != nil || idx <= start || idx > end || seen[idx] {
 			continue
 		}
 		seen[idx] = true
@@ -102,10 +360,11 @@ func parseSelection(text string, opts []string, limit int) []string {
 }
 
 // setStage updates the conversation state and remembers the previous stage to
-// support navigating backward.
+// support navigating backward. A new stage starts on the first keyboard page.
 func (c *conversationState) setStage(s convStage) {
 	c.PrevStage = c.Stage
 	c.Stage = s
+	c.Page = 0
 }
 
 // back returns the conversation to the previous stage if possible.
@@ -118,9 +377,14 @@ func (c *conversationState) back() {
 
 // numberKeyboard builds a keyboard with numeric buttons from 1 to n.
 func numberKeyboard(n int) [][]string {
+	return numberRangeKeyboard(1, n)
+}
+
+// numberRangeKeyboard builds a keyboard with numeric buttons from first to last.
+func numberRangeKeyboard(first, last int) [][]string {
 	rows := [][]string{}
 	row := []string{}
-	for i := 1; i <= n; i++ {
+	for i := first; i <= last; i++ {
 		row = append(row, strconv.Itoa(i))
 		if len(row) == 5 {
 			rows = append(rows, row)
@@ -141,6 +405,82 @@ func numberKeyboardWithDone(n int) [][]string {
 	return rows
 }
 
+// pageSize returns how many category buttons fit on one keyboard page.
+func (a *App) pageSize() int {
+	if n := a.config().Options.KeyboardPageSize; n > 0 {
+		return n
+	}
+	return defaultKeyboardPageSize
+}
+
+// pageBounds returns the range of option indexes shown on the given page.
+func pageBounds(n, page, size int) (int, int) {
+	start := page * size
+	if start >= n {
+		start = 0
+	}
+	end := start + size
+	if end > n {
+		end = n
+	}
+	return start, end
+}
+
+// pageKeyboard builds the numeric keyboard for the conversation's current
+// page of n options. The "more" button is added only when the options do not
+// fit on a single page.
+func (a *App) pageKeyboard(c *conversationState, n int, done bool) [][]string {
+	size := a.pageSize()
+	start, end := pageBounds(n, c.Page, size)
+	rows := numberRangeKeyboard(start+1, end)
+	if n > size {
+		rows = append(rows, []string{morePage})
+	}
+	if done {
+		rows = append(rows, []string{"Готово"})
+	}
+	return rows
+}
+
+// nextPage advances the conversation to the next page of n options, wrapping
+// around to the first one after the last page.
+func (a *App) nextPage(c *conversationState, n int) {
+	c.Page++
+	if c.Page*a.pageSize() >= n {
+		c.Page = 0
+	}
+}
+
+// pageOptions lists the options of the conversation's current keyboard page
+// for a prompt, numbered by their position in opts.
+func (a *App) pageOptions(c *conversationState, opts []string) string {
+	start, end := pageBounds(len(opts), c.Page, a.pageSize())
+	lines := make([]string, 0, end-start)
+	for i := start; i < end; i++ {
+		lines = append(lines, fmt.Sprintf("%d. %s", i+1, opts[i]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// selectOnPage parses the user's choice accepting only the options visible on
+// the current keyboard page.
+func (a *App) selectOnPage(c *conversationState, text string, opts []string, limit int) []string {
+	start, end := pageBounds(len(opts), c.Page, a.pageSize())
+	return parseSelectionRange(text, opts, start, end, limit)
+}
+
+// categoryPrompt renders the single category choice prompt: either the
+// replacement of c.OldCat or the next category of the full update.
+func (a *App) categoryPrompt(c *conversationState) (string, [][]string) {
+	opts := addCustomOption(a.ui().categoryOptions, c.AllowCustomCategory)
+	if c.OldCat != "" {
+		prompt := fmt.Sprintf(a.ui().messages["prompt_choose_new"], c.OldCat, a.pageOptions(c, opts))
+		return prompt, addBackCancel(a.pageKeyboard(c, len(opts), false))
+	}
+	prompt := fmt.Sprintf(a.ui().messages["prompt_choose_category"], c.Step+1, a.pageOptions(c, opts))
+	return prompt, addBack(a.pageKeyboard(c, len(opts), true))
+}
+
 // addBack appends a "Back" button to the given keyboard.
 func addBack(kb [][]string) [][]string {
 	return append(kb, []string{"Назад"})
@@ -156,43 +496,291 @@ func addCancel(kb [][]string) [][]string {
 	return append(kb, []string{"Отмена"})
 }
 
+// TelegramClient describes the part of the Telegram client used by the application.
+type TelegramClient interface {
+	SendMessage(ctx context.Context, chatID int64, text string, keyboard [][]string, mode telegram.ParseMode) (int, error)
+	GetUpdates(ctx context.Context, offset int) ([]telegram.Update, error)
+	SetCommands(ctx context.Context, commands []telegram.BotCommand) error
+	SetMyDescription(ctx context.Context, description string) error
+	SetMyShortDescription(ctx context.Context, description string) error
+	DeleteMessage(ctx context.Context, chatID int64, messageID int) error
+	EditMessageText(ctx context.Context, chatID int64, messageID int, text string, mode telegram.ParseMode) error
+	SendInlineMessage(ctx context.Context, chatID int64, text string, buttons [][]telegram.InlineButton, mode telegram.ParseMode) (int, error)
+	EditInlineMessage(ctx context.Context, chatID int64, messageID int, text string, buttons [][]telegram.InlineButton, mode telegram.ParseMode) error
+	AnswerCallbackQuery(ctx context.Context, queryID, text string) error
+	SendDocument(ctx context.Context, chatID int64, filename string, data []byte, caption string) (int, error)
+	GetMe(ctx context.Context) (telegram.User, error)
+}
+
 // App coordinates the services and telegram client.
 type App struct {
-	cfg             *config.Config
-	repo            repository.UserSettingsRepository
-	userService     *service.UserService
-	tgClient        *telegram.Client
-	aiClient        *openai.Client
-	convs           map[int64]*conversationState
+	cfgMu       sync.RWMutex
+	cfg         *config.Config
+	repo        repository.UserSettingsRepository
+	userService *service.UserService
+	tgClient    TelegramClient
+	aiClient    service.AIClient
+	// uiCfg is swapped together with cfg by /reload; read it through ui.
+	uiCfg       *uiConfig
+	convs       *conversations
+	chats       *chatLocks
+	clock       service.Clock
+	sendLimiter *rateLimiter
+	maintenance atomic.Bool
+	// botUsername is the bot's own username used to recognise group
+	// commands like /start@bot; it is looked up once at startup.
+	botUsername string
+	// outbox queues scheduled digests for delivery with retries; without
+	// it digests are sent right away.
+	outbox repository.OutboxRepository
+	// state persists the scheduler's last tick for the readiness check;
+	// lastBeat is the last stored one in Unix nanoseconds.
+	state     repository.StateRepository
+	lastBeat  atomic.Int64
+	startedAt time.Time
+
+	digestMu     sync.Mutex
+	lastDigests  map[int64]string
+	last24hCache map[int64]last24hDigest
+	newsCache    map[int64]newsDigest
+
+	dueCursor int64
+
+	genMu       sync.Mutex
+	genSeq      int
+	generations map[int64]generation
+	generating  sync.WaitGroup
+}
+
+// uiConfig is the user-facing part of the configuration: the message
+// templates and the option lists. /reload replaces it as a whole, so a
+// snapshot taken with ui is never changed underneath a handler.
+type uiConfig struct {
+	messages        map[string]string
 	infoOptions     []string
 	categoryOptions []string
-	messages        map[string]string
 }
 
-// New constructs the application instance with all dependencies wired.
-func New(cfg *config.Config, repo repository.UserSettingsRepository) *App {
-	return &App{
-		cfg:             cfg,
-		repo:            repo,
-		tgClient:        telegram.NewClient(cfg.TelegramToken),
-		aiClient:        openai.NewClient(cfg.OpenAIToken, cfg.OpenAIBaseURL),
-		convs:           map[int64]*conversationState{},
+// newUIConfig takes the user-facing snapshot of cfg.
+func newUIConfig(cfg *config.Config) *uiConfig {
+	return &uiConfig{
+		messages:        cfg.Messages,
 		infoOptions:     cfg.Options.InfoOptions,
 		categoryOptions: cfg.Options.CategoryOptions,
-		messages:        cfg.Messages,
 	}
 }
 
-// sendMessage is a small wrapper around the Telegram client that logs failures
-// but still returns the message ID to the caller.
+// last24hDigest is the latest last-24h result of a user, kept for
+// /reading_list.
+type last24hDigest struct {
+	Category string
+	Text     string
+	At       time.Time
+}
+
+// generation is an in-flight on-demand news generation for a chat.
+type generation struct {
+	id     int
+	cancel context.CancelFunc
+}
+
+// New constructs the application instance with all dependencies wired.
+func New(cfg *config.Config, repo repository.UserSettingsRepository) *App {
+	ai := openai.NewClientWithEndpoints(cfg.OpenAIToken, cfg.OpenAIChatBaseURL, cfg.OpenAIResponsesBaseURL)
+	ai.SetRetry(cfg.OpenAIMaxRetries, cfg.OpenAIRetryBase)
+	a := &App{
+		cfg:         cfg,
+		repo:        repo,
+		tgClient:    telegram.NewClient(cfg.TelegramToken),
+		aiClient:    ai,
+		convs:       newConversations(),
+		chats:       newChatLocks(),
+		lastDigests: map[int64]string{},
+		generations: map[int64]generation{},
+		uiCfg:       newUIConfig(cfg),
+		clock:       service.SystemClock{},
+		sendLimiter: newRateLimiter(cfg.SendRate),
+	}
+	a.maintenance.Store(cfg.Maintenance)
+	return a
+}
+
+// SetOutbox makes the scheduler queue digests in the outbox, from which a
+// worker delivers them with retries.
+func (a *App) SetOutbox(o repository.OutboxRepository) {
+	a.outbox = o
+}
+
+// SetState makes the scheduler record its ticks, which /readyz checks.
+func (a *App) SetState(s repository.StateRepository) {
+	a.state = s
+}
+
+// config returns the active configuration.
+func (a *App) config() *config.Config {
+	a.cfgMu.RLock()
+	defer a.cfgMu.RUnlock()
+	return a.cfg
+}
+
+// ui returns the active message templates and option lists.
+func (a *App) ui() *uiConfig {
+	a.cfgMu.RLock()
+	defer a.cfgMu.RUnlock()
+	return a.uiCfg
+}
+
+// tariffFor returns the named tariff, falling back to the base tariff.
+func (a *App) tariffFor(name string) config.Tariff {
+	cfg := a.config()
+	if t, ok := cfg.Tariffs[name]; ok {
+		return t
+	}
+	return cfg.Tariffs["base"]
+}
+
+// isAdmin reports whether the Telegram username belongs to a bot operator.
+func (a *App) isAdmin(username string) bool {
+	for _, admin := range a.config().Admins {
+		if strings.EqualFold(admin, username) {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadConfig re-reads options, tariffs and messages from disk and activates
+// them. The current configuration stays in place if the new one is invalid.
+func (a *App) reloadConfig() error {
+	next, err := a.config().Reload()
+	if err != nil {
+		return err
+	}
+	a.cfgMu.Lock()
+	a.cfg = next
+	a.uiCfg = newUIConfig(next)
+	a.cfgMu.Unlock()
+	if a.userService != nil {
+		a.userService.SetTariffs(next.Tariffs)
+		a.userService.SetEmptyReply(next.Messages["empty_reply"])
+		a.userService.SetSafety(next.Options.SafeModePrompt, next.Options.BannedWords)
+		a.userService.SetDebug(next.DebugPrompts)
+		a.userService.SetSearchConcurrency(next.SearchConcurrency)
+	}
+	return nil
+}
+
+// renameInfos migrates stored topics to the current info option names
+// according to the configured aliases. Only users with an old name are
+// touched: each is read again and saved under its chat lock, so a handler
+// saving the same user meanwhile is not overwritten. The caller must not hold
+// a chat lock; /reload runs it with inBackground.
+func (a *App) renameInfos(ctx context.Context) {
+	aliases := a.config().Options.InfoAliases
+	if len(aliases) == 0 {
+		return
+	}
+	all, err := a.repo.List(ctx)
+	if err != nil {
+		log.Println("rename info types:", err)
+		return
+	}
+	n := 0
+	for _, u := range all {
+		if !u.RenameInfos(aliases) {
+			continue
+		}
+		unlock, err := a.chats.lock(ctx, u.UserID)
+		if err != nil {
+			log.Println("rename info types:", err)
+			return
+		}
+		changed, err := a.userService.RenameUserInfos(ctx, u.UserID, aliases)
+		unlock()
+		if err != nil {
+			log.Println("rename info types:", err)
+			return
+		}
+		if changed {
+			n++
+		}
+	}
+	log.Printf("rename info types: %d users updated", n)
+}
+
+// inBackground runs f outside the current update handler and lets shutdown
+// wait for it. Admin commands that need other chats' locks use it: the
+// handler holds the admin's own chat lock, and taking a second one there
+// would deadlock two admins acting on each other's chats.
+func (a *App) inBackground(f func()) {
+	a.generating.Add(1)
+	go func() {
+		defer a.generating.Done()
+		f()
+	}()
+}
+
+// onUserChat runs f in the background under the chat lock of userID, which
+// may also be the calling admin's own chat; see inBackground.
+func (a *App) onUserChat(ctx context.Context, userID int64, f func()) {
+	a.inBackground(func() {
+		unlock, err := a.chats.lock(ctx, userID)
+		if err != nil {
+			log.Println("lock chat:", err)
+			return
+		}
+		defer unlock()
+		f()
+	})
+}
+
+// sendMessage is a small wrapper around the Telegram client that sends HTML
+// text, logs failures but still returns the message ID to the caller.
 func (a *App) sendMessage(ctx context.Context, chatID int64, text string, kb [][]string) (int, error) {
-	msgID, err := a.tgClient.SendMessage(ctx, chatID, text, kb)
+	return a.sendMessageMode(ctx, chatID, text, kb, telegram.ParseModeHTML)
+}
+
+// sendMessageMode is like sendMessage but uses the given parse mode.
+func (a *App) sendMessageMode(ctx context.Context, chatID int64, text string, kb [][]string, mode telegram.ParseMode) (int, error) {
+	if err := a.sendLimiter.Wait(ctx, isBulk(ctx)); err != nil {
+		return 0, err
+	}
+	msgID, err := a.tgClient.SendMessage(ctx, chatID, text, kb, mode)
 	if err != nil {
 		log.Printf("telegram send message: %v\ntext: %s", err, text)
+		a.noteBlocked(ctx, chatID, err)
 	}
 	return msgID, err
 }
 
+// noteBlocked deactivates the chat's user when an interactive send failed
+// because they blocked the bot. Bulk sends of the scheduler and the outbox
+// handle telegram.ErrBlocked themselves.
+func (a *App) noteBlocked(ctx context.Context, chatID int64, err error) {
+	if !errors.Is(err, telegram.ErrBlocked) || isBulk(ctx) {
+		return
+	}
+	u, err := a.repo.Get(ctx, chatID)
+	if err != nil || u.Blocked {
+		return
+	}
+	a.markBlocked(ctx, u)
+}
+
+// sendDocument uploads a file to the chat, sharing the send rate limit with
+// the messages.
+func (a *App) sendDocument(ctx context.Context, chatID int64, filename string, data []byte, caption string) error {
+	if err := a.sendLimiter.Wait(ctx, isBulk(ctx)); err != nil {
+		return err
+	}
+	_, err := a.tgClient.SendDocument(ctx, chatID, filename, data, caption)
+	if err != nil {
+		log.Printf("telegram send document: %v", err)
+		a.noteBlocked(ctx, chatID, err)
+	}
+	return err
+}
+
 // sendLongMessage splits a long message into several Telegram messages so that
 // each part fits into the platform's limit.
 func (a *App) sendLongMessage(ctx context.Context, chatID int64, text string) error {
@@ -212,6 +800,90 @@ func (a *App) sendLongMessage(ctx context.Context, chatID int64, text string) er
 	return nil
 }
 
+// sendFormatted sends model output in the given parse mode, splitting it into
+// several messages when needed. MarkdownV2 parts are converted with
+// markdownToV2 after splitting, so their raw size is halved to leave room for
+// escaping.
+func (a *App) sendFormatted(ctx context.Context, chatID int64, text string, mode telegram.ParseMode) error {
+	limit := 4096
+	if mode == telegram.ParseModeMarkdownV2 {
+		limit /= 2
+	}
+	runes := []rune(text)
+	for len(runes) > 0 {
+		n := min(limit, len(runes))
+		part := string(runes[:n])
+		if mode == telegram.ParseModeMarkdownV2 {
+			part = markdownToV2(part)
+		}
+		if _, err := a.sendMessageMode(ctx, chatID, part, nil, mode); err != nil {
+			return err
+		}
+		runes = runes[n:]
+	}
+	return nil
+}
+
+// replaceMessage turns a placeholder message into the final text by editing it
+// in place. Text that does not fit into a single message, or a failed edit,
+// falls back to sendFormatted followed by removal of the placeholder. Without
+// a placeholder (ID 0) the text is simply sent.
+func (a *App) replaceMessage(ctx context.Context, chatID int64, placeholderID int, text string, mode telegram.ParseMode) error {
+	if placeholderID == 0 {
+		return a.sendFormatted(ctx, chatID, text, mode)
+	}
+	edited := text
+	if mode == telegram.ParseModeMarkdownV2 {
+		edited = markdownToV2(text)
+	}
+	if len([]rune(edited)) <= 4096 {
+		err := a.tgClient.EditMessageText(ctx, chatID, placeholderID, edited, mode)
+		if err == nil {
+			return nil
+		}
+		log.Printf("telegram edit message: %v", err)
+	}
+	err := a.sendFormatted(ctx, chatID, text, mode)
+	a.deleteMessage(ctx, chatID, placeholderID)
+	return err
+}
+
+// markdownToV2 converts model output to MarkdownV2, keeping **bold** spans and
+// escaping everything else. Unbalanced markers are escaped literally.
+func markdownToV2(text string) string {
+	parts := strings.Split(text, "**")
+	if len(parts)%2 == 0 {
+		return telegram.EscapeMarkdownV2(text)
+	}
+	var b strings.Builder
+	for i, p := range parts {
+		if i%2 == 1 && p != "" {
+			b.WriteString("*" + telegram.EscapeMarkdownV2(p) + "*")
+			continue
+		}
+		b.WriteString(telegram.EscapeMarkdownV2(p))
+	}
+	return b.String()
+}
+
+// markdownToHTML is the HTML counterpart of markdownToV2: **bold** spans become
+// <b> tags and everything else is HTML-escaped.
+func markdownToHTML(text string) string {
+	parts := strings.Split(text, "**")
+	if len(parts)%2 == 0 {
+		return html.EscapeString(text)
+	}
+	var b strings.Builder
+	for i, p := range parts {
+		if i%2 == 1 && p != "" {
+			b.WriteString("<b>" + html.EscapeString(p) + "</b>")
+			continue
+		}
+		b.WriteString(html.EscapeString(p))
+	}
+	return b.String()
+}
+
 // deleteMessage removes a previously sent message and logs any deletion error.
 func (a *App) deleteMessage(ctx context.Context, chatID int64, messageID int) {
 	if err := a.tgClient.DeleteMessage(ctx, chatID, messageID); err != nil {
@@ -221,30 +893,50 @@ func (a *App) deleteMessage(ctx context.Context, chatID int64, messageID int) {
 
 // saveTopics persists the conversation topics to the repository. It also sends
 // a confirmation message to the user about the updated or created settings.
+// The topics are HTML-escaped there since custom categories are free text.
 func (a *App) saveTopics(ctx context.Context, m *telegram.Message, c *conversationState) {
+	if cat := emptyCategory(c.Topics); cat != "" {
+		a.askEmptyCategory(ctx, m.Chat.ID, c, cat)
+		return
+	}
+	a.mergeDuplicateCategories(ctx, m.Chat.ID, c)
 	var settings *model.UserSettings
 	var err error
 	if c.UpdateTopics {
 		settings, err = a.repo.Get(ctx, m.Chat.ID)
 		if err != nil && !errors.Is(err, os.ErrNotExist) {
-			log.Println("save settings:", err)
-			delete(a.convs, m.Chat.ID)
+			a.saveFailed(ctx, m, c, err)
 			return
 		}
 		if err != nil && errors.Is(err, os.ErrNotExist) {
 			settings = &model.UserSettings{UserID: m.Chat.ID, UserName: m.Chat.Username}
 		}
-		settings.Topics = c.Topics
+		replaceTopics(settings, c.Topics)
 		if err := a.repo.Save(ctx, settings); err != nil {
-			log.Println("save settings:", err)
-		} else {
-			parts := []string{}
-			for cat, types := range c.Topics {
-				parts = append(parts, fmt.Sprintf("%s: %s", cat, strings.Join(types, ", ")))
-			}
-			a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf(a.messages["settings_updated"], strings.Join(parts, "\n")), nil)
+			a.saveFailed(ctx, m, c, err)
+			return
+		}
+		a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf(a.ui().messages["settings_updated"], html.EscapeString(formatTopics(c.Topics))), nil)
+		a.convs.delete(m.Chat.ID)
+		return
+	}
+
+	existing, err := a.repo.Get(ctx, m.Chat.ID)
+	if err == nil {
+		if len(existing.Topics) > 0 && !c.ConfirmOverwrite {
+			c.setStage(stageConfirmOverwrite)
+			msgID, _ := a.sendMessage(ctx, m.Chat.ID, a.ui().messages["confirm_overwrite"], addCancel([][]string{{"Заменить"}}))
+			c.LastMsgID = msgID
+			return
 		}
-		delete(a.convs, m.Chat.ID)
+		replaceTopics(existing, c.Topics)
+		existing.Active = true
+		if err := a.repo.Save(ctx, existing); err != nil {
+			a.saveFailed(ctx, m, c, err)
+			return
+		}
+		a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf(a.ui().messages["settings_updated"], html.EscapeString(formatTopics(c.Topics))), nil)
+		a.convs.delete(m.Chat.ID)
 		return
 	}
 
@@ -252,51 +944,202 @@ func (a *App) saveTopics(ctx context.Context, m *telegram.Message, c *conversati
 		UserID:            m.Chat.ID,
 		UserName:          m.Chat.Username,
 		Topics:            c.Topics,
-		Tariff:            "base",
-		LastScheduledSent: time.Now().Unix(),
+		Tariff:            model.DefaultTariff,
+		LastScheduledSent: a.clock.Now().Unix(),
 		LastGetNewsNow:    0,
 		GetNewsNowCount:   0,
 		LastGetLast24h:    0,
 		GetLast24hCount:   0,
 		Active:            true,
 	}
+	if err := a.repo.Save(ctx, settings); err != nil {
+		a.saveFailed(ctx, m, c, err)
+		return
+	}
+	a.convs.delete(m.Chat.ID)
+	a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf(a.ui().messages["settings_saved"], html.EscapeString(formatTopics(c.Topics))), nil)
+	if a.config().NoFirstDigest {
+		return
+	}
+	ds, err := a.userService.GetNewsMultiInfoDigests(ctx, settings)
+	if err != nil {
+		log.Println("get news:", err)
+		a.reportFailure(ctx, m.Chat.ID, 0)
+		return
+	}
+	msgs := digestMessages(settings, ds)
+	recordDigests(settings, ds, a.clock.Now())
 	if err := a.repo.Save(ctx, settings); err != nil {
 		log.Println("save settings:", err)
-	} else {
-		parts := []string{}
-		for cat, types := range c.Topics {
-			parts = append(parts, fmt.Sprintf("%s: %s", cat, strings.Join(types, ", ")))
+	}
+	if err := a.sendDigest(ctx, m.Chat.ID, msgs); err != nil {
+		log.Println("send msg err: ", err)
+	}
+}
+
+// sendDigest sends the digest messages in order, stopping at the first error.
+func (a *App) sendDigest(ctx context.Context, chatID int64, msgs []string) error {
+	for _, msg := range msgs {
+		if err := a.sendFormatted(ctx, chatID, msg, telegram.ParseModeMarkdownV2); err != nil {
+			return err
 		}
-		a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf(a.messages["settings_saved"], strings.Join(parts, "\n")), nil)
-		msg, err := a.userService.GetNewsMultiInfo(ctx, settings)
-		if err == nil {
-			if len([]rune(msg)) > 4096 {
-				if err := a.sendLongMessage(ctx, m.Chat.ID, msg); err != nil {
-					log.Println("send msg err: ", err)
-				}
-			} else {
-				a.sendMessage(ctx, m.Chat.ID, msg, nil)
-			}
-		} else {
-			log.Println("get news:", err)
+	}
+	return nil
+}
+
+// sendInOrder runs a bulk send to the chat once the chat is free, so it
+// follows whatever an update handler is currently sending there instead of
+// interleaving with it.
+func (a *App) sendInOrder(ctx context.Context, chatID int64, send func() error) error {
+	unlock, err := a.chats.lock(ctx, chatID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return send()
+}
+
+// sendBulkDigest sends a scheduled digest with sendDigest in the chat's
+// order.
+func (a *App) sendBulkDigest(ctx context.Context, chatID int64, msgs []string) error {
+	return a.sendInOrder(ctx, chatID, func() error { return a.sendDigest(ctx, chatID, msgs) })
+}
+
+// emptyCategory returns the first category (in display order) that has no
+// info types selected, or "" when every category is complete.
+func emptyCategory(topics map[string][]string) string {
+	for _, cat := range sortedCategories(topics) {
+		if len(topics[cat]) == 0 {
+			return cat
+		}
+	}
+	return ""
+}
+
+// mergeDuplicateCategories folds categories that differ only by case or emoji
+// into one, keeping the preset name when there is one, and tells the user
+// which categories were merged.
+func (a *App) mergeDuplicateCategories(ctx context.Context, chatID int64, c *conversationState) {
+	topics, merges := model.MergeDuplicateCategories(c.Topics, func(name string) bool {
+		return slices.Contains(a.ui().categoryOptions, name)
+	})
+	for _, m := range merges {
+		if c.InfoLimit > 0 && len(topics[m.Into]) > c.InfoLimit {
+			topics[m.Into] = topics[m.Into][:c.InfoLimit]
 		}
+		names := append([]string{m.Into}, m.From...)
+		a.sendMessage(ctx, chatID, fmt.Sprintf(a.ui().messages["categories_merged"], html.EscapeString(strings.Join(names, "», «")), html.EscapeString(m.Into)), nil)
 	}
-	delete(a.convs, m.Chat.ID)
+	c.Topics = topics
+}
+
+// askEmptyCategory asks the user to either pick info types for cat or drop
+// it before the topics are saved.
+func (a *App) askEmptyCategory(ctx context.Context, chatID int64, c *conversationState, cat string) {
+	c.CurrentCat = cat
+	c.setStage(stageEmptyCategory)
+	msgID, _ := a.sendMessage(ctx, chatID, fmt.Sprintf(a.ui().messages["empty_category"], html.EscapeString(cat)), addCancel([][]string{{pickInfos}, {dropCategory}}))
+	c.LastMsgID = msgID
+}
+
+// saveFailed keeps the conversation after topics could not be persisted and
+// offers the user to retry the save instead of redoing the whole dialog.
+func (a *App) saveFailed(ctx context.Context, m *telegram.Message, c *conversationState, err error) {
+	log.Println("save settings:", err)
+	c.setStage(stageRetrySave)
+	msgID, _ := a.sendMessage(ctx, m.Chat.ID, a.ui().messages["save_failed"], addCancel([][]string{{retrySave}}))
+	c.LastMsgID = msgID
+}
+
+// reportFailure tells the user an operation failed instead of leaving the chat
+// silent. The "generating" notice, if any, is turned into the error message.
+func (a *App) reportFailure(ctx context.Context, chatID int64, placeholderID int) {
+	if err := a.replaceMessage(ctx, chatID, placeholderID, a.ui().messages["operation_failed"], telegram.ParseModeHTML); err != nil {
+		log.Println("send msg err: ", err)
+	}
+}
+
+// setDescription sets the bot's profile description and short description
+// from the "bot_description" and "bot_short_description" messages. A missing
+// text leaves the one set in BotFather untouched.
+func (a *App) setDescription(ctx context.Context) {
+	ui := a.ui()
+	description, short := ui.messages["bot_description"], ui.messages["bot_short_description"]
+	if description != "" {
+		if err := a.tgClient.SetMyDescription(ctx, description); err != nil {
+			log.Println("set description:", err)
+		}
+	}
+	if short != "" {
+		if err := a.tgClient.SetMyShortDescription(ctx, short); err != nil {
+			log.Println("set short description:", err)
+		}
+	}
+}
+
+// loadBotUsername asks Telegram for the bot's username. Without it commands
+// addressed to any bot are accepted.
+func (a *App) loadBotUsername(ctx context.Context) {
+	me, err := a.tgClient.GetMe(ctx)
+	if err != nil {
+		log.Println("get me:", err)
+		return
+	}
+	a.botUsername = me.Username
+}
+
+// commandForBot strips the "@bot" suffix from a command such as
+// "/start@MyBot extra", as sent in group chats. It reports false for commands
+// addressed to another bot. Texts that are not commands are returned as is.
+func commandForBot(text, bot string) (string, bool) {
+	if !strings.HasPrefix(text, "/") {
+		return text, true
+	}
+	end := strings.IndexAny(text, " \t\n")
+	if end < 0 {
+		end = len(text)
+	}
+	name, mention, found := strings.Cut(text[:end], "@")
+	if !found {
+		return text, true
+	}
+	if bot != "" && !strings.EqualFold(mention, bot) {
+		return text, false
+	}
+	return name + text[end:], true
 }
 
 // Run starts the main application logic and blocks until the context is
-// cancelled. It launches goroutines for updates and scheduled messages.
+// cancelled or the process gets SIGINT or SIGTERM. It launches goroutines for
+// updates and scheduled messages and waits for them to wind down.
 func (a *App) Run(ctx context.Context) error {
 	log.Println("application starting")
-	a.userService = service.NewUserService(a.repo, a.aiClient, a.cfg.Tariffs)
+	a.userService = service.NewUserService(a.repo, a.aiClient, a.config().Tariffs)
+	a.userService.SetClock(a.clock)
+	a.userService.SetEmptyReply(a.ui().messages["empty_reply"])
+	a.userService.SetSafety(a.config().Options.SafeModePrompt, a.config().Options.BannedWords)
+	a.userService.SetDebug(a.config().DebugPrompts)
+	a.userService.SetSearchConcurrency(a.config().SearchConcurrency)
+	a.renameInfos(ctx)
 
 	a.setCommands(ctx)
+	a.setDescription(ctx)
+	a.loadBotUsername(ctx)
 
-	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
 	defer stop()
+	a.startedAt = a.clock.Now()
 
 	var wg sync.WaitGroup
 
+	if addr := a.config().HealthAddr; addr != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.serveHealth(ctx, addr)
+		}()
+	}
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -309,15 +1152,87 @@ func (a *App) Run(ctx context.Context) error {
 		a.scheduleMessages(ctx)
 	}()
 
+	if a.outbox != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.deliverOutbox(ctx)
+		}()
+	}
+
+	if cfg := a.config(); cfg.PruneInterval > 0 && cfg.PruneRetention > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.pruneBlockedUsers(ctx, cfg.PruneInterval)
+		}()
+	}
+
 	<-ctx.Done()
 	wg.Wait()
+	a.generating.Wait()
 	log.Println("application stopped")
 	return nil
 }
 
-// handleUpdates continuously polls Telegram for updates and dispatches them
-// for further processing.
+// handleUpdates continuously polls Telegram for updates and handles them on
+// a pool of UPDATE_WORKERS workers. Polling and handling are decoupled by a
+// bounded queue, so a large batch does not stop the bot from fetching newer
+// updates and chats with a backlog take turns with everyone else. Each chat
+// is handled by one worker at a time, so its messages keep their order while
+// a slow reply to one user does not delay the others. Telegram considers every
+// queued update delivered, so on shutdown polling stops and the workers drain
+// the queue for up to ShutdownGrace before returning.
 func (a *App) handleUpdates(ctx context.Context) {
+	q := newUpdateQueue(a.config().UpdateQueueSize)
+	workers := a.config().UpdateWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	hctx, cancel := drainContext(ctx, a.config().ShutdownGrace)
+	defer cancel()
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				u, err := q.pop(hctx)
+				if err != nil {
+					return
+				}
+				unlock, err := a.chats.lock(hctx, updateChat(u))
+				if err != nil {
+					return
+				}
+				a.handleUpdate(hctx, u)
+				unlock()
+				q.done(u)
+			}
+		}()
+	}
+	a.pollUpdates(ctx, q)
+	q.close()
+	wg.Wait()
+}
+
+// drainContext returns a context that keeps the values of ctx but ends grace
+// after ctx is done, for finishing work accepted before a shutdown.
+func drainContext(ctx context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	dctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		time.AfterFunc(grace, cancel)
+	})
+	return dctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// pollUpdates fetches updates from Telegram into the queue. The offset
+// advances past every queued update, confirming it to Telegram on the next
+// poll.
+func (a *App) pollUpdates(ctx context.Context, q *updateQueue) {
 	offset := 0
 	for {
 		if ctx.Err() != nil {
@@ -328,38 +1243,101 @@ func (a *App) handleUpdates(ctx context.Context) {
 			if errors.Is(err, context.Canceled) {
 				return
 			}
-			log.Println("get updates:", err)
-			time.Sleep(time.Second)
+			delay := time.Second
+			if errors.Is(err, telegram.ErrConflict) {
+				if d := a.config().ConflictBackoff; d > 0 {
+					delay = d
+				}
+				log.Printf("get updates: another instance is polling with the same bot token, retrying in %s", delay)
+			} else {
+				log.Println("get updates:", err)
+			}
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
 			continue
 		}
 		for _, u := range updates {
-			offset = u.UpdateID + 1
-			if u.Message == nil {
-				continue
+			if err := q.push(ctx, u); err != nil {
+				return
 			}
-			a.handleMessage(ctx, u.Message)
+			offset = u.UpdateID + 1
 		}
 	}
 }
 
+// handleUpdate dispatches a single update. An edited message is treated as a
+// new answer to the active conversation stage, e.g. a corrected category
+// number; outside of a dialog edits are ignored so commands do not rerun.
+// Inline button presses go to handleCallback.
+func (a *App) handleUpdate(ctx context.Context, u telegram.Update) {
+	if u.Message != nil {
+		a.handleMessage(ctx, u.Message)
+		return
+	}
+	if u.CallbackQuery != nil {
+		a.handleCallback(ctx, u.CallbackQuery)
+		return
+	}
+	if u.EditedMessage == nil || !a.config().HandleEdits || a.inMaintenance(u.EditedMessage) {
+		return
+	}
+	if conv, ok := a.convs.get(u.EditedMessage.Chat.ID); ok && conv.Stage != 0 {
+		a.continueConversation(ctx, u.EditedMessage, conv)
+	}
+}
+
 // handleMessage routes incoming user messages to the appropriate command
 // handlers or continues an existing conversation.
 func (a *App) handleMessage(ctx context.Context, m *telegram.Message) {
+	text, ok := commandForBot(m.Text, a.botUsername)
+	if !ok {
+		return
+	}
+	m.Text = text
+	if a.inMaintenance(m) {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["maintenance"], nil)
+		return
+	}
+	if strings.HasPrefix(m.Text, "/") {
+		// Only the latest command's output should reach the user.
+		a.cancelGeneration(m.Chat.ID)
+	}
+	// A command may carry an argument after the first space, e.g.
+	// "/get_news_now Технологии".
+	cmd, arg, _ := strings.Cut(strings.TrimSpace(m.Text), " ")
+	arg = strings.TrimSpace(arg)
 	// if user text first time
-	if conv, ok := a.convs[m.Chat.ID]; ok && conv.Stage != 0 && m.Text != "/start" {
+	if conv, ok := a.convs.get(m.Chat.ID); ok && conv.Stage != 0 && cmd != "/start" {
 		a.continueConversation(ctx, m, conv)
 		return
 	}
 
-	switch m.Text {
+	switch cmd {
 	case "/start":
 		a.handleStartCommand(ctx, m)
 	case "/stop":
 		a.handleStopCommand(ctx, m)
 	case "/get_news_now":
-		a.handleGetNewsNowCommand(ctx, m)
+		a.handleGetNewsNowCommand(ctx, m, arg)
 	case "/get_last_24h_news":
-		a.handleGetLast24hNewsCommand(ctx, m)
+		a.handleGetLast24hNewsCommand(ctx, m, arg)
+	case "/get_last_24h_links":
+		a.handleGetLast24hLinksCommand(ctx, m, arg)
+	case "/resend":
+		a.handleResendCommand(ctx, m)
+	case "/rate":
+		a.handleRateCommand(ctx, m)
+	case "/history":
+		a.handleHistoryCommand(ctx, m, arg)
+	case "/search":
+		a.handleSearchCommand(ctx, m, arg)
+	case "/reading_list":
+		a.handleReadingListCommand(ctx, m)
+	case "/download_my_data":
+		a.handleDownloadMyDataCommand(ctx, m)
 	case "/topics":
 		a.handleTopicsCommand(ctx, m)
 	case "/my_topics":
@@ -374,27 +1352,105 @@ func (a *App) handleMessage(ctx context.Context, m *telegram.Message) {
 		a.handleInfoCommand(ctx, m)
 	case "/tariffs":
 		a.handleTariffsCommand(ctx, m)
+	case "/compare":
+		a.handleCompareCommand(ctx, m)
 	case "/sett":
 		a.handleSetTariffCommand(ctx, m)
+	case "/next":
+		a.handleNextCommand(ctx, m)
+	case "/boost":
+		a.handleBoostCommand(ctx, m)
+	case "/safe_mode":
+		a.handleSafeModeCommand(ctx, m)
+	case "/style":
+		a.handleStyleCommand(ctx, m)
+	case "/category_tone":
+		a.handleCategoryToneCommand(ctx, m, arg)
+	case "/snooze_topic":
+		a.handleSnoozeTopicCommand(ctx, m, arg)
+	case "/clone_topic":
+		a.handleCloneTopicCommand(ctx, m, arg)
+	case "/format":
+		a.handleFormatCommand(ctx, m, arg)
+	case "/length":
+		a.handleLengthCommand(ctx, m, arg)
+	case "/categories_per_send":
+		a.handleCategoriesPerSendCommand(ctx, m, arg)
+	case "/timezone":
+		a.handleTimezoneCommand(ctx, m, arg)
+	case "/save_profile":
+		a.handleSaveProfileCommand(ctx, m, arg)
+	case "/profiles":
+		a.handleProfilesCommand(ctx, m)
+	case "/load_profile":
+		a.handleLoadProfileCommand(ctx, m, arg)
+	case "/undo":
+		a.handleUndoCommand(ctx, m)
+	case "/separate_messages":
+		a.handleSeparateMessagesCommand(ctx, m)
+	case "/short":
+		a.handleShortCommand(ctx, m)
+	case "/shuffle":
+		a.handleShuffleCommand(ctx, m)
+	case "/labels":
+		a.handleLabelsCommand(ctx, m)
+	case "/reload":
+		a.handleReloadCommand(ctx, m)
+	case "/categories_stats":
+		a.handleCategoriesStatsCommand(ctx, m)
+	case "/tariff_stats":
+		a.handleTariffStatsCommand(ctx, m)
+	case "/conv":
+		a.handleConvCommand(ctx, m, arg)
+	case "/maintenance":
+		a.handleMaintenanceCommand(ctx, m, arg)
+	case "/ping_ai":
+		a.handlePingAICommand(ctx, m)
+	case "/reset_quota":
+		a.handleResetQuotaCommand(ctx, m, arg)
+	case "/trial":
+		a.handleTrialCommand(ctx, m, arg)
 		//case "/test":
 	//	a.handleTestCmd(ctx, m)
 	default:
+		if a.isOptOut(m.Text) {
+			a.handleStopCommand(ctx, m)
+			return
+		}
 		log.Printf("user %d(@%s) texted: %s", m.Chat.ID, m.Chat.Username, m.Text)
-		promt := a.messages["unknown_text"]
+		promt := a.ui().messages["unknown_text"]
 		a.sendMessage(ctx, m.Chat.ID, promt, nil)
 	}
 }
 
+// inMaintenance reports whether the message must get the maintenance notice
+// instead of being handled. Admins are never stopped so they can turn the
+// mode off again.
+func (a *App) inMaintenance(m *telegram.Message) bool {
+	return a.maintenance.Load() && !a.isAdmin(m.Chat.Username)
+}
+
+// isOptOut reports whether the free-form text is one of the configured opt-out
+// keywords. Case and surrounding punctuation are ignored.
+func (a *App) isOptOut(text string) bool {
+	keywords := a.config().Options.OptOutKeywords
+	if len(keywords) == 0 {
+		keywords = defaultOptOutKeywords
+	}
+	text = strings.Trim(strings.TrimSpace(text), ".!")
+	for _, k := range keywords {
+		if strings.EqualFold(text, k) {
+			return true
+		}
+	}
+	return false
+}
+
 // inTimeRange checks whether the provided time falls within the "HH:MM-HH:MM"
 // range specified in rng. If the range is invalid the function returns true.
 func inTimeRange(now time.Time, rng string) bool {
-	parts := strings.Split(rng, "-")
-	if len(parts) != 2 {
-		return true
-	}
-	start, err1 := time.Parse("15:04", parts[0])
-	end, err2 := time.Parse("15:04", parts[1])
-	if err1 != nil || err2 != nil {
+	start, end, err := parseTimeRange(rng)
+	if err != nil {
 		return true
 	}
 	y, m, d := now.Date()
@@ -406,58 +1462,345 @@ func inTimeRange(now time.Time, rng string) bool {
 	return !now.Before(start) && !now.After(end)
 }
 
+// badTimeRanges remembers the invalid time ranges already reported so the
+// scheduler does not repeat the warning every tick.
+var badTimeRanges sync.Map
+
+// parseTimeRange parses rng with config.ParseTimeRange and logs a warning
+// the first time an invalid value is met; an empty range means no limit.
+// Validate rejects invalid ranges at startup, so this only catches values
+// that bypassed it.
+func parseTimeRange(rng string) (time.Time, time.Time, error) {
+	start, end, err := config.ParseTimeRange(rng)
+	if err != nil && rng != "" {
+		if _, seen := badTimeRanges.LoadOrStore(rng, true); !seen {
+			log.Printf("warning: %v, schedule is not restricted", err)
+		}
+	}
+	return start, end, err
+}
+
+// nextWindowStart returns the first moment at or after t when the
+// "HH:MM-HH:MM" range rng opens. For an invalid range t itself is returned.
+func nextWindowStart(t time.Time, rng string) time.Time {
+	start, _, err := parseTimeRange(rng)
+	if err != nil {
+		return t
+	}
+	y, m, d := t.Date()
+	next := time.Date(y, m, d, start.Hour(), start.Minute(), 0, 0, t.Location())
+	if next.Before(t) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// scheduleInterval returns the minimal pause between scheduled digests.
+func scheduleInterval(t config.Tariff) time.Duration {
+	return time.Duration(t.Schedule.FrequencyMinutes) * time.Minute
+}
+
+// boostInterval returns the pause used while a /boost is active, or the usual
+// interval when the tariff does not allow a shorter one.
+func boostInterval(t config.Tariff) time.Duration {
+	d := time.Duration(t.Schedule.MinFrequencyMinutes) * time.Minute
+	if d <= 0 || d >= scheduleInterval(t) {
+		return scheduleInterval(t)
+	}
+	return d
+}
+
+// userInterval returns the pause between scheduled digests for u at now:
+// the boosted one until the user's boost expires, the tariff's afterwards.
+func userInterval(now time.Time, u *model.UserSettings, t config.Tariff) time.Duration {
+	if now.Unix() < u.BoostUntil {
+		return boostInterval(t)
+	}
+	return scheduleInterval(t)
+}
+
+// userJitter returns the user's fixed offset of 0..jitter_minutes minutes. It
+// is derived from the user ID so that users with identical schedules do not
+// all get their digest in the same minute.
+func userJitter(u *model.UserSettings, t config.Tariff) time.Duration {
+	n := t.Schedule.JitterMinutes
+	if n <= 0 {
+		return 0
+	}
+	h := fnv.New32a()
+	binary.Write(h, binary.LittleEndian, u.UserID)
+	return time.Duration(h.Sum32()%uint32(n+1)) * time.Minute
+}
+
+// scheduleAllows reports whether a digest may be sent to u at now: the active
+// hours have been open for at least the user's jitter and one interval plus
+// the jitter has passed since the previous send. The active hours are those
+// of the user's timezone.
+func scheduleAllows(now time.Time, u *model.UserSettings, t config.Tariff) bool {
+	now = u.LocalTime(now)
+	jitter := userJitter(u, t)
+	if !inTimeRange(now, t.Schedule.TimeRange) || !inTimeRange(now.Add(-jitter), t.Schedule.TimeRange) {
+		return false
+	}
+	return now.Sub(time.Unix(u.LastScheduledSent, 0)) >= userInterval(now, u, t)+jitter
+}
+
+// nextScheduledSend predicts when the scheduler will send the next digest to
+// u: one interval plus the user's jitter after the previous send, moved past
+// the start of the active hours if that moment falls outside them. The result
+// is in the user's timezone.
+func nextScheduledSend(now time.Time, u *model.UserSettings, t config.Tariff) time.Time {
+	now = u.LocalTime(now)
+	jitter := userJitter(u, t)
+	next := time.Unix(u.LastScheduledSent, 0).In(now.Location()).Add(userInterval(now, u, t) + jitter)
+	if next.Before(now) {
+		next = now
+	}
+	if !inTimeRange(next, t.Schedule.TimeRange) || !inTimeRange(next.Add(-jitter), t.Schedule.TimeRange) {
+		next = nextWindowStart(next.Add(-jitter), t.Schedule.TimeRange).Add(jitter)
+	}
+	return next
+}
+
 // scheduleMessages periodically sends news digests to active users respecting
 // their tariff restrictions and configured time range.
 func (a *App) scheduleMessages(ctx context.Context) {
-	ticker := time.NewTicker(time.Minute)
+	ticker := time.NewTicker(schedulerInterval)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			users, err := a.userService.ActiveUsers(ctx)
-			if err != nil {
-				log.Println("active users:", err)
-				continue
-			}
-			now := time.Now()
-			for _, u := range users {
-				tariff, ok := a.cfg.Tariffs[u.Tariff]
-				if !ok {
-					tariff = a.cfg.Tariffs["base"]
-				}
-				if !inTimeRange(now, tariff.Schedule.TimeRange) {
-					continue
-				}
-				last := time.Unix(u.LastScheduledSent, 0)
-				if now.Sub(last) < time.Duration(tariff.Schedule.FrequencyMinutes)*time.Minute {
-					continue
-				}
-				if len(u.Topics) == 0 {
-					a.sendMessage(ctx, u.UserID, "Вы не задали категории. Если хотите получать автоматические сообщения для расширения кругозора, то задайте темы с помощью /update_topics или же остановите автоматическую рассылку с помощью команды /stop", nil)
-					u.LastScheduledSent = now.Unix()
-					if err := a.repo.Save(ctx, u); err != nil {
-						log.Println("save settings:", err)
-					}
-					continue
-				}
+			now := a.clock.Now()
+			a.recordTick(ctx, now)
+			a.scheduleTick(ctx, now)
+		}
+	}
+}
 
-				msg, err := a.userService.GetNewsMultiInfo(ctx, u)
-				if err != nil {
-					log.Println("get news:", err)
-					continue
-				}
-				a.sendMessage(ctx, u.UserID, msg, nil)
-				log.Printf("user %d(@%s) got scheduled news", u.UserID, u.UserName)
+// scheduleTick processes one batch of users due for a digest. The cursor moves
+// through the user IDs across ticks, so users skipped by sendScheduled (e.g.
+// outside their active hours) do not starve the rest of the list. Nothing is
+// sent in maintenance mode; users due meanwhile get their digest afterwards.
+// Once ctx is cancelled no further user is started, while the sends already
+// under way get up to ShutdownGrace to finish, so a digest does not go out
+// without its LastScheduledSent being saved; the rest stay due for the next
+// start. A heartbeat is stored before each user and at the end, and every
+// digest is bounded by scheduledSendTimeout, so /readyz does not take a long
+// batch for a stalled scheduler.
+func (a *App) scheduleTick(ctx context.Context, now time.Time) {
+	if a.maintenance.Load() {
+		return
+	}
+	ctx = service.WithScheduled(withBulk(ctx))
+	cfg := a.config()
+	batch := cfg.BatchSize
+	if batch <= 0 {
+		batch = 100
+	}
+	users, err := a.userService.DueUsers(ctx, now.Add(-a.minScheduleInterval()), a.dueCursor, batch)
+	if err != nil {
+		log.Println("due users:", err)
+		return
+	}
+	if len(users) < batch {
+		a.dueCursor = 0
+	} else {
+		a.dueCursor = users[len(users)-1].UserID
+	}
 
-				u.LastScheduledSent = now.Unix()
-				if err := a.repo.Save(ctx, u); err != nil {
-					log.Println("save settings:", err)
-				}
+	workers := max(cfg.Workers, 1)
+	sem := make(chan struct{}, workers)
+	sendCtx, cancel := drainContext(ctx, cfg.ShutdownGrace)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i, u := range users {
+		sem <- struct{}{}
+		if ctx.Err() != nil {
+			<-sem
+			a.dueCursor = 0
+			log.Printf("scheduler stopping: %d due users left for the next start", len(users)-i)
+			break
+		}
+		a.heartbeat(ctx)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			userCtx, cancel := context.WithTimeout(sendCtx, scheduledSendTimeout)
+			defer cancel()
+			a.sendScheduled(userCtx, u, now)
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() == nil {
+		a.heartbeat(ctx)
+	}
+}
+
+// minScheduleInterval returns the shortest schedule interval among tariffs,
+// boosts included; a user whose last digest is more recent than that cannot be
+// due on any tariff.
+func (a *App) minScheduleInterval() time.Duration {
+	var shortest time.Duration
+	for _, t := range a.config().Tariffs {
+		if d := boostInterval(t); shortest == 0 || d < shortest {
+			shortest = d
+		}
+	}
+	return shortest
+}
+
+// sendScheduled delivers a scheduled digest to a single user if their tariff
+// schedule allows it at the given moment.
+func (a *App) sendScheduled(ctx context.Context, u *model.UserSettings, now time.Time) {
+	tariff := a.tariffFor(u.Tariff)
+	if !scheduleAllows(now, u, tariff) {
+		return
+	}
+	if len(u.Topics) == 0 {
+		err := a.sendInOrder(ctx, u.UserID, func() error {
+			_, err := a.sendMessage(ctx, u.UserID, "Вы не задали категории. Если хотите получать автоматические сообщения для расширения кругозора, то задайте темы с помощью /update_topics или же остановите автоматическую рассылку с помощью команды /stop", nil)
+			return err
+		})
+		if errors.Is(err, telegram.ErrBlocked) {
+			a.blockUser(ctx, u.UserID)
+			return
+		}
+		a.updateSettings(ctx, u.UserID, func(s *model.UserSettings) { s.LastScheduledSent = now.Unix() })
+		return
+	}
+
+	ds, err := a.userService.GetNewsMultiInfoDigests(ctx, u)
+	if errors.Is(err, service.ErrAllSnoozed) {
+		// Nothing to send in this slot; try again at the next one.
+		a.updateSettings(ctx, u.UserID, func(s *model.UserSettings) { s.LastScheduledSent = now.Unix() })
+		return
+	}
+	if err != nil {
+		log.Println("get news:", err)
+		return
+	}
+	msgs := digestMessages(u, ds)
+	if a.outbox != nil {
+		slot := now.Truncate(userInterval(now, u, tariff)).Unix()
+		if _, err := a.outbox.Enqueue(ctx, &model.OutboxMessage{UserID: u.UserID, Slot: slot, Texts: msgs}); err != nil {
+			log.Println("enqueue digest:", err)
+			return
+		}
+	} else {
+		if err := a.sendBulkDigest(ctx, u.UserID, msgs); err != nil {
+			if errors.Is(err, telegram.ErrBlocked) {
+				a.blockUser(ctx, u.UserID)
+				return
 			}
+			log.Println("send msg err: ", err)
 		}
+		log.Printf("user %d(@%s) got scheduled news", u.UserID, u.UserName)
+		a.rememberDigest(u.UserID, strings.Join(msgs, "\n\n"))
 	}
+	// u was read before the slow generation; apply the results to fresh
+	// settings so changes the user made meanwhile are kept.
+	a.updateSettings(ctx, u.UserID, func(s *model.UserSettings) {
+		s.RotationOrder, s.RotationPos, s.RotationStarted = u.RotationOrder, u.RotationPos, u.RotationStarted
+		recordDigests(s, ds, now)
+		s.LastScheduledSent = now.Unix()
+	})
+}
+
+// pruneBlockedUsers periodically deletes users who blocked the bot longer
+// than the configured retention ago.
+func (a *App) pruneBlockedUsers(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		a.pruneOnce(ctx, a.clock.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pruneOnce runs a single pruning pass and logs the result.
+func (a *App) pruneOnce(ctx context.Context, now time.Time) {
+	cfg := a.config()
+	if cfg.PruneRetention <= 0 {
+		return
+	}
+	n, err := a.userService.PruneBlocked(ctx, now.Add(-cfg.PruneRetention), cfg.PruneDryRun)
+	if err != nil {
+		log.Println("prune blocked users:", err)
+		return
+	}
+	if cfg.PruneDryRun {
+		log.Printf("prune blocked users (dry run): %d would be removed", n)
+		return
+	}
+	log.Printf("prune blocked users: %d removed", n)
+}
+
+// markBlocked deactivates a user who blocked the bot so the scheduler stops
+// targeting them. Sending /start again re-activates the user. The caller
+// holds the user's chat lock; code outside it uses blockUser.
+func (a *App) markBlocked(ctx context.Context, u *model.UserSettings) {
+	a.setBlocked(u)
+	if err := a.repo.Save(ctx, u); err != nil {
+		log.Println("save settings:", err)
+	}
+}
+
+// blockUser is markBlocked for code running outside the user's chat lock,
+// such as the scheduler: the change is applied to fresh settings under it.
+func (a *App) blockUser(ctx context.Context, userID int64) {
+	a.updateSettings(ctx, userID, a.setBlocked)
+}
+
+// setBlocked marks the settings of a user who blocked the bot.
+func (a *App) setBlocked(u *model.UserSettings) {
+	log.Printf("user %d(@%s) blocked the bot, deactivating", u.UserID, u.UserName)
+	u.Active = false
+	u.Blocked = true
+	u.BlockedAt = a.clock.Now().Unix()
+}
+
+// rememberDigest caches the latest scheduled digest so it can be re-sent with
+// /resend. Every scheduled send replaces the previously cached text.
+func (a *App) rememberDigest(userID int64, text string) {
+	a.digestMu.Lock()
+	defer a.digestMu.Unlock()
+	if a.lastDigests == nil {
+		a.lastDigests = map[int64]string{}
+	}
+	a.lastDigests[userID] = text
+}
+
+// rememberLast24h caches the latest last-24h result of the user.
+func (a *App) rememberLast24h(userID int64, d last24hDigest) {
+	a.digestMu.Lock()
+	defer a.digestMu.Unlock()
+	if a.last24hCache == nil {
+		a.last24hCache = map[int64]last24hDigest{}
+	}
+	a.last24hCache[userID] = d
+}
+
+// lastLast24h returns the cached last-24h result for the user.
+func (a *App) lastLast24h(userID int64) (last24hDigest, bool) {
+	a.digestMu.Lock()
+	defer a.digestMu.Unlock()
+	d, ok := a.last24hCache[userID]
+	return d, ok
+}
+
+// lastDigest returns the cached scheduled digest for the user.
+func (a *App) lastDigest(userID int64) (string, bool) {
+	a.digestMu.Lock()
+	defer a.digestMu.Unlock()
+	text, ok := a.lastDigests[userID]
+	return text, ok
 }
 
 // setCommands registers the list of bot commands with Telegram so that users
@@ -468,8 +1811,30 @@ func (a *App) setCommands(ctx context.Context) {
 		{Command: "info", Description: "Посмотреть доступные команды"},
 		{Command: "topics", Description: "Управление категориями и типам информации"},
 		{Command: "tariffs", Description: "Посмотреть существующие тарифы и их возможности"},
+		{Command: "compare", Description: "Сравнить лимиты тарифов в таблице"},
 		{Command: "get_news_now", Description: "Получить информацию по заданной категории сейчас"},
 		{Command: "get_last_24h_news", Description: "Получить новости за 24 часа по заданной категории сейчас"},
+		{Command: "next", Description: "Узнать, когда придёт следующая рассылка"},
+		{Command: "boost", Description: "Получать рассылки чаще в течение суток"},
+		{Command: "history", Description: "Посмотреть последние полученные подборки"},
+		{Command: "rate", Description: "Оценить последнюю подборку"},
+		{Command: "search", Description: "Получить новость на любую тему без сохранения"},
+		{Command: "safe_mode", Description: "Включить или выключить безопасный режим"},
+		{Command: "style", Description: "Выбрать тон и объём подборок"},
+		{Command: "category_tone", Description: "Выбрать тон для отдельной категории"},
+		{Command: "format", Description: "Выбрать оформление подборок: текст или тезисы"},
+		{Command: "length", Description: "Выбрать длину подборок"},
+		{Command: "categories_per_send", Description: "Сколько категорий присылать в одной рассылке"},
+		{Command: "timezone", Description: "Указать свой часовой пояс"},
+		{Command: "separate_messages", Description: "Присылать типы информации отдельными сообщениями"},
+		{Command: "short", Description: "Короткие рассылки: один тип информации на категорию"},
+		{Command: "shuffle", Description: "Перемешивать порядок типов информации в подборках"},
+		{Command: "labels", Description: "Показывать или скрывать строки «Категория» и «Тип»"},
+		{Command: "snooze_topic", Description: "Поставить одну категорию на паузу"},
+		{Command: "clone_topic", Description: "Скопировать категорию с другими типами информации"},
+		{Command: "get_last_24h_links", Description: "Получить заголовки новостей за 24 часа со ссылками на источники"},
+		{Command: "reading_list", Description: "Скачать ссылки из последней подборки за 24 часа файлом"},
+		{Command: "download_my_data", Description: "Скачать все данные, которые бот хранит о вас"},
 		{Command: "stop", Description: "Остановить отправку сообщений"},
 		//{Command: "update_topics", Description: "Обновить категории и типы информации"},
 		//{Command: "add_topic", Description: "Добавить категории с типом информации"},
@@ -497,21 +1862,142 @@ func (a *App) setUserTariff(ctx context.Context, username, tariff string) error
 	if user == nil {
 		return fmt.Errorf("user %s not found", username)
 	}
-	if _, ok := a.cfg.Tariffs[tariff]; !ok {
+	if _, ok := a.config().Tariffs[tariff]; !ok {
 		return fmt.Errorf("unknown tariff")
 	}
 	user.Tariff = tariff
 	return a.repo.Save(ctx, user)
 }
 
+// nextPendingCategory takes the next category from the batch selected in the
+// add flow and asks for its info types (or for a custom category name).
+func (a *App) nextPendingCategory(ctx context.Context, m *telegram.Message, c *conversationState) {
+	cat := c.PendingCats[0]
+	c.PendingCats = c.PendingCats[1:]
+	c.SelectedInfos = nil
+	if c.AllowCustomCategory && cat == "😇Своя категория" {
+		if customLimitReached(c) {
+			a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf(a.ui().messages["limit_custom_categories"], c.MaxCustomCategories), nil)
+			if len(c.PendingCats) > 0 {
+				a.nextPendingCategory(ctx, m, c)
+				return
+			}
+			c.setStage(stageCategory)
+			prompt, kb := a.categoryPrompt(c)
+			msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, kb)
+			c.LastMsgID = msgID
+			return
+		}
+		a.askCustomCategory(ctx, m.Chat.ID, c)
+		return
+	}
+	c.CurrentCat = cat
+	c.setStage(stageInfoTypes)
+	prompt := fmt.Sprintf(a.ui().messages["prompt_choose_info"], c.CurrentCat, c.InfoLimit, a.formatInfoOptions())
+	kb := numberKeyboardWithDone(len(a.ui().infoOptions))
+	if canShareInfos(c) {
+		kb = append(kb, []string{sameInfos})
+	}
+	msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addBack(kb))
+	c.LastMsgID = msgID
+}
+
+// totalInfoRoom checks the tariff's cap on info types summed over all
+// categories when the current category (replacing OldCat, if any) gets n info
+// types. It returns how many info types the category may have at most and
+// whether n fits. Changes that do not increase the total are always allowed,
+// so users above the cap after a tariff change can still edit their topics.
+func totalInfoRoom(c *conversationState, n int) (int, bool) {
+	if c.TotalInfoLimit <= 0 {
+		return n, true
+	}
+	before, others := 0, 0
+	for cat, infos := range c.Topics {
+		before += len(infos)
+		if cat != c.CurrentCat && cat != c.OldCat {
+			others += len(infos)
+		}
+	}
+	room := max(c.TotalInfoLimit-others, 0)
+	return room, others+n <= c.TotalInfoLimit || others+n <= before
+}
+
+// Bounds of a custom category name used when options.json leaves them unset.
+const (
+	defaultCustomCategoryMinWords = 1
+	defaultCustomCategoryMaxWords = 3
+	defaultCustomCategoryWordLen  = 30
+)
+
+// customCategoryBounds returns the configured word count range and maximum
+// word length of a custom category name.
+func (a *App) customCategoryBounds() (minWords, maxWords, wordLen int) {
+	o := a.config().Options
+	minWords, maxWords, wordLen = o.CustomCategoryMinWords, o.CustomCategoryMaxWords, o.CustomCategoryWordLen
+	if minWords <= 0 {
+		minWords = defaultCustomCategoryMinWords
+	}
+	if maxWords <= 0 {
+		maxWords = defaultCustomCategoryMaxWords
+	}
+	if maxWords < minWords {
+		maxWords = minWords
+	}
+	if wordLen <= 0 {
+		wordLen = defaultCustomCategoryWordLen
+	}
+	return minWords, maxWords, wordLen
+}
+
+// askCustomCategory asks for the name of a custom category.
+func (a *App) askCustomCategory(ctx context.Context, chatID int64, c *conversationState) {
+	minWords, maxWords, _ := a.customCategoryBounds()
+	c.setStage(stageCustomCategory)
+	msgID, _ := a.sendMessage(ctx, chatID, fmt.Sprintf(a.ui().messages["enter_custom_category"], minWords, maxWords), nil)
+	c.LastMsgID = msgID
+}
+
+// checkCategoryWords splits text into the words of a custom category name.
+// When the name is outside the configured bounds the words are nil and the
+// second result is the message explaining what to fix.
+func (a *App) checkCategoryWords(text string) ([]string, string) {
+	minWords, maxWords, wordLen := a.customCategoryBounds()
+	words := strings.Fields(text)
+	if len(words) < minWords || len(words) > maxWords {
+		return nil, fmt.Sprintf(a.ui().messages["enter_words"], minWords, maxWords)
+	}
+	for _, w := range words {
+		if utf8.RuneCountInString(w) > wordLen {
+			return nil, fmt.Sprintf(a.ui().messages["word_too_long"], html.EscapeString(w), wordLen)
+		}
+	}
+	return words, ""
+}
+
+// customLimitReached reports whether the tariff's cap on custom (🫆) categories
+// is used up by the topics collected so far. The category being replaced does
+// not count; a zero cap means no limit.
+func customLimitReached(c *conversationState) bool {
+	if c.MaxCustomCategories <= 0 {
+		return false
+	}
+	n := 0
+	for cat := range c.Topics {
+		if strings.HasPrefix(cat, "🫆") && cat != c.OldCat {
+			n++
+		}
+	}
+	return n >= c.MaxCustomCategories
+}
+
 // continueConversation processes messages that are part of a multi-step dialog
 // and advances the conversation state machine accordingly.
 func (a *App) continueConversation(ctx context.Context, m *telegram.Message, c *conversationState) {
 	if strings.EqualFold(m.Text, "Отмена") {
 		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
 		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
-		a.sendMessage(ctx, m.Chat.ID, a.messages["cancelled"], nil)
-		delete(a.convs, m.Chat.ID)
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["cancelled"], nil)
+		a.convs.delete(m.Chat.ID)
 		return
 	}
 	if strings.EqualFold(m.Text, "Назад") && c.PrevStage == 0 {
@@ -523,63 +2009,78 @@ func (a *App) continueConversation(ctx context.Context, m *telegram.Message, c *
 	}
 	switch c.Stage {
 	case stageWelcome:
-		if strings.TrimSpace(m.Text) != "Продолжить" {
-			msg, _ := a.sendMessage(ctx, m.Chat.ID, a.messages["press_continue"], [][]string{{"Продолжить"}})
+		if strings.TrimSpace(m.Text) != continueOnboarding {
+			msg, _ := a.sendMessage(ctx, m.Chat.ID, a.ui().messages["press_continue"], [][]string{{continueOnboarding}})
 			c.LastMsgID = msg
 			return
 		}
 		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
 		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
-		t := a.cfg.Tariffs["base"]
+		t := a.tariffFor("base")
 		c.Step = 0
 		c.CategoryLimit = t.Limits.CategoryLimit
 		c.InfoLimit = t.Limits.InfoTypeLimit
 		c.AllowCustomCategory = t.AllowCustomCategory
+		c.MaxCustomCategories = t.Limits.MaxCustomCategories
+		c.TotalInfoLimit = t.Limits.TotalInfoTypeLimit
 		c.setStage(stageChooseCategoryCount)
-		prompt := fmt.Sprintf(a.messages["prompt_choose_count"], c.CategoryLimit)
-		msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addBack(numberKeyboard(c.CategoryLimit)))
-		c.LastMsgID = msgID
+		c.LastMsgID = a.askCategoryCount(ctx, m.Chat.ID, c)
 	case stageChooseCategoryCount:
+		if strings.TrimSpace(m.Text) == continueOnboarding {
+			// A repeated tap on the welcome button that arrived after the
+			// first one moved on: the count prompt is already shown.
+			a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+			return
+		}
+		if strings.TrimSpace(m.Text) == describeInterests && a.canSuggest(c) {
+			a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+			a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+			c.setStage(stageInterests)
+			msgID, _ := a.sendMessage(ctx, m.Chat.ID, a.ui().messages["interests_prompt"], [][]string{{pickManually}})
+			c.LastMsgID = msgID
+			return
+		}
 		count, err := strconv.Atoi(strings.TrimSpace(m.Text))
 		if err != nil || count < 1 || count > c.CategoryLimit {
-			msg, _ := a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf(a.messages["prompt_choose_count"], c.CategoryLimit), addBack(numberKeyboard(c.CategoryLimit)))
-			c.LastMsgID = msg
+			c.LastMsgID = a.askCategoryCount(ctx, m.Chat.ID, c)
 			return
 		}
 		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
 		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
 		c.CategoryLimit = count
 		c.setStage(stageCategory)
-		opts := addCustomOption(a.categoryOptions, c.AllowCustomCategory)
-		prompt := fmt.Sprintf(a.messages["prompt_choose_category"], 1, formatOptions(opts))
-		msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addBack(numberKeyboardWithDone(len(opts))))
+		opts := addCustomOption(a.ui().categoryOptions, c.AllowCustomCategory)
+		prompt := fmt.Sprintf(a.ui().messages["prompt_choose_category"], 1, a.pageOptions(c, opts))
+		msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addBack(a.pageKeyboard(c, len(opts), true)))
 		c.LastMsgID = msgID
 
+	case stageInterests:
+		a.suggestCategories(ctx, m, c)
+	case stageInterestsConfirm:
+		a.confirmSuggested(ctx, m, c)
+
 	case stageUpdateChoice:
 		//if strings.EqualFold(m.Text, "Готово") {
 		//	a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
 		//	a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
-		//	a.sendMessage(ctx, m.Chat.ID, a.messages["no_changes"], nil)
-		//	delete(a.convs, m.Chat.ID)
+		//	a.sendMessage(ctx, m.Chat.ID, a.ui().messages["no_changes"], nil)
+		//	a.convs.delete(m.Chat.ID)
 		//	return
 		//}
 		choice := parseSelection(m.Text, []string{"Обновить все", "Обновить несколько"}, 1)
 		if len(choice) == 0 {
-			msg, _ := a.sendMessage(ctx, m.Chat.ID, a.messages["choose_action"], addCancel(numberKeyboard(2)))
+			msg, _ := a.sendMessage(ctx, m.Chat.ID, a.ui().messages["choose_action"], addCancel(numberKeyboard(2)))
 			c.LastMsgID = msg
 			return
 		}
 		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
 		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
 		if choice[0] == "Обновить несколько" {
-			c.AvailableCats = make([]string, 0, len(c.Topics))
-			for cat := range c.Topics {
-				c.AvailableCats = append(c.AvailableCats, cat)
-			}
+			c.AvailableCats = sortedCategories(c.Topics)
 			c.setStage(stageSelectManyExisting)
-			prompt := fmt.Sprintf(a.messages["prompt_choose_existing_multi"], formatOptions(c.AvailableCats))
+			prompt := fmt.Sprintf(a.ui().messages["prompt_choose_existing_multi"], formatOptions(c.AvailableCats))
 			if len(c.SelectedCats) > 0 {
-				prompt += "\n\n" + fmt.Sprintf(a.messages["already_selected"], strings.Join(c.SelectedCats, ", "))
+				prompt += "\n\n" + fmt.Sprintf(a.ui().messages["already_selected"], strings.Join(c.SelectedCats, ", "))
 			}
 			msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addBackCancel(numberKeyboard(len(c.AvailableCats))))
 			c.LastMsgID = msgID
@@ -589,36 +2090,33 @@ func (a *App) continueConversation(ctx context.Context, m *telegram.Message, c *
 		c.Topics = map[string][]string{}
 		c.Step = 0
 		c.setStage(stageCategory)
-		opts := addCustomOption(a.categoryOptions, c.AllowCustomCategory)
-		prompt := fmt.Sprintf(a.messages["prompt_choose_category"], 1, formatOptions(opts))
-		msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addBackCancel(numberKeyboard(len(opts))))
+		opts := addCustomOption(a.ui().categoryOptions, c.AllowCustomCategory)
+		prompt := fmt.Sprintf(a.ui().messages["prompt_choose_category"], 1, a.pageOptions(c, opts))
+		msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addBackCancel(a.pageKeyboard(c, len(opts), false)))
 		c.LastMsgID = msgID
 
 	case stageDeleteChoice:
 		if strings.EqualFold(m.Text, "Готово") {
 			a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
 			a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
-			a.sendMessage(ctx, m.Chat.ID, a.messages["no_changes"], nil)
-			delete(a.convs, m.Chat.ID)
+			a.sendMessage(ctx, m.Chat.ID, a.ui().messages["no_changes"], nil)
+			a.convs.delete(m.Chat.ID)
 			return
 		}
 		choice := parseSelection(m.Text, []string{"Удалить все", "Удалить несколько"}, 1)
 		if len(choice) == 0 {
-			msg, _ := a.sendMessage(ctx, m.Chat.ID, a.messages["choose_delete_action"], addBack(numberKeyboardWithDone(2)))
+			msg, _ := a.sendMessage(ctx, m.Chat.ID, a.ui().messages["choose_delete_action"], addBack(numberKeyboardWithDone(2)))
 			c.LastMsgID = msg
 			return
 		}
 		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
 		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
 		if choice[0] == "Удалить несколько" {
-			c.AvailableCats = make([]string, 0, len(c.Topics))
-			for cat := range c.Topics {
-				c.AvailableCats = append(c.AvailableCats, cat)
-			}
+			c.AvailableCats = sortedCategories(c.Topics)
 			c.setStage(stageSelectDelete)
-			prompt := fmt.Sprintf(a.messages["prompt_choose_delete_multi"], formatOptions(c.AvailableCats))
+			prompt := fmt.Sprintf(a.ui().messages["prompt_choose_delete_multi"], formatOptions(c.AvailableCats))
 			if len(c.SelectedCats) > 0 {
-				prompt += "\n\n" + fmt.Sprintf(a.messages["already_selected"], strings.Join(c.SelectedCats, ", "))
+				prompt += "\n\n" + fmt.Sprintf(a.ui().messages["already_selected"], strings.Join(c.SelectedCats, ", "))
 			}
 			msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addBack(numberKeyboardWithDone(len(c.AvailableCats))))
 			c.LastMsgID = msgID
@@ -634,17 +2132,17 @@ func (a *App) continueConversation(ctx context.Context, m *telegram.Message, c *
 			a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
 			a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
 			if len(c.SelectedCats) == 0 {
-				a.sendMessage(ctx, m.Chat.ID, a.messages["no_changes"], nil)
-				delete(a.convs, m.Chat.ID)
+				a.sendMessage(ctx, m.Chat.ID, a.ui().messages["no_changes"], nil)
+				a.convs.delete(m.Chat.ID)
 				return
 			}
 			c.CategoryLimit = len(c.SelectedCats)
 			c.Step = 0
 			c.OldCat = c.SelectedCats[0]
 			c.setStage(stageCategory)
-			opts := addCustomOption(a.categoryOptions, c.AllowCustomCategory)
-			prompt := fmt.Sprintf(a.messages["prompt_choose_new"], c.OldCat, formatOptions(opts))
-			msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addBackCancel(numberKeyboard(len(opts))))
+			opts := addCustomOption(a.ui().categoryOptions, c.AllowCustomCategory)
+			prompt := fmt.Sprintf(a.ui().messages["prompt_choose_new"], c.OldCat, a.pageOptions(c, opts))
+			msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addBackCancel(a.pageKeyboard(c, len(opts), false)))
 			c.LastMsgID = msgID
 			return
 		}
@@ -654,14 +2152,14 @@ func (a *App) continueConversation(ctx context.Context, m *telegram.Message, c *
 			a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
 			c.setStage(stageUpdateChoice)
 			c.SelectedCats = nil
-			msgID, _ := a.sendMessage(ctx, m.Chat.ID, a.messages["choose_action"], addCancel(numberKeyboard(2)))
+			msgID, _ := a.sendMessage(ctx, m.Chat.ID, a.ui().messages["choose_action"], addCancel(numberKeyboard(2)))
 			c.LastMsgID = msgID
 			return
 		}
 
 		cats := parseSelection(m.Text, c.AvailableCats, len(c.AvailableCats))
 		if len(cats) == 0 {
-			msg, _ := a.sendMessage(ctx, m.Chat.ID, a.messages["choose_category_number"], addBack(numberKeyboardWithDone(len(c.AvailableCats))))
+			msg, _ := a.sendMessage(ctx, m.Chat.ID, a.ui().messages["choose_category_number"], addBack(numberKeyboardWithDone(len(c.AvailableCats))))
 			c.LastMsgID = msg
 			return
 		}
@@ -679,9 +2177,9 @@ func (a *App) continueConversation(ctx context.Context, m *telegram.Message, c *
 				c.SelectedCats = append(c.SelectedCats, cat)
 			}
 		}
-		prompt := fmt.Sprintf(a.messages["prompt_choose_existing_multi"], formatOptions(c.AvailableCats))
+		prompt := fmt.Sprintf(a.ui().messages["prompt_choose_existing_multi"], formatOptions(c.AvailableCats))
 		if len(c.SelectedCats) > 0 {
-			prompt += "\n\n" + fmt.Sprintf(a.messages["already_selected"], strings.Join(c.SelectedCats, ", "))
+			prompt += "\n\n" + fmt.Sprintf(a.ui().messages["already_selected"], strings.Join(c.SelectedCats, ", "))
 		}
 		msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addBackCancel(numberKeyboardWithDone(len(c.AvailableCats))))
 		c.LastMsgID = msgID
@@ -691,8 +2189,8 @@ func (a *App) continueConversation(ctx context.Context, m *telegram.Message, c *
 			a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
 			a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
 			if len(c.SelectedCats) == 0 {
-				a.sendMessage(ctx, m.Chat.ID, a.messages["no_changes"], nil)
-				delete(a.convs, m.Chat.ID)
+				a.sendMessage(ctx, m.Chat.ID, a.ui().messages["no_changes"], nil)
+				a.convs.delete(m.Chat.ID)
 				return
 			}
 			for _, cat := range c.SelectedCats {
@@ -703,7 +2201,7 @@ func (a *App) continueConversation(ctx context.Context, m *telegram.Message, c *
 		}
 		cats := parseSelection(m.Text, c.AvailableCats, len(c.AvailableCats))
 		if len(cats) == 0 {
-			msg, _ := a.sendMessage(ctx, m.Chat.ID, a.messages["choose_category_number"], addBack(numberKeyboardWithDone(len(c.AvailableCats))))
+			msg, _ := a.sendMessage(ctx, m.Chat.ID, a.ui().messages["choose_category_number"], addBack(numberKeyboardWithDone(len(c.AvailableCats))))
 			c.LastMsgID = msg
 			return
 		}
@@ -721,21 +2219,87 @@ func (a *App) continueConversation(ctx context.Context, m *telegram.Message, c *
 				c.SelectedCats = append(c.SelectedCats, cat)
 			}
 		}
-		prompt := fmt.Sprintf(a.messages["prompt_choose_delete_multi"], formatOptions(c.AvailableCats))
+		prompt := fmt.Sprintf(a.ui().messages["prompt_choose_delete_multi"], formatOptions(c.AvailableCats))
 		if len(c.SelectedCats) > 0 {
-			prompt += "\n\n" + fmt.Sprintf(a.messages["already_selected"], strings.Join(c.SelectedCats, ", "))
+			prompt += "\n\n" + fmt.Sprintf(a.ui().messages["already_selected"], strings.Join(c.SelectedCats, ", "))
 		}
 		msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, numberKeyboardWithDone(len(c.AvailableCats)))
 		c.LastMsgID = msgID
 
+	case stageSelectManyNew:
+		opts := addCustomOption(a.ui().categoryOptions, c.AllowCustomCategory)
+		if m.Text == morePage {
+			a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+			a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+			a.nextPage(c, len(opts))
+			prompt := fmt.Sprintf(a.ui().messages["prompt_choose_new_multi"], c.CategoryLimit, a.pageOptions(c, opts))
+			if len(c.SelectedCats) > 0 {
+				prompt += "\n\n" + fmt.Sprintf(a.ui().messages["already_selected"], strings.Join(c.SelectedCats, ", "))
+			}
+			msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addCancel(a.pageKeyboard(c, len(opts), true)))
+			c.LastMsgID = msgID
+			return
+		}
+		if !strings.EqualFold(m.Text, "Готово") {
+			cats := a.selectOnPage(c, m.Text, opts, c.CategoryLimit-len(c.SelectedCats))
+			if len(cats) == 0 {
+				msg, _ := a.sendMessage(ctx, m.Chat.ID, a.ui().messages["choose_category_number"], addCancel(a.pageKeyboard(c, len(opts), true)))
+				c.LastMsgID = msg
+				return
+			}
+			a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+			a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+			for _, cat := range cats {
+				exists := false
+				for _, ex := range c.SelectedCats {
+					if ex == cat {
+						exists = true
+						break
+					}
+				}
+				if !exists && len(c.SelectedCats) < c.CategoryLimit {
+					c.SelectedCats = append(c.SelectedCats, cat)
+				}
+			}
+			if len(c.SelectedCats) < c.CategoryLimit {
+				prompt := fmt.Sprintf(a.ui().messages["prompt_choose_new_multi"], c.CategoryLimit, a.pageOptions(c, opts))
+				prompt += "\n\n" + fmt.Sprintf(a.ui().messages["already_selected"], strings.Join(c.SelectedCats, ", "))
+				msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addCancel(a.pageKeyboard(c, len(opts), true)))
+				c.LastMsgID = msgID
+				return
+			}
+		} else {
+			a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+			a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+			if len(c.SelectedCats) == 0 {
+				a.sendMessage(ctx, m.Chat.ID, a.ui().messages["no_changes"], nil)
+				a.convs.delete(m.Chat.ID)
+				return
+			}
+		}
+		c.Step = 0
+		c.CategoryLimit = len(c.SelectedCats)
+		c.PendingCats = c.SelectedCats
+		c.SelectedCats = nil
+		a.nextPendingCategory(ctx, m, c)
+
 	case stageCategory:
-		opts := addCustomOption(a.categoryOptions, c.AllowCustomCategory)
+		opts := addCustomOption(a.ui().categoryOptions, c.AllowCustomCategory)
+		if m.Text == morePage {
+			a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+			a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+			a.nextPage(c, len(opts))
+			prompt, kb := a.categoryPrompt(c)
+			msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, kb)
+			c.LastMsgID = msgID
+			return
+		}
 		if strings.EqualFold(m.Text, "Готово") {
 			a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
 			a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
 			if c.Step == 0 {
-				a.sendMessage(ctx, m.Chat.ID, a.messages["no_changes"], nil)
-				delete(a.convs, m.Chat.ID)
+				a.sendMessage(ctx, m.Chat.ID, a.ui().messages["no_changes"], nil)
+				a.convs.delete(m.Chat.ID)
 				return
 			}
 			a.saveTopics(ctx, m, c)
@@ -749,42 +2313,47 @@ func (a *App) continueConversation(ctx context.Context, m *telegram.Message, c *
 				c.setStage(stageUpdateChoice)
 				c.SelectedCats = nil
 				m.Text = ""
-				msgID, _ := a.sendMessage(ctx, m.Chat.ID, a.messages["choose_action"], addCancel(numberKeyboard(2)))
+				msgID, _ := a.sendMessage(ctx, m.Chat.ID, a.ui().messages["choose_action"], addCancel(numberKeyboard(2)))
 				c.LastMsgID = msgID
 				return
 			}
 			c.setStage(stageUpdateChoice)
 			c.OldCat = ""
-			msgID, _ := a.sendMessage(ctx, m.Chat.ID, a.messages["choose_action"], addCancel(numberKeyboard(2)))
+			msgID, _ := a.sendMessage(ctx, m.Chat.ID, a.ui().messages["choose_action"], addCancel(numberKeyboard(2)))
 			c.LastMsgID = msgID
 			return
 		}
 
-		cats := parseSelection(m.Text, opts, 1)
+		cats := a.selectOnPage(c, m.Text, opts, 1)
 		if len(cats) == 0 {
-			msg, _ := a.sendMessage(ctx, m.Chat.ID, a.messages["choose_category_number"], addBackCancel(numberKeyboard(len(opts))))
+			msg, _ := a.sendMessage(ctx, m.Chat.ID, a.ui().messages["choose_category_number"], addBackCancel(a.pageKeyboard(c, len(opts), false)))
 			c.LastMsgID = msg
 			return
 		}
 		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
 		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
 		if c.AllowCustomCategory && cats[0] == "😇Своя категория" {
-			c.setStage(stageCustomCategory)
-			msgID, _ := a.sendMessage(ctx, m.Chat.ID, a.messages["enter_custom_category"], nil)
-			c.LastMsgID = msgID
+			if customLimitReached(c) {
+				a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf(a.ui().messages["limit_custom_categories"], c.MaxCustomCategories), nil)
+				prompt, kb := a.categoryPrompt(c)
+				msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, kb)
+				c.LastMsgID = msgID
+				return
+			}
+			a.askCustomCategory(ctx, m.Chat.ID, c)
 			return
 		}
 		c.CurrentCat = cats[0]
 		c.SelectedInfos = nil
 		c.setStage(stageInfoTypes)
-		prompt := fmt.Sprintf(a.messages["prompt_choose_info"], c.CurrentCat, c.InfoLimit, formatOptions(a.infoOptions))
-		msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addBackCancel(numberKeyboard(len(a.infoOptions))))
+		prompt := fmt.Sprintf(a.ui().messages["prompt_choose_info"], c.CurrentCat, c.InfoLimit, a.formatInfoOptions())
+		msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addBackCancel(numberKeyboard(len(a.ui().infoOptions))))
 		c.LastMsgID = msgID
 
 	case stageCustomCategory:
-		words := strings.Fields(m.Text)
-		if len(words) < 1 || len(words) > 3 {
-			msg, _ := a.sendMessage(ctx, m.Chat.ID, a.messages["enter_words_1_3"], nil)
+		words, problem := a.checkCategoryWords(m.Text)
+		if problem != "" {
+			msg, _ := a.sendMessage(ctx, m.Chat.ID, problem, nil)
 			c.LastMsgID = msg
 			return
 		}
@@ -793,47 +2362,45 @@ func (a *App) continueConversation(ctx context.Context, m *telegram.Message, c *
 		c.CurrentCat = "🫆" + strings.Join(words, " ")
 		c.setStage(stageInfoTypes)
 		c.SelectedInfos = nil
-		prompt := fmt.Sprintf(a.messages["prompt_choose_info"], c.CurrentCat, c.InfoLimit, formatOptions(a.infoOptions))
-		msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addBack(numberKeyboardWithDone(len(a.infoOptions))))
+		prompt := fmt.Sprintf(a.ui().messages["prompt_choose_info"], c.CurrentCat, c.InfoLimit, a.formatInfoOptions())
+		msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addBack(numberKeyboardWithDone(len(a.ui().infoOptions))))
 		c.LastMsgID = msgID
 
 	case stageInfoTypes:
+		if m.Text == sameInfos && canShareInfos(c) {
+			a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+			a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+			c.PendingCats = append([]string{c.CurrentCat}, c.PendingCats...)
+			a.askSharedInfos(ctx, m.Chat.ID, c)
+			return
+		}
 		if strings.EqualFold(m.Text, "Назад") {
 			a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
 			a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
 			c.setStage(stageCategory)
-
-			opts := addCustomOption(a.categoryOptions, c.AllowCustomCategory)
-			var prompt string
-			var msgID int
-			if c.OldCat != "" {
-				prompt = fmt.Sprintf(a.messages["prompt_choose_new"], c.OldCat, formatOptions(opts))
-				msgID, _ = a.sendMessage(ctx, m.Chat.ID, prompt, addBackCancel(numberKeyboard(len(opts))))
-			} else {
-				prompt = fmt.Sprintf(a.messages["prompt_choose_category"], c.Step+1, formatOptions(opts))
-				msgID, _ = a.sendMessage(ctx, m.Chat.ID, prompt, addBack(numberKeyboardWithDone(len(opts))))
-			}
+			prompt, kb := a.categoryPrompt(c)
+			msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, kb)
 			c.LastMsgID = msgID
 			return
 		}
 		if strings.EqualFold(m.Text, "Готово") {
 			if len(c.SelectedInfos) == 0 && len(c.Topics[c.CurrentCat]) == 0 {
-				prompt := fmt.Sprintf(a.messages["prompt_choose_info"], c.CurrentCat, c.InfoLimit, formatOptions(a.infoOptions))
+				prompt := fmt.Sprintf(a.ui().messages["prompt_choose_info"], c.CurrentCat, c.InfoLimit, a.formatInfoOptions())
 				if len(c.SelectedInfos) > 0 {
-					prompt += "\n\n" + fmt.Sprintf(a.messages["already_selected"], strings.Join(c.SelectedInfos, ", "))
+					prompt += "\n\n" + fmt.Sprintf(a.ui().messages["already_selected"], strings.Join(c.SelectedInfos, ", "))
 				}
-				msg, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addBack(numberKeyboardWithDone(len(a.infoOptions))))
+				msg, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addBack(numberKeyboardWithDone(len(a.ui().infoOptions))))
 				c.LastMsgID = msg
 				return
 			}
 		} else {
-			infos := parseSelection(m.Text, a.infoOptions, c.InfoLimit-len(c.SelectedInfos))
+			infos := parseSelection(m.Text, a.ui().infoOptions, c.InfoLimit-len(c.SelectedInfos))
 			if len(infos) == 0 {
-				prompt := fmt.Sprintf(a.messages["prompt_choose_info"], c.CurrentCat, c.InfoLimit, formatOptions(a.infoOptions))
+				prompt := fmt.Sprintf(a.ui().messages["prompt_choose_info"], c.CurrentCat, c.InfoLimit, a.formatInfoOptions())
 				if len(c.SelectedInfos) > 0 {
-					prompt += "\n\n" + fmt.Sprintf(a.messages["already_selected"], strings.Join(c.SelectedInfos, ", "))
+					prompt += "\n\n" + fmt.Sprintf(a.ui().messages["already_selected"], strings.Join(c.SelectedInfos, ", "))
 				}
-				msg, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addBack(numberKeyboardWithDone(len(a.infoOptions))))
+				msg, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addBack(numberKeyboardWithDone(len(a.ui().infoOptions))))
 				c.LastMsgID = msg
 				return
 			}
@@ -852,25 +2419,16 @@ func (a *App) continueConversation(ctx context.Context, m *telegram.Message, c *
 				}
 			}
 			if len(c.SelectedInfos) < c.InfoLimit {
-				prompt := fmt.Sprintf(a.messages["prompt_choose_info"], c.CurrentCat, c.InfoLimit, formatOptions(a.infoOptions))
+				prompt := fmt.Sprintf(a.ui().messages["prompt_choose_info"], c.CurrentCat, c.InfoLimit, a.formatInfoOptions())
 				if len(c.SelectedInfos) > 0 {
-					prompt += "\n\n" + fmt.Sprintf(a.messages["already_selected"], strings.Join(c.SelectedInfos, ", "))
+					prompt += "\n\n" + fmt.Sprintf(a.ui().messages["already_selected"], strings.Join(c.SelectedInfos, ", "))
 				}
-				msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addBack(numberKeyboardWithDone(len(a.infoOptions))))
+				msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addBack(numberKeyboardWithDone(len(a.ui().infoOptions))))
 				c.LastMsgID = msgID
 				return
 			}
 		}
 
-		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
-		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
-		if c.Topics == nil {
-			c.Topics = map[string][]string{}
-		}
-		if c.OldCat != "" {
-			delete(c.Topics, c.OldCat)
-			c.OldCat = ""
-		}
 		existing := c.Topics[c.CurrentCat]
 		for _, inf := range c.SelectedInfos {
 			found := false
@@ -884,6 +2442,26 @@ func (a *App) continueConversation(ctx context.Context, m *telegram.Message, c *
 				existing = append(existing, inf)
 			}
 		}
+		if room, ok := totalInfoRoom(c, len(existing)); !ok {
+			a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+			a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+			c.SelectedInfos = nil
+			a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf(a.ui().messages["limit_total_infos"], c.TotalInfoLimit, room), nil)
+			prompt := fmt.Sprintf(a.ui().messages["prompt_choose_info"], c.CurrentCat, c.InfoLimit, a.formatInfoOptions())
+			msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addBack(numberKeyboardWithDone(len(a.ui().infoOptions))))
+			c.LastMsgID = msgID
+			return
+		}
+
+		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+		if c.Topics == nil {
+			c.Topics = map[string][]string{}
+		}
+		if c.OldCat != "" {
+			delete(c.Topics, c.OldCat)
+			c.OldCat = ""
+		}
 		c.Topics[c.CurrentCat] = existing
 		c.SelectedInfos = nil
 		c.Step++
@@ -892,145 +2470,332 @@ func (a *App) continueConversation(ctx context.Context, m *telegram.Message, c *
 			return
 		}
 
+		if len(c.PendingCats) > 0 {
+			a.nextPendingCategory(ctx, m, c)
+			return
+		}
+
 		if len(c.SelectedCats) > 0 && c.Step < len(c.SelectedCats) {
 			c.OldCat = c.SelectedCats[c.Step]
 			c.Stage = stageCategory
-			opts := addCustomOption(a.categoryOptions, c.AllowCustomCategory)
-			prompt := fmt.Sprintf(a.messages["prompt_choose_new"], c.OldCat, formatOptions(opts))
-			msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, numberKeyboard(len(opts)))
+			opts := addCustomOption(a.ui().categoryOptions, c.AllowCustomCategory)
+			prompt := fmt.Sprintf(a.ui().messages["prompt_choose_new"], c.OldCat, a.pageOptions(c, opts))
+			msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, a.pageKeyboard(c, len(opts), false))
 			c.LastMsgID = msgID
 			return
 		}
 
 		c.setStage(stageCategory)
-		opts := addCustomOption(a.categoryOptions, c.AllowCustomCategory)
-		prompt := fmt.Sprintf(a.messages["prompt_choose_category"], c.Step+1, formatOptions(opts))
-		msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addBack(numberKeyboardWithDone(len(opts))))
+		opts := addCustomOption(a.ui().categoryOptions, c.AllowCustomCategory)
+		prompt := fmt.Sprintf(a.ui().messages["prompt_choose_category"], c.Step+1, a.pageOptions(c, opts))
+		msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addBack(a.pageKeyboard(c, len(opts), true)))
 		c.LastMsgID = msgID
 	case stageGetNewsCategory:
 		cats := parseSelection(m.Text, c.AvailableCats, 1)
 		if len(cats) == 0 {
-			msg, _ := a.sendMessage(ctx, m.Chat.ID, a.messages["choose_category_number"], addCancel(numberKeyboard(len(c.AvailableCats))))
+			msg, _ := a.sendMessage(ctx, m.Chat.ID, a.ui().messages["choose_category_number"], addCancel(numberKeyboard(len(c.AvailableCats))))
 			c.LastMsgID = msg
 			return
 		}
 		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
 		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
-		tariff, ok := a.cfg.Tariffs[c.Settings.Tariff]
-		if !ok {
-			tariff = a.cfg.Tariffs["base"]
+		a.generateNews(ctx, m.Chat.ID, c, cats[0])
+
+	case stageGetLast24hCategory:
+		cats := parseSelection(m.Text, c.AvailableCats, 1)
+		if len(cats) == 0 {
+			msg, _ := a.sendMessage(ctx, m.Chat.ID, a.ui().messages["choose_category_number"], addCancel(numberKeyboard(len(c.AvailableCats))))
+			c.LastMsgID = msg
+			return
 		}
-		now := time.Now()
-		last := time.Unix(c.Settings.LastGetNewsNow, 0)
-		if now.YearDay() != last.YearDay() || now.Year() != last.Year() {
-			c.Settings.GetNewsNowCount = 0
+		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+		a.generateLast24h(ctx, m.Chat.ID, c, cats[0])
+
+	case stageSetTariffUser:
+		username := strings.TrimPrefix(strings.TrimSpace(m.Text), "@")
+		if username == "" {
+			msg, _ := a.sendMessage(ctx, m.Chat.ID, "Введите username пользователя", addBack(nil))
+			c.LastMsgID = msg
+			return
 		}
-		if c.Settings.GetNewsNowCount >= tariff.Limits.GetNewsNowPerDay {
-			a.sendMessage(ctx, m.Chat.ID, a.messages["limit_today"], nil)
-			delete(a.convs, m.Chat.ID)
+		c.TargetUser = username
+		tariffs := []string{"base", "plus", "premium", "ultimate"}
+		prompt := "Выберите тариф"
+		msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addBack([][]string{tariffs}))
+		c.setStage(stageSetTariffChoice)
+		c.LastMsgID = msgID
+
+	case stageSetTariffChoice:
+		choice := strings.TrimSpace(m.Text)
+		if choice != "base" && choice != "plus" && choice != "premium" && choice != "ultimate" {
+			msg, _ := a.sendMessage(ctx, m.Chat.ID, "Выберите тариф", addBack([][]string{{"base", "plus", "premium", "ultimate"}}))
+			c.LastMsgID = msg
 			return
 		}
-		c.Settings.GetNewsNowCount++
-		c.Settings.LastGetNewsNow = now.Unix()
-		if err := a.repo.Save(ctx, c.Settings); err != nil {
-			log.Println("save settings:", err)
+		c.NewTariff = choice
+		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+		if err := a.setUserTariff(ctx, c.TargetUser, c.NewTariff); err != nil {
+			a.sendMessage(ctx, m.Chat.ID, "Ошибка: "+err.Error(), nil)
+		} else {
+			a.sendMessage(ctx, m.Chat.ID, "Тариф обновлен", nil)
 		}
-		msg, err := a.userService.GetNewsForCategoryMultiInfo(ctx, c.Settings, cats[0])
-		if err != nil {
-			log.Println("get news:", err)
-			delete(a.convs, m.Chat.ID)
+		a.convs.delete(m.Chat.ID)
+
+	case stageConfirmOverwrite:
+		if strings.TrimSpace(m.Text) != "Заменить" {
+			msg, _ := a.sendMessage(ctx, m.Chat.ID, a.ui().messages["confirm_overwrite"], addCancel([][]string{{"Заменить"}}))
+			c.LastMsgID = msg
 			return
 		}
-		if len([]rune(msg)) > 4096 {
-			if err := a.sendLongMessage(ctx, m.Chat.ID, msg); err != nil {
-				log.Println("send msg err: ", err)
-			}
-		} else {
-			a.sendMessage(ctx, m.Chat.ID, msg, nil)
+		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+		c.ConfirmOverwrite = true
+		a.saveTopics(ctx, m, c)
+
+	case stageUndoConfirm:
+		if strings.TrimSpace(m.Text) != undoApply {
+			a.askUndo(ctx, m.Chat.ID, c)
+			return
 		}
-		delete(a.convs, m.Chat.ID)
+		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+		a.convs.delete(m.Chat.ID)
+		a.applyUndo(ctx, m.Chat.ID, c.Settings)
 
-	case stageGetLast24hCategory:
-		cats := parseSelection(m.Text, c.AvailableCats, 1)
-		if len(cats) == 0 {
-			msg, _ := a.sendMessage(ctx, m.Chat.ID, a.messages["choose_category_number"], addCancel(numberKeyboard(len(c.AvailableCats))))
+	case stageRetrySave:
+		if !strings.EqualFold(strings.TrimSpace(m.Text), retrySave) {
+			msg, _ := a.sendMessage(ctx, m.Chat.ID, a.ui().messages["save_failed"], addCancel([][]string{{retrySave}}))
 			c.LastMsgID = msg
 			return
 		}
 		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
 		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+		a.saveTopics(ctx, m, c)
 
-		tariff, ok := a.cfg.Tariffs[c.Settings.Tariff]
+	case stageStyleTemplate:
+		t := a.tariffFor(c.Settings.Tariff)
+		choice, ok := pickPreset(m.Text, templateNames(t))
 		if !ok {
-			tariff = a.cfg.Tariffs["base"]
+			a.askStyle(ctx, m.Chat.ID, c, a.ui().messages["style_choose_template"], templateLabel(c.Settings, t), templateNames(t))
+			return
 		}
-		now := time.Now()
-		last := time.Unix(c.Settings.LastGetLast24h, 0)
-		if now.YearDay() != last.YearDay() || now.Year() != last.Year() {
-			c.Settings.GetLast24hCount = 0
+		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+		c.Settings.PromptTemplate = choice
+		a.askNextStyle(ctx, m.Chat.ID, c, stageStyleTone)
+
+	case stageStyleTone:
+		t := a.tariffFor(c.Settings.Tariff)
+		choice, ok := pickPreset(m.Text, t.GPT.StylePresets)
+		if !ok {
+			a.askStyle(ctx, m.Chat.ID, c, a.ui().messages["style_choose_tone"], service.UserStyle(c.Settings, t).GPT.Style, t.GPT.StylePresets)
+			return
 		}
-		if c.Settings.GetLast24hCount >= tariff.Limits.GetLast24hNewPerDay {
-			a.sendMessage(ctx, m.Chat.ID, a.messages["limit_today"], nil)
-			delete(a.convs, m.Chat.ID)
+		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+		c.Settings.Tone = choice
+		a.askNextStyle(ctx, m.Chat.ID, c, stageStyleVolume)
+
+	case stageStyleVolume:
+		t := a.tariffFor(c.Settings.Tariff)
+		choice, ok := pickPreset(m.Text, t.GPT.VolumePresets)
+		if !ok {
+			a.askStyle(ctx, m.Chat.ID, c, a.ui().messages["style_choose_volume"], service.UserStyle(c.Settings, t).GPT.Volume, t.GPT.VolumePresets)
 			return
 		}
+		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+		c.Settings.Volume = choice
+		a.saveStyle(ctx, m.Chat.ID, c)
 
-		msgWait, _ := a.sendMessage(ctx, m.Chat.ID, a.messages["wait_search"], nil)
+	case stageToneCategory:
+		cats := parseSelection(m.Text, c.AvailableCats, 1)
+		if len(cats) == 0 {
+			msg, _ := a.sendMessage(ctx, m.Chat.ID, a.ui().messages["choose_category_number"], addCancel(numberKeyboard(len(c.AvailableCats))))
+			c.LastMsgID = msg
+			return
+		}
+		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+		c.setStage(stageCategoryTone)
+		a.askCategoryTone(ctx, m.Chat.ID, c, cats[0])
 
-		msg, err := a.userService.GetLast24hNewsForCategory(ctx, c.Settings, cats[0])
-		if err != nil {
-			log.Println("get news:", err)
-			delete(a.convs, m.Chat.ID)
+	case stageCategoryTone:
+		t := a.tariffFor(c.Settings.Tariff)
+		choice, ok := pickPreset(m.Text, t.GPT.StylePresets)
+		if !ok {
+			a.askCategoryTone(ctx, m.Chat.ID, c, c.CurrentCat)
 			return
 		}
+		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+		a.saveCategoryTone(ctx, m.Chat.ID, c, choice)
 
-		a.deleteMessage(ctx, m.Chat.ID, msgWait)
-		c.Settings.GetLast24hCount++
-		c.Settings.LastGetLast24h = now.Unix()
-		if err := a.repo.Save(ctx, c.Settings); err != nil {
-			log.Println("save settings:", err)
+	case stageEmptyCategory:
+		switch strings.TrimSpace(m.Text) {
+		case pickInfos:
+			a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+			a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+			c.SelectedInfos = nil
+			c.OldCat = ""
+			c.PendingCats = nil
+			c.SelectedCats = nil
+			// The dialog is over, so completing this category saves the topics.
+			c.Step = c.CategoryLimit - 1
+			c.setStage(stageInfoTypes)
+			prompt := fmt.Sprintf(a.ui().messages["prompt_choose_info"], c.CurrentCat, c.InfoLimit, a.formatInfoOptions())
+			msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addCancel(numberKeyboardWithDone(len(a.ui().infoOptions))))
+			c.LastMsgID = msgID
+		case dropCategory:
+			a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+			a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+			delete(c.Topics, c.CurrentCat)
+			a.saveTopics(ctx, m, c)
+		default:
+			a.askEmptyCategory(ctx, m.Chat.ID, c, c.CurrentCat)
 		}
-		if len([]rune(msg)) > 4096 {
-			if err := a.sendLongMessage(ctx, m.Chat.ID, msg); err != nil {
-				log.Println("send msg err: ", err)
-			}
-		} else {
-			_, err = a.sendMessage(ctx, m.Chat.ID, msg, nil)
-			if err != nil {
-				log.Println("send msg err: ", err)
-			}
+
+	case stageCloneCategory:
+		cats := parseSelection(m.Text, c.AvailableCats, 1)
+		if len(cats) == 0 {
+			msg, _ := a.sendMessage(ctx, m.Chat.ID, a.ui().messages["choose_category_number"], addCancel(numberKeyboard(len(c.AvailableCats))))
+			c.LastMsgID = msg
+			return
 		}
-		delete(a.convs, m.Chat.ID)
+		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+		a.askCloneName(ctx, m.Chat.ID, c, cats[0])
 
-	case stageSetTariffUser:
-		username := strings.TrimPrefix(strings.TrimSpace(m.Text), "@")
-		if username == "" {
-			msg, _ := a.sendMessage(ctx, m.Chat.ID, "Введите username пользователя", addBack(nil))
+	case stageCloneName:
+		words, problem := a.checkCategoryWords(m.Text)
+		if problem != "" {
+			msg, _ := a.sendMessage(ctx, m.Chat.ID, problem, addCancel(nil))
 			c.LastMsgID = msg
 			return
 		}
-		c.TargetUser = username
-		tariffs := []string{"base", "plus", "premium", "ultimate"}
-		prompt := "Выберите тариф"
-		msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addBack([][]string{tariffs}))
-		c.setStage(stageSetTariffChoice)
+		name := cloneName(c.CurrentCat, strings.Join(words, " "))
+		if categoryTaken(c.Topics, name) {
+			msg, _ := a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf(a.ui().messages["clone_exists"], html.EscapeString(name)), addCancel(nil))
+			c.LastMsgID = msg
+			return
+		}
+		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+		c.CurrentCat = name
+		c.SelectedInfos = nil
+		c.setStage(stageInfoTypes)
+		prompt := fmt.Sprintf(a.ui().messages["prompt_choose_info"], c.CurrentCat, c.InfoLimit, a.formatInfoOptions())
+		msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addCancel(numberKeyboardWithDone(len(a.ui().infoOptions))))
 		c.LastMsgID = msgID
 
-	case stageSetTariffChoice:
-		choice := strings.TrimSpace(m.Text)
-		if choice != "base" && choice != "plus" && choice != "premium" && choice != "ultimate" {
-			msg, _ := a.sendMessage(ctx, m.Chat.ID, "Выберите тариф", addBack([][]string{{"base", "plus", "premium", "ultimate"}}))
+	case stageSnoozeCategory:
+		cats := parseSelection(m.Text, c.AvailableCats, 1)
+		if len(cats) == 0 {
+			msg, _ := a.sendMessage(ctx, m.Chat.ID, a.ui().messages["choose_category_number"], addCancel(numberKeyboard(len(c.AvailableCats))))
 			c.LastMsgID = msg
 			return
 		}
-		c.NewTariff = choice
 		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
 		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
-		if err := a.setUserTariff(ctx, c.TargetUser, c.NewTariff); err != nil {
-			a.sendMessage(ctx, m.Chat.ID, "Ошибка: "+err.Error(), nil)
+		c.setStage(stageSnoozeDuration)
+		a.askSnoozeDuration(ctx, m.Chat.ID, c, cats[0])
+
+	case stageSnoozeDuration:
+		choice := strings.TrimSpace(m.Text)
+		if choice == snoozeResume {
+			a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+			a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+			a.saveSnooze(ctx, m.Chat.ID, c, 0)
+			return
+		}
+		for _, d := range snoozeDurations {
+			if d.Label == choice {
+				a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+				a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+				a.saveSnooze(ctx, m.Chat.ID, c, d.Days)
+				return
+			}
+		}
+		a.askSnoozeDuration(ctx, m.Chat.ID, c, c.CurrentCat)
+
+	case stageFormat:
+		format, ok := pickFormat(m.Text)
+		if !ok {
+			a.askFormat(ctx, m.Chat.ID, c)
+			return
+		}
+		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+		a.convs.delete(m.Chat.ID)
+		a.saveFormat(ctx, m.Chat.ID, c.Settings, format)
+
+	case stageRate:
+		text := strings.TrimSpace(m.Text)
+		if text != rateUp && text != rateDown {
+			a.askRate(ctx, m.Chat.ID, c)
+			return
+		}
+		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+		a.convs.delete(m.Chat.ID)
+		a.saveRating(ctx, m.Chat.ID, c, text == rateUp)
+
+	case stageLength:
+		tokens, ok := pickLength(m.Text)
+		if !ok {
+			a.askLength(ctx, m.Chat.ID, c)
+			return
+		}
+		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+		a.convs.delete(m.Chat.ID)
+		a.saveLength(ctx, m.Chat.ID, c.Settings, tokens)
+
+	case stageCategoriesPerSend:
+		n, ok := pickPerSend(c.Settings, m.Text)
+		if !ok {
+			a.askPerSend(ctx, m.Chat.ID, c)
+			return
+		}
+		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+		a.convs.delete(m.Chat.ID)
+		a.savePerSend(ctx, m.Chat.ID, c.Settings, n)
+
+	case stageSharedInfoTypes:
+		if strings.EqualFold(m.Text, "Назад") {
+			a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+			a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+			a.nextPendingCategory(ctx, m, c)
+			return
+		}
+		if !strings.EqualFold(m.Text, "Готово") {
+			infos := parseSelection(m.Text, a.ui().infoOptions, c.InfoLimit-len(c.SelectedInfos))
+			if len(infos) == 0 {
+				a.askSharedInfos(ctx, m.Chat.ID, c)
+				return
+			}
+			a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+			a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+			for _, inf := range infos {
+				if !slices.Contains(c.SelectedInfos, inf) && len(c.SelectedInfos) < c.InfoLimit {
+					c.SelectedInfos = append(c.SelectedInfos, inf)
+				}
+			}
+			if len(c.SelectedInfos) < c.InfoLimit {
+				a.askSharedInfos(ctx, m.Chat.ID, c)
+				return
+			}
 		} else {
-			a.sendMessage(ctx, m.Chat.ID, "Тариф обновлен", nil)
+			a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+			a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+			if len(c.SelectedInfos) == 0 {
+				a.askSharedInfos(ctx, m.Chat.ID, c)
+				return
+			}
 		}
-		delete(a.convs, m.Chat.ID)
+		a.applySharedInfos(ctx, m, c)
 	}
 }
@@ -0,0 +1,2954 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ilinovom/summary-tasks-bot/internal/config"
+	"github.com/ilinovom/summary-tasks-bot/internal/model"
+	"github.com/ilinovom/summary-tasks-bot/internal/repository"
+	"github.com/ilinovom/summary-tasks-bot/internal/service"
+	"github.com/ilinovom/summary-tasks-bot/pkg/telegram"
+)
+
+// sentMessage records a single outbound message captured by fakeTelegram.
+type sentMessage struct {
+	ChatID   int64
+	Text     string
+	Keyboard [][]string
+	Mode     telegram.ParseMode
+}
+
+// fakeTelegram is an in-memory TelegramClient that records outbound calls.
+type fakeTelegram struct {
+	mu        sync.Mutex
+	nextID    int
+	sent      []sentMessage
+	deleted   []int
+	edited    map[int]string
+	events    []string
+	documents []sentDocument
+	// buttons are the inline buttons of the sent or edited messages by ID.
+	buttons map[int][][]telegram.InlineButton
+	answers []string
+	// sendErr, when set, fails every SendMessage call.
+	sendErr error
+}
+
+// sentDocument records a file uploaded through fakeTelegram.
+type sentDocument struct {
+	ChatID  int64
+	Name    string
+	Data    string
+	Caption string
+}
+
+var _ TelegramClient = (*fakeTelegram)(nil)
+
+// SendMessage records the message and returns a sequential message ID, or
+// fails with sendErr.
+func (f *fakeTelegram) SendMessage(ctx context.Context, chatID int64, text string, keyboard [][]string, mode telegram.ParseMode) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.sendErr != nil {
+		return 0, f.sendErr
+	}
+	f.nextID++
+	f.sent = append(f.sent, sentMessage{ChatID: chatID, Text: text, Keyboard: keyboard, Mode: mode})
+	f.events = append(f.events, "send "+text)
+	return f.nextID, nil
+}
+
+// SendDocument records the uploaded file like a message with its name.
+func (f *fakeTelegram) SendDocument(ctx context.Context, chatID int64, filename string, data []byte, caption string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	f.documents = append(f.documents, sentDocument{ChatID: chatID, Name: filename, Data: string(data), Caption: caption})
+	f.events = append(f.events, "document "+filename)
+	return f.nextID, nil
+}
+
+// GetUpdates returns no updates.
+func (f *fakeTelegram) GetUpdates(ctx context.Context, offset int) ([]telegram.Update, error) {
+	return nil, nil
+}
+
+// SetCommands accepts any command list.
+func (f *fakeTelegram) SetCommands(ctx context.Context, commands []telegram.BotCommand) error {
+	return nil
+}
+
+// SetMyDescription accepts any description.
+func (f *fakeTelegram) SetMyDescription(ctx context.Context, description string) error {
+	return nil
+}
+
+// SetMyShortDescription accepts any short description.
+func (f *fakeTelegram) SetMyShortDescription(ctx context.Context, description string) error {
+	return nil
+}
+
+// GetMe returns the bot account "MyBot".
+func (f *fakeTelegram) GetMe(ctx context.Context) (telegram.User, error) {
+	return telegram.User{ID: 1, IsBot: true, Username: "MyBot"}, nil
+}
+
+// DeleteMessage records the deleted message ID.
+func (f *fakeTelegram) DeleteMessage(ctx context.Context, chatID int64, messageID int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted = append(f.deleted, messageID)
+	f.events = append(f.events, fmt.Sprintf("delete %d", messageID))
+	return nil
+}
+
+// EditMessageText records the new text of the message.
+func (f *fakeTelegram) EditMessageText(ctx context.Context, chatID int64, messageID int, text string, mode telegram.ParseMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.edited == nil {
+		f.edited = map[int]string{}
+	}
+	f.edited[messageID] = text
+	f.events = append(f.events, fmt.Sprintf("edit %d %s", messageID, text))
+	return nil
+}
+
+// SendInlineMessage records the message like SendMessage together with its
+// buttons.
+func (f *fakeTelegram) SendInlineMessage(ctx context.Context, chatID int64, text string, buttons [][]telegram.InlineButton, mode telegram.ParseMode) (int, error) {
+	id, err := f.SendMessage(ctx, chatID, text, nil, mode)
+	if err == nil {
+		f.setButtons(id, buttons)
+	}
+	return id, err
+}
+
+// EditInlineMessage records the new text and buttons of the message.
+func (f *fakeTelegram) EditInlineMessage(ctx context.Context, chatID int64, messageID int, text string, buttons [][]telegram.InlineButton, mode telegram.ParseMode) error {
+	f.EditMessageText(ctx, chatID, messageID, text, mode)
+	f.setButtons(messageID, buttons)
+	return nil
+}
+
+// setButtons records the inline buttons of a message.
+func (f *fakeTelegram) setButtons(messageID int, buttons [][]telegram.InlineButton) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.buttons == nil {
+		f.buttons = map[int][][]telegram.InlineButton{}
+	}
+	f.buttons[messageID] = buttons
+}
+
+// AnswerCallbackQuery records the notice shown for a button press.
+func (f *fakeTelegram) AnswerCallbackQuery(ctx context.Context, queryID, text string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.answers = append(f.answers, text)
+	return nil
+}
+
+// takeEvents returns the outbound calls recorded since the previous call.
+func (f *fakeTelegram) takeEvents() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := f.events
+	f.events = nil
+	return out
+}
+
+// texts returns the texts of all recorded messages.
+func (f *fakeTelegram) texts() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]string, len(f.sent))
+	for i, s := range f.sent {
+		out[i] = s.Text
+	}
+	return out
+}
+
+// countingAI is a service.AIClient that returns a fixed reply or error and
+// counts calls, keeping the last prompt.
+type countingAI struct {
+	mu     sync.Mutex
+	reply  string
+	err    error
+	calls  int
+	prompt string
+}
+
+// ChatCompletion returns the configured reply and error.
+func (c *countingAI) ChatCompletion(ctx context.Context, model, prompt string, maxTokens int, temperature *float64) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	c.prompt = prompt
+	return c.reply, c.err
+}
+
+// ChatResponses returns the configured reply.
+func (c *countingAI) ChatResponses(ctx context.Context, model, prompt string, maxTokens int, temperature *float64) (string, error) {
+	return c.ChatCompletion(ctx, model, prompt, maxTokens, temperature)
+}
+
+// newTestApp wires an App with fakes and a file-backed repository.
+func newTestApp(t *testing.T, ai service.AIClient) (*App, *fakeTelegram) {
+	t.Helper()
+	repo, err := repository.NewFileUserSettingsRepository(filepath.Join(t.TempDir(), "settings.json"))
+	if err != nil {
+		t.Fatalf("new repo: %v", err)
+	}
+	cfg := &config.Config{
+		Options: config.Options{
+			InfoOptions:     []string{"Факты", "Тренды", "Идеи"},
+			CategoryOptions: []string{"Наука", "Спорт", "Финансы"},
+		},
+		Tariffs: map[string]config.Tariff{
+			"base": {
+				Schedule: config.Schedule{FrequencyMinutes: 60, TimeRange: "00:00-23:59"},
+				Limits:   config.Limits{GetNewsNowPerDay: 5, CategoryLimit: 2, InfoTypeLimit: 2},
+				GPT:      config.GPTConfig{PromptMain: "{тип} {категория}"},
+			},
+		},
+		Messages: map[string]string{
+			"resend_prefix": "<b>RESEND</b>\n",
+			"resend_empty":  "nothing to resend",
+		},
+	}
+	a := New(cfg, repo)
+	tg := &fakeTelegram{}
+	a.tgClient = tg
+	a.aiClient = ai
+	a.userService = service.NewUserService(repo, ai, cfg.Tariffs)
+	return a, tg
+}
+
+// message builds an inbound Telegram message for the given chat.
+func message(chatID int64, text string) *telegram.Message {
+	return &telegram.Message{Chat: telegram.Chat{ID: chatID, Username: "user"}, Text: text}
+}
+
+// TestResendCommand_UsesCachedDigest verifies /resend re-sends the last
+// scheduled digest without another GPT call, keeping the prefix markup and
+// escaping only the digest.
+func TestResendCommand_UsesCachedDigest(t *testing.T) {
+	ai := &countingAI{reply: "digest <body> & **bold**"}
+	a, tg := newTestApp(t, ai)
+	ctx := context.Background()
+	u := &model.UserSettings{UserID: 1, Active: true, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты"}}}
+	if err := a.repo.Save(ctx, u); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.sendScheduled(ctx, u, time.Now())
+	if ai.calls != 1 {
+		t.Fatalf("expected 1 GPT call for scheduled send, got %d", ai.calls)
+	}
+
+	a.handleMessage(ctx, message(1, "/resend"))
+	if ai.calls != 1 {
+		t.Fatalf("resend must not call GPT, got %d calls", ai.calls)
+	}
+	texts := tg.texts()
+	if len(texts) != 2 || texts[1] != "<b>RESEND</b>\nКатегория: Наука\n\nТип: Факты\ndigest &lt;body&gt; &amp; <b>bold</b>" {
+		t.Fatalf("unexpected resend output: %q", texts)
+	}
+}
+
+// TestResendCommand_Empty checks the reply when nothing has been cached yet.
+func TestResendCommand_Empty(t *testing.T) {
+	a, tg := newTestApp(t, &countingAI{})
+	a.handleMessage(context.Background(), message(1, "/resend"))
+	texts := tg.texts()
+	if len(texts) != 1 || !strings.Contains(texts[0], "nothing to resend") {
+		t.Fatalf("unexpected reply: %q", texts)
+	}
+}
+
+// TestStartFlow_IgnoresRepeatedPresses verifies that a double /start and a
+// double "Продолжить" lead to a single welcome and a single count prompt, and
+// the extra presses are removed from the chat.
+func TestStartFlow_IgnoresRepeatedPresses(t *testing.T) {
+	a, tg := newTestApp(t, nil)
+	ctx := context.Background()
+	a.ui().messages["start"] = "welcome"
+	a.ui().messages["prompt_choose_count"] = "how many (max %d)?"
+	press := func(id int, text string) {
+		m := message(1, text)
+		m.MessageID = id
+		a.handleMessage(ctx, m)
+	}
+
+	press(10, "/start")
+	press(11, "/start")
+	press(12, continueOnboarding)
+	press(13, continueOnboarding)
+	if want := []string{"welcome", "how many (max 2)?"}; !slices.Equal(tg.texts(), want) {
+		t.Fatalf("sent %q, want %q", tg.texts(), want)
+	}
+	c, _ := a.convs.get(1)
+	if c == nil || c.Stage != stageChooseCategoryCount || c.LastMsgID != 2 {
+		t.Fatalf("expected the count prompt to stay current, got %+v", c)
+	}
+	tg.mu.Lock()
+	deleted := append([]int(nil), tg.deleted...)
+	tg.mu.Unlock()
+	if want := []int{11, 12, 1, 13}; !slices.Equal(deleted, want) {
+		t.Fatalf("deleted %v, want %v", deleted, want)
+	}
+
+	press(14, "1")
+	if c.Stage != stageCategory {
+		t.Fatalf("the count must still be accepted, stage %v", c.Stage)
+	}
+}
+
+// TestStartFlow_WelcomeSendFails verifies that when the welcome message cannot
+// be sent no onboarding conversation is left behind, so a later /start shows
+// the welcome again.
+func TestStartFlow_WelcomeSendFails(t *testing.T) {
+	a, tg := newTestApp(t, nil)
+	ctx := context.Background()
+	a.ui().messages["start"] = "welcome"
+	tg.sendErr = errors.New("network down")
+
+	a.handleMessage(ctx, message(1, "/start"))
+	if c, ok := a.convs.get(1); ok {
+		t.Fatalf("expected no conversation after a failed welcome, got %+v", c)
+	}
+
+	tg.sendErr = nil
+	a.handleMessage(ctx, message(1, "/start"))
+	c, ok := a.convs.get(1)
+	if !ok || c.Stage != stageWelcome || c.LastMsgID != 1 {
+		t.Fatalf("expected a fresh onboarding, got %+v", c)
+	}
+	if want := []string{"welcome"}; !slices.Equal(tg.texts(), want) {
+		t.Fatalf("sent %q, want %q", tg.texts(), want)
+	}
+}
+
+// failOnceTelegram fails the first message it is asked to send.
+type failOnceTelegram struct {
+	*fakeTelegram
+	failed bool
+}
+
+// SendMessage fails on the first call and records the later ones.
+func (f *failOnceTelegram) SendMessage(ctx context.Context, chatID int64, text string, keyboard [][]string, mode telegram.ParseMode) (int, error) {
+	if !f.failed {
+		f.failed = true
+		return 0, errors.New("network down")
+	}
+	return f.fakeTelegram.SendMessage(ctx, chatID, text, keyboard, mode)
+}
+
+// TestStartFlow_WelcomeRetry verifies a failed welcome is sent again after a
+// pause and the onboarding then starts, while WelcomeRetries=0 gives up.
+func TestStartFlow_WelcomeRetry(t *testing.T) {
+	old := welcomeRetryDelay
+	welcomeRetryDelay = 20 * time.Millisecond
+	t.Cleanup(func() { welcomeRetryDelay = old })
+	a, tg := newTestApp(t, nil)
+	ctx := context.Background()
+	a.ui().messages["start"] = "welcome"
+
+	a.tgClient = &failOnceTelegram{fakeTelegram: tg}
+	a.handleMessage(ctx, message(1, "/start"))
+	if _, ok := a.convs.get(1); ok {
+		t.Fatalf("WelcomeRetries=0 must not retry the welcome")
+	}
+
+	a.cfg.WelcomeRetries = 1
+	a.tgClient = &failOnceTelegram{fakeTelegram: tg}
+	start := time.Now()
+	a.handleMessage(ctx, message(2, "/start"))
+	if c, ok := a.convs.get(2); !ok || c.Stage != stageWelcome {
+		t.Fatalf("expected onboarding after the retried welcome, got %+v", c)
+	}
+	if time.Since(start) < welcomeRetryDelay {
+		t.Fatalf("the welcome was sent again without a pause")
+	}
+}
+
+// TestStartFlow_SuggestsCategoriesFromInterests verifies a new user can
+// describe their interests instead of picking categories: the model's reply
+// is mapped onto valid options within the tariff limits and, once confirmed,
+// the flow asks for the info types of each suggested category.
+func TestStartFlow_SuggestsCategoriesFromInterests(t *testing.T) {
+	ai := &countingAI{reply: "Кино\n1. наука\nСвоя: Космос\n- спорт\nФинансы"}
+	a, tg := newTestApp(t, ai)
+	ctx := context.Background()
+	a.ui().messages["interests_suggested"] = "suggested:\n%s"
+
+	for _, text := range []string{"/start", "Продолжить", describeInterests, "космос, наука и бег"} {
+		a.handleMessage(ctx, message(1, text))
+	}
+	c, _ := a.convs.get(1)
+	if c == nil || c.Stage != stageInterestsConfirm {
+		t.Fatalf("expected the suggestions to be confirmed, got %+v", c)
+	}
+	if want := []string{"Наука", "Спорт"}; !slices.Equal(c.Suggested, want) {
+		t.Fatalf("suggested %q, want %q", c.Suggested, want)
+	}
+	if texts := tg.texts(); texts[len(texts)-1] != "suggested:\n1. Наука\n2. Спорт" {
+		t.Fatalf("unexpected suggestion message %q", texts[len(texts)-1])
+	}
+	if !strings.Contains(ai.prompt, "космос, наука и бег") || strings.Contains(ai.prompt, "Своя:") {
+		t.Fatalf("unexpected suggestion prompt %q", ai.prompt)
+	}
+
+	a.handleMessage(ctx, message(1, acceptSuggested))
+	if c.Stage != stageInfoTypes || c.CurrentCat != "Наука" {
+		t.Fatalf("expected info types of the first suggestion, got stage %v cat %q", c.Stage, c.CurrentCat)
+	}
+	a.handleMessage(ctx, message(1, "1 2"))
+	a.handleMessage(ctx, message(1, "3"))
+	a.handleMessage(ctx, message(1, "Готово"))
+	u, err := a.repo.Get(ctx, 1)
+	if err != nil {
+		t.Fatalf("user was not saved: %v", err)
+	}
+	want := map[string][]string{"Наука": {"Факты", "Тренды"}, "Спорт": {"Идеи"}}
+	if !reflect.DeepEqual(u.Topics, want) {
+		t.Fatalf("saved topics %v, want %v", u.Topics, want)
+	}
+}
+
+// TestStartFlow_LimitsSuggestionAttempts verifies a dialog asks the AI for
+// suggestions at most maxSuggestAttempts times; afterwards the describe option
+// is no longer offered or accepted.
+func TestStartFlow_LimitsSuggestionAttempts(t *testing.T) {
+	ai := &countingAI{reply: "Кино"}
+	a, tg := newTestApp(t, ai)
+	ctx := context.Background()
+
+	a.handleMessage(ctx, message(1, "/start"))
+	a.handleMessage(ctx, message(1, "Продолжить"))
+	for i := 0; i < maxSuggestAttempts+2; i++ {
+		a.handleMessage(ctx, message(1, describeInterests))
+		a.handleMessage(ctx, message(1, "кино и музыка"))
+	}
+	if ai.calls != maxSuggestAttempts {
+		t.Fatalf("expected %d suggestion calls, got %d", maxSuggestAttempts, ai.calls)
+	}
+	if kb := tg.lastKeyboard(); slices.Contains(kb, describeInterests) {
+		t.Fatalf("describe option still offered after the limit: %q", kb)
+	}
+}
+
+// TestStartCommand_ClearsStaleOnboarding verifies that an existing user with a
+// lingering start conversation keeps their topics: /start drops the stale flow
+// and a forced save asks for confirmation before replacing topics.
+func TestStartCommand_ClearsStaleOnboarding(t *testing.T) {
+	a, tg := newTestApp(t, nil)
+	ctx := context.Background()
+	a.ui().messages["confirm_overwrite"] = "replace?"
+	orig := map[string][]string{"Спорт": {"Тренды"}}
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "plus", Active: true, Topics: orig}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.convs.set(1, &conversationState{Command: "/start", Stage: stageWelcome})
+	a.handleMessage(ctx, message(1, "/start"))
+	if _, ok := a.convs.get(1); ok {
+		t.Fatalf("stale start conversation was not cleared")
+	}
+
+	c := &conversationState{Command: "/start", Stage: stageInfoTypes, Topics: map[string][]string{"Наука": {"Факты"}}}
+	a.convs.set(1, c)
+	a.saveTopics(ctx, message(1, "Готово"), c)
+	u, _ := a.repo.Get(ctx, 1)
+	if _, ok := u.Topics["Спорт"]; !ok || len(u.Topics) != 1 {
+		t.Fatalf("topics overwritten without confirmation: %#v", u.Topics)
+	}
+	if texts := tg.texts(); texts[len(texts)-1] != "replace?" {
+		t.Fatalf("expected confirmation prompt, got %q", texts)
+	}
+
+	a.handleMessage(ctx, message(1, "Заменить"))
+	u, _ = a.repo.Get(ctx, 1)
+	if _, ok := u.Topics["Наука"]; !ok || len(u.Topics) != 1 || u.Tariff != "plus" {
+		t.Fatalf("unexpected settings after confirmation: %#v", u)
+	}
+	if _, ok := a.convs.get(1); ok {
+		t.Fatalf("conversation should be finished")
+	}
+}
+
+// TestAddTopics_BatchSelection adds two categories in a single pass: both are
+// picked up front and info types are then requested for each in turn.
+func TestAddTopics_BatchSelection(t *testing.T) {
+	a, _ := newTestApp(t, nil)
+	ctx := context.Background()
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base", Active: true}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	for _, text := range []string{"/add_topic", "1 2 3", "1", "Готово", "2", "Готово"} {
+		a.handleMessage(ctx, message(1, text))
+	}
+
+	u, _ := a.repo.Get(ctx, 1)
+	if len(u.Topics) != 2 {
+		t.Fatalf("expected 2 categories within the limit, got %#v", u.Topics)
+	}
+	if got := u.Topics["Наука"]; len(got) != 1 || got[0] != "Факты" {
+		t.Fatalf("unexpected infos for first category: %v", got)
+	}
+	if got := u.Topics["Спорт"]; len(got) != 1 || got[0] != "Тренды" {
+		t.Fatalf("unexpected infos for second category: %v", got)
+	}
+	if _, ok := a.convs.get(1); ok {
+		t.Fatalf("conversation should be finished")
+	}
+}
+
+// blockingAI blocks every request until its context is cancelled.
+type blockingAI struct {
+	started chan struct{}
+}
+
+// ChatCompletion signals the start of a call and waits for cancellation.
+func (b *blockingAI) ChatCompletion(ctx context.Context, model, prompt string, maxTokens int, temperature *float64) (string, error) {
+	b.started <- struct{}{}
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+// ChatResponses behaves like ChatCompletion.
+func (b *blockingAI) ChatResponses(ctx context.Context, model, prompt string, maxTokens int, temperature *float64) (string, error) {
+	return b.ChatCompletion(ctx, model, prompt, maxTokens, temperature)
+}
+
+// TestGetNewsNow_CancelledByNewCommand verifies that a new command cancels the
+// in-flight generation for the chat without consuming the daily quota.
+func TestGetNewsNow_CancelledByNewCommand(t *testing.T) {
+	ai := &blockingAI{started: make(chan struct{}, 1)}
+	a, tg := newTestApp(t, ai)
+	ctx := context.Background()
+	a.ui().messages["prompt_choose_news_cat"] = "choose %s"
+	a.ui().messages["your_topics"] = "topics %s"
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты"}}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.handleMessage(ctx, message(1, "/get_news_now"))
+	a.handleMessage(ctx, message(1, "1"))
+	<-ai.started
+	a.handleMessage(ctx, message(1, "/my_topics"))
+	a.generating.Wait()
+
+	u, _ := a.repo.Get(ctx, 1)
+	if u.GetNewsNowCount != 0 {
+		t.Fatalf("cancelled generation consumed quota: %d", u.GetNewsNowCount)
+	}
+	texts := tg.texts()
+	if last := texts[len(texts)-1]; !strings.HasPrefix(last, "topics") {
+		t.Fatalf("expected the latest command's reply last, got %q", texts)
+	}
+	if len(a.generations) != 0 {
+		t.Fatalf("generation was not released")
+	}
+}
+
+// TestMarkdownToV2 checks bold spans survive and other markup is escaped.
+func TestMarkdownToV2(t *testing.T) {
+	cases := map[string]string{
+		"**Факт**: 2+2=4.": "*Факт*: 2\\+2\\=4\\.",
+		"a ** b":           "a \\*\\* b",
+		"_x_ (y)":          "\\_x\\_ \\(y\\)",
+	}
+	for in, want := range cases {
+		if got := markdownToV2(in); got != want {
+			t.Errorf("markdownToV2(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// writeConfigFiles stores the given JSON documents and points cfg at them.
+func writeConfigFiles(t *testing.T, cfg *config.Config, options, tariffs, messages string) {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{"options.json": options, "tariff.json": tariffs, "messages.json": messages}
+	for name, body := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	cfg.OptionsFile = filepath.Join(dir, "options.json")
+	cfg.TariffFile = filepath.Join(dir, "tariff.json")
+	cfg.MessagesFile = filepath.Join(dir, "messages.json")
+}
+
+// TestReloadCommand_RejectsInvalidConfig verifies /reload keeps the active
+// configuration when the new one fails validation and applies a valid one.
+func TestReloadCommand_RejectsInvalidConfig(t *testing.T) {
+	a, tg := newTestApp(t, nil)
+	ctx := context.Background()
+	a.cfg.Admins = []string{"admin"}
+	admin := &telegram.Message{Chat: telegram.Chat{ID: 9, Username: "admin"}, Text: "/reload"}
+
+	writeConfigFiles(t, a.cfg, `{"info_options":["A"],"category_options":["B"]}`, `{"plus":{}}`, `{"start":"hi"}`)
+	a.handleMessage(ctx, admin)
+	if _, ok := a.config().Tariffs["base"]; !ok || a.ui().categoryOptions[0] != "Наука" {
+		t.Fatalf("invalid config replaced the active one")
+	}
+	if texts := tg.texts(); !strings.Contains(texts[len(texts)-1], "base tariff") {
+		t.Fatalf("expected validation error reply, got %q", texts)
+	}
+
+	writeConfigFiles(t, a.cfg, `{"info_options":["A"],"category_options":["B"]}`, `{"base":{}}`, `{"start":"hi"}`)
+	a.handleMessage(ctx, admin)
+	if a.ui().categoryOptions[0] != "B" || a.ui().messages["start"] != "hi" {
+		t.Fatalf("valid config was not applied")
+	}
+
+	a.handleMessage(ctx, message(1, "/reload"))
+	if len(tg.texts()) != 2 {
+		t.Fatalf("non-admin must not trigger a reload")
+	}
+}
+
+// TestReloadCommand_ConcurrentUpdates runs /reload while other chats are
+// being handled, as on the update worker pool; under -race it catches
+// handlers reading messages or options that the reload replaces.
+func TestReloadCommand_ConcurrentUpdates(t *testing.T) {
+	a, _ := newTestApp(t, &countingAI{reply: "news"})
+	ctx := context.Background()
+	a.cfg.Admins = []string{"admin"}
+	writeConfigFiles(t, a.cfg, `{"info_options":["Факты"],"category_options":["Наука"]}`, `{"base":{}}`, `{"start":"hi","info":"help"}`)
+	for id := int64(1); id <= 4; id++ {
+		if err := a.repo.Save(ctx, &model.UserSettings{UserID: id, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты"}}}); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 20 {
+			a.handleMessage(ctx, &telegram.Message{Chat: telegram.Chat{ID: 9, Username: "admin"}, Text: "/reload"})
+		}
+	}()
+	for id := int64(1); id <= 4; id++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, text := range []string{"/info", "/my_topics", "/add_topic", "/cancel", "/tariffs"} {
+				a.handleMessage(ctx, message(id, text))
+			}
+		}()
+	}
+	wg.Wait()
+	if a.ui().messages["start"] != "hi" {
+		t.Fatalf("reloaded messages were not applied")
+	}
+}
+
+// lastKeyboard returns the flattened keyboard of the last sent message.
+func (f *fakeTelegram) lastKeyboard() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := []string{}
+	for _, row := range f.sent[len(f.sent)-1].Keyboard {
+		out = append(out, row...)
+	}
+	return out
+}
+
+// TestAddTopics_PaginatedKeyboard verifies that a long category list is split
+// into keyboard pages listed one at a time, that only numbers from the visible
+// page are accepted, that the selection survives page switches and that the
+// next stage starts on the first page.
+func TestAddTopics_PaginatedKeyboard(t *testing.T) {
+	a, tg := newTestApp(t, nil)
+	ctx := context.Background()
+	a.cfg.Options.KeyboardPageSize = 5
+	a.ui().categoryOptions = nil
+	for i := 1; i <= 12; i++ {
+		a.ui().categoryOptions = append(a.ui().categoryOptions, fmt.Sprintf("Кат%d", i))
+	}
+	a.ui().messages["prompt_choose_new_multi"] = "choose %d\n%s"
+	a.ui().messages["already_selected"] = "selected: %s"
+	a.ui().messages["choose_category_number"] = "wrong number"
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.handleMessage(ctx, message(1, "/add_topic"))
+	if kb := strings.Join(tg.lastKeyboard(), " "); kb != "1 2 3 4 5 ещё → Готово Отмена" {
+		t.Fatalf("unexpected first page: %q", kb)
+	}
+	if texts := tg.texts(); texts[len(texts)-1] != "choose 2\n1. Кат1\n2. Кат2\n3. Кат3\n4. Кат4\n5. Кат5" {
+		t.Fatalf("prompt must list the first page only: %q", texts[len(texts)-1])
+	}
+	a.handleMessage(ctx, message(1, "7"))
+	c, _ := a.convs.get(1)
+	if texts := tg.texts(); texts[len(texts)-1] != "wrong number" || len(c.SelectedCats) != 0 {
+		t.Fatalf("index from another page must be rejected")
+	}
+
+	a.handleMessage(ctx, message(1, "ещё →"))
+	if kb := strings.Join(tg.lastKeyboard(), " "); kb != "6 7 8 9 10 ещё → Готово Отмена" {
+		t.Fatalf("unexpected second page: %q", kb)
+	}
+	if texts := tg.texts(); !strings.HasPrefix(texts[len(texts)-1], "choose 2\n6. Кат6\n") || strings.Contains(texts[len(texts)-1], "Кат1\n") {
+		t.Fatalf("prompt must list the second page only: %q", texts[len(texts)-1])
+	}
+	a.handleMessage(ctx, message(1, "7"))
+	a.handleMessage(ctx, message(1, "ещё →"))
+	if kb := strings.Join(tg.lastKeyboard(), " "); kb != "11 12 ещё → Готово Отмена" {
+		t.Fatalf("unexpected last page: %q", kb)
+	}
+	a.handleMessage(ctx, message(1, "ещё →"))
+	texts := tg.texts()
+	if !strings.HasSuffix(texts[len(texts)-1], "selected: Кат7") || c.Page != 0 {
+		t.Fatalf("selection lost after wrapping to the first page: %q", texts[len(texts)-1])
+	}
+
+	a.handleMessage(ctx, message(1, "1"))
+	c, _ = a.convs.get(1)
+	if c.Stage != stageInfoTypes || c.CurrentCat != "Кат7" || len(c.PendingCats) != 1 || c.PendingCats[0] != "Кат1" {
+		t.Fatalf("unexpected state after selection: %+v", c)
+	}
+
+	c.Page = 1
+	c.setStage(stageCategory)
+	if c.Page != 0 {
+		t.Fatalf("a new stage must start on the first page, got page %d", c.Page)
+	}
+}
+
+// TestNextScheduledSend covers predictions inside and outside the active hours.
+func TestNextScheduledSend(t *testing.T) {
+	at := func(day, hour, min int) time.Time { return time.Date(2024, 5, day, hour, min, 0, 0, time.UTC) }
+	tariff := config.Tariff{Schedule: config.Schedule{FrequencyMinutes: 60, TimeRange: "08:00-22:00"}}
+	cases := []struct {
+		name string
+		now  time.Time
+		last time.Time
+		rng  string
+		want time.Time
+	}{
+		{"in window", at(10, 10, 0), at(10, 9, 30), "", at(10, 10, 30)},
+		{"overdue", at(10, 10, 0), at(10, 7, 0), "", at(10, 10, 0)},
+		{"interval ends after window", at(10, 21, 45), at(10, 21, 30), "", at(11, 8, 0)},
+		{"out of window", at(10, 23, 0), at(10, 21, 30), "", at(11, 8, 0)},
+		{"early morning", at(10, 6, 0), at(9, 21, 30), "", at(10, 8, 0)},
+		{"overnight window", at(10, 12, 0), at(10, 5, 30), "22:00-06:00", at(10, 22, 0)},
+	}
+	for _, tc := range cases {
+		tr := tariff
+		if tc.rng != "" {
+			tr.Schedule.TimeRange = tc.rng
+		}
+		u := &model.UserSettings{LastScheduledSent: tc.last.Unix()}
+		if got := nextScheduledSend(tc.now, u, tr); !got.Equal(tc.want) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.want, got)
+		}
+	}
+
+	// At 05:30 UTC the active hours are already open in UTC+5.
+	u := &model.UserSettings{LastScheduledSent: at(10, 4, 0).Unix(), Timezone: "Asia/Yekaterinburg"}
+	if got := nextScheduledSend(at(10, 5, 30), u, tariff); !got.Equal(at(10, 5, 30)) {
+		t.Fatalf("user timezone: expected %v, got %v", at(10, 5, 30), got)
+	}
+	if !scheduleAllows(at(10, 5, 30), u, tariff) {
+		t.Fatalf("user timezone: the schedule must be open at 10:30 local time")
+	}
+}
+
+// TestGetNewsNow_EditsPlaceholder verifies that a short result replaces the
+// "generating" placeholder in place instead of arriving as a new message.
+func TestGetNewsNow_EditsPlaceholder(t *testing.T) {
+	a, tg := newTestApp(t, &countingAI{reply: "short news"})
+	ctx := context.Background()
+	a.ui().messages["prompt_choose_news_cat"] = "choose %s"
+	a.ui().messages["generating"] = "Генерирую…"
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты"}}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.handleMessage(ctx, message(1, "/get_news_now"))
+	tg.takeEvents()
+	a.handleMessage(ctx, message(1, "1"))
+	a.generating.Wait()
+
+	events := tg.takeEvents()
+	sends := 0
+	for _, e := range events {
+		if strings.HasPrefix(e, "send ") {
+			sends++
+		}
+	}
+	if sends != 1 || !strings.HasPrefix(events[len(events)-1], "edit 2 ") {
+		t.Fatalf("expected one placeholder edited in place, got %q", events)
+	}
+	if edited := tg.edited[2]; !strings.Contains(edited, "short news") {
+		t.Fatalf("placeholder edited to %q", edited)
+	}
+}
+
+// TestGetNewsNow_ReportsFailure verifies a failed generation turns the
+// placeholder into an error message and a failed save is reported too.
+func TestGetNewsNow_ReportsFailure(t *testing.T) {
+	a, tg := newTestApp(t, &countingAI{err: errors.New("boom")})
+	ctx := context.Background()
+	a.ui().messages["prompt_choose_news_cat"] = "choose %s"
+	a.ui().messages["generating"] = "Генерирую…"
+	a.ui().messages["operation_failed"] = "failed"
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base", Active: true, Topics: map[string][]string{"Наука": {"Факты"}}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.handleMessage(ctx, message(1, "/get_news_now"))
+	a.handleMessage(ctx, message(1, "1"))
+	a.generating.Wait()
+	if edited := tg.edited[2]; edited != "failed" {
+		t.Fatalf("placeholder edited to %q, want error message", edited)
+	}
+	if u, _ := a.repo.Get(ctx, 1); u.GetNewsNowCount != 0 {
+		t.Fatalf("failed generation must not use the quota, got %d", u.GetNewsNowCount)
+	}
+
+	a.repo = &flakyRepo{UserSettingsRepository: a.repo, failures: 1}
+	a.handleMessage(ctx, message(1, "/safe_mode"))
+	if texts := tg.texts(); texts[len(texts)-1] != "failed" {
+		t.Fatalf("expected error message after failed save, got %q", texts)
+	}
+}
+
+// TestGetNewsNow_FailedSendKeepsQuota verifies a digest that could not be
+// delivered does not use up a unit of the daily quota, for /get_news_now as
+// well as /get_last_24h_news.
+func TestGetNewsNow_FailedSendKeepsQuota(t *testing.T) {
+	ai := &countingAI{reply: "news"}
+	a, tg := newTestApp(t, ai)
+	ctx := context.Background()
+	a.ui().messages["prompt_choose_news_cat"] = "choose %s"
+	a.ui().messages["prompt_choose_last24_cat"] = "choose %s"
+	trial := map[string]int64{model.FeatureLast24h: a.clock.Now().Add(time.Hour).Unix()}
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base", TrialFeatures: trial, Topics: map[string][]string{"Наука": {"Факты"}}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	for _, cmd := range []string{"/get_news_now", "/get_last_24h_news"} {
+		tg.sendErr = nil
+		a.handleMessage(ctx, message(1, cmd))
+		tg.sendErr = errors.New("network down")
+		a.handleMessage(ctx, message(1, "1"))
+		a.generating.Wait()
+	}
+	if ai.calls != 2 {
+		t.Fatalf("expected both digests to be generated, got %d AI calls", ai.calls)
+	}
+	u, _ := a.repo.Get(ctx, 1)
+	if u.GetNewsNowCount != 0 || u.GetLast24hCount != 0 || len(u.History) != 0 {
+		t.Fatalf("failed sends must not be charged, got %d/%d and %d history entries", u.GetNewsNowCount, u.GetLast24hCount, len(u.History))
+	}
+
+	tg.sendErr = nil
+	a.handleMessage(ctx, message(1, "/get_news_now"))
+	a.handleMessage(ctx, message(1, "1"))
+	a.generating.Wait()
+	if u, _ := a.repo.Get(ctx, 1); u.GetNewsNowCount != 1 {
+		t.Fatalf("a delivered digest must be charged, count %d", u.GetNewsNowCount)
+	}
+}
+
+// TestGetNewsNow_NoNews verifies a generation failing for every info type
+// tells the user to try another category and gives the quota unit back
+// unless failed requests are charged.
+func TestGetNewsNow_NoNews(t *testing.T) {
+	a, tg := newTestApp(t, &countingAI{err: errors.New("boom")})
+	ctx := context.Background()
+	a.ui().messages["prompt_choose_news_cat"] = "choose %s"
+	a.ui().messages["generating"] = "Генерирую…"
+	a.ui().messages["no_news"] = "no news, try another category"
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base", Active: true, Topics: map[string][]string{"Наука": {"Факты", "Тренды"}}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	getNews := func() {
+		a.handleMessage(ctx, message(1, "/get_news_now"))
+		a.handleMessage(ctx, message(1, "1"))
+		a.generating.Wait()
+	}
+
+	getNews()
+	if edited := tg.edited[2]; edited != "no news, try another category" {
+		t.Fatalf("placeholder edited to %q, want the no-news message", edited)
+	}
+	if u, _ := a.repo.Get(ctx, 1); u.GetNewsNowCount != 0 {
+		t.Fatalf("quota must be refunded, got %d", u.GetNewsNowCount)
+	}
+
+	a.cfg.ChargeFailedNews = true
+	getNews()
+	if u, _ := a.repo.Get(ctx, 1); u.GetNewsNowCount != 1 {
+		t.Fatalf("failed request must be charged, got %d", u.GetNewsNowCount)
+	}
+}
+
+// TestSearchCommand verifies an ad-hoc topic is sanitized into the prompt,
+// answered without being saved and counted against the daily quota.
+func TestSearchCommand(t *testing.T) {
+	ai := &countingAI{reply: "ответ"}
+	a, tg := newTestApp(t, ai)
+	ctx := context.Background()
+	a.ui().messages["generating"] = "Генерирую…"
+	a.ui().messages["search_usage"] = "usage"
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты"}}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.handleMessage(ctx, message(1, "/search"))
+	a.handleMessage(ctx, message(1, "/search  квантовые {тип}\nкомпьютеры"))
+	a.generating.Wait()
+	if ai.prompt != "Факты квантовые тип компьютеры" {
+		t.Fatalf("unexpected prompt %q", ai.prompt)
+	}
+	if texts := tg.texts(); texts[0] != "usage" {
+		t.Fatalf("expected usage hint for an empty topic, got %q", texts)
+	}
+	if edited := tg.edited[2]; !strings.Contains(edited, "квантовые тип компьютеры") || !strings.Contains(edited, "ответ") {
+		t.Fatalf("placeholder edited to %q", edited)
+	}
+	u, _ := a.repo.Get(ctx, 1)
+	if u.GetNewsNowCount != 1 || len(u.Topics) != 1 {
+		t.Fatalf("expected one quota unit and unchanged topics, got %d, %v", u.GetNewsNowCount, u.Topics)
+	}
+}
+
+// gatedAI signals the start of a call and replies once release is closed.
+type gatedAI struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+// ChatCompletion waits for release and returns a fixed reply.
+func (g *gatedAI) ChatCompletion(ctx context.Context, model, prompt string, maxTokens int, temperature *float64) (string, error) {
+	g.started <- struct{}{}
+	<-g.release
+	return "ответ", nil
+}
+
+// ChatResponses behaves like ChatCompletion.
+func (g *gatedAI) ChatResponses(ctx context.Context, model, prompt string, maxTokens int, temperature *float64) (string, error) {
+	return g.ChatCompletion(ctx, model, prompt, maxTokens, temperature)
+}
+
+// TestSearchCommand_KeepsConcurrentChanges verifies that charging a delivered
+// search does not overwrite settings saved while it was generating.
+func TestSearchCommand_KeepsConcurrentChanges(t *testing.T) {
+	ai := &gatedAI{started: make(chan struct{}, 1), release: make(chan struct{})}
+	a, _ := newTestApp(t, ai)
+	ctx := context.Background()
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты"}}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.handleMessage(ctx, message(1, "/search космос"))
+	<-ai.started
+	u, _ := a.repo.Get(ctx, 1)
+	u.Topics["Спорт"] = []string{"Идеи"}
+	if err := a.repo.Save(ctx, u); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	close(ai.release)
+	a.generating.Wait()
+
+	u, _ = a.repo.Get(ctx, 1)
+	if u.GetNewsNowCount != 1 || len(u.Topics) != 2 {
+		t.Fatalf("expected one quota unit and the new topic kept, got %d, %v", u.GetNewsNowCount, u.Topics)
+	}
+}
+
+// TestSendScheduled_KeepsConcurrentChanges verifies that saving a scheduled
+// digest does not overwrite settings the user changed while it was generating.
+func TestSendScheduled_KeepsConcurrentChanges(t *testing.T) {
+	ai := &gatedAI{started: make(chan struct{}, 1), release: make(chan struct{})}
+	a, _ := newTestApp(t, ai)
+	ctx := context.Background()
+	u := &model.UserSettings{UserID: 1, Active: true, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты"}}}
+	if err := a.repo.Save(ctx, u); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	now := time.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.sendScheduled(ctx, u, now)
+	}()
+	<-ai.started
+	stored, _ := a.repo.Get(ctx, 1)
+	stored.Active = false
+	stored.Topics["Спорт"] = []string{"Идеи"}
+	if err := a.repo.Save(ctx, stored); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	close(ai.release)
+	<-done
+
+	stored, _ = a.repo.Get(ctx, 1)
+	if stored.Active || len(stored.Topics) != 2 {
+		t.Fatalf("changes made during generation were lost: active %v, topics %v", stored.Active, stored.Topics)
+	}
+	if stored.LastScheduledSent != now.Unix() || len(stored.History) != 1 || stored.RotationPos != 1 {
+		t.Fatalf("digest not recorded: %+v", stored)
+	}
+}
+
+// TestGetNewsNow_LongResultReplacesPlaceholder checks that results too long
+// for an edit are sent as new messages and the placeholder is removed.
+func TestGetNewsNow_LongResultReplacesPlaceholder(t *testing.T) {
+	a, tg := newTestApp(t, &countingAI{reply: strings.Repeat("а", 5000)})
+	ctx := context.Background()
+	a.ui().messages["prompt_choose_news_cat"] = "choose %s"
+	a.ui().messages["generating"] = "Генерирую…"
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты"}}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.handleMessage(ctx, message(1, "/get_news_now"))
+	a.handleMessage(ctx, message(1, "1"))
+	a.generating.Wait()
+
+	if len(tg.edited) != 0 {
+		t.Fatalf("long result must not be edited in: %v", tg.edited)
+	}
+	if last := tg.deleted[len(tg.deleted)-1]; last != 2 {
+		t.Fatalf("placeholder was not deleted, deleted %v", tg.deleted)
+	}
+	if n := len(tg.texts()); n < 4 {
+		t.Fatalf("expected the result split into new messages, got %d sends", n)
+	}
+}
+
+// TestReply_BlockedUserDeactivated verifies that a reply refused because the
+// user blocked the bot deactivates them like a scheduled send does.
+func TestReply_BlockedUserDeactivated(t *testing.T) {
+	a, tg := newTestApp(t, nil)
+	ctx := context.Background()
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Active: true, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты"}}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	tg.sendErr = telegram.ErrBlocked
+
+	a.handleMessage(ctx, message(1, "/my_topics"))
+
+	got, err := a.repo.Get(ctx, 1)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if got.Active || !got.Blocked {
+		t.Fatalf("expected blocked inactive user, got active=%v blocked=%v", got.Active, got.Blocked)
+	}
+}
+
+// TestSendScheduled_BlockedUserDeactivated verifies that a 403 from Telegram
+// marks the user blocked and inactive so the scheduler skips them afterwards.
+func TestSendScheduled_BlockedUserDeactivated(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"ok":false,"error_code":403,"description":"Forbidden: bot was blocked by the user"}`))
+	}))
+	defer srv.Close()
+	a, _ := newTestApp(t, &countingAI{reply: "digest"})
+	a.tgClient = telegram.NewClientWithBaseURL("token", srv.URL)
+	ctx := context.Background()
+	u := &model.UserSettings{UserID: 1, Active: true, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты"}}}
+	if err := a.repo.Save(ctx, u); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.sendScheduled(ctx, u, time.Now())
+
+	got, err := a.repo.Get(ctx, 1)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if got.Active || !got.Blocked {
+		t.Fatalf("expected blocked inactive user, got active=%v blocked=%v", got.Active, got.Blocked)
+	}
+	active, err := a.userService.ActiveUsers(ctx)
+	if err != nil || len(active) != 0 {
+		t.Fatalf("blocked user still scheduled: %v (%v)", active, err)
+	}
+}
+
+// TestOptOutKeyword_StopsUser verifies free-form opt-out words stop the
+// digests outside of dialogs but are left alone inside a conversation.
+func TestOptOutKeyword_StopsUser(t *testing.T) {
+	a, tg := newTestApp(t, nil)
+	ctx := context.Background()
+	a.ui().messages["stopped"] = "stopped"
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Active: true, Tariff: "base"}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.convs.set(1, &conversationState{Stage: stageCustomCategory})
+	a.handleMessage(ctx, message(1, "стоп"))
+	if u, _ := a.repo.Get(ctx, 1); !u.Active {
+		t.Fatalf("keyword inside a dialog must not stop the user")
+	}
+	a.convs.delete(1)
+
+	a.handleMessage(ctx, message(1, "Отписаться!"))
+	if u, _ := a.repo.Get(ctx, 1); u.Active {
+		t.Fatalf("user still active after opt-out keyword")
+	}
+	if texts := tg.texts(); texts[len(texts)-1] != "stopped" {
+		t.Fatalf("expected stop confirmation, got %q", texts)
+	}
+}
+
+// TestFormatInfoOptions_Grouped verifies grouped rendering keeps numbering
+// continuous so the shown numbers select the same flat options.
+func TestFormatInfoOptions_Grouped(t *testing.T) {
+	a, _ := newTestApp(t, nil)
+	a.cfg.Options.InfoGroups = []config.OptionGroup{
+		{Title: "Знания", Options: []string{"Факты", "Тренды"}},
+		{Title: "Практика", Options: []string{"Идеи"}},
+	}
+	want := "<b>Знания</b>\n1. Факты\n2. Тренды\n\n<b>Практика</b>\n3. Идеи"
+	if got := a.formatInfoOptions(); got != want {
+		t.Fatalf("unexpected rendering:\n%s", got)
+	}
+	if err := a.cfg.Validate(); err != nil {
+		t.Fatalf("groups matching info_options rejected: %v", err)
+	}
+	for i, o := range a.ui().infoOptions {
+		if got := parseSelection(strconv.Itoa(i+1), a.ui().infoOptions, 1); len(got) != 1 || got[0] != o {
+			t.Fatalf("number %d selects %q, want %q", i+1, got, o)
+		}
+		if !strings.Contains(want, fmt.Sprintf("%d. %s", i+1, o)) {
+			t.Fatalf("option %q is not shown as number %d", o, i+1)
+		}
+	}
+
+	a.cfg.Options.InfoGroups[1].Options = []string{"Другое"}
+	if err := a.cfg.Validate(); err == nil {
+		t.Fatalf("expected mismatch between info_groups and info_options to be rejected")
+	}
+}
+
+// flakyRepo fails the first saves and delegates everything else.
+type flakyRepo struct {
+	repository.UserSettingsRepository
+	failures int
+}
+
+// Save fails while failures remain, then stores the settings.
+func (r *flakyRepo) Save(ctx context.Context, s *model.UserSettings) error {
+	if r.failures > 0 {
+		r.failures--
+		return errors.New("connection reset")
+	}
+	return r.UserSettingsRepository.Save(ctx, s)
+}
+
+// TestSaveTopics_RetryAfterFailure verifies a failed save keeps the dialog and
+// the "Повторить" button persists the same topics.
+func TestSaveTopics_RetryAfterFailure(t *testing.T) {
+	a, tg := newTestApp(t, nil)
+	ctx := context.Background()
+	a.ui().messages["save_failed"] = "save failed"
+	a.ui().messages["settings_updated"] = "updated %s"
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты"}, "Спорт": {"Идеи"}}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	repo := &flakyRepo{UserSettingsRepository: a.repo, failures: 1}
+	a.repo = repo
+
+	for _, text := range []string{"/delete_topics", "2", "1", "Готово"} {
+		a.handleMessage(ctx, message(1, text))
+	}
+	c, ok := a.convs.get(1)
+	if !ok || c.Stage != stageRetrySave || len(c.Topics) != 1 {
+		t.Fatalf("conversation not preserved after failed save: %+v", c)
+	}
+	texts := tg.texts()
+	if texts[len(texts)-1] != "save failed" || !strings.Contains(fmt.Sprint(tg.lastKeyboard()), "Повторить") {
+		t.Fatalf("expected retry prompt, got %q", texts[len(texts)-1])
+	}
+
+	a.handleMessage(ctx, message(1, "Повторить"))
+	if _, ok := a.convs.get(1); ok {
+		t.Fatalf("conversation must be cleared after a successful retry")
+	}
+	u, _ := a.repo.Get(ctx, 1)
+	if len(u.Topics) != 1 || len(u.Topics["Спорт"]) != 1 {
+		t.Fatalf("unexpected topics after retry: %#v", u.Topics)
+	}
+}
+
+// TestSaveTopics_FirstDigest verifies a new user gets an immediate digest
+// unless the operator disabled it.
+func TestSaveTopics_FirstDigest(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		ai := &countingAI{reply: "first digest"}
+		a, tg := newTestApp(t, ai)
+		a.cfg.NoFirstDigest = disabled
+		a.ui().messages["settings_saved"] = "saved %s"
+		c := &conversationState{Topics: map[string][]string{"Наука": {"Факты"}}}
+		a.convs.set(1, c)
+		a.saveTopics(context.Background(), message(1, "Готово"), c)
+
+		want := 1
+		if disabled {
+			want = 0
+		}
+		if ai.calls != want {
+			t.Fatalf("disabled=%v: expected %d AI calls, got %d", disabled, want, ai.calls)
+		}
+		texts := tg.texts()
+		if sent := strings.Contains(strings.Join(texts, "\n"), "first digest"); sent == disabled {
+			t.Fatalf("disabled=%v: unexpected messages %q", disabled, texts)
+		}
+	}
+}
+
+// TestStyleCommand_SavesPresets verifies /style walks through the tariff
+// presets and stores the choice, and that "По умолчанию" clears it.
+func TestStyleCommand_SavesPresets(t *testing.T) {
+	a, tg := newTestApp(t, &countingAI{})
+	ctx := context.Background()
+	base := a.cfg.Tariffs["base"]
+	base.GPT.Style, base.GPT.Volume = "вдохновляющий", "кратко"
+	base.GPT.StylePresets = []string{"вдохновляющий", "с юмором"}
+	base.GPT.VolumePresets = []string{"кратко", "подробно"}
+	a.cfg.Tariffs["base"] = base
+	a.ui().messages["style_choose_tone"] = "tone? %s"
+	a.ui().messages["style_choose_volume"] = "volume? %s"
+	a.ui().messages["style_saved"] = "saved %s/%s"
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base", Volume: "подробно"}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	for _, text := range []string{"/style", "саркастичный", "с юмором", styleDefault} {
+		a.handleMessage(ctx, message(1, text))
+	}
+	texts := tg.texts()
+	want := []string{"tone? вдохновляющий", "tone? вдохновляющий", "volume? подробно", "saved с юмором/кратко"}
+	if fmt.Sprint(texts) != fmt.Sprint(want) {
+		t.Fatalf("unexpected dialog: %q", texts)
+	}
+	u, _ := a.repo.Get(ctx, 1)
+	if u.Tone != "с юмором" || u.Volume != "" {
+		t.Fatalf("unexpected style saved: %q/%q", u.Tone, u.Volume)
+	}
+	if _, ok := a.convs.get(1); ok {
+		t.Fatalf("conversation must be finished")
+	}
+}
+
+// TestStyleCommand_PicksTemplate verifies /style offers the tariff's prompt
+// templates before the presets and stores the chosen key.
+func TestStyleCommand_PicksTemplate(t *testing.T) {
+	a, tg := newTestApp(t, &countingAI{})
+	ctx := context.Background()
+	base := a.cfg.Tariffs["base"]
+	base.GPT.PromptTemplates = map[string]string{"casual": "c", "analytical": "a"}
+	base.GPT.VolumePresets = []string{"кратко"}
+	a.cfg.Tariffs["base"] = base
+	a.ui().messages["style_choose_template"] = "template? %s"
+	a.ui().messages["style_choose_volume"] = "volume? %s"
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base"}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	for _, text := range []string{"/style", "analytical", styleDefault} {
+		a.handleMessage(ctx, message(1, text))
+	}
+	tg.mu.Lock()
+	first := tg.sent[0]
+	tg.mu.Unlock()
+	if first.Text != "template? "+styleDefault || fmt.Sprint(first.Keyboard[:2]) != "[[analytical] [casual]]" {
+		t.Fatalf("unexpected template prompt %q %q", first.Text, first.Keyboard)
+	}
+	u, _ := a.repo.Get(ctx, 1)
+	if u.PromptTemplate != "analytical" {
+		t.Fatalf("expected the template to be saved, got %q", u.PromptTemplate)
+	}
+}
+
+// TestCategoryToneCommand verifies /category_tone stores a tone for the chosen
+// category and "По умолчанию" drops it again.
+func TestCategoryToneCommand(t *testing.T) {
+	a, tg := newTestApp(t, &countingAI{})
+	ctx := context.Background()
+	base := a.cfg.Tariffs["base"]
+	base.GPT.Style = "вдохновляющий"
+	base.GPT.StylePresets = []string{"вдохновляющий", "серьёзный"}
+	a.cfg.Tariffs["base"] = base
+	a.ui().messages["category_tone_choose_category"] = "which? %s"
+	a.ui().messages["category_tone_choose"] = "tone for %s? %s"
+	a.ui().messages["category_tone_saved"] = "%s: %s"
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты"}, "Финансы": {"Тренды"}}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	for _, text := range []string{"/category_tone", "2", "игривый", "серьёзный"} {
+		a.handleMessage(ctx, message(1, text))
+	}
+	u, _ := a.repo.Get(ctx, 1)
+	if u.CategoryTones["Финансы"] != "серьёзный" || len(u.CategoryTones) != 1 {
+		t.Fatalf("unexpected category tones: %v", u.CategoryTones)
+	}
+	texts := tg.texts()
+	want := []string{"tone for Финансы? вдохновляющий", "tone for Финансы? вдохновляющий", "Финансы: серьёзный"}
+	if !strings.HasPrefix(texts[0], "which? ") || fmt.Sprint(texts[1:]) != fmt.Sprint(want) {
+		t.Fatalf("unexpected dialog: %q", texts)
+	}
+
+	a.handleMessage(ctx, message(1, "/category_tone финансы"))
+	a.handleMessage(ctx, message(1, styleDefault))
+	u, _ = a.repo.Get(ctx, 1)
+	if len(u.CategoryTones) != 0 {
+		t.Fatalf("default must drop the category tone, got %v", u.CategoryTones)
+	}
+	if texts := tg.texts(); texts[len(texts)-1] != "Финансы: вдохновляющий" {
+		t.Fatalf("unexpected reply %q", texts[len(texts)-1])
+	}
+}
+
+// TestSaveTopics_RejectsEmptyCategory verifies a category without info types
+// is never saved: the user either picks types for it or drops it.
+func TestSaveTopics_RejectsEmptyCategory(t *testing.T) {
+	for _, choice := range []string{pickInfos, dropCategory} {
+		a, _ := newTestApp(t, &countingAI{})
+		ctx := context.Background()
+		a.cfg.NoFirstDigest = true
+		a.ui().messages["empty_category"] = "empty %s"
+		a.ui().messages["prompt_choose_info"] = "info for %s (%d) %s"
+		a.ui().messages["settings_saved"] = "saved %s"
+		c := &conversationState{CategoryLimit: 2, InfoLimit: 2, Topics: map[string][]string{"Наука": {"Факты"}, "Спорт": nil}}
+		a.convs.set(1, c)
+		a.saveTopics(ctx, message(1, "Готово"), c)
+		if c.Stage != stageEmptyCategory || c.CurrentCat != "Спорт" {
+			t.Fatalf("expected prompt for the empty category, got stage %v cat %q", c.Stage, c.CurrentCat)
+		}
+		if _, err := a.repo.Get(ctx, 1); err == nil {
+			t.Fatalf("topics saved with an empty category")
+		}
+
+		a.handleMessage(ctx, message(1, choice))
+		want := map[string][]string{"Наука": {"Факты"}}
+		if choice == pickInfos {
+			a.handleMessage(ctx, message(1, "2"))
+			a.handleMessage(ctx, message(1, "Готово"))
+			want["Спорт"] = []string{"Тренды"}
+		}
+		u, err := a.repo.Get(ctx, 1)
+		if err != nil {
+			t.Fatalf("%s: topics not saved: %v", choice, err)
+		}
+		if fmt.Sprint(u.Topics) != fmt.Sprint(want) {
+			t.Fatalf("%s: unexpected topics %v", choice, u.Topics)
+		}
+	}
+}
+
+// TestSaveTopics_EscapesEmptyCategory verifies a custom category name is
+// HTML-escaped in the empty category prompt.
+func TestSaveTopics_EscapesEmptyCategory(t *testing.T) {
+	a, tg := newTestApp(t, &countingAI{})
+	a.ui().messages["empty_category"] = "empty %s"
+	c := &conversationState{CategoryLimit: 2, InfoLimit: 2, Topics: map[string][]string{"Наука": {"Факты"}, "🫆a<b": nil}}
+	a.convs.set(1, c)
+	a.saveTopics(context.Background(), message(1, "Готово"), c)
+	if texts := tg.texts(); len(texts) != 1 || texts[0] != "empty 🫆a&lt;b" {
+		t.Fatalf("unexpected prompt %q", texts)
+	}
+}
+
+// TestScheduleJitter verifies users with identical schedules get different,
+// stable send minutes within the configured jitter.
+func TestScheduleJitter(t *testing.T) {
+	tariff := config.Tariff{Schedule: config.Schedule{FrequencyMinutes: 60, TimeRange: "08:00-22:00", JitterMinutes: 30}}
+	last := time.Date(2024, 5, 10, 9, 0, 0, 0, time.UTC)
+	now := last.Add(time.Minute)
+	u1 := &model.UserSettings{UserID: 1, LastScheduledSent: last.Unix()}
+	u2 := &model.UserSettings{UserID: 2, LastScheduledSent: last.Unix()}
+
+	n1, n2 := nextScheduledSend(now, u1, tariff), nextScheduledSend(now, u2, tariff)
+	if n1.Equal(n2) {
+		t.Fatalf("expected different send times, both got %v", n1)
+	}
+	for _, n := range []time.Time{n1, n2} {
+		if d := n.Sub(last); d < time.Hour || d > 90*time.Minute {
+			t.Fatalf("send time %v outside the jitter range", n)
+		}
+	}
+	if !nextScheduledSend(now, u1, tariff).Equal(n1) {
+		t.Fatalf("jitter must be stable for the same user")
+	}
+	for _, u := range []*model.UserSettings{u1, u2} {
+		next := nextScheduledSend(now, u, tariff)
+		if scheduleAllows(next.Add(-time.Minute), u, tariff) || !scheduleAllows(next, u, tariff) {
+			t.Fatalf("user %d: scheduler disagrees with predicted send time %v", u.UserID, next)
+		}
+	}
+
+	tariff.Schedule.JitterMinutes = 0
+	if n := nextScheduledSend(now, u1, tariff); !n.Equal(last.Add(time.Hour)) {
+		t.Fatalf("without jitter expected %v, got %v", last.Add(time.Hour), n)
+	}
+}
+
+// TestCategoriesStatsCommand verifies admins get the category ranking, with
+// the names HTML-escaped, and other users get no reply.
+func TestCategoriesStatsCommand(t *testing.T) {
+	a, tg := newTestApp(t, nil)
+	ctx := context.Background()
+	a.cfg.Admins = []string{"admin"}
+	for id, cats := range map[int64][]string{1: {"Наука", "🫆a<b"}, 2: {"Наука"}} {
+		topics := map[string][]string{}
+		for _, c := range cats {
+			topics[c] = []string{"Факты"}
+		}
+		if err := a.repo.Save(ctx, &model.UserSettings{UserID: id, Topics: topics}); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	a.handleMessage(ctx, message(1, "/categories_stats"))
+	if texts := tg.texts(); len(texts) != 0 {
+		t.Fatalf("non-admin must not get stats, got %q", texts)
+	}
+	a.handleMessage(ctx, &telegram.Message{Chat: telegram.Chat{ID: 9, Username: "admin"}, Text: "/categories_stats"})
+	texts := tg.texts()
+	if len(texts) != 1 || texts[0] != "Популярные категории:\n1. Наука — 2\n2. 🫆a&lt;b — 1" {
+		t.Fatalf("unexpected stats: %q", texts)
+	}
+}
+
+// TestRateCommand_UpdatesInfoRatings verifies /rate counts a 👍 or 👎 for
+// every info type of the latest digest's category and keeps earlier counts.
+func TestRateCommand_UpdatesInfoRatings(t *testing.T) {
+	a, tg := newTestApp(t, nil)
+	ctx := context.Background()
+	a.ui().messages["rate_prompt"] = "rate %s"
+	a.ui().messages["rate_saved"] = "thanks"
+	a.ui().messages["rate_nothing"] = "nothing"
+	a.ui().messages["rate_done"] = "done"
+	u := &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты"}, "Спорт": {"Тренды"}}}
+	if err := a.repo.Save(ctx, u); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	a.handleMessage(ctx, message(1, "/rate"))
+	if texts := tg.texts(); texts[len(texts)-1] != "nothing" {
+		t.Fatalf("expected nothing to rate without history, got %q", texts)
+	}
+
+	u.History = []model.HistoryEntry{{Category: "Спорт", At: 1, Infos: []string{"Тренды"}}, {Category: "Наука", At: 2, Infos: []string{"Факты", "Идеи"}}}
+	u.InfoRatings = map[string]model.InfoRating{"Факты": {Likes: 2}}
+	if err := a.repo.Save(ctx, u); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	for _, text := range []string{"/rate", "5", rateDown, "/rate"} {
+		a.handleMessage(ctx, message(1, text))
+	}
+	want := []string{"nothing", "rate Наука", "rate Наука", "thanks", "done"}
+	if texts := tg.texts(); !slices.Equal(texts, want) {
+		t.Fatalf("sent %q, want %q", texts, want)
+	}
+	stored, _ := a.repo.Get(ctx, 1)
+	if got := fmt.Sprint(stored.InfoRatings); got != "map[Идеи:{0 1} Факты:{2 1}]" {
+		t.Fatalf("unexpected ratings %s", got)
+	}
+	if !stored.History[1].Rated || stored.History[0].Rated {
+		t.Fatalf("only the latest digest must be marked rated: %+v", stored.History)
+	}
+}
+
+// TestTariffStatsCommand verifies admins get the user count of every tariff
+// in tier order, including a tariff that is no longer configured.
+func TestTariffStatsCommand(t *testing.T) {
+	a, tg := newTestApp(t, nil)
+	ctx := context.Background()
+	a.cfg.Admins = []string{"admin"}
+	for id, tariff := range map[int64]string{1: "base", 2: "base", 3: "legacy"} {
+		if err := a.repo.Save(ctx, &model.UserSettings{UserID: id, Tariff: tariff}); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	a.handleMessage(ctx, message(1, "/tariff_stats"))
+	if texts := tg.texts(); len(texts) != 0 {
+		t.Fatalf("non-admin must not get stats, got %q", texts)
+	}
+	a.handleMessage(ctx, &telegram.Message{Chat: telegram.Chat{ID: 9, Username: "admin"}, Text: "/tariff_stats"})
+	want := "Пользователи по тарифам:\nbase — 2\nlegacy — 1\nВсего: 3"
+	if texts := tg.texts(); len(texts) != 1 || texts[0] != want {
+		t.Fatalf("unexpected stats: %q, want %q", texts, want)
+	}
+}
+
+// TestSendScheduled_SeparateMessages verifies a digest is split into one
+// message per info type only when the user enabled separate messages.
+func TestSendScheduled_SeparateMessages(t *testing.T) {
+	for _, separate := range []bool{false, true} {
+		a, tg := newTestApp(t, &countingAI{reply: "news"})
+		ctx := context.Background()
+		u := &model.UserSettings{UserID: 1, Active: true, Tariff: "base", SeparateMessages: separate,
+			Topics: map[string][]string{"Наука": {"Факты", "Тренды"}}}
+		if err := a.repo.Save(ctx, u); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+
+		a.sendScheduled(ctx, u, time.Now())
+		texts := tg.texts()
+		want := 1
+		if separate {
+			want = len(u.Topics["Наука"])
+		}
+		if len(texts) != want {
+			t.Fatalf("separate=%v: expected %d messages, got %q", separate, want, texts)
+		}
+		for _, text := range texts {
+			if !strings.HasPrefix(text, "Категория: Наука") {
+				t.Fatalf("separate=%v: message without category header: %q", separate, text)
+			}
+		}
+	}
+}
+
+// TestGetNewsNow_CategoryArgument verifies "/get_news_now <category>" skips
+// the picker for a known category and falls back to it otherwise.
+func TestGetNewsNow_CategoryArgument(t *testing.T) {
+	cases := []struct {
+		text   string
+		picker bool
+	}{
+		{"/get_news_now спорт", false},
+		{"/get_news_now Кино", true},
+		{"/get_news_now", true},
+	}
+	for _, tc := range cases {
+		ai := &countingAI{reply: "news"}
+		a, tg := newTestApp(t, ai)
+		ctx := context.Background()
+		a.ui().messages["prompt_choose_news_cat"] = "choose %s"
+		if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты"}, "Спорт": {"Идеи"}}}); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+
+		a.handleMessage(ctx, message(1, tc.text))
+		a.generating.Wait()
+		texts := tg.texts()
+		if tc.picker {
+			if ai.calls != 0 || len(texts) != 1 || !strings.HasPrefix(texts[0], "choose ") {
+				t.Fatalf("%q: expected the category picker, got %q", tc.text, texts)
+			}
+			if c, ok := a.convs.get(1); !ok || c.Stage != stageGetNewsCategory {
+				t.Fatalf("%q: picker conversation not started", tc.text)
+			}
+			continue
+		}
+		if ai.calls != 1 || len(texts) != 1 || !strings.Contains(texts[0], "Спорт") {
+			t.Fatalf("%q: expected news for Спорт without picker, got %q", tc.text, texts)
+		}
+		if _, ok := a.convs.get(1); ok {
+			t.Fatalf("%q: conversation must not remain", tc.text)
+		}
+	}
+}
+
+// TestGetNewsNow_QuotaDisplay verifies the remaining requests are shown near
+// the limit and the limit message carries the counts and the reset time.
+func TestGetNewsNow_QuotaDisplay(t *testing.T) {
+	a, tg := newTestApp(t, &countingAI{})
+	ctx := context.Background()
+	a.ui().messages["prompt_choose_news_cat"] = "choose %s"
+	a.ui().messages["quota_left"] = "left %d of %d"
+	a.ui().messages["limit_today"] = "used %d of %d, reset %s"
+	now := time.Now()
+	u := &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты"}}, GetNewsNowCount: 4, LastGetNewsNow: now.Unix()}
+	if err := a.repo.Save(ctx, u); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.handleMessage(ctx, message(1, "/get_news_now"))
+	texts := tg.texts()
+	if len(texts) != 1 || !strings.HasSuffix(texts[0], "\n\nleft 1 of 5") {
+		t.Fatalf("expected remaining quota in the picker, got %q", texts)
+	}
+	a.convs.delete(1)
+
+	u.GetNewsNowCount = 5
+	if err := a.repo.Save(ctx, u); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	a.handleMessage(ctx, message(1, "/get_news_now"))
+	texts = tg.texts()
+	reset := quotaReset(now).Format("02.01.2006 15:04")
+	if got := texts[len(texts)-1]; got != "used 5 of 5, reset "+reset {
+		t.Fatalf("unexpected limit message %q", got)
+	}
+	if !strings.HasSuffix(reset, " 00:00") {
+		t.Fatalf("quota must reset at midnight, got %s", reset)
+	}
+}
+
+// TestHandleUpdate_EditedMessage verifies an edited answer advances the
+// active conversation only when edits are enabled.
+func TestHandleUpdate_EditedMessage(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		ai := &countingAI{reply: "news"}
+		a, _ := newTestApp(t, ai)
+		ctx := context.Background()
+		a.cfg.HandleEdits = enabled
+		a.ui().messages["prompt_choose_news_cat"] = "choose %s"
+		if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты"}}}); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+
+		a.handleUpdate(ctx, telegram.Update{UpdateID: 1, Message: message(1, "/get_news_now")})
+		a.handleUpdate(ctx, telegram.Update{UpdateID: 2, EditedMessage: message(1, "1")})
+		a.generating.Wait()
+
+		_, pending := a.convs.get(1)
+		if enabled && (pending || ai.calls != 1) {
+			t.Fatalf("edited answer must pick the category: pending=%v calls=%d", pending, ai.calls)
+		}
+		if !enabled && (!pending || ai.calls != 0) {
+			t.Fatalf("edits must be ignored when disabled: pending=%v calls=%d", pending, ai.calls)
+		}
+	}
+}
+
+// TestCustomCategory_WordBounds verifies a custom category name with too few,
+// too many or too long words is refused without leaving the name prompt and
+// that the bounds come from options.json.
+func TestCustomCategory_WordBounds(t *testing.T) {
+	a, tg := newTestApp(t, &countingAI{})
+	ctx := context.Background()
+	base := a.cfg.Tariffs["base"]
+	base.AllowCustomCategory = true
+	a.cfg.Tariffs["base"] = base
+	a.ui().messages["enter_custom_category"] = "name (%d-%d words)"
+	a.ui().messages["enter_words"] = "need %d-%d words"
+	a.ui().messages["word_too_long"] = "%s is over %d"
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base"}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.handleMessage(ctx, message(1, "/add_topic"))
+	a.handleMessage(ctx, message(1, "4"))
+	a.handleMessage(ctx, message(1, "Готово"))
+	c, _ := a.convs.get(1)
+	if c == nil || c.Stage != stageCustomCategory {
+		t.Fatalf("expected the custom category prompt, got %+v", c)
+	}
+	for text, reply := range map[string]string{
+		" ":                     "need 1-3 words",
+		"раз два три четыре":    "need 1-3 words",
+		strings.Repeat("я", 31): strings.Repeat("я", 31) + " is over 30",
+	} {
+		a.handleMessage(ctx, message(1, text))
+		if c.Stage != stageCustomCategory || c.CurrentCat != "" {
+			t.Fatalf("%q: the flow must not advance, got stage %v cat %q", text, c.Stage, c.CurrentCat)
+		}
+		if texts := tg.texts(); texts[len(texts)-1] != reply {
+			t.Fatalf("%q: expected %q, got %q", text, reply, texts[len(texts)-1])
+		}
+	}
+	if texts := tg.texts(); !slices.Contains(texts, "name (1-3 words)") {
+		t.Fatalf("expected the bounds in the prompt, got %q", texts)
+	}
+
+	a.cfg.Options.CustomCategoryMaxWords = 4
+	a.handleMessage(ctx, message(1, "раз два три четыре"))
+	if c.Stage != stageInfoTypes || c.CurrentCat != "🫆раз два три четыре" {
+		t.Fatalf("configured bounds must accept four words, got stage %v cat %q", c.Stage, c.CurrentCat)
+	}
+}
+
+// TestAddTopics_CustomCategoryCap verifies a new custom category is refused
+// once the tariff cap is used up while preset categories can still be added.
+func TestAddTopics_CustomCategoryCap(t *testing.T) {
+	a, tg := newTestApp(t, &countingAI{})
+	ctx := context.Background()
+	base := a.cfg.Tariffs["base"]
+	base.AllowCustomCategory = true
+	base.Limits.CategoryLimit = 3
+	base.Limits.MaxCustomCategories = 1
+	a.cfg.Tariffs["base"] = base
+	a.ui().messages["limit_custom_categories"] = "custom cap %d"
+	a.ui().messages["prompt_choose_category"] = "category %d: %s"
+	a.ui().messages["prompt_choose_info"] = "info for %s (%d) %s"
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"🫆Мои котики": {"Факты"}}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.handleMessage(ctx, message(1, "/add_topic"))
+	a.handleMessage(ctx, message(1, "4"))
+	a.handleMessage(ctx, message(1, "Готово"))
+	c, _ := a.convs.get(1)
+	if c == nil || c.Stage != stageCategory {
+		t.Fatalf("expected the preset picker after the refused custom category, got %+v", c)
+	}
+	if texts := tg.texts(); !slices.Contains(texts, "custom cap 1") {
+		t.Fatalf("expected custom cap notice, got %q", texts)
+	}
+
+	a.handleMessage(ctx, message(1, "4"))
+	if c.Stage != stageCategory {
+		t.Fatalf("custom category must stay refused, got stage %v", c.Stage)
+	}
+	a.handleMessage(ctx, message(1, "1"))
+	if c.Stage != stageInfoTypes || c.CurrentCat != "Наука" {
+		t.Fatalf("preset category must be accepted, got stage %v cat %q", c.Stage, c.CurrentCat)
+	}
+}
+
+// fakeClock is a service.Clock whose time only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// Now returns the fake current time.
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the fake time forward by d.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// TestTimezoneCommand verifies /timezone validates and saves the timezone and
+// that the daily quota then starts over at the user's midnight.
+func TestTimezoneCommand(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 5, 10, 21, 30, 0, 0, time.UTC)}
+	a, tg := newTestApp(t, &countingAI{reply: "news"})
+	a.clock = clock
+	ctx := context.Background()
+	a.ui().messages["limit_today"] = "limit"
+	a.ui().messages["timezone_saved"] = "saved %s %s"
+	a.ui().messages["timezone_invalid"] = "invalid %s"
+	a.ui().messages["timezone_current"] = "current %s"
+	u := &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты"}},
+		GetNewsNowCount: 5, LastGetNewsNow: clock.Now().Add(-time.Hour).Unix()}
+	if err := a.repo.Save(ctx, u); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.handleMessage(ctx, message(1, "/get_news_now Наука"))
+	a.handleMessage(ctx, message(1, "/timezone Mars/Olympus"))
+	a.handleMessage(ctx, message(1, "/timezone Europe/Moscow"))
+	a.handleMessage(ctx, message(1, "/timezone"))
+	want := []string{"limit", "invalid Mars/Olympus", "saved Europe/Moscow 00:30", "current Europe/Moscow"}
+	if texts := tg.texts(); !slices.Equal(texts, want) {
+		t.Fatalf("sent %q, want %q", texts, want)
+	}
+
+	// 21:30 UTC is already the next day in Moscow.
+	a.handleMessage(ctx, message(1, "/get_news_now Наука"))
+	a.generating.Wait()
+	saved, _ := a.repo.Get(ctx, 1)
+	if saved.GetNewsNowCount != 1 || saved.Timezone != "Europe/Moscow" {
+		t.Fatalf("quota must restart at the user's midnight, got count %d in %q", saved.GetNewsNowCount, saved.Timezone)
+	}
+}
+
+// TestGetNewsNow_QuotaResetsAtMidnight verifies the daily quota starts over on
+// the next calendar day of the injected clock.
+func TestGetNewsNow_QuotaResetsAtMidnight(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 5, 10, 23, 50, 0, 0, time.Local)}
+	a, tg := newTestApp(t, &countingAI{reply: "news"})
+	a.clock = clock
+	a.userService.SetClock(clock)
+	ctx := context.Background()
+	a.ui().messages["limit_today"] = "limit"
+	a.ui().messages["prompt_choose_news_cat"] = "choose %s"
+	u := &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты"}},
+		GetNewsNowCount: 5, LastGetNewsNow: clock.Now().Add(-time.Hour).Unix()}
+	if err := a.repo.Save(ctx, u); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.handleMessage(ctx, message(1, "/get_news_now"))
+	if texts := tg.texts(); len(texts) != 1 || texts[0] != "limit" {
+		t.Fatalf("expected the limit before midnight, got %q", texts)
+	}
+
+	clock.Advance(15 * time.Minute)
+	a.handleMessage(ctx, message(1, "/get_news_now Наука"))
+	a.generating.Wait()
+	saved, _ := a.repo.Get(ctx, 1)
+	if saved.GetNewsNowCount != 1 || saved.LastGetNewsNow != clock.Now().Unix() {
+		t.Fatalf("quota must restart after midnight, got count %d at %d", saved.GetNewsNowCount, saved.LastGetNewsNow)
+	}
+}
+
+// TestSnoozeTopic_EscapesCategory verifies a custom category name is
+// HTML-escaped in the snooze dialog.
+func TestSnoozeTopic_EscapesCategory(t *testing.T) {
+	a, tg := newTestApp(t, nil)
+	a.clock = &fakeClock{now: time.Date(2024, 5, 10, 10, 0, 0, 0, time.Local)}
+	ctx := context.Background()
+	a.ui().messages["snooze_choose_duration"] = "how long for %s?"
+	a.ui().messages["snooze_set"] = "%s paused until %s"
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"🫆a<b": {"Факты"}}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.handleMessage(ctx, message(1, "/snooze_topic"))
+	a.handleMessage(ctx, message(1, "1"))
+	a.handleMessage(ctx, message(1, "1 день"))
+	texts := tg.texts()
+	if !slices.Contains(texts, "how long for 🫆a&lt;b?") || !slices.Contains(texts, "🫆a&lt;b paused until 11.05.2024 10:00") {
+		t.Fatalf("category must be escaped, got %q", texts)
+	}
+}
+
+// TestSnoozeTopic_SkipsCategoryUntilExpiry verifies a snoozed category is left
+// out of scheduled and on-demand digests, marked in /my_topics and comes back
+// after expiry.
+func TestSnoozeTopic_SkipsCategoryUntilExpiry(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 5, 10, 10, 0, 0, 0, time.Local)}
+	a, tg := newTestApp(t, &countingAI{reply: "news"})
+	a.clock = clock
+	a.userService.SetClock(clock)
+	ctx := context.Background()
+	a.ui().messages["snooze_choose_duration"] = "how long for %s?"
+	a.ui().messages["snooze_set"] = "%s paused until %s"
+	a.ui().messages["topic_snoozed"] = " (paused until %s)"
+	a.ui().messages["your_topics"] = "%s"
+	a.ui().messages["prompt_choose_news_cat"] = "choose %s"
+	u := &model.UserSettings{UserID: 1, Active: true, Tariff: "base",
+		Topics: map[string][]string{"Наука": {"Факты"}, "Спорт": {"Факты"}}}
+	if err := a.repo.Save(ctx, u); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.handleMessage(ctx, message(1, "/snooze_topic спорт"))
+	a.handleMessage(ctx, message(1, "1 день"))
+	if _, ok := a.convs.get(1); ok {
+		t.Fatalf("dialog must end after choosing the duration")
+	}
+	a.handleMessage(ctx, message(1, "/my_topics"))
+	if texts := tg.texts(); !slices.Contains(texts, "Наука: Факты\n\nСпорт (paused until 11.05.2024 10:00): Факты") {
+		t.Fatalf("/my_topics must mark the snoozed category, got %q", texts)
+	}
+	a.handleMessage(ctx, message(1, "/get_news_now"))
+	if texts := tg.texts(); texts[len(texts)-1] != "choose 1. Наука" {
+		t.Fatalf("/get_news_now must not offer the snoozed category, got %q", texts[len(texts)-1])
+	}
+	a.convs.delete(1)
+	u, _ = a.repo.Get(ctx, 1)
+	if _, err := a.userService.GetNewsForCategory(ctx, u, "Спорт"); !errors.Is(err, service.ErrCategorySnoozed) {
+		t.Fatalf("expected ErrCategorySnoozed on demand, got %v", err)
+	}
+
+	digests := func(n int) map[string]int {
+		seen := map[string]int{}
+		sent := len(tg.texts())
+		for i := 0; i < n; i++ {
+			u, _ := a.repo.Get(ctx, 1)
+			a.sendScheduled(ctx, u, clock.Now())
+			clock.Advance(2 * time.Hour)
+		}
+		for _, text := range tg.texts()[sent:] {
+			if cat, ok := strings.CutPrefix(text, "Категория: "); ok {
+				seen[strings.SplitN(cat, "\n", 2)[0]]++
+			}
+		}
+		return seen
+	}
+	if seen := digests(4); seen["Спорт"] != 0 || seen["Наука"] != 4 {
+		t.Fatalf("snoozed category must be skipped, got %v", seen)
+	}
+	clock.Advance(24 * time.Hour)
+	if seen := digests(2); seen["Спорт"] != 1 || seen["Наука"] != 1 {
+		t.Fatalf("category must return after the snooze expires, got %v", seen)
+	}
+}
+
+// TestConvCommand verifies /conv reports the stage and selections of the
+// user's active dialog to admins only.
+func TestConvCommand(t *testing.T) {
+	a, tg := newTestApp(t, nil)
+	ctx := context.Background()
+	a.cfg.Admins = []string{"admin"}
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, UserName: "user", Tariff: "base"}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	admin := func(text string) string {
+		before := len(tg.texts())
+		a.handleMessage(ctx, &telegram.Message{Chat: telegram.Chat{ID: 9, Username: "admin"}, Text: text})
+		a.generating.Wait()
+		texts := tg.texts()
+		if len(texts) != before+1 {
+			t.Fatalf("%s: expected one reply, got %q", text, texts[before:])
+		}
+		return texts[before]
+	}
+
+	if got := admin("/conv @user"); got != "У @user нет активного диалога" {
+		t.Fatalf("unexpected reply without a dialog: %q", got)
+	}
+	a.convs.set(1, &conversationState{Command: "/update_topics", Stage: stageInfoTypes, PrevStage: stageCategory, Step: 1,
+		CurrentCat: "Спорт", SelectedInfos: []string{"Факты"}, Topics: map[string][]string{"Наука": {"Тренды"}}})
+	want := "Диалог @user: /update_topics\nЭтап: info_types (предыдущий: category)\nШаг: 1\nТекущая категория: Спорт\nВыбранные типы: Факты\nТемы:\nНаука: Тренды"
+	if got := admin("/conv user"); got != want {
+		t.Fatalf("unexpected report:\n got %q\nwant %q", got, want)
+	}
+
+	before := len(tg.texts())
+	a.handleMessage(ctx, &telegram.Message{Chat: telegram.Chat{ID: 2, Username: "other"}, Text: "/conv user"})
+	a.generating.Wait()
+	if texts := tg.texts(); len(texts) != before {
+		t.Fatalf("non-admin must not get a report, got %q", texts[before:])
+	}
+
+	// The dialog is only read once the user's chat worker releases it.
+	unlock, err := a.chats.lock(ctx, 1)
+	if err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	done := make(chan string)
+	go func() { done <- admin("/conv user") }()
+	select {
+	case got := <-done:
+		t.Fatalf("report %q sent while the user's chat was busy", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	if got := <-done; got != want {
+		t.Fatalf("unexpected report after unlock: %q", got)
+	}
+}
+
+// TestConvCommand_AdminsOnEachOther verifies two admins running /conv on each
+// other at the same time, each with their own chat locked by the worker, do
+// not deadlock.
+func TestConvCommand_AdminsOnEachOther(t *testing.T) {
+	a, tg := newTestApp(t, nil)
+	ctx := context.Background()
+	a.cfg.Admins = []string{"one", "two"}
+	for id, name := range map[int64]string{1: "one", 2: "two"} {
+		if err := a.repo.Save(ctx, &model.UserSettings{UserID: id, UserName: name, Tariff: "base"}); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	// Like the update workers, hold both admins' chats while they are handled.
+	var unlocks []func()
+	for id := int64(1); id <= 2; id++ {
+		unlock, err := a.chats.lock(ctx, id)
+		if err != nil {
+			t.Fatalf("lock: %v", err)
+		}
+		unlocks = append(unlocks, unlock)
+	}
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		var wg sync.WaitGroup
+		for _, m := range []*telegram.Message{
+			{Chat: telegram.Chat{ID: 1, Username: "one"}, Text: "/conv two"},
+			{Chat: telegram.Chat{ID: 2, Username: "two"}, Text: "/conv one"},
+		} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				a.handleMessage(ctx, m)
+			}()
+		}
+		wg.Wait()
+	}()
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatalf("admins running /conv on each other deadlocked")
+	}
+	for _, unlock := range unlocks {
+		unlock()
+	}
+	a.generating.Wait()
+	if texts := tg.texts(); len(texts) != 2 {
+		t.Fatalf("expected a report for each admin, got %q", texts)
+	}
+}
+
+// TestStageName verifies every stage has a readable name.
+func TestStageName(t *testing.T) {
+	for s := stageUpdateChoice; s <= stageInterestsConfirm; s++ {
+		if name := stageName(s); strings.HasPrefix(name, "stage(") {
+			t.Fatalf("stage %d has no name", s)
+		}
+	}
+	if got := stageName(0); got != "none" {
+		t.Fatalf("expected none for the zero stage, got %q", got)
+	}
+}
+
+// TestSaveTopics_EscapesConfirmation verifies custom category text is
+// HTML-escaped in the save confirmations while emoji are kept as is.
+func TestSaveTopics_EscapesConfirmation(t *testing.T) {
+	for _, key := range []string{"settings_saved", "settings_updated"} {
+		a, tg := newTestApp(t, nil)
+		a.cfg.NoFirstDigest = true
+		a.ui().messages[key] = "<b>saved</b>\n%s"
+		c := &conversationState{UpdateTopics: key == "settings_updated", Topics: map[string][]string{"🫆A<B & C": {"Факты"}}}
+		a.convs.set(1, c)
+		a.saveTopics(context.Background(), message(1, "Готово"), c)
+
+		want := "<b>saved</b>\n🫆A&lt;B &amp; C: Факты"
+		if texts := tg.texts(); len(texts) != 1 || texts[0] != want {
+			t.Fatalf("%s: expected %q, got %q", key, want, texts)
+		}
+	}
+}
+
+// TestSaveTopics_MergesDuplicateCategories verifies case variants of a preset
+// category are merged into it before saving and the user is told about it.
+func TestSaveTopics_MergesDuplicateCategories(t *testing.T) {
+	a, tg := newTestApp(t, nil)
+	ctx := context.Background()
+	a.cfg.NoFirstDigest = true
+	a.ui().messages["categories_merged"] = "merged %s into %s"
+	a.ui().messages["settings_saved"] = "saved %s"
+	c := &conversationState{Topics: map[string][]string{"Наука": {"Факты"}, "наука": {"Тренды", "Факты"}}}
+	a.convs.set(1, c)
+	a.saveTopics(ctx, message(1, "Готово"), c)
+
+	texts := tg.texts()
+	if len(texts) != 2 || texts[0] != "merged Наука», «наука into Наука" || texts[1] != "saved Наука: Факты, Тренды" {
+		t.Fatalf("unexpected messages: %q", texts)
+	}
+	settings, err := a.repo.Get(ctx, 1)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if len(settings.Topics) != 1 || fmt.Sprint(settings.Topics["Наука"]) != "[Факты Тренды]" {
+		t.Fatalf("unexpected topics: %v", settings.Topics)
+	}
+}
+
+// TestAddTopics_TotalInfoTypeLimit verifies info types are capped by their sum
+// over all categories: going one above the limit is refused, reaching it is
+// accepted.
+func TestAddTopics_TotalInfoTypeLimit(t *testing.T) {
+	a, tg := newTestApp(t, &countingAI{})
+	ctx := context.Background()
+	base := a.cfg.Tariffs["base"]
+	base.Limits.CategoryLimit = 3
+	base.Limits.TotalInfoTypeLimit = 3
+	a.cfg.Tariffs["base"] = base
+	a.ui().messages["limit_total_infos"] = "total cap %d, room %d"
+	a.ui().messages["prompt_choose_info"] = "info for %s (%d) %s"
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты", "Тренды"}}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.handleMessage(ctx, message(1, "/add_topic"))
+	a.handleMessage(ctx, message(1, "2"))
+	a.handleMessage(ctx, message(1, "Готово"))
+	if c, _ := a.convs.get(1); c == nil || c.Stage != stageInfoTypes || c.CurrentCat != "Спорт" {
+		t.Fatalf("expected info types for Спорт, got %+v", c)
+	}
+	a.handleMessage(ctx, message(1, "1 2"))
+	if texts := tg.texts(); !slices.Contains(texts, "total cap 3, room 1") {
+		t.Fatalf("expected total cap notice, got %q", texts)
+	}
+	if c, _ := a.convs.get(1); c == nil || c.Stage != stageInfoTypes || len(c.SelectedInfos) != 0 || c.Topics["Спорт"] != nil {
+		t.Fatalf("refused selection must not be stored, got %+v", c)
+	}
+
+	a.handleMessage(ctx, message(1, "1"))
+	a.handleMessage(ctx, message(1, "Готово"))
+	topics := map[string][]string{}
+	if c, _ := a.convs.get(1); c != nil {
+		topics = c.Topics
+	} else if saved, err := a.repo.Get(ctx, 1); err == nil {
+		topics = saved.Topics
+	}
+	if !slices.Equal(topics["Спорт"], []string{"Факты"}) || len(topics["Наука"]) != 2 {
+		t.Fatalf("selection at the limit must be accepted, got %v", topics)
+	}
+}
+
+// TestExtractLinks verifies links are taken from the digest HTML in order,
+// with entities decoded, nested tags stripped and repeated URLs dropped.
+func TestExtractLinks(t *testing.T) {
+	text := `Категория: Наука
+
+1. <b>Запуск ракеты</b> — <a href="https://example.com/a?x=1&amp;y=2">Reuters</a>
+2. Новый телескоп — <a href="https://example.org/b"><i>NASA</i> &amp; ESA</a>
+3. Повтор — <a href="https://example.com/a?x=1&amp;y=2">снова</a>
+4. <a href="https://example.net/c"></a>`
+	want := []readingLink{
+		{Title: "Reuters", URL: "https://example.com/a?x=1&y=2"},
+		{Title: "NASA & ESA", URL: "https://example.org/b"},
+		{Title: "https://example.net/c", URL: "https://example.net/c"},
+	}
+	if got := extractLinks(text); !slices.Equal(got, want) {
+		t.Fatalf("unexpected links:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+// TestReadingListCommand verifies /reading_list sends the links of the latest
+// last-24h digest as a file named after its date and category.
+func TestReadingListCommand(t *testing.T) {
+	a, tg := newTestApp(t, nil)
+	ctx := context.Background()
+	a.ui().messages["reading_list_empty"] = "nothing yet"
+	a.ui().messages["reading_list_caption"] = "%s, %s"
+
+	a.handleMessage(ctx, message(1, "/reading_list"))
+	if texts := tg.texts(); len(texts) != 1 || texts[0] != "nothing yet" {
+		t.Fatalf("expected the empty notice, got %q", texts)
+	}
+
+	at := time.Date(2024, 5, 10, 9, 30, 0, 0, time.Local)
+	a.rememberLast24h(1, last24hDigest{Category: "Наука и техника", At: at,
+		Text: `Категория: Наука и техника
+
+- Спутник [x] — <a href="https://example.com/1">Спутник [x]</a>`})
+	a.handleMessage(ctx, message(1, "/reading_list"))
+	want := sentDocument{ChatID: 1, Name: "reading-list-2024-05-10-наука-и-техника.md", Caption: "Наука и техника, 10.05.2024",
+		Data: "# Наука и техника — 10.05.2024\n\n- [Спутник \\[x\\]](https://example.com/1)\n"}
+	if len(tg.documents) != 1 || tg.documents[0] != want {
+		t.Fatalf("unexpected document:\n got %+v\nwant %+v", tg.documents, want)
+	}
+}
+
+// TestDownloadMyDataCommand verifies /download_my_data sends the stored
+// settings and today's quota usage as a JSON file.
+func TestDownloadMyDataCommand(t *testing.T) {
+	now := time.Date(2024, 5, 10, 10, 0, 0, 0, time.Local)
+	a, tg := newTestApp(t, nil)
+	a.clock = &fakeClock{now: now}
+	ctx := context.Background()
+	a.ui().messages["my_data_caption"] = "your data"
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты"}},
+		GetNewsNowCount: 2, LastGetNewsNow: now.Add(-time.Hour).Unix(),
+		History: []model.HistoryEntry{{Category: "Наука", At: now.Unix(), Summary: "news"}}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.handleMessage(ctx, message(1, "/download_my_data"))
+	if len(tg.documents) != 1 || tg.documents[0].Name != "my-data-1.json" || tg.documents[0].Caption != "your data" {
+		t.Fatalf("unexpected documents %+v", tg.documents)
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(tg.documents[0].Data), &doc); err != nil {
+		t.Fatalf("document is not JSON: %v", err)
+	}
+	for _, key := range []string{"exported_at", "settings", "quota"} {
+		if _, ok := doc[key]; !ok {
+			t.Fatalf("document lacks %q: %s", key, tg.documents[0].Data)
+		}
+	}
+	var settings model.UserSettings
+	if err := json.Unmarshal(doc["settings"], &settings); err != nil || settings.UserID != 1 || len(settings.Topics["Наука"]) != 1 || len(settings.History) != 1 {
+		t.Fatalf("unexpected settings %s (%v)", doc["settings"], err)
+	}
+	var quota quotaUsage
+	if err := json.Unmarshal(doc["quota"], &quota); err != nil {
+		t.Fatalf("quota: %v", err)
+	}
+	want := quotaUsage{Tariff: "base", GetNewsNowUsed: 2, GetNewsNowLimit: 5, ResetsAt: time.Date(2024, 5, 11, 0, 0, 0, 0, time.Local).Format(time.RFC3339)}
+	if quota != want {
+		t.Fatalf("unexpected quota:\n got %+v\nwant %+v", quota, want)
+	}
+}
+
+// TestFormatCommand verifies the digest format is saved from the picker and
+// from the command argument.
+func TestFormatCommand(t *testing.T) {
+	a, tg := newTestApp(t, nil)
+	ctx := context.Background()
+	a.ui().messages["format_choose"] = "format? now %s"
+	a.ui().messages["format_saved"] = "format: %s"
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base"}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.handleMessage(ctx, message(1, "/format"))
+	a.handleMessage(ctx, message(1, "Тезисы списком"))
+	if u, _ := a.repo.Get(ctx, 1); u.Format != model.FormatBullets {
+		t.Fatalf("expected bullets, got %q", u.Format)
+	}
+	a.handleMessage(ctx, message(1, "/format prose"))
+	if u, _ := a.repo.Get(ctx, 1); u.Format != model.FormatProse {
+		t.Fatalf("expected prose, got %q", u.Format)
+	}
+	want := []string{"format? now По умолчанию", "format: Тезисы списком", "format: Связный текст"}
+	if texts := tg.texts(); !slices.Equal(texts, want) {
+		t.Fatalf("unexpected replies %q", texts)
+	}
+}
+
+// TestLengthCommand verifies the chosen length is saved and the reply shows
+// the limit clamped to the tariff.
+func TestLengthCommand(t *testing.T) {
+	a, tg := newTestApp(t, nil)
+	ctx := context.Background()
+	base := a.cfg.Tariffs["base"]
+	base.GPT.MaxTokens = 1000
+	a.cfg.Tariffs["base"] = base
+	a.ui().messages["length_choose"] = "length? now %s"
+	a.ui().messages["length_saved"] = "length: %s, %d"
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base"}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.handleMessage(ctx, message(1, "/length"))
+	a.handleMessage(ctx, message(1, "Длинные"))
+	if u, _ := a.repo.Get(ctx, 1); u.MaxTokens != 2048 {
+		t.Fatalf("expected 2048 tokens, got %d", u.MaxTokens)
+	}
+	a.handleMessage(ctx, message(1, "/length short"))
+	want := []string{"length? now По умолчанию", "length: Длинные, 1000", "length: Короткие, 512"}
+	if texts := tg.texts(); !slices.Equal(texts, want) {
+		t.Fatalf("unexpected replies %q", texts)
+	}
+}
+
+// TestCloneTopicCommand verifies a category is copied into a distinct custom
+// category with its own info types and the original is left intact.
+func TestCloneTopicCommand(t *testing.T) {
+	a, tg := newTestApp(t, nil)
+	ctx := context.Background()
+	base := a.cfg.Tariffs["base"]
+	base.AllowCustomCategory = true
+	a.cfg.Tariffs["base"] = base
+	a.ui().messages["clone_enter_name"] = "name for %s (%d-%d words)?"
+	a.ui().messages["clone_exists"] = "%s exists"
+	a.ui().messages["settings_updated"] = "updated:\n%s"
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты"}}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.handleMessage(ctx, message(1, "/clone_topic наука"))
+	a.handleMessage(ctx, message(1, "Идеи"))
+	a.handleMessage(ctx, message(1, "2"))
+	a.handleMessage(ctx, message(1, "Готово"))
+
+	u, err := a.repo.Get(ctx, 1)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	want := map[string][]string{"Наука": {"Факты"}, "🫆Наука — Идеи": {"Тренды"}}
+	if !maps.EqualFunc(u.Topics, want, slices.Equal) {
+		t.Fatalf("unexpected topics %v", u.Topics)
+	}
+	texts := tg.texts()
+	if texts[0] != "name for Наука (1-3 words)?" || texts[len(texts)-1] != "updated:\nНаука: Факты\n🫆Наука — Идеи: Тренды" {
+		t.Fatalf("unexpected replies %q", texts)
+	}
+	if _, ok := a.convs.get(1); ok {
+		t.Fatalf("conversation must end after saving")
+	}
+}
+
+// TestCloneTopicCommand_EscapesNames verifies the category being copied and
+// the name typed for the copy are HTML-escaped in the dialog.
+func TestCloneTopicCommand_EscapesNames(t *testing.T) {
+	a, tg := newTestApp(t, nil)
+	ctx := context.Background()
+	base := a.cfg.Tariffs["base"]
+	base.AllowCustomCategory = true
+	base.Limits.CategoryLimit = 3
+	a.cfg.Tariffs["base"] = base
+	a.ui().messages["clone_enter_name"] = "name for %s (%d-%d words)?"
+	a.ui().messages["clone_exists"] = "%s exists"
+	topics := map[string][]string{"🫆x<y": {"Факты"}, "🫆x<y — a<b": {"Идеи"}}
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base", Topics: topics}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.handleMessage(ctx, message(1, "/clone_topic"))
+	a.handleMessage(ctx, message(1, "1"))
+	a.handleMessage(ctx, message(1, "a<b"))
+
+	texts := tg.texts()
+	if len(texts) != 3 || texts[1] != "name for 🫆x&lt;y (1-3 words)?" || texts[2] != "🫆x&lt;y — a&lt;b exists" {
+		t.Fatalf("unexpected replies %q", texts)
+	}
+}
+
+// TestMaintenanceMode verifies that in maintenance mode scheduled digests are
+// not sent, users get the notice instead of replies and admins are not
+// affected.
+func TestMaintenanceMode(t *testing.T) {
+	ai := &countingAI{reply: "news"}
+	a, tg := newTestApp(t, ai)
+	ctx := context.Background()
+	a.cfg.Admins = []string{"admin"}
+	a.ui().messages["maintenance"] = "maintenance"
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Active: true, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты"}}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	admin := &telegram.Message{Chat: telegram.Chat{ID: 9, Username: "admin"}, Text: "/maintenance on"}
+
+	a.handleMessage(ctx, admin)
+	a.handleMessage(ctx, message(1, "/get_news_now"))
+	a.scheduleTick(ctx, time.Now())
+	a.generating.Wait()
+	if ai.calls != 0 {
+		t.Fatalf("nothing must be generated in maintenance mode, got %d calls", ai.calls)
+	}
+	want := []string{"Режим обслуживания включён: рассылка приостановлена", "maintenance"}
+	if texts := tg.texts(); !slices.Equal(texts, want) {
+		t.Fatalf("unexpected messages %q", texts)
+	}
+	if _, ok := a.convs.get(1); ok {
+		t.Fatalf("no dialog must start in maintenance mode")
+	}
+
+	admin.Text = "/maintenance off"
+	a.handleMessage(ctx, admin)
+	a.scheduleTick(ctx, time.Now())
+	if ai.calls == 0 {
+		t.Fatalf("digests must resume after maintenance")
+	}
+}
+
+// cancelAI cancels the scheduler's context on its first call, like a SIGTERM
+// arriving in the middle of a batch, and then replies as usual.
+type cancelAI struct {
+	countingAI
+	cancel context.CancelFunc
+}
+
+// ChatCompletion cancels the context and returns the configured reply.
+func (c *cancelAI) ChatCompletion(ctx context.Context, model, prompt string, maxTokens int, temperature *float64) (string, error) {
+	c.cancel()
+	return c.countingAI.ChatCompletion(ctx, model, prompt, maxTokens, temperature)
+}
+
+// ChatResponses cancels the context and returns the configured reply.
+func (c *cancelAI) ChatResponses(ctx context.Context, model, prompt string, maxTokens int, temperature *float64) (string, error) {
+	return c.ChatCompletion(ctx, model, prompt, maxTokens, temperature)
+}
+
+// TestScheduleTick_DrainsOnCancel verifies a shutdown in the middle of a batch
+// lets the digest under way be delivered and recorded, and starts no other
+// user, whose LastScheduledSent stays as it was.
+func TestScheduleTick_DrainsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ai := &cancelAI{countingAI: countingAI{reply: "news"}, cancel: cancel}
+	a, tg := newTestApp(t, ai)
+	a.cfg.Workers = 1
+	a.cfg.ShutdownGrace = 5 * time.Second
+	now := time.Date(2024, 5, 10, 10, 0, 0, 0, time.Local)
+	for id := int64(1); id <= 3; id++ {
+		if err := a.repo.Save(ctx, &model.UserSettings{UserID: id, Active: true, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты"}}}); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	a.scheduleTick(ctx, now)
+	if ai.calls != 1 {
+		t.Fatalf("expected only the first user to be generated, got %d calls", ai.calls)
+	}
+	if len(tg.sent) != 1 || tg.sent[0].ChatID != 1 {
+		t.Fatalf("expected the started digest to be delivered, got %+v", tg.sent)
+	}
+	for id := int64(1); id <= 3; id++ {
+		u, err := a.repo.Get(context.Background(), id)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		want := int64(0)
+		if id == 1 {
+			want = now.Unix()
+		}
+		if u.LastScheduledSent != want {
+			t.Fatalf("user %d: LastScheduledSent %d, want %d", id, u.LastScheduledSent, want)
+		}
+	}
+}
+
+// hangingAI cancels the scheduler's context and then hangs until its own
+// context ends, like a model call that outlives the shutdown.
+type hangingAI struct {
+	cancel context.CancelFunc
+}
+
+// ChatCompletion cancels the scheduler and waits for ctx.
+func (h *hangingAI) ChatCompletion(ctx context.Context, model, prompt string, maxTokens int, temperature *float64) (string, error) {
+	h.cancel()
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+// ChatResponses behaves like ChatCompletion.
+func (h *hangingAI) ChatResponses(ctx context.Context, model, prompt string, maxTokens int, temperature *float64) (string, error) {
+	return h.ChatCompletion(ctx, model, prompt, maxTokens, temperature)
+}
+
+// TestScheduleTick_DrainIsBounded verifies a digest still generating when the
+// shutdown grace runs out is abandoned: the tick returns and the user stays
+// due without a message.
+func TestScheduleTick_DrainIsBounded(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a, tg := newTestApp(t, &hangingAI{cancel: cancel})
+	a.cfg.ShutdownGrace = 50 * time.Millisecond
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Active: true, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты"}}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		a.scheduleTick(ctx, time.Date(2024, 5, 10, 10, 0, 0, 0, time.Local))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("scheduleTick did not give up after the shutdown grace")
+	}
+	u, _ := a.repo.Get(context.Background(), 1)
+	if len(tg.texts()) != 0 || u.LastScheduledSent != 0 {
+		t.Fatalf("abandoned digest must leave the user due, sent %q, LastScheduledSent %d", tg.texts(), u.LastScheduledSent)
+	}
+}
+
+// TestPingAICommand verifies that /ping_ai reports success or the AI error
+// with the base tariff's model and is ignored for non-admins.
+func TestPingAICommand(t *testing.T) {
+	ai := &countingAI{reply: "pong"}
+	a, tg := newTestApp(t, ai)
+	ctx := context.Background()
+	a.cfg.Admins = []string{"admin"}
+	base := a.cfg.Tariffs["base"]
+	base.GPT.Model = "gpt-test"
+	a.cfg.Tariffs["base"] = base
+	admin := &telegram.Message{Chat: telegram.Chat{ID: 9, Username: "admin"}, Text: "/ping_ai"}
+
+	a.handleMessage(ctx, message(1, "/ping_ai"))
+	if ai.calls != 0 || len(tg.texts()) != 0 {
+		t.Fatalf("non-admin must be ignored, got %d calls and %q", ai.calls, tg.texts())
+	}
+
+	a.handleMessage(ctx, admin)
+	ai.err = errors.New("boom")
+	a.handleMessage(ctx, admin)
+	texts := tg.texts()
+	if ai.calls != 2 || len(texts) != 2 {
+		t.Fatalf("expected two pings, got %d calls and %q", ai.calls, texts)
+	}
+	if !strings.HasPrefix(texts[0], "OpenAI (gpt-test) ответил за ") {
+		t.Fatalf("unexpected success reply %q", texts[0])
+	}
+	if !strings.HasPrefix(texts[1], "OpenAI (gpt-test) ошибка за ") || !strings.HasSuffix(texts[1], ": boom") {
+		t.Fatalf("unexpected error reply %q", texts[1])
+	}
+}
+
+// TestAddTopics_SameInfosForAll verifies that info types chosen once are
+// applied to every category of the batch and that the total info type cap
+// is enforced for the whole batch.
+func TestAddTopics_SameInfosForAll(t *testing.T) {
+	a, tg := newTestApp(t, &countingAI{})
+	ctx := context.Background()
+	base := a.cfg.Tariffs["base"]
+	base.Limits.CategoryLimit = 3
+	base.Limits.InfoTypeLimit = 3
+	base.Limits.TotalInfoTypeLimit = 5
+	a.cfg.Tariffs["base"] = base
+	a.ui().messages["limit_total_infos"] = "total cap %d, room %d"
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"Наука": {"Идеи"}}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.handleMessage(ctx, message(1, "/add_topic"))
+	a.handleMessage(ctx, message(1, "2 3"))
+	if kb := tg.lastKeyboard(); !slices.Contains(kb, sameInfos) {
+		t.Fatalf("expected the shortcut button, got %q", kb)
+	}
+	a.handleMessage(ctx, message(1, sameInfos))
+	a.handleMessage(ctx, message(1, "1 2 3"))
+	if texts := tg.texts(); !slices.Contains(texts, "total cap 5, room 2") {
+		t.Fatalf("expected total cap notice, got %q", texts)
+	}
+	if c, _ := a.convs.get(1); c == nil || c.Stage != stageSharedInfoTypes || len(c.SelectedInfos) != 0 {
+		t.Fatalf("refused selection must be asked again, got %+v", c)
+	}
+
+	a.handleMessage(ctx, message(1, "1 3"))
+	a.handleMessage(ctx, message(1, "Готово"))
+	if c, _ := a.convs.get(1); c != nil {
+		t.Fatalf("dialog must end after saving, got %+v", c)
+	}
+	saved, err := a.repo.Get(ctx, 1)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	want := map[string][]string{"Наука": {"Идеи"}, "Спорт": {"Факты", "Идеи"}, "Финансы": {"Факты", "Идеи"}}
+	if fmt.Sprint(saved.Topics) != fmt.Sprint(want) {
+		t.Fatalf("unexpected topics %v, want %v", saved.Topics, want)
+	}
+}
+
+// TestTopicProfiles verifies that topics can be saved as named profiles,
+// listed and loaded back, and that a profile exceeding the tariff limits is
+// not loaded.
+func TestTopicProfiles(t *testing.T) {
+	a, tg := newTestApp(t, &countingAI{})
+	ctx := context.Background()
+	a.ui().messages["profile_saved"] = "saved %s"
+	a.ui().messages["profiles_list"] = "profiles:\n%s"
+	a.ui().messages["profile_loaded"] = "loaded %s:\n%s"
+	a.ui().messages["profile_over_limit"] = "over limit %s"
+	work := map[string][]string{"Наука": {"Факты"}, "Финансы": {"Тренды"}}
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base", Topics: work}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.handleMessage(ctx, message(1, "/save_profile работа"))
+	u, _ := a.repo.Get(ctx, 1)
+	u.Topics = map[string][]string{"Спорт": {"Идеи"}}
+	u.Profiles["большой"] = map[string][]string{"Наука": {"Факты"}, "Спорт": {"Идеи"}, "Финансы": {"Идеи"}}
+	if err := a.repo.Save(ctx, u); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	a.handleMessage(ctx, message(1, "/save_profile выходные"))
+	a.handleMessage(ctx, message(1, "/profiles"))
+	a.handleMessage(ctx, message(1, "/load_profile большой"))
+	a.handleMessage(ctx, message(1, "/load_profile работа"))
+
+	want := []string{
+		"saved работа",
+		"saved выходные",
+		"profiles:\n<b>большой</b>\nНаука: Факты\nСпорт: Идеи\nФинансы: Идеи\n\n<b>выходные</b>\nСпорт: Идеи\n\n<b>работа</b>\nНаука: Факты\nФинансы: Тренды",
+		"over limit большой",
+		"loaded работа:\nНаука: Факты\nФинансы: Тренды",
+	}
+	if texts := tg.texts(); !slices.Equal(texts, want) {
+		t.Fatalf("unexpected messages:\n got %q\nwant %q", texts, want)
+	}
+	u, _ = a.repo.Get(ctx, 1)
+	if fmt.Sprint(u.Topics) != fmt.Sprint(work) || len(u.Profiles) != 3 {
+		t.Fatalf("unexpected settings after load: topics %v, profiles %v", u.Topics, u.Profiles)
+	}
+}
+
+// TestUndoTopics verifies that /undo restores the topics replaced by the last
+// change after confirmation and that a second /undo swaps them back.
+func TestUndoTopics(t *testing.T) {
+	a, tg := newTestApp(t, &countingAI{})
+	ctx := context.Background()
+	a.ui().messages["undo_empty"] = "nothing to undo"
+	a.ui().messages["undo_done"] = "restored:\n%s"
+	before := map[string][]string{"Наука": {"Факты"}}
+	after := map[string][]string{"Наука": {"Факты"}, "Спорт": {"Факты"}}
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base", Topics: before}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	topics := func() map[string][]string {
+		u, err := a.repo.Get(ctx, 1)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		return u.Topics
+	}
+
+	a.handleMessage(ctx, message(1, "/undo"))
+	for _, text := range []string{"/add_topic", "2", "Готово", "1", "Готово"} {
+		a.handleMessage(ctx, message(1, text))
+	}
+	if got := topics(); fmt.Sprint(got) != fmt.Sprint(after) {
+		t.Fatalf("unexpected topics after adding: %v", got)
+	}
+
+	a.handleMessage(ctx, message(1, "/undo"))
+	if c, _ := a.convs.get(1); c == nil || c.Stage != stageUndoConfirm {
+		t.Fatalf("undo must ask for confirmation, got %+v", c)
+	}
+	if got := topics(); fmt.Sprint(got) != fmt.Sprint(after) {
+		t.Fatalf("topics changed before confirmation: %v", got)
+	}
+	a.handleMessage(ctx, message(1, undoApply))
+	if got := topics(); fmt.Sprint(got) != fmt.Sprint(before) {
+		t.Fatalf("undo must restore the previous topics, got %v", got)
+	}
+
+	a.handleMessage(ctx, message(1, "/undo"))
+	a.handleMessage(ctx, message(1, undoApply))
+	if got := topics(); fmt.Sprint(got) != fmt.Sprint(after) {
+		t.Fatalf("second undo must swap back, got %v", got)
+	}
+	texts := tg.texts()
+	if texts[0] != "nothing to undo" || texts[len(texts)-1] != "restored:\nНаука: Факты\nСпорт: Факты" {
+		t.Fatalf("unexpected messages %q", texts)
+	}
+}
+
+// TestResetQuotaCommand verifies that /reset_quota zeroes the user's daily
+// counters, persists them, reports a counter from an earlier day as zero and
+// is ignored for non-admins.
+func TestResetQuotaCommand(t *testing.T) {
+	a, tg := newTestApp(t, &countingAI{})
+	clock := &fakeClock{now: time.Date(2024, 5, 10, 12, 0, 0, 0, time.Local)}
+	a.clock = clock
+	ctx := context.Background()
+	a.cfg.Admins = []string{"admin"}
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, UserName: "user", Tariff: "base", GetNewsNowCount: 5, LastGetNewsNow: clock.Now().Add(-time.Hour).Unix(),
+		GetLast24hCount: 2, LastGetLast24h: clock.Now().Add(-24 * time.Hour).Unix()}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.handleMessage(ctx, message(1, "/reset_quota user"))
+	if u, _ := a.repo.Get(ctx, 1); u.GetNewsNowCount != 5 || u.GetLast24hCount != 2 {
+		t.Fatalf("non-admin must not reset quotas, got %+v", u)
+	}
+
+	admin := &telegram.Message{Chat: telegram.Chat{ID: 9, Username: "admin"}, Text: "/reset_quota @user"}
+	a.handleMessage(ctx, admin)
+	a.generating.Wait()
+	u, err := a.repo.Get(ctx, 1)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if u.GetNewsNowCount != 0 || u.GetLast24hCount != 0 {
+		t.Fatalf("counters must be zeroed, got %d and %d", u.GetNewsNowCount, u.GetLast24hCount)
+	}
+	want := "Квоты @user сброшены:\n/get_news_now: 5 → 0 из 5\n/get_last_24h_news: 0 → 0 из 0"
+	if texts := tg.texts(); len(texts) != 1 || texts[0] != want {
+		t.Fatalf("unexpected messages %q", texts)
+	}
+}
+
+// TestCommandForBot verifies that the @bot suffix of group commands is
+// stripped and commands addressed to other bots are ignored.
+func TestCommandForBot(t *testing.T) {
+	cases := []struct {
+		text, bot, want string
+		ok              bool
+	}{
+		{"/start", "MyBot", "/start", true},
+		{"/start@MyBot", "MyBot", "/start", true},
+		{"/start@mybot extra", "MyBot", "/start extra", true},
+		{"/start extra", "MyBot", "/start extra", true},
+		{"/get_news_now@MyBot Наука", "MyBot", "/get_news_now Наука", true},
+		{"/start@OtherBot", "MyBot", "", false},
+		{"/start@AnyBot", "", "/start", true},
+		{"mail me@example.com", "MyBot", "mail me@example.com", true},
+	}
+	for _, c := range cases {
+		got, ok := commandForBot(c.text, c.bot)
+		if ok != c.ok || (ok && got != c.want) {
+			t.Errorf("commandForBot(%q, %q) = %q, %v; want %q, %v", c.text, c.bot, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+// TestHandleMessage_GroupCommand verifies that /start, /start@MyBot and
+// /start extra all start the dialog once the bot username is known, while a
+// command for another bot is ignored.
+func TestHandleMessage_GroupCommand(t *testing.T) {
+	a, tg := newTestApp(t, &countingAI{})
+	ctx := context.Background()
+	a.ui().messages["start"] = "welcome"
+	a.loadBotUsername(ctx)
+	if a.botUsername != "MyBot" {
+		t.Fatalf("unexpected bot username %q", a.botUsername)
+	}
+	for _, text := range []string{"/start", "/start@MyBot", "/start extra", "/start@OtherBot"} {
+		a.handleMessage(ctx, message(1, text))
+		a.convs.delete(1)
+	}
+	if texts := tg.texts(); !slices.Equal(texts, []string{"welcome", "welcome", "welcome"}) {
+		t.Fatalf("unexpected replies %q", texts)
+	}
+}
+
+// TestHistoryCommand verifies the history keeps only the latest digests and
+// /history pages through them newest first.
+func TestHistoryCommand(t *testing.T) {
+	a, tg := newTestApp(t, nil)
+	ctx := context.Background()
+	a.ui().messages["history_page"] = "page %d/%d\n%s"
+	a.ui().messages["history_more"] = "\nnext /history %d"
+	u := &model.UserSettings{UserID: 1, Tariff: "base"}
+	start := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	for i := 1; i <= model.MaxHistory+2; i++ {
+		text := fmt.Sprintf("Категория: cat%d\n\nТип: Факты\n**digest %d** <b>x</b>\nmore", i, i)
+		recordHistory(u, fmt.Sprintf("cat%d", i), nil, text, start.Add(time.Duration(i)*time.Hour))
+	}
+	if len(u.History) != model.MaxHistory || u.History[0].Category != "cat3" || u.History[len(u.History)-1].Summary != "digest 22 x" {
+		t.Fatalf("unexpected history after overflow: %+v", u.History)
+	}
+	if err := a.repo.Save(ctx, u); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.handleMessage(ctx, message(1, "/history"))
+	a.handleMessage(ctx, message(1, "/history 4"))
+	texts := tg.texts()
+	if !strings.HasPrefix(texts[0], "page 1/4\n") || !strings.Contains(texts[0], "<b>cat22</b>\ndigest 22 x") || strings.Contains(texts[0], "cat17") || !strings.HasSuffix(texts[0], "next /history 2") {
+		t.Fatalf("unexpected first page %q", texts[0])
+	}
+	if !strings.HasPrefix(texts[1], "page 4/4\n") || !strings.Contains(texts[1], "cat3") || strings.Contains(texts[1], "next /history") {
+		t.Fatalf("unexpected last page %q", texts[1])
+	}
+}
+
+// TestRenameInfos_Aliases verifies that after an info option was renamed the
+// stored topics are migrated to the new name and still resolve to an option.
+func TestRenameInfos_Aliases(t *testing.T) {
+	a, _ := newTestApp(t, nil)
+	ctx := context.Background()
+	a.cfg.Options.InfoOptions = []string{"Интересные факты", "Тренды", "Идеи"}
+	a.ui().infoOptions = a.cfg.Options.InfoOptions
+	a.cfg.Options.InfoAliases = map[string]string{"Факты": "Интересные факты"}
+	stored := &model.UserSettings{
+		UserID:     1,
+		Tariff:     "base",
+		Topics:     map[string][]string{"Наука": {"Факты", "Тренды"}, "Спорт": {"Факты", "Интересные факты"}},
+		PrevTopics: map[string][]string{"Наука": {"Факты"}},
+	}
+	for _, u := range []*model.UserSettings{stored, {UserID: 2, Tariff: "base", Topics: map[string][]string{"Наука": {"Идеи"}}}} {
+		if err := a.repo.Save(ctx, u); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	a.renameInfos(ctx)
+	if !strings.Contains(buf.String(), "rename info types: 1 users updated") {
+		t.Fatalf("expected the number of updated users in the log, got %q", buf.String())
+	}
+	u, _ := a.repo.Get(ctx, 1)
+	want := map[string][]string{"Наука": {"Интересные факты", "Тренды"}, "Спорт": {"Интересные факты"}}
+	if !reflect.DeepEqual(u.Topics, want) || u.PrevTopics["Наука"][0] != "Интересные факты" {
+		t.Fatalf("unexpected topics after rename: %v, prev %v", u.Topics, u.PrevTopics)
+	}
+	for _, infos := range u.Topics {
+		for _, info := range infos {
+			if !slices.Contains(a.ui().infoOptions, info) {
+				t.Fatalf("stored info %q does not resolve to an option", info)
+			}
+		}
+	}
+}
+
+// listHookRepo runs afterList once the user list was read, to change users
+// between the listing and the next step.
+type listHookRepo struct {
+	repository.UserSettingsRepository
+	afterList func()
+}
+
+// List returns the stored users and then runs the hook.
+func (r *listHookRepo) List(ctx context.Context) ([]*model.UserSettings, error) {
+	all, err := r.UserSettingsRepository.List(ctx)
+	r.afterList()
+	return all, err
+}
+
+// TestRenameInfos_KeepsConcurrentChanges verifies the rename re-reads a user
+// before saving, so a change made after the listing survives, and that a
+// failed save is logged without a count of updated users.
+func TestRenameInfos_KeepsConcurrentChanges(t *testing.T) {
+	a, _ := newTestApp(t, nil)
+	ctx := context.Background()
+	a.cfg.Options.InfoAliases = map[string]string{"Факты": "Интересные факты"}
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты"}}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	file := a.repo
+	a.repo = &listHookRepo{UserSettingsRepository: file, afterList: func() {
+		u, _ := file.Get(ctx, 1)
+		u.Tone = "живо"
+		file.Save(ctx, u)
+	}}
+	a.renameInfos(ctx)
+	u, _ := file.Get(ctx, 1)
+	if u.Tone != "живо" || u.Topics["Наука"][0] != "Интересные факты" {
+		t.Fatalf("expected both the rename and the concurrent change, got tone %q, topics %v", u.Tone, u.Topics)
+	}
+
+	a.cfg.Options.InfoAliases = map[string]string{"Интересные факты": "Факты"}
+	flaky := &flakyRepo{UserSettingsRepository: file, failures: 1}
+	a.repo = flaky
+	a.userService = service.NewUserService(flaky, nil, a.cfg.Tariffs)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	a.renameInfos(ctx)
+	if out := buf.String(); !strings.Contains(out, "connection reset") || strings.Contains(out, "users updated") {
+		t.Fatalf("expected the error without a count, got %q", out)
+	}
+}
+
+// TestBoostCommand_ShortensIntervalForADay verifies /boost switches the
+// scheduler to the tariff's minimum interval and the usual interval returns
+// once the boost has expired.
+func TestBoostCommand_ShortensIntervalForADay(t *testing.T) {
+	start := time.Date(2024, 5, 10, 10, 0, 0, 0, time.Local)
+	clock := &fakeClock{now: start}
+	a, tg := newTestApp(t, &countingAI{reply: "news"})
+	a.clock = clock
+	tariff := a.cfg.Tariffs["base"]
+	tariff.Schedule.MinFrequencyMinutes = 15
+	a.cfg.Tariffs["base"] = tariff
+	a.ui().messages["boost_on"] = "every %d min until %s"
+	ctx := context.Background()
+	u := &model.UserSettings{UserID: 1, Active: true, Tariff: "base", LastScheduledSent: start.Unix(),
+		Topics: map[string][]string{"Наука": {"Факты"}}}
+	if err := a.repo.Save(ctx, u); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.handleMessage(ctx, message(1, "/boost"))
+	if texts := tg.texts(); len(texts) != 1 || !strings.HasPrefix(texts[0], "every 15 min until ") {
+		t.Fatalf("unexpected reply: %q", texts)
+	}
+	sends := func(from time.Time) int {
+		before := len(tg.texts())
+		for now := from; now.Before(from.Add(2 * time.Hour)); now = now.Add(5 * time.Minute) {
+			a.scheduleTick(ctx, now)
+		}
+		return len(tg.texts()) - before
+	}
+	if n := sends(start.Add(5 * time.Minute)); n != 8 {
+		t.Fatalf("expected a digest every 15 minutes while boosted, got %d in two hours", n)
+	}
+	if n := sends(start.Add(boostDuration + time.Hour)); n != 2 {
+		t.Fatalf("expected hourly digests after the boost expired, got %d in two hours", n)
+	}
+}
+
+// TestCompareCommand verifies the tariff table is built from the loaded
+// tariffs, ordered by tier, and follows config changes.
+func TestCompareCommand(t *testing.T) {
+	a, tg := newTestApp(t, nil)
+	ctx := context.Background()
+	a.ui().messages["compare_header"] = "compare"
+	a.cfg.Tariffs["pro"] = config.Tariff{
+		Tier:                1,
+		Schedule:            config.Schedule{FrequencyMinutes: 450, MinFrequencyMinutes: 120, TimeRange: "05:00-19:00"},
+		Limits:              config.Limits{GetNewsNowPerDay: 20, GetLast24hNewPerDay: 4, CategoryLimit: 5, InfoTypeLimit: 3, MaxCustomCategories: 2},
+		AllowCustomCategory: true,
+	}
+
+	a.handleMessage(ctx, message(1, "/compare"))
+	texts := tg.texts()
+	if len(texts) != 1 {
+		t.Fatalf("expected one message, got %q", texts)
+	}
+	want := "compare\n<pre>" +
+		"                    base        pro\n" +
+		"Категорий           2           5\n" +
+		"Типов в категории   2           3\n" +
+		"Типов всего         ∞           ∞\n" +
+		"Свои категории      нет         2\n" +
+		"Новости сейчас/день 5           20\n" +
+		"Новости 24ч/день    нет         4\n" +
+		"Рассылка раз в      1ч          7ч30м\n" +
+		"С /boost раз в      нет         2ч\n" +
+		"Часы рассылки       00:00-23:59 05:00-19:00\n" +
+		"Свой стиль          нет         нет</pre>"
+	if texts[0] != want {
+		t.Fatalf("unexpected comparison:\n%s\nwant:\n%s", texts[0], want)
+	}
+
+	base := a.cfg.Tariffs["base"]
+	base.Tier = 2
+	base.Limits.CategoryLimit = 7
+	a.cfg.Tariffs["base"] = base
+	a.handleMessage(ctx, message(1, "/compare"))
+	if got := tg.texts()[1]; !strings.Contains(got, "pro         base\n") || !strings.Contains(got, "Категорий           5           7\n") {
+		t.Fatalf("comparison must follow the config:\n%s", got)
+	}
+}
+
+// TestTrialCommand_Last24hUntilExpiry verifies a base user given a trial by
+// an admin can use /get_last_24h_news within the trial's daily limit and gets
+// the tariff notice again once the trial expired.
+func TestTrialCommand_Last24hUntilExpiry(t *testing.T) {
+	start := time.Date(2024, 5, 10, 10, 0, 0, 0, time.Local)
+	clock := &fakeClock{now: start}
+	a, tg := newTestApp(t, &countingAI{reply: "news"})
+	a.clock = clock
+	a.cfg.Admins = []string{"admin"}
+	tariff := a.cfg.Tariffs["base"]
+	tariff.Limits.TrialLast24hPerDay = 2
+	a.cfg.Tariffs["base"] = tariff
+	a.ui().messages["plus_only"] = "plus only"
+	a.ui().messages["prompt_choose_last24_cat"] = "choose %s"
+	a.ui().messages["trial_granted"] = "trial until %s"
+	a.ui().messages["limit_today"] = "used %d of %d, reset %s"
+	ctx := context.Background()
+	u := &model.UserSettings{UserID: 1, UserName: "user", Active: true, Tariff: "base",
+		Topics: map[string][]string{"Наука": {"Факты"}}}
+	if err := a.repo.Save(ctx, u); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	last := func() string {
+		texts := tg.texts()
+		return texts[len(texts)-1]
+	}
+
+	a.handleMessage(ctx, message(1, "/get_last_24h_news"))
+	if got := last(); got != "plus only" {
+		t.Fatalf("base user without a trial must be refused, got %q", got)
+	}
+
+	a.handleMessage(ctx, &telegram.Message{Chat: telegram.Chat{ID: 9, Username: "admin"}, Text: "/trial @user 3"})
+	a.generating.Wait()
+	if got := last(); got != "trial until 13.05.2024 10:00" {
+		t.Fatalf("user must be told about the trial, got %q", got)
+	}
+	a.handleMessage(ctx, message(1, "/get_last_24h_news"))
+	if got := last(); !strings.HasPrefix(got, "choose ") {
+		t.Fatalf("user on a trial must be asked for a category, got %q", got)
+	}
+	a.convs.delete(1)
+
+	stored, _ := a.repo.Get(ctx, 1)
+	stored.GetLast24hCount, stored.LastGetLast24h = 2, start.Unix()
+	if err := a.repo.Save(ctx, stored); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	a.handleMessage(ctx, message(1, "/get_last_24h_news"))
+	if got := last(); !strings.HasPrefix(got, "used 2 of 2,") {
+		t.Fatalf("the trial's daily limit must apply, got %q", got)
+	}
+
+	clock.now = start.Add(3*24*time.Hour + time.Minute)
+	a.handleMessage(ctx, message(1, "/get_last_24h_news"))
+	if got := last(); got != "plus only" {
+		t.Fatalf("expired trial must be refused, got %q", got)
+	}
+}
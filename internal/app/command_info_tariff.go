@@ -1,31 +1,450 @@
 package app
 
 import (
+	"cmp"
 	"context"
+	"fmt"
+	"html"
 	"log"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/ilinovom/summary-tasks-bot/internal/config"
+	"github.com/ilinovom/summary-tasks-bot/internal/model"
+	"github.com/ilinovom/summary-tasks-bot/internal/service"
 	"github.com/ilinovom/summary-tasks-bot/pkg/telegram"
 )
 
 // handleInfoCommand sends the list of available commands.
 func (a *App) handleInfoCommand(ctx context.Context, m *telegram.Message) {
 	log.Printf("user %d(@%s) called /info", m.Chat.ID, m.Chat.Username)
-	a.sendLongMessage(ctx, m.Chat.ID, a.messages["info"])
+	a.sendLongMessage(ctx, m.Chat.ID, a.ui().messages["info"])
 }
 
 // handleTariffsCommand prints information about available tariffs.
 func (a *App) handleTariffsCommand(ctx context.Context, m *telegram.Message) {
 	log.Printf("user %d(@%s) called /tariffs", m.Chat.ID, m.Chat.Username)
-	a.sendLongMessage(ctx, m.Chat.ID, a.messages["tariffs"])
+	a.sendLongMessage(ctx, m.Chat.ID, a.ui().messages["tariffs"])
+}
+
+// handleCompareCommand shows the limits of all tariffs side by side. The table
+// is built from the loaded tariffs, so it follows every config change.
+func (a *App) handleCompareCommand(ctx context.Context, m *telegram.Message) {
+	log.Printf("user %d(@%s) called /compare", m.Chat.ID, m.Chat.Username)
+	table := compareTariffs(a.config().Tariffs)
+	a.sendMessage(ctx, m.Chat.ID, a.ui().messages["compare_header"]+"\n<pre>"+html.EscapeString(table)+"</pre>", nil)
+}
+
+// compareTariffs renders a plain-text table with one column per tariff,
+// ordered by tier and then by name, and one row per limit or feature.
+func compareTariffs(tariffs map[string]config.Tariff) string {
+	names := tariffNames(tariffs)
+	unlimited := func(n int) string {
+		if n <= 0 {
+			return "∞"
+		}
+		return strconv.Itoa(n)
+	}
+	rows := []struct {
+		label string
+		value func(t config.Tariff) string
+	}{
+		{"Категорий", func(t config.Tariff) string { return strconv.Itoa(t.Limits.CategoryLimit) }},
+		{"Типов в категории", func(t config.Tariff) string { return strconv.Itoa(t.Limits.InfoTypeLimit) }},
+		{"Типов всего", func(t config.Tariff) string { return unlimited(t.Limits.TotalInfoTypeLimit) }},
+		{"Свои категории", func(t config.Tariff) string {
+			if !t.AllowCustomCategory {
+				return "нет"
+			}
+			return unlimited(t.Limits.MaxCustomCategories)
+		}},
+		{"Новости сейчас/день", func(t config.Tariff) string { return strconv.Itoa(t.Limits.GetNewsNowPerDay) }},
+		{"Новости 24ч/день", func(t config.Tariff) string {
+			if t.Limits.GetLast24hNewPerDay <= 0 {
+				return "нет"
+			}
+			return strconv.Itoa(t.Limits.GetLast24hNewPerDay)
+		}},
+		{"Рассылка раз в", func(t config.Tariff) string { return formatInterval(scheduleInterval(t)) }},
+		{"С /boost раз в", func(t config.Tariff) string {
+			if boostInterval(t) >= scheduleInterval(t) {
+				return "нет"
+			}
+			return formatInterval(boostInterval(t))
+		}},
+		{"Часы рассылки", func(t config.Tariff) string { return t.Schedule.TimeRange }},
+		{"Свой стиль", func(t config.Tariff) string {
+			if len(t.GPT.PromptTemplates) == 0 && len(t.GPT.StylePresets) == 0 && len(t.GPT.VolumePresets) == 0 {
+				return "нет"
+			}
+			return "да"
+		}},
+	}
+
+	cells := [][]string{append([]string{""}, names...)}
+	for _, r := range rows {
+		line := []string{r.label}
+		for _, name := range names {
+			line = append(line, r.value(tariffs[name]))
+		}
+		cells = append(cells, line)
+	}
+	widths := make([]int, len(cells[0]))
+	for _, line := range cells {
+		for i, c := range line {
+			widths[i] = max(widths[i], utf8.RuneCountInString(c))
+		}
+	}
+	var b strings.Builder
+	for _, line := range cells {
+		for i, c := range line {
+			if i > 0 {
+				b.WriteString(" ")
+			}
+			b.WriteString(c)
+			if i < len(line)-1 {
+				b.WriteString(strings.Repeat(" ", widths[i]-utf8.RuneCountInString(c)))
+			}
+		}
+		b.WriteString("\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// formatInterval renders a schedule interval as hours and minutes, e.g.
+// "14ч10м".
+func formatInterval(d time.Duration) string {
+	h, m := int(d.Hours()), int(d.Minutes())%60
+	switch {
+	case h == 0:
+		return fmt.Sprintf("%dм", m)
+	case m == 0:
+		return fmt.Sprintf("%dч", h)
+	}
+	return fmt.Sprintf("%dч%dм", h, m)
 }
 
 // handleSetTariffCommand is an admin-only command that changes another user's tariff.
 func (a *App) handleSetTariffCommand(ctx context.Context, m *telegram.Message) {
-	if m.Chat.Username != "omilinov" {
+	if !a.isAdmin(m.Chat.Username) {
 		return
 	}
-	conv := &conversationState{Stage: stageSetTariffUser}
-	a.convs[m.Chat.ID] = conv
+	conv := &conversationState{Command: "/sett", Stage: stageSetTariffUser}
+	a.convs.set(m.Chat.ID, conv)
 	msgID, _ := a.sendMessage(ctx, m.Chat.ID, "Введите username пользователя", nil)
 	conv.LastMsgID = msgID
 }
+
+// handleReloadCommand is an admin-only command that reloads options, tariffs and
+// messages from disk without restarting the bot. The bot's profile texts are
+// set again from the new messages.
+func (a *App) handleReloadCommand(ctx context.Context, m *telegram.Message) {
+	if !a.isAdmin(m.Chat.Username) {
+		return
+	}
+	log.Printf("user %d(@%s) called /reload", m.Chat.ID, m.Chat.Username)
+	if err := a.reloadConfig(); err != nil {
+		a.sendMessage(ctx, m.Chat.ID, "Конфигурация не обновлена: "+err.Error(), nil)
+		return
+	}
+	a.inBackground(func() { a.renameInfos(ctx) })
+	a.setDescription(ctx)
+	a.sendMessage(ctx, m.Chat.ID, "Конфигурация обновлена", nil)
+}
+
+// handleCategoriesStatsCommand is an admin-only command that lists the
+// categories chosen by the most users.
+func (a *App) handleCategoriesStatsCommand(ctx context.Context, m *telegram.Message) {
+	if !a.isAdmin(m.Chat.Username) {
+		return
+	}
+	log.Printf("user %d(@%s) called /categories_stats", m.Chat.ID, m.Chat.Username)
+	counts, err := a.repo.CategoryCounts(ctx, categoryStatsTop)
+	if err != nil {
+		log.Println("category counts:", err)
+		a.sendMessage(ctx, m.Chat.ID, "Ошибка: "+err.Error(), nil)
+		return
+	}
+	if len(counts) == 0 {
+		a.sendMessage(ctx, m.Chat.ID, "Категории пока никто не выбрал", nil)
+		return
+	}
+	lines := make([]string, len(counts))
+	for i, c := range counts {
+		lines[i] = fmt.Sprintf("%d. %s — %d", i+1, html.EscapeString(c.Name), c.Users)
+	}
+	a.sendMessage(ctx, m.Chat.ID, "Популярные категории:\n"+strings.Join(lines, "\n"), nil)
+}
+
+// handleTariffStatsCommand is an admin-only command that reports how many
+// users are on each tariff, in tier order, followed by tariffs that are no
+// longer configured.
+func (a *App) handleTariffStatsCommand(ctx context.Context, m *telegram.Message) {
+	if !a.isAdmin(m.Chat.Username) {
+		return
+	}
+	log.Printf("user %d(@%s) called /tariff_stats", m.Chat.ID, m.Chat.Username)
+	counts, err := a.repo.CountByTariff(ctx)
+	if err != nil {
+		log.Println("count by tariff:", err)
+		a.sendMessage(ctx, m.Chat.ID, "Ошибка: "+err.Error(), nil)
+		return
+	}
+	names := tariffNames(a.config().Tariffs)
+	var unknown []string
+	for name := range counts {
+		if !slices.Contains(names, name) {
+			unknown = append(unknown, name)
+		}
+	}
+	slices.Sort(unknown)
+	total := 0
+	lines := []string{"Пользователи по тарифам:"}
+	for _, name := range append(names, unknown...) {
+		total += counts[name]
+		lines = append(lines, fmt.Sprintf("%s — %d", html.EscapeString(name), counts[name]))
+	}
+	lines = append(lines, fmt.Sprintf("Всего: %d", total))
+	a.sendMessage(ctx, m.Chat.ID, strings.Join(lines, "\n"), nil)
+}
+
+// tariffNames returns the tariff names ordered by tier and then by name.
+func tariffNames(tariffs map[string]config.Tariff) []string {
+	names := slices.Collect(maps.Keys(tariffs))
+	slices.SortFunc(names, func(x, y string) int {
+		if c := cmp.Compare(tariffs[x].Tier, tariffs[y].Tier); c != 0 {
+			return c
+		}
+		return strings.Compare(x, y)
+	})
+	return names
+}
+
+// handleConvCommand is an admin-only command that reports the dialog a user
+// is currently in: command, stage, step and what has been selected so far.
+func (a *App) handleConvCommand(ctx context.Context, m *telegram.Message, arg string) {
+	if !a.isAdmin(m.Chat.Username) {
+		return
+	}
+	log.Printf("user %d(@%s) called /conv", m.Chat.ID, m.Chat.Username)
+	username := strings.TrimPrefix(strings.TrimSpace(arg), "@")
+	if username == "" {
+		a.sendMessage(ctx, m.Chat.ID, "Использование: /conv <username>", nil)
+		return
+	}
+	u, err := a.userService.GetByUsername(ctx, username)
+	if err != nil {
+		a.sendMessage(ctx, m.Chat.ID, "Пользователь не найден", nil)
+		return
+	}
+	// The dialog belongs to the user's chat worker: read it under that chat's
+	// lock.
+	a.onUserChat(ctx, u.UserID, func() {
+		lines, ok := a.convReport(u.UserID, u.UserName)
+		if !ok {
+			a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf("У @%s нет активного диалога", u.UserName), nil)
+			return
+		}
+		a.sendMessage(ctx, m.Chat.ID, strings.Join(lines, "\n"), nil)
+	})
+}
+
+// convReport describes the dialog of the chat for /conv, reporting false
+// when there is none. The caller holds the chat's lock.
+func (a *App) convReport(chatID int64, username string) ([]string, bool) {
+	c, ok := a.convs.get(chatID)
+	if !ok {
+		return nil, false
+	}
+	lines := []string{
+		fmt.Sprintf("Диалог @%s: %s", username, c.Command),
+		fmt.Sprintf("Этап: %s (предыдущий: %s)", stageName(c.Stage), stageName(c.PrevStage)),
+		fmt.Sprintf("Шаг: %d", c.Step),
+	}
+	if c.CurrentCat != "" {
+		lines = append(lines, "Текущая категория: "+c.CurrentCat)
+	}
+	if len(c.SelectedCats) > 0 {
+		lines = append(lines, "Выбранные категории: "+strings.Join(c.SelectedCats, ", "))
+	}
+	if len(c.PendingCats) > 0 {
+		lines = append(lines, "Ожидают типов: "+strings.Join(c.PendingCats, ", "))
+	}
+	if len(c.SelectedInfos) > 0 {
+		lines = append(lines, "Выбранные типы: "+strings.Join(c.SelectedInfos, ", "))
+	}
+	if len(c.Topics) > 0 {
+		lines = append(lines, "Темы:\n"+formatTopics(c.Topics))
+	}
+	return lines, true
+}
+
+// handleMaintenanceCommand is an admin-only command that switches maintenance
+// mode: scheduled digests pause and other users get a notice instead of
+// replies. Without an argument it reports the current mode.
+func (a *App) handleMaintenanceCommand(ctx context.Context, m *telegram.Message, arg string) {
+	if !a.isAdmin(m.Chat.Username) {
+		return
+	}
+	log.Printf("user %d(@%s) called /maintenance %s", m.Chat.ID, m.Chat.Username, arg)
+	switch strings.ToLower(arg) {
+	case "on":
+		a.maintenance.Store(true)
+	case "off":
+		a.maintenance.Store(false)
+	case "":
+	default:
+		a.sendMessage(ctx, m.Chat.ID, "Использование: /maintenance on|off", nil)
+		return
+	}
+	if a.maintenance.Load() {
+		a.sendMessage(ctx, m.Chat.ID, "Режим обслуживания включён: рассылка приостановлена", nil)
+		return
+	}
+	a.sendMessage(ctx, m.Chat.ID, "Режим обслуживания выключен", nil)
+}
+
+// pingAIPrompt is the fixed prompt sent by /ping_ai.
+const pingAIPrompt = "Ответь одним словом: pong"
+
+// pingAITimeout bounds how long /ping_ai waits for the AI service.
+const pingAITimeout = 30 * time.Second
+
+// handlePingAICommand is an admin-only command that sends a trivial prompt
+// with the base tariff's model and reports the latency or the error. No user
+// settings or quotas are touched.
+func (a *App) handlePingAICommand(ctx context.Context, m *telegram.Message) {
+	if !a.isAdmin(m.Chat.Username) {
+		return
+	}
+	log.Printf("user %d(@%s) called /ping_ai", m.Chat.ID, m.Chat.Username)
+	if a.aiClient == nil {
+		a.sendMessage(ctx, m.Chat.ID, "AI-клиент не настроен", nil)
+		return
+	}
+	model := a.tariffFor("base").GPT.Model
+	pingCtx, cancel := context.WithTimeout(ctx, pingAITimeout)
+	defer cancel()
+	start := time.Now()
+	_, err := a.aiClient.ChatCompletion(pingCtx, model, pingAIPrompt, 0, nil)
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		log.Println("ping ai:", err)
+		a.sendMessage(ctx, m.Chat.ID, html.EscapeString(fmt.Sprintf("OpenAI (%s) ошибка за %s: %v", model, elapsed, err)), nil)
+		return
+	}
+	a.sendMessage(ctx, m.Chat.ID, html.EscapeString(fmt.Sprintf("OpenAI (%s) ответил за %s", model, elapsed)), nil)
+}
+
+// handleResetQuotaCommand is an admin-only command that zeroes a user's daily
+// /get_news_now and /get_last_24h_news counters and reports the quota before
+// and after; counters left from an earlier day count as zero. The user is
+// updated under their chat lock.
+func (a *App) handleResetQuotaCommand(ctx context.Context, m *telegram.Message, arg string) {
+	if !a.isAdmin(m.Chat.Username) {
+		return
+	}
+	log.Printf("user %d(@%s) called /reset_quota %s", m.Chat.ID, m.Chat.Username, arg)
+	username := strings.TrimPrefix(strings.TrimSpace(arg), "@")
+	if username == "" {
+		a.sendMessage(ctx, m.Chat.ID, "Использование: /reset_quota <username>", nil)
+		return
+	}
+	u, err := a.userService.GetByUsername(ctx, username)
+	if err != nil {
+		a.sendMessage(ctx, m.Chat.ID, "Пользователь не найден", nil)
+		return
+	}
+	a.onUserChat(ctx, u.UserID, func() {
+		u, err := a.repo.Get(ctx, u.UserID)
+		if err != nil {
+			log.Println("get settings:", err)
+			a.sendMessage(ctx, m.Chat.ID, "Пользователь не найден", nil)
+			return
+		}
+		now := u.LocalTime(a.clock.Now())
+		newsBefore, last24hBefore := u.GetNewsNowCount, u.GetLast24hCount
+		if !service.SameDay(now, time.Unix(u.LastGetNewsNow, 0)) {
+			newsBefore = 0
+		}
+		if !service.SameDay(now, time.Unix(u.LastGetLast24h, 0)) {
+			last24hBefore = 0
+		}
+		u.GetNewsNowCount = 0
+		u.GetLast24hCount = 0
+		if err := a.repo.Save(ctx, u); err != nil {
+			log.Println("save settings:", err)
+			a.sendMessage(ctx, m.Chat.ID, "Не удалось сохранить настройки", nil)
+			return
+		}
+		limits := a.tariffFor(u.Tariff).Limits
+		a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf("Квоты @%s сброшены:\n/get_news_now: %d → 0 из %d\n/get_last_24h_news: %d → 0 из %d",
+			u.UserName, newsBefore, limits.GetNewsNowPerDay, last24hBefore, limits.GetLast24hNewPerDay), nil)
+	})
+}
+
+// defaultTrialDays is the length of a trial granted with /trial without a
+// number of days.
+const defaultTrialDays = 7
+
+// handleTrialCommand is an admin-only command that lets a user try the
+// last-24h digests for a number of days whatever the tariff. Zero days ends
+// the trial. The user is told until when the trial runs. The user is updated
+// under their chat lock.
+func (a *App) handleTrialCommand(ctx context.Context, m *telegram.Message, arg string) {
+	if !a.isAdmin(m.Chat.Username) {
+		return
+	}
+	log.Printf("user %d(@%s) called /trial %s", m.Chat.ID, m.Chat.Username, arg)
+	fields := strings.Fields(arg)
+	days := defaultTrialDays
+	if len(fields) == 2 {
+		n, err := strconv.Atoi(fields[1])
+		if err != nil || n < 0 {
+			fields = nil
+		}
+		days = n
+	}
+	if len(fields) == 0 || len(fields) > 2 {
+		a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf("Использование: /trial <username> [дней, по умолчанию %d; 0 завершает пробный период]", defaultTrialDays), nil)
+		return
+	}
+	u, err := a.userService.GetByUsername(ctx, strings.TrimPrefix(fields[0], "@"))
+	if err != nil {
+		a.sendMessage(ctx, m.Chat.ID, "Пользователь не найден", nil)
+		return
+	}
+	a.onUserChat(ctx, u.UserID, func() {
+		u, err := a.repo.Get(ctx, u.UserID)
+		if err != nil {
+			log.Println("get settings:", err)
+			a.sendMessage(ctx, m.Chat.ID, "Пользователь не найден", nil)
+			return
+		}
+		until := a.clock.Now().AddDate(0, 0, days)
+		if days == 0 {
+			delete(u.TrialFeatures, model.FeatureLast24h)
+		} else {
+			if u.TrialFeatures == nil {
+				u.TrialFeatures = map[string]int64{}
+			}
+			u.TrialFeatures[model.FeatureLast24h] = until.Unix()
+		}
+		if err := a.repo.Save(ctx, u); err != nil {
+			log.Println("save settings:", err)
+			a.sendMessage(ctx, m.Chat.ID, "Не удалось сохранить настройки", nil)
+			return
+		}
+		if days == 0 {
+			a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf("Пробный доступ @%s к /get_last_24h_news завершён", u.UserName), nil)
+			return
+		}
+		until = until.Truncate(time.Minute)
+		a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf("@%s может пользоваться /get_last_24h_news до %s", u.UserName, until.Format("02.01.2006 15:04")), nil)
+		a.sendMessage(ctx, u.UserID, fmt.Sprintf(a.ui().messages["trial_granted"], until.Format("02.01.2006 15:04")), nil)
+	})
+}
@@ -3,85 +3,745 @@ package app
 import (
 	"context"
 	"fmt"
+	"html"
 	"log"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
+	"github.com/ilinovom/summary-tasks-bot/internal/config"
+	"github.com/ilinovom/summary-tasks-bot/internal/model"
+	"github.com/ilinovom/summary-tasks-bot/internal/service"
 	"github.com/ilinovom/summary-tasks-bot/pkg/telegram"
 )
 
+// handleNextCommand tells the user when the next scheduled digest is expected.
+// Times are shown in the user's timezone, the same one the schedule uses.
+func (a *App) handleNextCommand(ctx context.Context, m *telegram.Message) {
+	log.Printf("user %d(@%s) called /next", m.Chat.ID, m.Chat.Username)
+	settings, err := a.repo.Get(ctx, m.Chat.ID)
+	if err != nil {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
+		return
+	}
+	if !settings.Active {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["next_inactive"], nil)
+		return
+	}
+	tariff := a.tariffFor(settings.Tariff)
+	now := settings.LocalTime(a.clock.Now())
+	next := nextScheduledSend(now, settings, tariff).Format("02.01.2006 15:04")
+	if !inTimeRange(now, tariff.Schedule.TimeRange) {
+		a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf(a.ui().messages["next_outside_hours"], next), nil)
+		return
+	}
+	a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf(a.ui().messages["next_send"], next), nil)
+}
+
+// boostDuration is how long a /boost keeps the shorter schedule interval.
+const boostDuration = 24 * time.Hour
+
+// handleBoostCommand switches the user to the tariff's minimum schedule
+// interval for the next day; the usual interval returns on its own once the
+// boost expires. Repeating the command restarts the day.
+func (a *App) handleBoostCommand(ctx context.Context, m *telegram.Message) {
+	log.Printf("user %d(@%s) called /boost", m.Chat.ID, m.Chat.Username)
+	settings, err := a.repo.Get(ctx, m.Chat.ID)
+	if err != nil {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
+		return
+	}
+	tariff := a.tariffFor(settings.Tariff)
+	interval := boostInterval(tariff)
+	if interval >= scheduleInterval(tariff) {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["boost_unavailable"], nil)
+		return
+	}
+	until := settings.LocalTime(a.clock.Now()).Add(boostDuration)
+	settings.BoostUntil = until.Unix()
+	if err := a.repo.Save(ctx, settings); err != nil {
+		log.Println("save settings:", err)
+		a.reportFailure(ctx, m.Chat.ID, 0)
+		return
+	}
+	a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf(a.ui().messages["boost_on"], int(interval.Minutes()), until.Format("02.01.2006 15:04")), nil)
+}
+
 // handleGetNewsNowCommand starts the flow for the /get_news_now command.
-// It asks the user to choose a category and records usage stats.
-func (a *App) handleGetNewsNowCommand(ctx context.Context, m *telegram.Message) {
+// It asks the user to choose a category and records usage stats. A known
+// category given as the argument skips the selection step.
+func (a *App) handleGetNewsNowCommand(ctx context.Context, m *telegram.Message, arg string) {
 	log.Printf("user %d(@%s) called /get_news_now", m.Chat.ID, m.Chat.Username)
 	settings, err := a.repo.Get(ctx, m.Chat.ID)
 	if err != nil {
-		a.sendMessage(ctx, m.Chat.ID, a.messages["start_first"], nil)
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
 		return
 	}
-	tariff, ok := a.cfg.Tariffs[settings.Tariff]
-	if !ok {
-		tariff = a.cfg.Tariffs["base"]
-	}
-	now := time.Now()
-	last := time.Unix(settings.LastGetNewsNow, 0)
-	if now.YearDay() != last.YearDay() || now.Year() != last.Year() {
+	tariff := a.tariffFor(settings.Tariff)
+	now := settings.LocalTime(a.clock.Now())
+	if !service.SameDay(now, time.Unix(settings.LastGetNewsNow, 0)) {
 		settings.GetNewsNowCount = 0
 	}
 	if settings.GetNewsNowCount >= tariff.Limits.GetNewsNowPerDay {
-		a.sendMessage(ctx, m.Chat.ID, a.messages["limit_today"], nil)
+		a.sendMessage(ctx, m.Chat.ID, a.limitMessage(settings.GetNewsNowCount, tariff.Limits.GetNewsNowPerDay, now), nil)
 		return
 	}
 	if len(settings.Topics) == 0 {
-		a.sendMessage(ctx, m.Chat.ID, a.messages["no_topics"], nil)
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["no_topics"], nil)
+		return
+	}
+	conv := &conversationState{Command: "/get_news_now", Stage: stageGetNewsCategory, Settings: settings}
+	if conv.AvailableCats = activeCategories(settings, now); len(conv.AvailableCats) == 0 {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["all_snoozed"], nil)
 		return
 	}
-	conv := &conversationState{Stage: stageGetNewsCategory, Settings: settings}
-	conv.AvailableCats = make([]string, 0, len(settings.Topics))
-	for cat := range settings.Topics {
-		conv.AvailableCats = append(conv.AvailableCats, cat)
+	a.convs.set(m.Chat.ID, conv)
+	if cat, ok := matchCategory(conv.AvailableCats, arg); ok {
+		a.generateNews(ctx, m.Chat.ID, conv, cat)
+		return
 	}
-	a.convs[m.Chat.ID] = conv
-	prompt := fmt.Sprintf(a.messages["prompt_choose_news_cat"], formatOptions(conv.AvailableCats))
+	prompt := fmt.Sprintf(a.ui().messages["prompt_choose_news_cat"], formatOptions(conv.AvailableCats))
+	prompt += a.quotaNote(settings.GetNewsNowCount, tariff.Limits.GetNewsNowPerDay)
 	msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addCancel(numberKeyboard(len(conv.AvailableCats))))
 	conv.LastMsgID = msgID
 }
 
 // handleGetLast24hNewsCommand handles the /get_last_24h_news command for Plus tariff users.
-func (a *App) handleGetLast24hNewsCommand(ctx context.Context, m *telegram.Message) {
-	log.Printf("user %d(@%s) called /get_last_24h_news", m.Chat.ID, m.Chat.Username)
+func (a *App) handleGetLast24hNewsCommand(ctx context.Context, m *telegram.Message, arg string) {
+	a.startLast24h(ctx, m, "/get_last_24h_news", arg)
+}
+
+// handleGetLast24hLinksCommand works like /get_last_24h_news but asks for a
+// list of headlines with source links instead of prose.
+func (a *App) handleGetLast24hLinksCommand(ctx context.Context, m *telegram.Message, arg string) {
+	a.startLast24h(ctx, m, "/get_last_24h_links", arg)
+}
+
+// startLast24h checks the last-24h quota and asks the user for a category
+// unless arg already names one. The command is kept in the conversation to
+// pick the digest format later.
+func (a *App) startLast24h(ctx context.Context, m *telegram.Message, command, arg string) {
+	log.Printf("user %d(@%s) called %s", m.Chat.ID, m.Chat.Username, command)
 	settings, err := a.repo.Get(ctx, m.Chat.ID)
 	if err != nil {
-		a.sendMessage(ctx, m.Chat.ID, a.messages["start_first"], nil)
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
 		return
 	}
-	if settings.Tariff != "plus" && settings.Tariff != "premium" && settings.Tariff != "ultimate" {
-		a.sendMessage(ctx, m.Chat.ID, a.messages["plus_only"], nil)
+	now := settings.LocalTime(a.clock.Now())
+	if !hasFeature(settings, model.FeatureLast24h, now) {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["plus_only"], nil)
 		return
 	}
-	tariff, ok := a.cfg.Tariffs[settings.Tariff]
-	if !ok {
-		tariff = a.cfg.Tariffs["base"]
-	}
-	now := time.Now()
-	last := time.Unix(settings.LastGetLast24h, 0)
-	if now.YearDay() != last.YearDay() || now.Year() != last.Year() {
+	limit := last24hLimit(settings, a.tariffFor(settings.Tariff))
+	if !service.SameDay(now, time.Unix(settings.LastGetLast24h, 0)) {
 		settings.GetLast24hCount = 0
 	}
-	if settings.GetLast24hCount >= tariff.Limits.GetLast24hNewPerDay {
-		a.sendMessage(ctx, m.Chat.ID, a.messages["limit_today"], nil)
+	if settings.GetLast24hCount >= limit {
+		a.sendMessage(ctx, m.Chat.ID, a.limitMessage(settings.GetLast24hCount, limit, now), nil)
 		return
 	}
 	if len(settings.Topics) == 0 {
-		a.sendMessage(ctx, m.Chat.ID, a.messages["no_topics"], nil)
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["no_topics"], nil)
+		return
+	}
+	conv := &conversationState{Command: command, Stage: stageGetLast24hCategory, Settings: settings}
+	if conv.AvailableCats = activeCategories(settings, now); len(conv.AvailableCats) == 0 {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["all_snoozed"], nil)
 		return
 	}
-	conv := &conversationState{Stage: stageGetLast24hCategory, Settings: settings}
-	conv.AvailableCats = make([]string, 0, len(settings.Topics))
-	for cat := range settings.Topics {
-		conv.AvailableCats = append(conv.AvailableCats, cat)
+	a.convs.set(m.Chat.ID, conv)
+	if cat, ok := matchCategory(conv.AvailableCats, arg); ok {
+		a.generateLast24h(ctx, m.Chat.ID, conv, cat)
+		return
 	}
-	a.convs[m.Chat.ID] = conv
-	prompt := fmt.Sprintf(a.messages["prompt_choose_last24_cat"], formatOptions(conv.AvailableCats))
+	prompt := fmt.Sprintf(a.ui().messages["prompt_choose_last24_cat"], formatOptions(conv.AvailableCats))
+	prompt += a.quotaNote(settings.GetLast24hCount, limit)
 	msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addCancel(numberKeyboard(len(conv.AvailableCats))))
 	conv.LastMsgID = msgID
 }
+
+// featureTariffs lists the tariffs that include a feature; users on other
+// tariffs need a running trial.
+var featureTariffs = map[string][]string{
+	model.FeatureLast24h: {"plus", "premium", "ultimate"},
+}
+
+// hasFeature reports whether u may use feature at now, through the tariff or
+// a trial granted with /trial.
+func hasFeature(u *model.UserSettings, feature string, now time.Time) bool {
+	return slices.Contains(featureTariffs[feature], u.Tariff) || u.HasTrial(feature, now.Unix())
+}
+
+// last24hLimit returns u's daily number of last-24h digests: the tariff's
+// limit, or its trial limit when only a trial grants the feature.
+func last24hLimit(u *model.UserSettings, t config.Tariff) int {
+	if slices.Contains(featureTariffs[model.FeatureLast24h], u.Tariff) {
+		return t.Limits.GetLast24hNewPerDay
+	}
+	return max(t.Limits.TrialLast24hPerDay, 1)
+}
+
+// quotaReset returns the moment the daily counters start over: the next
+// midnight in the bot's timezone.
+func quotaReset(now time.Time) time.Time {
+	y, m, d := now.Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, now.Location())
+}
+
+// limitMessage renders limit_today with the used and total requests and the
+// reset time. Templates without format verbs are sent unchanged.
+func (a *App) limitMessage(used, limit int, now time.Time) string {
+	tmpl := a.ui().messages["limit_today"]
+	if !strings.Contains(tmpl, "%") {
+		return tmpl
+	}
+	return fmt.Sprintf(tmpl, used, limit, quotaReset(now).Format("02.01.2006 15:04"))
+}
+
+// quotaNote returns the "remaining requests" line appended to the category
+// picker, or "" when quota_left is not configured.
+func (a *App) quotaNote(used, limit int) string {
+	tmpl := a.ui().messages["quota_left"]
+	if tmpl == "" {
+		return ""
+	}
+	return "\n\n" + fmt.Sprintf(tmpl, max(limit-used, 0), limit)
+}
+
+// matchCategory finds the user's category named by a command argument,
+// ignoring case.
+func matchCategory(cats []string, arg string) (string, bool) {
+	if arg == "" {
+		return "", false
+	}
+	for _, c := range cats {
+		if strings.EqualFold(c, arg) {
+			return c, true
+		}
+	}
+	return "", false
+}
+
+// generateNews re-checks the daily quota, ends the conversation and starts
+// generating news for the category in the background.
+func (a *App) generateNews(ctx context.Context, chatID int64, c *conversationState, category string) {
+	tariff := a.tariffFor(c.Settings.Tariff)
+	now := c.Settings.LocalTime(a.clock.Now())
+	if !service.SameDay(now, time.Unix(c.Settings.LastGetNewsNow, 0)) {
+		c.Settings.GetNewsNowCount = 0
+	}
+	if c.Settings.GetNewsNowCount >= tariff.Limits.GetNewsNowPerDay {
+		a.sendMessage(ctx, chatID, a.limitMessage(c.Settings.GetNewsNowCount, tariff.Limits.GetNewsNowPerDay, now), nil)
+		a.convs.delete(chatID)
+		return
+	}
+	a.convs.delete(chatID)
+	placeholderID := 0
+	if text := a.ui().messages["generating"]; text != "" {
+		placeholderID, _ = a.sendMessage(ctx, chatID, text, nil)
+	}
+	gctx, done := a.startGeneration(ctx, chatID)
+	a.generating.Add(1)
+	go func() {
+		defer a.generating.Done()
+		defer done()
+		a.deliverNews(gctx, chatID, c.Settings, category, placeholderID, now)
+	}()
+}
+
+// generateLast24h re-checks the access and the last-24h quota, ends the
+// conversation and starts the search for the category in the background.
+func (a *App) generateLast24h(ctx context.Context, chatID int64, c *conversationState, category string) {
+	now := c.Settings.LocalTime(a.clock.Now())
+	if !hasFeature(c.Settings, model.FeatureLast24h, now) {
+		a.sendMessage(ctx, chatID, a.ui().messages["plus_only"], nil)
+		a.convs.delete(chatID)
+		return
+	}
+	limit := last24hLimit(c.Settings, a.tariffFor(c.Settings.Tariff))
+	if !service.SameDay(now, time.Unix(c.Settings.LastGetLast24h, 0)) {
+		c.Settings.GetLast24hCount = 0
+	}
+	if c.Settings.GetLast24hCount >= limit {
+		a.sendMessage(ctx, chatID, a.limitMessage(c.Settings.GetLast24hCount, limit, now), nil)
+		a.convs.delete(chatID)
+		return
+	}
+
+	msgWait, _ := a.sendMessage(ctx, chatID, a.ui().messages["wait_search"], nil)
+	a.convs.delete(chatID)
+	gctx, done := a.startGeneration(ctx, chatID)
+	a.generating.Add(1)
+	go func() {
+		defer a.generating.Done()
+		defer done()
+		a.deliverLast24h(gctx, chatID, c.Settings, category, c.Command == "/get_last_24h_links", msgWait, now)
+	}()
+}
+
+// handleResendCommand re-sends the last scheduled digest from the cache
+// without calling OpenAI and without touching the on-demand quota.
+func (a *App) handleResendCommand(ctx context.Context, m *telegram.Message) {
+	log.Printf("user %d(@%s) called /resend", m.Chat.ID, m.Chat.Username)
+	text, ok := a.lastDigest(m.Chat.ID)
+	if !ok {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["resend_empty"], nil)
+		return
+	}
+	// The prefix is template HTML; only the digest is escaped, part by part,
+	// so that a split never cuts a tag or an entity in half.
+	prefix := a.ui().messages["resend_prefix"]
+	runes := []rune(text)
+	for len(runes) > 0 {
+		n := min(4096/2, len(runes))
+		if _, err := a.sendMessageMode(ctx, m.Chat.ID, prefix+markdownToHTML(string(runes[:n])), nil, telegram.ParseModeHTML); err != nil {
+			log.Println("send msg err: ", err)
+			return
+		}
+		prefix = ""
+		runes = runes[n:]
+	}
+}
+
+// handleReadingListCommand sends the links of the user's latest last-24h
+// digest as a Markdown file named after its date and category.
+func (a *App) handleReadingListCommand(ctx context.Context, m *telegram.Message) {
+	log.Printf("user %d(@%s) called /reading_list", m.Chat.ID, m.Chat.Username)
+	d, ok := a.lastLast24h(m.Chat.ID)
+	if !ok {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["reading_list_empty"], nil)
+		return
+	}
+	links := extractLinks(d.Text)
+	if len(links) == 0 {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["reading_list_no_links"], nil)
+		return
+	}
+	name, data := readingListFile(d, links)
+	caption := fmt.Sprintf(a.ui().messages["reading_list_caption"], d.Category, d.At.Format("02.01.2006"))
+	if err := a.sendDocument(ctx, m.Chat.ID, name, data, caption); err != nil {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["reading_list_failed"], nil)
+	}
+}
+
+// readingLink is a single entry of a reading list.
+type readingLink struct {
+	Title string
+	URL   string
+}
+
+var (
+	// reAnchor matches the links of a digest rendered as Telegram HTML.
+	reAnchor = regexp.MustCompile(`(?is)<a\s+href="([^"]*)"[^>]*>(.*?)</a>`)
+	// reHTMLTag matches any tag nested in the link text.
+	reHTMLTag = regexp.MustCompile(`<[^>]*>`)
+)
+
+// extractLinks returns the links of an HTML digest in order of appearance,
+// skipping repeated URLs. Links without text are titled with their URL.
+func extractLinks(text string) []readingLink {
+	var links []readingLink
+	seen := map[string]bool{}
+	for _, m := range reAnchor.FindAllStringSubmatch(text, -1) {
+		url := strings.TrimSpace(html.UnescapeString(m[1]))
+		if url == "" || seen[url] {
+			continue
+		}
+		seen[url] = true
+		title := strings.Join(strings.Fields(html.UnescapeString(reHTMLTag.ReplaceAllString(m[2], ""))), " ")
+		if title == "" {
+			title = url
+		}
+		links = append(links, readingLink{Title: title, URL: url})
+	}
+	return links
+}
+
+// readingListFile renders the links as a Markdown list and names the file
+// after the digest date and category.
+func readingListFile(d last24hDigest, links []readingLink) (string, []byte) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s — %s\n\n", d.Category, d.At.Format("02.01.2006"))
+	for _, l := range links {
+		title := strings.NewReplacer("[", "\\[", "]", "\\]").Replace(l.Title)
+		fmt.Fprintf(&b, "- [%s](%s)\n", title, l.URL)
+	}
+	slug := strings.Trim(strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return '-'
+	}, d.Category), "-")
+	name := "reading-list-" + d.At.Format("2006-01-02")
+	if slug != "" {
+		name += "-" + slug
+	}
+	return name + ".md", []byte(b.String())
+}
+
+// handleSearchCommand generates news for a free-text topic that is not saved
+// among the user's categories, e.g. "/search квантовые компьютеры". It uses
+// the /get_news_now daily quota.
+func (a *App) handleSearchCommand(ctx context.Context, m *telegram.Message, arg string) {
+	log.Printf("user %d(@%s) called /search", m.Chat.ID, m.Chat.Username)
+	settings, err := a.repo.Get(ctx, m.Chat.ID)
+	if err != nil {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
+		return
+	}
+	topic := service.SanitizeTopic(arg)
+	if topic == "" {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["search_usage"], nil)
+		return
+	}
+	tariff := a.tariffFor(settings.Tariff)
+	now := settings.LocalTime(a.clock.Now())
+	if !service.SameDay(now, time.Unix(settings.LastGetNewsNow, 0)) {
+		settings.GetNewsNowCount = 0
+	}
+	if settings.GetNewsNowCount >= tariff.Limits.GetNewsNowPerDay {
+		a.sendMessage(ctx, m.Chat.ID, a.limitMessage(settings.GetNewsNowCount, tariff.Limits.GetNewsNowPerDay, now), nil)
+		return
+	}
+	placeholderID := 0
+	if text := a.ui().messages["generating"]; text != "" {
+		placeholderID, _ = a.sendMessage(ctx, m.Chat.ID, text, nil)
+	}
+	gctx, done := a.startGeneration(ctx, m.Chat.ID)
+	a.generating.Add(1)
+	go func() {
+		defer a.generating.Done()
+		defer done()
+		a.deliverSearch(gctx, m.Chat.ID, settings, topic, placeholderID, now)
+	}()
+}
+
+// deliverSearch generates news for the ad-hoc topic and sends it, counting
+// the request against the daily quota only once it was delivered.
+func (a *App) deliverSearch(ctx context.Context, chatID int64, settings *model.UserSettings, topic string, placeholderID int, now time.Time) {
+	msg, err := a.userService.SearchTopic(ctx, settings, topic)
+	if ctx.Err() != nil {
+		log.Printf("user %d: search cancelled", chatID)
+		a.removePlaceholder(context.WithoutCancel(ctx), chatID, placeholderID)
+		return
+	}
+	if err != nil {
+		log.Println("search:", err)
+		a.reportFailure(ctx, chatID, placeholderID)
+		return
+	}
+	if err := a.replaceMessage(ctx, chatID, placeholderID, msg, telegram.ParseModeMarkdownV2); err != nil {
+		log.Println("send msg err: ", err)
+		return
+	}
+	a.updateSettings(ctx, chatID, func(u *model.UserSettings) {
+		chargeNewsNow(u, now)
+	})
+}
+
+// updateSettings applies change to a fresh copy of the user's settings under
+// the chat's lock and saves it. Generations run outside the chat's lock, so
+// the settings they started with may be stale by the time they are done.
+func (a *App) updateSettings(ctx context.Context, chatID int64, change func(u *model.UserSettings)) {
+	ctx = context.WithoutCancel(ctx)
+	unlock, err := a.chats.lock(ctx, chatID)
+	if err != nil {
+		log.Println("save settings:", err)
+		return
+	}
+	defer unlock()
+	u, err := a.repo.Get(ctx, chatID)
+	if err != nil {
+		log.Println("save settings:", err)
+		return
+	}
+	change(u)
+	if err := a.repo.Save(ctx, u); err != nil {
+		log.Println("save settings:", err)
+	}
+}
+
+// chargeNewsNow counts an on-demand digest against the user's daily quota,
+// starting the count over on a new day.
+func chargeNewsNow(u *model.UserSettings, now time.Time) {
+	now = u.LocalTime(now)
+	if !service.SameDay(now, time.Unix(u.LastGetNewsNow, 0)) {
+		u.GetNewsNowCount = 0
+	}
+	u.GetNewsNowCount++
+	u.LastGetNewsNow = now.Unix()
+}
+
+// chargeLast24h counts a last-24h digest against the user's daily quota,
+// starting the count over on a new day.
+func chargeLast24h(u *model.UserSettings, now time.Time) {
+	now = u.LocalTime(now)
+	if !service.SameDay(now, time.Unix(u.LastGetLast24h, 0)) {
+		u.GetLast24hCount = 0
+	}
+	u.GetLast24hCount++
+	u.LastGetLast24h = now.Unix()
+}
+
+// startGeneration returns a context for a new on-demand generation in the chat,
+// cancelling the one still in flight. The returned function releases it.
+func (a *App) startGeneration(ctx context.Context, chatID int64) (context.Context, func()) {
+	a.genMu.Lock()
+	defer a.genMu.Unlock()
+	if g, ok := a.generations[chatID]; ok {
+		g.cancel()
+	}
+	gctx, cancel := context.WithCancel(ctx)
+	a.genSeq++
+	id := a.genSeq
+	a.generations[chatID] = generation{id: id, cancel: cancel}
+	return gctx, func() {
+		a.genMu.Lock()
+		if g, ok := a.generations[chatID]; ok && g.id == id {
+			delete(a.generations, chatID)
+		}
+		a.genMu.Unlock()
+		cancel()
+	}
+}
+
+// cancelGeneration aborts the in-flight generation for the chat, if any.
+func (a *App) cancelGeneration(chatID int64) {
+	a.genMu.Lock()
+	defer a.genMu.Unlock()
+	if g, ok := a.generations[chatID]; ok {
+		g.cancel()
+		delete(a.generations, chatID)
+	}
+}
+
+// deliverNews generates news for the category and sends it with the buttons
+// that regenerate a single info type. The daily counter is only advanced once
+// the digest was delivered, so a cancelled generation or a failed send costs
+// nothing.
+func (a *App) deliverNews(ctx context.Context, chatID int64, settings *model.UserSettings, category string, placeholderID int, now time.Time) {
+	d, err := a.userService.GetNewsForCategoryDigest(ctx, settings, category)
+	if ctx.Err() != nil {
+		log.Printf("user %d: news generation cancelled", chatID)
+		a.removePlaceholder(context.WithoutCancel(ctx), chatID, placeholderID)
+		return
+	}
+	if err != nil {
+		log.Println("get news:", err)
+		a.reportNoNews(ctx, chatID, placeholderID, now)
+		return
+	}
+	msgs := d.Messages(settings)
+	if err := a.sendNewsDigest(ctx, chatID, placeholderID, d, msgs); err != nil {
+		log.Println("send msg err: ", err)
+		return
+	}
+	a.updateSettings(ctx, chatID, func(u *model.UserSettings) {
+		chargeNewsNow(u, now)
+		recordHistory(u, category, d.Infos, msgs[0], now)
+	})
+}
+
+// reportNoNews tells the user no news could be generated for the category
+// and suggests another one. The request only uses up a unit of the daily
+// quota when CHARGE_FAILED_NEWS is set.
+func (a *App) reportNoNews(ctx context.Context, chatID int64, placeholderID int, now time.Time) {
+	if a.config().ChargeFailedNews {
+		a.updateSettings(ctx, chatID, func(u *model.UserSettings) {
+			chargeNewsNow(u, now)
+		})
+	}
+	text := a.ui().messages["no_news"]
+	if text == "" {
+		text = a.ui().messages["operation_failed"]
+	}
+	if err := a.replaceMessage(ctx, chatID, placeholderID, text, telegram.ParseModeHTML); err != nil {
+		log.Println("send msg err: ", err)
+	}
+}
+
+// removePlaceholder deletes the "generating" notice if one was sent.
+func (a *App) removePlaceholder(ctx context.Context, chatID int64, placeholderID int) {
+	if placeholderID != 0 {
+		a.deleteMessage(ctx, chatID, placeholderID)
+	}
+}
+
+// deliverLast24h generates the last-24h digest for the category and edits the
+// wait notice into the result unless the generation was cancelled. The daily
+// counter is only advanced once the result was delivered.
+func (a *App) deliverLast24h(ctx context.Context, chatID int64, settings *model.UserSettings, category string, sourcesOnly bool, waitMsgID int, now time.Time) {
+	get := a.userService.GetLast24hNewsForCategory
+	if sourcesOnly {
+		get = a.userService.GetLast24hSourcesForCategory
+	}
+	msg, err := get(ctx, settings, category)
+	if ctx.Err() != nil {
+		log.Printf("user %d: last 24h generation cancelled", chatID)
+		a.removePlaceholder(context.WithoutCancel(ctx), chatID, waitMsgID)
+		return
+	}
+	if err != nil {
+		log.Println("get news:", err)
+		a.reportFailure(ctx, chatID, waitMsgID)
+		return
+	}
+
+	if err := a.replaceMessage(ctx, chatID, waitMsgID, msg, telegram.ParseModeHTML); err != nil {
+		log.Println("send msg err: ", err)
+		return
+	}
+	a.updateSettings(ctx, chatID, func(u *model.UserSettings) {
+		chargeLast24h(u, now)
+		recordHistory(u, category, nil, msg, now)
+	})
+	a.rememberLast24h(chatID, last24hDigest{Category: category, Text: msg, At: now})
+}
+
+// historyPageSize is how many digests a /history page lists.
+const historyPageSize = 5
+
+// historySummaryChars caps the summary line stored for a digest.
+const historySummaryChars = 100
+
+// handleHistoryCommand lists the latest delivered digests, newest first. The
+// optional argument selects the page.
+func (a *App) handleHistoryCommand(ctx context.Context, m *telegram.Message, arg string) {
+	log.Printf("user %d(@%s) called /history", m.Chat.ID, m.Chat.Username)
+	settings, err := a.repo.Get(ctx, m.Chat.ID)
+	if err != nil {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
+		return
+	}
+	if len(settings.History) == 0 {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["history_empty"], nil)
+		return
+	}
+	pages := (len(settings.History) + historyPageSize - 1) / historyPageSize
+	page, err := strconv.Atoi(strings.TrimSpace(arg))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	page = min(page, pages)
+	loc := settings.LocalTime(a.clock.Now()).Location()
+	var lines []string
+	for i := (page - 1) * historyPageSize; i < min(page*historyPageSize, len(settings.History)); i++ {
+		e := settings.History[len(settings.History)-1-i]
+		at := time.Unix(e.At, 0).In(loc).Format("02.01.2006 15:04")
+		lines = append(lines, fmt.Sprintf("%s — <b>%s</b>\n%s", at, html.EscapeString(e.Category), html.EscapeString(e.Summary)))
+	}
+	text := fmt.Sprintf(a.ui().messages["history_page"], page, pages, strings.Join(lines, "\n\n"))
+	if page < pages {
+		text += fmt.Sprintf(a.ui().messages["history_more"], page+1)
+	}
+	a.sendMessage(ctx, m.Chat.ID, text, nil)
+}
+
+// handleRateCommand asks the user for a 👍 or 👎 on the latest delivered
+// digest. The answer is counted for every info type the digest was generated
+// for, so that scheduling can later favour the info types the user likes. A
+// digest is rated only once.
+func (a *App) handleRateCommand(ctx context.Context, m *telegram.Message) {
+	log.Printf("user %d(@%s) called /rate", m.Chat.ID, m.Chat.Username)
+	settings, err := a.repo.Get(ctx, m.Chat.ID)
+	if err != nil {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
+		return
+	}
+	if len(settings.History) == 0 || len(settings.History[len(settings.History)-1].Infos) == 0 {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["rate_nothing"], nil)
+		return
+	}
+	last := settings.History[len(settings.History)-1]
+	if last.Rated {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["rate_done"], nil)
+		return
+	}
+	conv := &conversationState{Command: "/rate", Stage: stageRate, Settings: settings}
+	conv.CurrentCat = last.Category
+	a.convs.set(m.Chat.ID, conv)
+	a.askRate(ctx, m.Chat.ID, conv)
+}
+
+// askRate shows the 👍 and 👎 buttons for the category of the latest digest.
+func (a *App) askRate(ctx context.Context, chatID int64, c *conversationState) {
+	prompt := fmt.Sprintf(a.ui().messages["rate_prompt"], html.EscapeString(c.CurrentCat))
+	msgID, _ := a.sendMessage(ctx, chatID, prompt, addCancel([][]string{{rateUp, rateDown}}))
+	c.LastMsgID = msgID
+}
+
+// saveRating counts the answer to /rate for the info types of the rated
+// digest, marks it rated and stores it. The settings are read again, so that
+// a digest delivered while the user was answering is kept.
+func (a *App) saveRating(ctx context.Context, chatID int64, c *conversationState, liked bool) {
+	u, err := a.repo.Get(ctx, chatID)
+	if err != nil {
+		log.Println("get settings:", err)
+		a.reportFailure(ctx, chatID, 0)
+		return
+	}
+	rated := c.Settings.History[len(c.Settings.History)-1]
+	i := slices.IndexFunc(u.History, func(e model.HistoryEntry) bool {
+		return e.At == rated.At && e.Category == rated.Category
+	})
+	if i < 0 {
+		a.sendMessage(ctx, chatID, a.ui().messages["rate_nothing"], nil)
+		return
+	}
+	if u.History[i].Rated {
+		a.sendMessage(ctx, chatID, a.ui().messages["rate_done"], nil)
+		return
+	}
+	u.RateInfos(u.History[i].Infos, liked)
+	u.History[i].Rated = true
+	if err := a.repo.Save(ctx, u); err != nil {
+		log.Println("save settings:", err)
+		a.reportFailure(ctx, chatID, 0)
+		return
+	}
+	a.sendMessage(ctx, chatID, a.ui().messages["rate_saved"], nil)
+}
+
+// recordHistory adds a delivered digest of the given info types to the
+// user's history; the caller persists the settings.
+func recordHistory(u *model.UserSettings, category string, infos []string, text string, at time.Time) {
+	u.AddHistory(model.HistoryEntry{Category: category, At: at.Unix(), Summary: digestSummary(text), Infos: slices.Clone(infos)})
+}
+
+// digestMessages returns the messages of the digests of a scheduled send, in
+// order.
+func digestMessages(u *model.UserSettings, ds []*service.InfoDigest) []string {
+	var msgs []string
+	for _, d := range ds {
+		msgs = append(msgs, d.Messages(u)...)
+	}
+	return msgs
+}
+
+// recordDigests adds every category of a scheduled send to the user's
+// history; the caller persists the settings.
+func recordDigests(u *model.UserSettings, ds []*service.InfoDigest, at time.Time) {
+	for _, d := range ds {
+		recordHistory(u, d.Category, d.Infos, d.Messages(u)[0], at)
+	}
+}
+
+// digestSummary returns the first line of the digest content, skipping the
+// category and info type headers and any markup.
+func digestSummary(text string) string {
+	for _, line := range strings.Split(text, "\n") {
+		line = html.UnescapeString(reHTMLTag.ReplaceAllString(line, ""))
+		line = strings.TrimSpace(strings.ReplaceAll(line, "**", ""))
+		if line == "" || strings.HasPrefix(line, "Категория:") || strings.HasPrefix(line, "Тип:") {
+			continue
+		}
+		if r := []rune(line); len(r) > historySummaryChars {
+			line = string(r[:historySummaryChars]) + "…"
+		}
+		return line
+	}
+	return ""
+}
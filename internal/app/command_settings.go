@@ -0,0 +1,562 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ilinovom/summary-tasks-bot/internal/config"
+	"github.com/ilinovom/summary-tasks-bot/internal/model"
+	"github.com/ilinovom/summary-tasks-bot/internal/service"
+	"github.com/ilinovom/summary-tasks-bot/pkg/telegram"
+)
+
+// handleSafeModeCommand toggles the stricter content filter for the user.
+func (a *App) handleSafeModeCommand(ctx context.Context, m *telegram.Message) {
+	log.Printf("user %d(@%s) called /safe_mode", m.Chat.ID, m.Chat.Username)
+	settings, err := a.repo.Get(ctx, m.Chat.ID)
+	if err != nil {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
+		return
+	}
+	settings.SafeMode = !settings.SafeMode
+	if err := a.repo.Save(ctx, settings); err != nil {
+		log.Println("save settings:", err)
+		a.reportFailure(ctx, m.Chat.ID, 0)
+		return
+	}
+	if settings.SafeMode {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["safe_mode_on"], nil)
+		return
+	}
+	a.sendMessage(ctx, m.Chat.ID, a.ui().messages["safe_mode_off"], nil)
+}
+
+// handleSeparateMessagesCommand toggles whether each info type of a digest is
+// sent as its own message.
+func (a *App) handleSeparateMessagesCommand(ctx context.Context, m *telegram.Message) {
+	log.Printf("user %d(@%s) called /separate_messages", m.Chat.ID, m.Chat.Username)
+	settings, err := a.repo.Get(ctx, m.Chat.ID)
+	if err != nil {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
+		return
+	}
+	settings.SeparateMessages = !settings.SeparateMessages
+	if err := a.repo.Save(ctx, settings); err != nil {
+		log.Println("save settings:", err)
+		a.reportFailure(ctx, m.Chat.ID, 0)
+		return
+	}
+	if settings.SeparateMessages {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["separate_messages_on"], nil)
+		return
+	}
+	a.sendMessage(ctx, m.Chat.ID, a.ui().messages["separate_messages_off"], nil)
+}
+
+// handleShortCommand toggles short scheduled digests that only cover the
+// first info type of each category.
+func (a *App) handleShortCommand(ctx context.Context, m *telegram.Message) {
+	log.Printf("user %d(@%s) called /short", m.Chat.ID, m.Chat.Username)
+	settings, err := a.repo.Get(ctx, m.Chat.ID)
+	if err != nil {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
+		return
+	}
+	settings.ShortDigest = !settings.ShortDigest
+	if err := a.repo.Save(ctx, settings); err != nil {
+		log.Println("save settings:", err)
+		a.reportFailure(ctx, m.Chat.ID, 0)
+		return
+	}
+	if settings.ShortDigest {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["short_on"], nil)
+		return
+	}
+	a.sendMessage(ctx, m.Chat.ID, a.ui().messages["short_off"], nil)
+}
+
+// handleLabelsCommand toggles the "Категория:" and "Тип:" lines at the top of
+// digests.
+func (a *App) handleLabelsCommand(ctx context.Context, m *telegram.Message) {
+	log.Printf("user %d(@%s) called /labels", m.Chat.ID, m.Chat.Username)
+	settings, err := a.repo.Get(ctx, m.Chat.ID)
+	if err != nil {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
+		return
+	}
+	settings.HideLabels = !settings.HideLabels
+	if err := a.repo.Save(ctx, settings); err != nil {
+		log.Println("save settings:", err)
+		a.reportFailure(ctx, m.Chat.ID, 0)
+		return
+	}
+	if settings.ShowLabels() {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["labels_on"], nil)
+		return
+	}
+	a.sendMessage(ctx, m.Chat.ID, a.ui().messages["labels_off"], nil)
+}
+
+// handleShuffleCommand toggles listing the info types of a digest in a random
+// order on every send.
+func (a *App) handleShuffleCommand(ctx context.Context, m *telegram.Message) {
+	log.Printf("user %d(@%s) called /shuffle", m.Chat.ID, m.Chat.Username)
+	settings, err := a.repo.Get(ctx, m.Chat.ID)
+	if err != nil {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
+		return
+	}
+	settings.ShuffleInfos = !settings.ShuffleInfos
+	if err := a.repo.Save(ctx, settings); err != nil {
+		log.Println("save settings:", err)
+		a.reportFailure(ctx, m.Chat.ID, 0)
+		return
+	}
+	if settings.ShuffleInfos {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["shuffle_on"], nil)
+		return
+	}
+	a.sendMessage(ctx, m.Chat.ID, a.ui().messages["shuffle_off"], nil)
+}
+
+// handleStyleCommand lets the user pick the prompt template, tone and volume
+// of the digests among those offered by their tariff.
+func (a *App) handleStyleCommand(ctx context.Context, m *telegram.Message) {
+	log.Printf("user %d(@%s) called /style", m.Chat.ID, m.Chat.Username)
+	settings, err := a.repo.Get(ctx, m.Chat.ID)
+	if err != nil {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
+		return
+	}
+	t := a.tariffFor(settings.Tariff)
+	if len(t.GPT.PromptTemplates) == 0 && len(t.GPT.StylePresets) == 0 && len(t.GPT.VolumePresets) == 0 {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["style_unavailable"], nil)
+		return
+	}
+	conv := &conversationState{Command: "/style", Settings: settings}
+	a.convs.set(m.Chat.ID, conv)
+	a.askNextStyle(ctx, m.Chat.ID, conv, stageStyleTemplate)
+}
+
+// askNextStyle asks for the first of the template, tone and volume, starting
+// at stage, that the tariff lets the user choose, and saves the style once
+// nothing is left to ask.
+func (a *App) askNextStyle(ctx context.Context, chatID int64, c *conversationState, stage convStage) {
+	t := a.tariffFor(c.Settings.Tariff)
+	current := service.UserStyle(c.Settings, t)
+	switch {
+	case stage == stageStyleTemplate && len(t.GPT.PromptTemplates) > 0:
+		c.setStage(stageStyleTemplate)
+		a.askStyle(ctx, chatID, c, a.ui().messages["style_choose_template"], templateLabel(c.Settings, t), templateNames(t))
+	case stage != stageStyleVolume && len(t.GPT.StylePresets) > 0:
+		c.setStage(stageStyleTone)
+		a.askStyle(ctx, chatID, c, a.ui().messages["style_choose_tone"], current.GPT.Style, t.GPT.StylePresets)
+	case len(t.GPT.VolumePresets) > 0:
+		c.setStage(stageStyleVolume)
+		a.askStyle(ctx, chatID, c, a.ui().messages["style_choose_volume"], current.GPT.Volume, t.GPT.VolumePresets)
+	default:
+		a.saveStyle(ctx, chatID, c)
+	}
+}
+
+// templateNames returns the names of the tariff's prompt templates in
+// alphabetical order.
+func templateNames(t config.Tariff) []string {
+	names := make([]string, 0, len(t.GPT.PromptTemplates))
+	for name := range t.GPT.PromptTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// templateLabel returns the user's prompt template, or styleDefault when the
+// tariff's own prompt is used.
+func templateLabel(u *model.UserSettings, t config.Tariff) string {
+	if _, ok := t.GPT.PromptTemplates[u.PromptTemplate]; ok && u.PromptTemplate != "" {
+		return u.PromptTemplate
+	}
+	return styleDefault
+}
+
+// handleCategoryToneCommand lets the user pick a tone for one category that
+// overrides the general one. A known category given as the argument skips the
+// selection step.
+func (a *App) handleCategoryToneCommand(ctx context.Context, m *telegram.Message, arg string) {
+	log.Printf("user %d(@%s) called /category_tone", m.Chat.ID, m.Chat.Username)
+	settings, err := a.repo.Get(ctx, m.Chat.ID)
+	if err != nil {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
+		return
+	}
+	if len(a.tariffFor(settings.Tariff).GPT.StylePresets) == 0 {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["style_unavailable"], nil)
+		return
+	}
+	if len(settings.Topics) == 0 {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["no_topics"], nil)
+		return
+	}
+	conv := &conversationState{Command: "/category_tone", Stage: stageToneCategory, Settings: settings}
+	conv.AvailableCats = sortedCategories(settings.Topics)
+	a.convs.set(m.Chat.ID, conv)
+	if cat, ok := matchCategory(conv.AvailableCats, arg); ok {
+		conv.Stage = stageCategoryTone
+		a.askCategoryTone(ctx, m.Chat.ID, conv, cat)
+		return
+	}
+	prompt := fmt.Sprintf(a.ui().messages["category_tone_choose_category"], formatOptions(conv.AvailableCats))
+	msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addCancel(numberKeyboard(len(conv.AvailableCats))))
+	conv.LastMsgID = msgID
+}
+
+// askCategoryTone offers the tariff's tone presets for the category.
+func (a *App) askCategoryTone(ctx context.Context, chatID int64, c *conversationState, cat string) {
+	c.CurrentCat = cat
+	t := a.tariffFor(c.Settings.Tariff)
+	current := service.CategoryStyle(c.Settings, t, cat).GPT.Style
+	// The prompt is formatted once more by askStyle with the current tone.
+	name := strings.ReplaceAll(html.EscapeString(cat), "%", "%%")
+	a.askStyle(ctx, chatID, c, fmt.Sprintf(a.ui().messages["category_tone_choose"], name, "%s"), current, t.GPT.StylePresets)
+}
+
+// saveCategoryTone stores the tone of the current category, or drops it when
+// the choice is empty so the general tone applies again, and ends the dialog.
+func (a *App) saveCategoryTone(ctx context.Context, chatID int64, c *conversationState, tone string) {
+	a.convs.delete(chatID)
+	u := c.Settings
+	if tone == "" {
+		delete(u.CategoryTones, c.CurrentCat)
+	} else {
+		if u.CategoryTones == nil {
+			u.CategoryTones = map[string]string{}
+		}
+		u.CategoryTones[c.CurrentCat] = tone
+	}
+	if err := a.repo.Save(ctx, u); err != nil {
+		log.Println("save settings:", err)
+		a.reportFailure(ctx, chatID, 0)
+		return
+	}
+	style := service.CategoryStyle(u, a.tariffFor(u.Tariff), c.CurrentCat).GPT.Style
+	a.sendMessage(ctx, chatID, fmt.Sprintf(a.ui().messages["category_tone_saved"], html.EscapeString(c.CurrentCat), style), nil)
+}
+
+// askStyle shows the presets one per row together with the reset button.
+func (a *App) askStyle(ctx context.Context, chatID int64, c *conversationState, prompt, current string, presets []string) {
+	kb := make([][]string, 0, len(presets)+1)
+	for _, p := range presets {
+		kb = append(kb, []string{p})
+	}
+	kb = append(kb, []string{styleDefault})
+	msgID, _ := a.sendMessage(ctx, chatID, fmt.Sprintf(prompt, current), addCancel(kb))
+	c.LastMsgID = msgID
+}
+
+// pickPreset validates the chosen preset. styleDefault yields an empty value
+// so the tariff default applies again.
+func pickPreset(text string, presets []string) (string, bool) {
+	choice := strings.TrimSpace(text)
+	if choice == styleDefault {
+		return "", true
+	}
+	return choice, slices.Contains(presets, choice)
+}
+
+// saveStyle persists the chosen tone and volume and ends the dialog.
+func (a *App) saveStyle(ctx context.Context, chatID int64, c *conversationState) {
+	a.convs.delete(chatID)
+	if err := a.repo.Save(ctx, c.Settings); err != nil {
+		log.Println("save settings:", err)
+		a.reportFailure(ctx, chatID, 0)
+		return
+	}
+	style := service.UserStyle(c.Settings, a.tariffFor(c.Settings.Tariff))
+	a.sendMessage(ctx, chatID, fmt.Sprintf(a.ui().messages["style_saved"], style.GPT.Style, style.GPT.Volume), nil)
+}
+
+// handleFormatCommand lets the user choose between prose and bullet-point
+// digests. A format given as the argument is saved right away.
+func (a *App) handleFormatCommand(ctx context.Context, m *telegram.Message, arg string) {
+	log.Printf("user %d(@%s) called /format", m.Chat.ID, m.Chat.Username)
+	settings, err := a.repo.Get(ctx, m.Chat.ID)
+	if err != nil {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
+		return
+	}
+	if format, ok := pickFormat(arg); ok && arg != "" {
+		a.saveFormat(ctx, m.Chat.ID, settings, format)
+		return
+	}
+	conv := &conversationState{Command: "/format", Stage: stageFormat, Settings: settings}
+	a.convs.set(m.Chat.ID, conv)
+	a.askFormat(ctx, m.Chat.ID, conv)
+}
+
+// askFormat shows the formats one per row together with the reset button.
+func (a *App) askFormat(ctx context.Context, chatID int64, c *conversationState) {
+	kb := make([][]string, 0, len(digestFormats)+1)
+	for _, f := range digestFormats {
+		kb = append(kb, []string{f.Label})
+	}
+	kb = append(kb, []string{styleDefault})
+	msgID, _ := a.sendMessage(ctx, chatID, fmt.Sprintf(a.ui().messages["format_choose"], formatLabel(c.Settings.Format)), addCancel(kb))
+	c.LastMsgID = msgID
+}
+
+// pickFormat maps a button label or format name to the stored value.
+// styleDefault yields an empty value so the prompt decides the shape again.
+func pickFormat(text string) (string, bool) {
+	choice := strings.TrimSpace(text)
+	if choice == styleDefault {
+		return "", true
+	}
+	for _, f := range digestFormats {
+		if strings.EqualFold(choice, f.Label) || strings.EqualFold(choice, f.Value) {
+			return f.Value, true
+		}
+	}
+	return "", false
+}
+
+// formatLabel returns the button label of a stored format.
+func formatLabel(format string) string {
+	for _, f := range digestFormats {
+		if f.Value == format {
+			return f.Label
+		}
+	}
+	return styleDefault
+}
+
+// saveFormat persists the chosen digest format.
+func (a *App) saveFormat(ctx context.Context, chatID int64, settings *model.UserSettings, format string) {
+	settings.Format = format
+	if err := a.repo.Save(ctx, settings); err != nil {
+		log.Println("save settings:", err)
+		a.reportFailure(ctx, chatID, 0)
+		return
+	}
+	a.sendMessage(ctx, chatID, fmt.Sprintf(a.ui().messages["format_saved"], formatLabel(format)), nil)
+}
+
+// handleLengthCommand lets the user choose shorter or longer digests. A
+// length given as the argument is saved right away.
+func (a *App) handleLengthCommand(ctx context.Context, m *telegram.Message, arg string) {
+	log.Printf("user %d(@%s) called /length", m.Chat.ID, m.Chat.Username)
+	settings, err := a.repo.Get(ctx, m.Chat.ID)
+	if err != nil {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
+		return
+	}
+	if tokens, ok := pickLength(arg); ok && arg != "" {
+		a.saveLength(ctx, m.Chat.ID, settings, tokens)
+		return
+	}
+	conv := &conversationState{Command: "/length", Stage: stageLength, Settings: settings}
+	a.convs.set(m.Chat.ID, conv)
+	a.askLength(ctx, m.Chat.ID, conv)
+}
+
+// askLength shows the lengths one per row together with the reset button.
+func (a *App) askLength(ctx context.Context, chatID int64, c *conversationState) {
+	kb := make([][]string, 0, len(digestLengths)+1)
+	for _, l := range digestLengths {
+		kb = append(kb, []string{l.Label})
+	}
+	kb = append(kb, []string{styleDefault})
+	msgID, _ := a.sendMessage(ctx, chatID, fmt.Sprintf(a.ui().messages["length_choose"], lengthLabel(c.Settings.MaxTokens)), addCancel(kb))
+	c.LastMsgID = msgID
+}
+
+// pickLength maps a button label or length name to its token limit.
+// styleDefault yields zero so the tariff limit applies again.
+func pickLength(text string) (int, bool) {
+	choice := strings.TrimSpace(text)
+	if choice == styleDefault {
+		return 0, true
+	}
+	for _, l := range digestLengths {
+		if strings.EqualFold(choice, l.Label) || strings.EqualFold(choice, l.Value) {
+			return l.Tokens, true
+		}
+	}
+	return 0, false
+}
+
+// lengthLabel returns the button label of a stored token limit.
+func lengthLabel(tokens int) string {
+	for _, l := range digestLengths {
+		if l.Tokens == tokens {
+			return l.Label
+		}
+	}
+	return styleDefault
+}
+
+// saveLength persists the chosen token limit and reports the limit that
+// applies under the user's tariff.
+func (a *App) saveLength(ctx context.Context, chatID int64, settings *model.UserSettings, tokens int) {
+	settings.MaxTokens = tokens
+	if err := a.repo.Save(ctx, settings); err != nil {
+		log.Println("save settings:", err)
+		a.reportFailure(ctx, chatID, 0)
+		return
+	}
+	limit := service.UserMaxTokens(settings, a.tariffFor(settings.Tariff))
+	a.sendMessage(ctx, chatID, fmt.Sprintf(a.ui().messages["length_saved"], lengthLabel(tokens), limit), nil)
+}
+
+// handleCategoriesPerSendCommand lets the user choose how many categories each
+// scheduled digest covers. A number given as the argument is saved right
+// away.
+func (a *App) handleCategoriesPerSendCommand(ctx context.Context, m *telegram.Message, arg string) {
+	log.Printf("user %d(@%s) called /categories_per_send", m.Chat.ID, m.Chat.Username)
+	settings, err := a.repo.Get(ctx, m.Chat.ID)
+	if err != nil {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
+		return
+	}
+	if n, ok := pickPerSend(settings, arg); ok {
+		a.savePerSend(ctx, m.Chat.ID, settings, n)
+		return
+	}
+	conv := &conversationState{Command: "/categories_per_send", Stage: stageCategoriesPerSend, Settings: settings}
+	a.convs.set(m.Chat.ID, conv)
+	a.askPerSend(ctx, m.Chat.ID, conv)
+}
+
+// askPerSend offers a number for every category of the user.
+func (a *App) askPerSend(ctx context.Context, chatID int64, c *conversationState) {
+	kb := numberKeyboard(max(len(c.Settings.Topics), 1))
+	msgID, _ := a.sendMessage(ctx, chatID, fmt.Sprintf(a.ui().messages["per_send_choose"], perSend(c.Settings)), addCancel(kb))
+	c.LastMsgID = msgID
+}
+
+// pickPerSend parses the number of categories per send, clamped to the
+// user's category count.
+func pickPerSend(u *model.UserSettings, text string) (int, bool) {
+	n, err := strconv.Atoi(strings.TrimSpace(text))
+	if err != nil || n < 1 {
+		return 0, false
+	}
+	return min(n, max(len(u.Topics), 1)), true
+}
+
+// perSend returns how many categories a scheduled digest of u covers.
+func perSend(u *model.UserSettings) int {
+	return min(max(u.ScheduledCategoriesPerSend, 1), max(len(u.Topics), 1))
+}
+
+// savePerSend persists the number of categories per scheduled digest.
+func (a *App) savePerSend(ctx context.Context, chatID int64, settings *model.UserSettings, n int) {
+	settings.ScheduledCategoriesPerSend = n
+	if err := a.repo.Save(ctx, settings); err != nil {
+		log.Println("save settings:", err)
+		a.reportFailure(ctx, chatID, 0)
+		return
+	}
+	a.sendMessage(ctx, chatID, fmt.Sprintf(a.ui().messages["per_send_saved"], n), nil)
+}
+
+// handleTimezoneCommand sets the timezone the user's days and active hours are
+// counted in, e.g. "/timezone Europe/Moscow". Without an argument it shows
+// the current one.
+func (a *App) handleTimezoneCommand(ctx context.Context, m *telegram.Message, arg string) {
+	log.Printf("user %d(@%s) called /timezone %s", m.Chat.ID, m.Chat.Username, arg)
+	settings, err := a.repo.Get(ctx, m.Chat.ID)
+	if err != nil {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
+		return
+	}
+	name := strings.TrimSpace(arg)
+	if name == "" {
+		current := settings.LocalTime(a.clock.Now()).Location().String()
+		a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf(a.ui().messages["timezone_current"], html.EscapeString(current)), nil)
+		return
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil || name == "Local" {
+		a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf(a.ui().messages["timezone_invalid"], html.EscapeString(name)), nil)
+		return
+	}
+	settings.Timezone = loc.String()
+	if err := a.repo.Save(ctx, settings); err != nil {
+		log.Println("save settings:", err)
+		a.reportFailure(ctx, m.Chat.ID, 0)
+		return
+	}
+	now := a.clock.Now().In(loc).Format("15:04")
+	a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf(a.ui().messages["timezone_saved"], html.EscapeString(settings.Timezone), now), nil)
+}
+
+// userDataExport is the document sent by /download_my_data: the stored
+// settings together with the usage derived from them. UserSettings holds no
+// credentials; the bot token and API keys live in the config and never get
+// here.
+type userDataExport struct {
+	ExportedAt string              `json:"exported_at"`
+	Settings   *model.UserSettings `json:"settings"`
+	Quota      quotaUsage          `json:"quota"`
+}
+
+// quotaUsage reports the user's requests of the day against the tariff
+// limits. A zero last-24h limit means the feature is not available.
+type quotaUsage struct {
+	Tariff          string `json:"tariff"`
+	GetNewsNowUsed  int    `json:"get_news_now_used"`
+	GetNewsNowLimit int    `json:"get_news_now_limit"`
+	GetLast24hUsed  int    `json:"get_last_24h_used"`
+	GetLast24hLimit int    `json:"get_last_24h_limit"`
+	ResetsAt        string `json:"resets_at"`
+}
+
+// handleDownloadMyDataCommand sends everything stored about the user as a
+// JSON file.
+func (a *App) handleDownloadMyDataCommand(ctx context.Context, m *telegram.Message) {
+	log.Printf("user %d(@%s) called /download_my_data", m.Chat.ID, m.Chat.Username)
+	settings, err := a.repo.Get(ctx, m.Chat.ID)
+	if err != nil {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
+		return
+	}
+	data, err := json.MarshalIndent(a.userData(settings, settings.LocalTime(a.clock.Now())), "", "  ")
+	if err != nil {
+		log.Println("marshal user data:", err)
+		a.reportFailure(ctx, m.Chat.ID, 0)
+		return
+	}
+	name := fmt.Sprintf("my-data-%d.json", m.Chat.ID)
+	if err := a.sendDocument(ctx, m.Chat.ID, name, data, a.ui().messages["my_data_caption"]); err != nil {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["my_data_failed"], nil)
+	}
+}
+
+// userData builds the /download_my_data document of u at now. Counters of an
+// earlier day are reported as zero, as the limits see them.
+func (a *App) userData(u *model.UserSettings, now time.Time) userDataExport {
+	tariff := u.Tariff
+	if tariff == "" {
+		tariff = model.DefaultTariff
+	}
+	t := a.tariffFor(tariff)
+	q := quotaUsage{Tariff: tariff, GetNewsNowLimit: t.Limits.GetNewsNowPerDay, ResetsAt: quotaReset(now).Format(time.RFC3339)}
+	if service.SameDay(now, time.Unix(u.LastGetNewsNow, 0)) {
+		q.GetNewsNowUsed = u.GetNewsNowCount
+	}
+	if hasFeature(u, model.FeatureLast24h, now) {
+		q.GetLast24hLimit = last24hLimit(u, t)
+		if service.SameDay(now, time.Unix(u.LastGetLast24h, 0)) {
+			q.GetLast24hUsed = u.GetLast24hCount
+		}
+	}
+	return userDataExport{ExportedAt: now.Format(time.RFC3339), Settings: u, Quota: q}
+}
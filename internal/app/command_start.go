@@ -2,7 +2,12 @@ package app
 
 import (
 	"context"
+	"fmt"
+	"html"
 	"log"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/ilinovom/summary-tasks-bot/pkg/telegram"
 )
@@ -10,27 +15,56 @@ import (
 // handleStartCommand processes the /start command.
 // It initializes user settings and begins the welcome conversation
 // if the user is unknown. Otherwise it simply reactivates the user.
+// A repeated /start while the welcome message is still waiting for
+// "Продолжить" is dropped instead of sending a second welcome.
 func (a *App) handleStartCommand(ctx context.Context, m *telegram.Message) {
 	log.Printf("user %d (@%s) called /start", m.Chat.ID, m.Chat.Username)
 	if _, err := a.repo.Get(ctx, m.Chat.ID); err != nil {
-		conv := &conversationState{Stage: stageWelcome}
-		a.convs[m.Chat.ID] = conv
-		msgID, err := a.sendMessage(ctx, m.Chat.ID, a.messages["start"], [][]string{{"Продолжить"}})
+		if conv, ok := a.convs.get(m.Chat.ID); ok && conv.Command == "/start" && conv.Stage == stageWelcome {
+			a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+			return
+		}
+		msgID, err := a.sendWelcome(ctx, m.Chat.ID)
 		if err != nil {
 			log.Printf("error when sending message to chat id %v: %v", m.Chat.ID, err)
+			return
 		}
-		conv.LastMsgID = msgID
+		a.convs.set(m.Chat.ID, &conversationState{Command: "/start", Stage: stageWelcome, LastMsgID: msgID})
 		return
 	}
+	if conv, ok := a.convs.get(m.Chat.ID); ok && conv.Command == "/start" {
+		// A stale onboarding flow must not overwrite the topics of a known user.
+		a.convs.delete(m.Chat.ID)
+	}
 	if err := a.userService.Start(ctx, m.Chat.ID, m.Chat.Username); err != nil {
 		log.Println("start:", err)
 	} else {
-		if _, err := a.sendMessage(ctx, m.Chat.ID, a.messages["start"], nil); err != nil {
+		if _, err := a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start"], nil); err != nil {
 			log.Printf("error when sending message to chat id %v: %v", m.Chat.ID, err)
 		}
 	}
 }
 
+// welcomeRetryDelay is the pause before a failed welcome is sent again.
+var welcomeRetryDelay = 500 * time.Millisecond
+
+// sendWelcome sends the onboarding welcome message, repeating a failed send
+// up to WelcomeRetries times after a short pause. The onboarding conversation
+// is only started once the user can see the message, so after a failure
+// /start begins anew.
+func (a *App) sendWelcome(ctx context.Context, chatID int64) (int, error) {
+	msgID, err := a.sendMessage(ctx, chatID, a.ui().messages["start"], [][]string{{continueOnboarding}})
+	for i := 0; err != nil && i < a.config().WelcomeRetries; i++ {
+		select {
+		case <-time.After(welcomeRetryDelay):
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+		msgID, err = a.sendMessage(ctx, chatID, a.ui().messages["start"], [][]string{{continueOnboarding}})
+	}
+	return msgID, err
+}
+
 // handleStopCommand processes the /stop command.
 // It disables scheduled news for the user.
 func (a *App) handleStopCommand(ctx context.Context, m *telegram.Message) {
@@ -38,6 +72,116 @@ func (a *App) handleStopCommand(ctx context.Context, m *telegram.Message) {
 	if err := a.userService.Stop(ctx, m.Chat.ID); err != nil {
 		log.Println("stop:", err)
 	} else {
-		a.sendMessage(ctx, m.Chat.ID, a.messages["stopped"], nil)
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["stopped"], nil)
+	}
+}
+
+// askCategoryCount asks a new user how many categories to fill in and returns
+// the prompt's message ID. With an AI client the keyboard also offers to
+// describe the interests in free text instead, until the dialog used up its
+// suggestion attempts.
+func (a *App) askCategoryCount(ctx context.Context, chatID int64, c *conversationState) int {
+	kb := numberKeyboard(c.CategoryLimit)
+	if a.canSuggest(c) {
+		kb = append(kb, []string{describeInterests})
+	}
+	msgID, _ := a.sendMessage(ctx, chatID, fmt.Sprintf(a.ui().messages["prompt_choose_count"], c.CategoryLimit), addBack(kb))
+	return msgID
+}
+
+// canSuggest reports whether the dialog may still ask the AI for category
+// suggestions.
+func (a *App) canSuggest(c *conversationState) bool {
+	return a.aiClient != nil && c.SuggestAttempts < maxSuggestAttempts
+}
+
+// suggestCategories maps the interests the user typed onto categories and
+// asks to confirm them. When nothing fitting is found the user picks the
+// categories manually.
+func (a *App) suggestCategories(ctx context.Context, m *telegram.Message, c *conversationState) {
+	a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+	a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+	if strings.TrimSpace(m.Text) == pickManually {
+		c.setStage(stageChooseCategoryCount)
+		c.LastMsgID = a.askCategoryCount(ctx, m.Chat.ID, c)
+		return
+	}
+	if !a.canSuggest(c) {
+		c.setStage(stageChooseCategoryCount)
+		c.LastMsgID = a.askCategoryCount(ctx, m.Chat.ID, c)
+		return
+	}
+	c.SuggestAttempts++
+	custom := 0
+	if c.AllowCustomCategory {
+		custom = c.CategoryLimit
+		if c.MaxCustomCategories > 0 {
+			custom = c.MaxCustomCategories
+		}
+	}
+	names, err := a.userService.SuggestCategories(ctx, m.Text, a.ui().categoryOptions, c.CategoryLimit, custom)
+	if err != nil {
+		log.Println("suggest categories:", err)
+	}
+	c.Suggested = a.validSuggestions(c, names)
+	if len(c.Suggested) == 0 {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["interests_none"], nil)
+		c.setStage(stageChooseCategoryCount)
+		c.LastMsgID = a.askCategoryCount(ctx, m.Chat.ID, c)
+		return
+	}
+	c.setStage(stageInterestsConfirm)
+	prompt := fmt.Sprintf(a.ui().messages["interests_suggested"], html.EscapeString(formatOptions(c.Suggested)))
+	msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, [][]string{{acceptSuggested}, {pickManually}})
+	c.LastMsgID = msgID
+}
+
+// validSuggestions keeps the suggested categories the user may actually
+// choose: preset options, and custom names only when the tariff allows them,
+// within the custom cap and the word bounds. The result fits the category
+// limit.
+func (a *App) validSuggestions(c *conversationState, names []string) []string {
+	var out []string
+	customs := 0
+	for _, name := range names {
+		if len(out) >= c.CategoryLimit || slices.Contains(out, name) {
+			continue
+		}
+		if !slices.Contains(a.ui().categoryOptions, name) {
+			custom, ok := strings.CutPrefix(name, "🫆")
+			if !ok || !c.AllowCustomCategory || (c.MaxCustomCategories > 0 && customs >= c.MaxCustomCategories) {
+				continue
+			}
+			if _, problem := a.checkCategoryWords(custom); problem != "" {
+				continue
+			}
+			customs++
+		}
+		out = append(out, name)
+	}
+	return out
+}
+
+// confirmSuggested continues with the suggested categories once the user
+// accepts them, asking for the info types of each, or returns to the manual
+// choice.
+func (a *App) confirmSuggested(ctx context.Context, m *telegram.Message, c *conversationState) {
+	switch strings.TrimSpace(m.Text) {
+	case acceptSuggested:
+		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+		c.CategoryLimit = len(c.Suggested)
+		c.Step = 0
+		c.PendingCats, c.Suggested = c.Suggested, nil
+		a.nextPendingCategory(ctx, m, c)
+	case pickManually:
+		a.deleteMessage(ctx, m.Chat.ID, m.MessageID)
+		a.deleteMessage(ctx, m.Chat.ID, c.LastMsgID)
+		c.Suggested = nil
+		c.setStage(stageChooseCategoryCount)
+		c.LastMsgID = a.askCategoryCount(ctx, m.Chat.ID, c)
+	default:
+		msgID, _ := a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf(a.ui().messages["interests_suggested"], html.EscapeString(formatOptions(c.Suggested))), [][]string{{acceptSuggested}, {pickManually}})
+		c.LastMsgID = msgID
 	}
 }
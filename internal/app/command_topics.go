@@ -3,38 +3,44 @@ package app
 import (
 	"context"
 	"fmt"
+	"html"
 	"log"
+	"maps"
+	"slices"
+	"sort"
 	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/ilinovom/summary-tasks-bot/internal/config"
+	"github.com/ilinovom/summary-tasks-bot/internal/model"
 	"github.com/ilinovom/summary-tasks-bot/pkg/telegram"
 )
 
 // handleUpdateTopicsCommand launches the flow for updating all topics.
 func (a *App) handleUpdateTopicsCommand(ctx context.Context, m *telegram.Message) {
 	log.Printf("user %d(@%s) called /update_topics", m.Chat.ID, m.Chat.Username)
-	tariff := a.cfg.Tariffs["base"]
+	tariff := a.tariffFor("base")
 	settings, err := a.repo.Get(ctx, m.Chat.ID)
 	if err == nil {
-		if t, ok := a.cfg.Tariffs[settings.Tariff]; ok {
-			tariff = t
-		}
+		tariff = a.tariffFor(settings.Tariff)
 	}
-	conv := &conversationState{UpdateTopics: true, CategoryLimit: tariff.Limits.CategoryLimit, InfoLimit: tariff.Limits.InfoTypeLimit, AllowCustomCategory: tariff.AllowCustomCategory}
+	conv := &conversationState{Command: "/update_topics", UpdateTopics: true, CategoryLimit: tariff.Limits.CategoryLimit, InfoLimit: tariff.Limits.InfoTypeLimit, AllowCustomCategory: tariff.AllowCustomCategory, MaxCustomCategories: tariff.Limits.MaxCustomCategories, TotalInfoLimit: tariff.Limits.TotalInfoTypeLimit}
 	if err == nil && len(settings.Topics) > 0 {
 		conv.Stage = stageUpdateChoice
 		conv.Topics = make(map[string][]string, len(settings.Topics))
 		for k, v := range settings.Topics {
 			conv.Topics[k] = append([]string(nil), v...)
 		}
-		a.convs[m.Chat.ID] = conv
-		msgID, _ := a.sendMessage(ctx, m.Chat.ID, a.messages["choose_action"], addCancel(numberKeyboard(2)))
+		a.convs.set(m.Chat.ID, conv)
+		msgID, _ := a.sendMessage(ctx, m.Chat.ID, a.ui().messages["choose_action"], addCancel(numberKeyboard(2)))
 		conv.LastMsgID = msgID
 		return
 	}
 	conv.Stage = stageCategory
-	a.convs[m.Chat.ID] = conv
-	prompt := fmt.Sprintf(a.messages["prompt_choose_category"], 1, formatOptions(a.categoryOptions))
-	msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addCancel(numberKeyboard(len(a.categoryOptions))))
+	a.convs.set(m.Chat.ID, conv)
+	prompt := fmt.Sprintf(a.ui().messages["prompt_choose_category"], 1, a.pageOptions(conv, a.ui().categoryOptions))
+	msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addCancel(a.pageKeyboard(conv, len(a.ui().categoryOptions), false)))
 	conv.LastMsgID = msgID
 }
 
@@ -43,38 +49,119 @@ func (a *App) handleAddTopicCommand(ctx context.Context, m *telegram.Message) {
 	log.Printf("user %d(@%s) called /add_topic", m.Chat.ID, m.Chat.Username)
 	settings, err := a.repo.Get(ctx, m.Chat.ID)
 	if err != nil {
-		a.sendMessage(ctx, m.Chat.ID, a.messages["start_first"], nil)
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
 		return
 	}
-	tariff := a.cfg.Tariffs["base"]
-	if t, ok := a.cfg.Tariffs[settings.Tariff]; ok {
-		tariff = t
-	}
+	tariff := a.tariffFor(settings.Tariff)
 	if len(settings.Topics) >= tariff.Limits.CategoryLimit {
-		a.sendMessage(ctx, m.Chat.ID, a.messages["limit_categories"], nil)
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["limit_categories"], nil)
 		return
 	}
 	conv := &conversationState{
+		Command:             "/add_topic",
 		UpdateTopics:        true,
 		CategoryLimit:       tariff.Limits.CategoryLimit - len(settings.Topics),
 		InfoLimit:           tariff.Limits.InfoTypeLimit,
 		AllowCustomCategory: tariff.AllowCustomCategory,
+		MaxCustomCategories: tariff.Limits.MaxCustomCategories,
+		TotalInfoLimit:      tariff.Limits.TotalInfoTypeLimit,
 		Topics:              make(map[string][]string, len(settings.Topics)),
 	}
 	for k, v := range settings.Topics {
 		conv.Topics[k] = append([]string(nil), v...)
 	}
-	conv.Stage = stageCategory
-	a.convs[m.Chat.ID] = conv
-	prompt := fmt.Sprintf(a.messages["prompt_choose_category"], len(conv.Topics)+1, formatOptions(a.categoryOptions))
-	msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addCancel(numberKeyboard(len(a.categoryOptions))))
+	conv.Stage = stageSelectManyNew
+	a.convs.set(m.Chat.ID, conv)
+	opts := addCustomOption(a.ui().categoryOptions, conv.AllowCustomCategory)
+	prompt := fmt.Sprintf(a.ui().messages["prompt_choose_new_multi"], conv.CategoryLimit, a.pageOptions(conv, opts))
+	msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addCancel(a.pageKeyboard(conv, len(opts), true)))
 	conv.LastMsgID = msgID
 }
 
+// handleCloneTopicCommand starts copying one of the user's categories into a
+// custom category with its own name and info types, e.g. "Технологии — Идеи"
+// next to "Технологии". The copy counts against the category and custom
+// category limits of the tariff.
+func (a *App) handleCloneTopicCommand(ctx context.Context, m *telegram.Message, arg string) {
+	log.Printf("user %d(@%s) called /clone_topic", m.Chat.ID, m.Chat.Username)
+	settings, err := a.repo.Get(ctx, m.Chat.ID)
+	if err != nil {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
+		return
+	}
+	if len(settings.Topics) == 0 {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["no_topics"], nil)
+		return
+	}
+	tariff := a.tariffFor(settings.Tariff)
+	if !tariff.AllowCustomCategory {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["clone_not_allowed"], nil)
+		return
+	}
+	if len(settings.Topics) >= tariff.Limits.CategoryLimit {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["limit_categories"], nil)
+		return
+	}
+	conv := &conversationState{
+		Command:             "/clone_topic",
+		Stage:               stageCloneCategory,
+		UpdateTopics:        true,
+		CategoryLimit:       1,
+		InfoLimit:           tariff.Limits.InfoTypeLimit,
+		AllowCustomCategory: true,
+		MaxCustomCategories: tariff.Limits.MaxCustomCategories,
+		TotalInfoLimit:      tariff.Limits.TotalInfoTypeLimit,
+		Topics:              make(map[string][]string, len(settings.Topics)),
+		AvailableCats:       sortedCategories(settings.Topics),
+	}
+	for k, v := range settings.Topics {
+		conv.Topics[k] = append([]string(nil), v...)
+	}
+	if customLimitReached(conv) {
+		a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf(a.ui().messages["limit_custom_categories"], conv.MaxCustomCategories), nil)
+		return
+	}
+	a.convs.set(m.Chat.ID, conv)
+	if cat, ok := matchCategory(conv.AvailableCats, arg); ok {
+		a.askCloneName(ctx, m.Chat.ID, conv, cat)
+		return
+	}
+	prompt := fmt.Sprintf(a.ui().messages["clone_choose_category"], formatOptions(conv.AvailableCats))
+	msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addCancel(numberKeyboard(len(conv.AvailableCats))))
+	conv.LastMsgID = msgID
+}
+
+// askCloneName asks for the words that tell the copy of cat apart.
+func (a *App) askCloneName(ctx context.Context, chatID int64, c *conversationState, cat string) {
+	minWords, maxWords, _ := a.customCategoryBounds()
+	c.CurrentCat = cat
+	c.setStage(stageCloneName)
+	msgID, _ := a.sendMessage(ctx, chatID, fmt.Sprintf(a.ui().messages["clone_enter_name"], html.EscapeString(cat), minWords, maxWords), addCancel(nil))
+	c.LastMsgID = msgID
+}
+
+// cloneName names the copy of cat as a custom category with the suffix
+// appended, e.g. "🫆Технологии — Идеи".
+func cloneName(cat, suffix string) string {
+	return "🫆" + strings.TrimPrefix(cat, "🫆") + " — " + suffix
+}
+
+// categoryTaken reports whether topics already hold name or a category that
+// differs from it only by case or emoji.
+func categoryTaken(topics map[string][]string, name string) bool {
+	key := model.CategoryKey(name)
+	for cat := range topics {
+		if model.CategoryKey(cat) == key {
+			return true
+		}
+	}
+	return false
+}
+
 // handleTopicsCommand shows the topics submenu.
 func (a *App) handleTopicsCommand(ctx context.Context, m *telegram.Message) {
 	log.Printf("user %d(@%s) called /topics", m.Chat.ID, m.Chat.Username)
-	a.sendMessage(ctx, m.Chat.ID, a.messages["topics_menu"], nil)
+	a.sendMessage(ctx, m.Chat.ID, a.ui().messages["topics_menu"], nil)
 }
 
 // handleDeleteTopicsCommand removes selected topics from user preferences.
@@ -82,20 +169,20 @@ func (a *App) handleDeleteTopicsCommand(ctx context.Context, m *telegram.Message
 	log.Printf("user %d(@%s) called /delete_topics", m.Chat.ID, m.Chat.Username)
 	settings, err := a.repo.Get(ctx, m.Chat.ID)
 	if err != nil {
-		a.sendMessage(ctx, m.Chat.ID, a.messages["start_first"], nil)
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
 		return
 	}
 	if len(settings.Topics) == 0 {
-		a.sendMessage(ctx, m.Chat.ID, a.messages["no_topics"], nil)
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["no_topics"], nil)
 		return
 	}
-	conv := &conversationState{UpdateTopics: true, DeleteTopics: true, Topics: make(map[string][]string, len(settings.Topics))}
+	conv := &conversationState{Command: "/delete_topics", UpdateTopics: true, DeleteTopics: true, Topics: make(map[string][]string, len(settings.Topics))}
 	for k, v := range settings.Topics {
 		conv.Topics[k] = append([]string(nil), v...)
 	}
 	conv.Stage = stageDeleteChoice
-	a.convs[m.Chat.ID] = conv
-	msgID, _ := a.sendMessage(ctx, m.Chat.ID, a.messages["choose_delete_action"], addCancel(numberKeyboard(2)))
+	a.convs.set(m.Chat.ID, conv)
+	msgID, _ := a.sendMessage(ctx, m.Chat.ID, a.ui().messages["choose_delete_action"], addCancel(numberKeyboard(2)))
 	conv.LastMsgID = msgID
 }
 
@@ -104,13 +191,349 @@ func (a *App) handleMyTopicsCommand(ctx context.Context, m *telegram.Message) {
 	log.Printf("user %d(@%s) called /my_topics", m.Chat.ID, m.Chat.Username)
 	settings, err := a.repo.Get(ctx, m.Chat.ID)
 	if err != nil {
-		a.sendMessage(ctx, m.Chat.ID, a.messages["start_first"], nil)
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
 		return
 	}
+	now := settings.LocalTime(a.clock.Now())
 	parts := []string{}
-	for cat, types := range settings.Topics {
-		parts = append(parts, fmt.Sprintf("%s: %s", cat, strings.Join(types, ", ")))
+	for _, cat := range sortedCategories(settings.Topics) {
+		parts = append(parts, fmt.Sprintf("%s%s: %s", cat, a.snoozeNote(settings, cat, now), strings.Join(settings.Topics[cat], ", ")))
 	}
-	msg := fmt.Sprintf(a.messages["your_topics"], strings.Join(parts, "\n\n"))
+	msg := fmt.Sprintf(a.ui().messages["your_topics"], strings.Join(parts, "\n\n"))
 	a.sendMessage(ctx, m.Chat.ID, msg, nil)
 }
+
+// handleSnoozeTopicCommand starts the flow pausing a single category for a
+// while. A known category given as the argument skips the selection step.
+func (a *App) handleSnoozeTopicCommand(ctx context.Context, m *telegram.Message, arg string) {
+	log.Printf("user %d(@%s) called /snooze_topic", m.Chat.ID, m.Chat.Username)
+	settings, err := a.repo.Get(ctx, m.Chat.ID)
+	if err != nil {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
+		return
+	}
+	if len(settings.Topics) == 0 {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["no_topics"], nil)
+		return
+	}
+	conv := &conversationState{Command: "/snooze_topic", Stage: stageSnoozeCategory, Settings: settings}
+	conv.AvailableCats = sortedCategories(settings.Topics)
+	a.convs.set(m.Chat.ID, conv)
+	if cat, ok := matchCategory(conv.AvailableCats, arg); ok {
+		conv.Stage = stageSnoozeDuration
+		a.askSnoozeDuration(ctx, m.Chat.ID, conv, cat)
+		return
+	}
+	now := settings.LocalTime(a.clock.Now())
+	labels := make([]string, len(conv.AvailableCats))
+	for i, cat := range conv.AvailableCats {
+		labels[i] = cat + a.snoozeNote(settings, cat, now)
+	}
+	prompt := fmt.Sprintf(a.ui().messages["snooze_choose_category"], formatOptions(labels))
+	msgID, _ := a.sendMessage(ctx, m.Chat.ID, prompt, addCancel(numberKeyboard(len(conv.AvailableCats))))
+	conv.LastMsgID = msgID
+}
+
+// askSnoozeDuration asks how long to pause the category. Already snoozed
+// categories also get a button to resume them.
+func (a *App) askSnoozeDuration(ctx context.Context, chatID int64, c *conversationState, cat string) {
+	c.CurrentCat = cat
+	kb := make([][]string, 0, len(snoozeDurations)+1)
+	for _, d := range snoozeDurations {
+		kb = append(kb, []string{d.Label})
+	}
+	if c.Settings.CategorySnoozed(cat, a.clock.Now()) {
+		kb = append(kb, []string{snoozeResume})
+	}
+	msgID, _ := a.sendMessage(ctx, chatID, fmt.Sprintf(a.ui().messages["snooze_choose_duration"], html.EscapeString(cat)), addCancel(kb))
+	c.LastMsgID = msgID
+}
+
+// saveSnooze pauses the current category for the given number of days, or
+// resumes it when days is zero, and ends the dialog. Expired pauses and those
+// of deleted categories are dropped on the way.
+func (a *App) saveSnooze(ctx context.Context, chatID int64, c *conversationState, days int) {
+	a.convs.delete(chatID)
+	u := c.Settings
+	now := u.LocalTime(a.clock.Now())
+	for cat := range u.SnoozedUntil {
+		if _, ok := u.Topics[cat]; !ok || !u.CategorySnoozed(cat, now) {
+			delete(u.SnoozedUntil, cat)
+		}
+	}
+	until := now.AddDate(0, 0, days)
+	if days > 0 {
+		if u.SnoozedUntil == nil {
+			u.SnoozedUntil = map[string]int64{}
+		}
+		u.SnoozedUntil[c.CurrentCat] = until.Unix()
+	} else {
+		delete(u.SnoozedUntil, c.CurrentCat)
+	}
+	if err := a.repo.Save(ctx, u); err != nil {
+		log.Println("save settings:", err)
+		a.reportFailure(ctx, chatID, 0)
+		return
+	}
+	if days == 0 {
+		a.sendMessage(ctx, chatID, fmt.Sprintf(a.ui().messages["snooze_resumed"], html.EscapeString(c.CurrentCat)), nil)
+		return
+	}
+	a.sendMessage(ctx, chatID, fmt.Sprintf(a.ui().messages["snooze_set"], html.EscapeString(c.CurrentCat), until.Format("02.01.2006 15:04")), nil)
+}
+
+// snoozeNote returns the "paused until" suffix for a snoozed category or an
+// empty string.
+func (a *App) snoozeNote(u *model.UserSettings, cat string, now time.Time) string {
+	if !u.CategorySnoozed(cat, now) {
+		return ""
+	}
+	until := u.LocalTime(time.Unix(u.SnoozedUntil[cat], 0)).Format("02.01.2006 15:04")
+	return fmt.Sprintf(a.ui().messages["topic_snoozed"], until)
+}
+
+// canShareInfos reports whether the category being asked for comes from a
+// batch of new categories that may get one set of info types together: more
+// categories are pending and none of them is a custom one yet to be named.
+func canShareInfos(c *conversationState) bool {
+	return len(c.PendingCats) > 0 && !strings.HasPrefix(c.CurrentCat, "🫆") && !slices.Contains(c.PendingCats, "😇Своя категория")
+}
+
+// askSharedInfos asks for the info types applied to the current category and
+// all pending ones.
+func (a *App) askSharedInfos(ctx context.Context, chatID int64, c *conversationState) {
+	c.setStage(stageSharedInfoTypes)
+	prompt := fmt.Sprintf(a.ui().messages["prompt_choose_info_all"], strings.Join(c.PendingCats, ", "), c.InfoLimit, a.formatInfoOptions())
+	if len(c.SelectedInfos) > 0 {
+		prompt += "\n\n" + fmt.Sprintf(a.ui().messages["already_selected"], strings.Join(c.SelectedInfos, ", "))
+	}
+	msgID, _ := a.sendMessage(ctx, chatID, prompt, addBack(numberKeyboardWithDone(len(a.ui().infoOptions))))
+	c.LastMsgID = msgID
+}
+
+// applySharedInfos adds the selected info types to every pending category
+// and saves the topics. A selection that would exceed the tariff's total
+// info type cap is refused and asked again.
+func (a *App) applySharedInfos(ctx context.Context, m *telegram.Message, c *conversationState) {
+	merged := make(map[string][]string, len(c.PendingCats))
+	for _, cat := range c.PendingCats {
+		infos := append([]string(nil), c.Topics[cat]...)
+		for _, inf := range c.SelectedInfos {
+			if !slices.Contains(infos, inf) {
+				infos = append(infos, inf)
+			}
+		}
+		merged[cat] = infos
+	}
+	if room, ok := sharedInfoRoom(c, merged); !ok {
+		c.SelectedInfos = nil
+		a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf(a.ui().messages["limit_total_infos"], c.TotalInfoLimit, room), nil)
+		a.askSharedInfos(ctx, m.Chat.ID, c)
+		return
+	}
+	if c.Topics == nil {
+		c.Topics = map[string][]string{}
+	}
+	for cat, infos := range merged {
+		c.Topics[cat] = infos
+	}
+	c.Step += len(c.PendingCats)
+	c.PendingCats = nil
+	c.SelectedInfos = nil
+	a.saveTopics(ctx, m, c)
+}
+
+// sharedInfoRoom checks the tariff's total info type cap when the pending
+// categories get the merged info types. Like totalInfoRoom it returns how
+// many info types each of them may have at most and whether the change fits.
+func sharedInfoRoom(c *conversationState, merged map[string][]string) (int, bool) {
+	if c.TotalInfoLimit <= 0 {
+		return 0, true
+	}
+	before, others, added := 0, 0, 0
+	for cat, infos := range c.Topics {
+		before += len(infos)
+		if _, ok := merged[cat]; !ok {
+			others += len(infos)
+		}
+	}
+	for _, infos := range merged {
+		added += len(infos)
+	}
+	room := max(c.TotalInfoLimit-others, 0) / len(merged)
+	return room, others+added <= c.TotalInfoLimit || others+added <= before
+}
+
+// handleSaveProfileCommand stores the user's current topics as a named
+// profile, replacing a profile with the same name.
+func (a *App) handleSaveProfileCommand(ctx context.Context, m *telegram.Message, arg string) {
+	log.Printf("user %d(@%s) called /save_profile %s", m.Chat.ID, m.Chat.Username, arg)
+	name := strings.TrimSpace(arg)
+	if name == "" || utf8.RuneCountInString(name) > maxProfileName {
+		a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf(a.ui().messages["profile_save_usage"], maxProfileName), nil)
+		return
+	}
+	settings, err := a.repo.Get(ctx, m.Chat.ID)
+	if err != nil {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
+		return
+	}
+	if len(settings.Topics) == 0 {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["profile_no_topics"], nil)
+		return
+	}
+	if _, ok := settings.Profiles[name]; !ok && len(settings.Profiles) >= maxProfiles {
+		a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf(a.ui().messages["profile_limit"], maxProfiles), nil)
+		return
+	}
+	profiles := make(map[string]map[string][]string, len(settings.Profiles)+1)
+	for k, v := range settings.Profiles {
+		profiles[k] = v
+	}
+	profiles[name] = copyTopics(settings.Topics)
+	settings.Profiles = profiles
+	if err := a.repo.Save(ctx, settings); err != nil {
+		log.Println("save settings:", err)
+		a.reportFailure(ctx, m.Chat.ID, 0)
+		return
+	}
+	a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf(a.ui().messages["profile_saved"], html.EscapeString(name)), nil)
+}
+
+// handleProfilesCommand lists the user's saved topic profiles.
+func (a *App) handleProfilesCommand(ctx context.Context, m *telegram.Message) {
+	log.Printf("user %d(@%s) called /profiles", m.Chat.ID, m.Chat.Username)
+	settings, err := a.repo.Get(ctx, m.Chat.ID)
+	if err != nil {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
+		return
+	}
+	if len(settings.Profiles) == 0 {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["profiles_empty"], nil)
+		return
+	}
+	names := make([]string, 0, len(settings.Profiles))
+	for name := range settings.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("<b>%s</b>\n%s", html.EscapeString(name), html.EscapeString(formatTopics(settings.Profiles[name])))
+	}
+	a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf(a.ui().messages["profiles_list"], strings.Join(parts, "\n\n")), nil)
+}
+
+// handleLoadProfileCommand replaces the user's topics with a saved profile
+// if it fits the limits of the current tariff.
+func (a *App) handleLoadProfileCommand(ctx context.Context, m *telegram.Message, arg string) {
+	log.Printf("user %d(@%s) called /load_profile %s", m.Chat.ID, m.Chat.Username, arg)
+	name := strings.TrimSpace(arg)
+	if name == "" {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["profile_load_usage"], nil)
+		return
+	}
+	settings, err := a.repo.Get(ctx, m.Chat.ID)
+	if err != nil {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
+		return
+	}
+	topics, ok := settings.Profiles[name]
+	if !ok {
+		a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf(a.ui().messages["profile_not_found"], html.EscapeString(name)), nil)
+		return
+	}
+	if !topicsWithinLimits(topics, a.tariffFor(settings.Tariff)) {
+		a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf(a.ui().messages["profile_over_limit"], html.EscapeString(name)), nil)
+		return
+	}
+	replaceTopics(settings, copyTopics(topics))
+	if err := a.repo.Save(ctx, settings); err != nil {
+		log.Println("save settings:", err)
+		a.reportFailure(ctx, m.Chat.ID, 0)
+		return
+	}
+	a.sendMessage(ctx, m.Chat.ID, fmt.Sprintf(a.ui().messages["profile_loaded"], html.EscapeString(name), html.EscapeString(formatTopics(settings.Topics))), nil)
+}
+
+// copyTopics returns a deep copy of a topics map.
+func copyTopics(topics map[string][]string) map[string][]string {
+	out := make(map[string][]string, len(topics))
+	for k, v := range topics {
+		out[k] = append([]string(nil), v...)
+	}
+	return out
+}
+
+// topicsWithinLimits reports whether topics respect the tariff's limits on
+// categories, info types per category and in total, and custom categories.
+func topicsWithinLimits(topics map[string][]string, t config.Tariff) bool {
+	if len(topics) > t.Limits.CategoryLimit {
+		return false
+	}
+	total, custom := 0, 0
+	for cat, infos := range topics {
+		if len(infos) > t.Limits.InfoTypeLimit {
+			return false
+		}
+		total += len(infos)
+		if strings.HasPrefix(cat, "🫆") {
+			custom++
+		}
+	}
+	if t.Limits.TotalInfoTypeLimit > 0 && total > t.Limits.TotalInfoTypeLimit {
+		return false
+	}
+	if custom > 0 && !t.AllowCustomCategory {
+		return false
+	}
+	return t.Limits.MaxCustomCategories <= 0 || custom <= t.Limits.MaxCustomCategories
+}
+
+// replaceTopics sets the user's topics and keeps the replaced ones for /undo.
+// Saving unchanged topics leaves the previous snapshot intact.
+func replaceTopics(u *model.UserSettings, topics map[string][]string) {
+	if maps.EqualFunc(u.Topics, topics, slices.Equal) {
+		return
+	}
+	u.PrevTopics = u.Topics
+	u.Topics = topics
+}
+
+// handleUndoCommand offers to restore the topics replaced by the latest
+// change.
+func (a *App) handleUndoCommand(ctx context.Context, m *telegram.Message) {
+	log.Printf("user %d(@%s) called /undo", m.Chat.ID, m.Chat.Username)
+	settings, err := a.repo.Get(ctx, m.Chat.ID)
+	if err != nil {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["start_first"], nil)
+		return
+	}
+	if settings.PrevTopics == nil {
+		a.sendMessage(ctx, m.Chat.ID, a.ui().messages["undo_empty"], nil)
+		return
+	}
+	conv := &conversationState{Command: "/undo", Stage: stageUndoConfirm, Settings: settings}
+	a.convs.set(m.Chat.ID, conv)
+	a.askUndo(ctx, m.Chat.ID, conv)
+}
+
+// askUndo shows the current and the previous topics and asks to confirm.
+func (a *App) askUndo(ctx context.Context, chatID int64, c *conversationState) {
+	u := c.Settings
+	prompt := fmt.Sprintf(a.ui().messages["undo_confirm"], html.EscapeString(formatTopics(u.Topics)), html.EscapeString(formatTopics(u.PrevTopics)))
+	msgID, _ := a.sendMessage(ctx, chatID, prompt, addCancel([][]string{{undoApply}}))
+	c.LastMsgID = msgID
+}
+
+// applyUndo swaps the current and the previous topics, so a second /undo
+// brings the change back.
+func (a *App) applyUndo(ctx context.Context, chatID int64, u *model.UserSettings) {
+	u.Topics, u.PrevTopics = u.PrevTopics, u.Topics
+	if err := a.repo.Save(ctx, u); err != nil {
+		log.Println("save settings:", err)
+		a.reportFailure(ctx, chatID, 0)
+		return
+	}
+	a.sendMessage(ctx, chatID, fmt.Sprintf(a.ui().messages["undo_done"], html.EscapeString(formatTopics(u.Topics))), nil)
+}
@@ -0,0 +1,103 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ilinovom/summary-tasks-bot/internal/repository"
+)
+
+// schedulerInterval is how often the scheduler looks for due users.
+const schedulerInterval = time.Minute
+
+// schedulerStaleAfter is how old the scheduler's last heartbeat may get before
+// /readyz reports the scheduler as stalled.
+const schedulerStaleAfter = 2 * schedulerInterval
+
+// heartbeatEvery is the shortest gap between two heartbeats stored while a
+// batch is being sent.
+const heartbeatEvery = 10 * time.Second
+
+// scheduledSendTimeout bounds a single scheduled digest, generation included.
+// The scheduler stores a heartbeat whenever a digest is started or the batch
+// ends, so a digest that cannot exceed this bound cannot keep the heartbeat
+// older than schedulerStaleAfter either.
+var scheduledSendTimeout = schedulerStaleAfter - heartbeatEvery
+
+// recordTick persists the time of a scheduler heartbeat.
+func (a *App) recordTick(ctx context.Context, now time.Time) {
+	if a.state == nil {
+		return
+	}
+	a.lastBeat.Store(now.UnixNano())
+	if err := a.state.SetTime(ctx, repository.SchedulerLastTick, now.Unix()); err != nil {
+		log.Println("record scheduler tick:", err)
+	}
+}
+
+// heartbeat records that scheduleTick is still making progress. It is called
+// before each user of a batch and at its end, and stores at most one
+// heartbeat per heartbeatEvery.
+func (a *App) heartbeat(ctx context.Context) {
+	now := a.clock.Now()
+	if now.Sub(time.Unix(0, a.lastBeat.Load())) < heartbeatEvery {
+		return
+	}
+	a.recordTick(ctx, now)
+}
+
+// checkScheduler returns an error if the scheduler has not ticked for longer
+// than schedulerStaleAfter, e.g. because its goroutine hangs. A tick stored
+// before the current start does not count, so a restart is not flagged
+// before the first tick.
+func (a *App) checkScheduler(ctx context.Context, now time.Time) error {
+	if a.state == nil {
+		return nil
+	}
+	at, err := a.state.Time(ctx, repository.SchedulerLastTick)
+	if err != nil {
+		return fmt.Errorf("scheduler last tick: %w", err)
+	}
+	last := time.Unix(at, 0)
+	if last.Before(a.startedAt) {
+		last = a.startedAt
+	}
+	if age := now.Sub(last); age > schedulerStaleAfter {
+		return fmt.Errorf("scheduler stalled: last tick %s ago", age.Truncate(time.Second))
+	}
+	return nil
+}
+
+// healthHandler serves /healthz, which answers while the process is up, and
+// /readyz, which also fails when the scheduler has stalled.
+func (a *App) healthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := a.checkScheduler(r.Context(), a.clock.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
+
+// serveHealth runs the health endpoints on addr until ctx is cancelled.
+func (a *App) serveHealth(ctx context.Context, addr string) {
+	srv := &http.Server{Addr: addr, Handler: a.healthHandler()}
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+	log.Printf("health endpoints listening on %s", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Println("health server:", err)
+	}
+}
@@ -0,0 +1,128 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ilinovom/summary-tasks-bot/internal/model"
+	"github.com/ilinovom/summary-tasks-bot/internal/repository"
+)
+
+// TestReadyz_StaleSchedulerTick verifies the readiness check fails once the
+// stored scheduler tick is older than two intervals and recovers with the
+// next tick, while the liveness check keeps answering.
+func TestReadyz_StaleSchedulerTick(t *testing.T) {
+	a, _ := newTestApp(t, &countingAI{})
+	state, err := repository.NewFileStateRepository(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatalf("new state: %v", err)
+	}
+	a.SetState(state)
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	a.clock = clock
+	a.startedAt = clock.Now().Add(-time.Hour)
+	ctx := context.Background()
+	get := func(path string) (int, string) {
+		rec := httptest.NewRecorder()
+		a.healthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	a.recordTick(ctx, clock.Now().Add(-3*schedulerInterval))
+	if code, body := get("/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "scheduler stalled") {
+		t.Fatalf("stale tick: got %d %q", code, body)
+	}
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Fatalf("liveness must not depend on the scheduler, got %d", code)
+	}
+
+	a.recordTick(ctx, clock.Now())
+	if code, body := get("/readyz"); code != http.StatusOK {
+		t.Fatalf("fresh tick: got %d %q", code, body)
+	}
+}
+
+// advancingAI moves the fake clock forward on every call, like a slow model.
+type advancingAI struct {
+	clock *fakeClock
+	step  time.Duration
+}
+
+// ChatCompletion advances the clock and returns a fixed digest.
+func (s *advancingAI) ChatCompletion(ctx context.Context, model, prompt string, maxTokens int, temperature *float64) (string, error) {
+	s.clock.Advance(s.step)
+	return "digest", nil
+}
+
+// ChatResponses behaves like ChatCompletion.
+func (s *advancingAI) ChatResponses(ctx context.Context, model, prompt string, maxTokens int, temperature *float64) (string, error) {
+	return s.ChatCompletion(ctx, model, prompt, maxTokens, temperature)
+}
+
+// TestScheduleTick_Heartbeat verifies a batch that runs for longer than the
+// stale threshold keeps /readyz green by storing heartbeats as it goes.
+func TestScheduleTick_Heartbeat(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	a, _ := newTestApp(t, &advancingAI{clock: clock, step: schedulerStaleAfter / 2})
+	state, err := repository.NewFileStateRepository(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatalf("new state: %v", err)
+	}
+	a.SetState(state)
+	a.clock = clock
+	a.startedAt = clock.Now().Add(-time.Hour)
+	a.cfg.Workers = 1
+	ctx := context.Background()
+	for id := int64(1); id <= 4; id++ {
+		u := &model.UserSettings{UserID: id, Active: true, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты"}}}
+		if err := a.repo.Save(ctx, u); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	start := clock.Now()
+	a.recordTick(ctx, start)
+	a.scheduleTick(ctx, start)
+
+	if clock.Now().Sub(start) <= schedulerStaleAfter {
+		t.Fatalf("the batch must outlast the stale threshold, took %s", clock.Now().Sub(start))
+	}
+	at, err := state.Time(ctx, repository.SchedulerLastTick)
+	if err != nil {
+		t.Fatalf("last tick: %v", err)
+	}
+	if last := time.Unix(at, 0); !last.After(start) {
+		t.Fatalf("no heartbeat during the batch, last tick %s", last)
+	}
+	if err := a.checkScheduler(ctx, clock.Now()); err != nil {
+		t.Fatalf("long batch reported as stalled: %v", err)
+	}
+}
+
+// TestScheduleTick_BoundsDigest verifies a digest that hangs is cancelled
+// after scheduledSendTimeout instead of holding up the scheduler.
+func TestScheduleTick_BoundsDigest(t *testing.T) {
+	a, _ := newTestApp(t, &hangingAI{cancel: func() {}})
+	ctx := context.Background()
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Active: true, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты"}}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	defer func(d time.Duration) { scheduledSendTimeout = d }(scheduledSendTimeout)
+	scheduledSendTimeout = 50 * time.Millisecond
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.scheduleTick(ctx, time.Now())
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("a hanging digest must not hold up the scheduler")
+	}
+}
@@ -0,0 +1,207 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ilinovom/summary-tasks-bot/pkg/telegram"
+)
+
+// mockTelegram emulates the Bot API methods used by the bot. Queued update
+// batches are returned by getUpdates one per call; afterwards getUpdates
+// blocks like a long poll until the client goes away.
+type mockTelegram struct {
+	mu      sync.Mutex
+	updates [][]telegram.Update
+	calls   []string
+	nextID  int
+	changed chan struct{}
+}
+
+// newMockTelegram starts the mock server and returns a client talking to it.
+func newMockTelegram(t *testing.T, updates ...[]telegram.Update) (*mockTelegram, *telegram.Client) {
+	t.Helper()
+	m := &mockTelegram{updates: updates, nextID: 1000, changed: make(chan struct{}, 1)}
+	srv := httptest.NewServer(http.HandlerFunc(m.serve))
+	t.Cleanup(srv.Close)
+	return m, telegram.NewClientWithBaseURL("token", srv.URL)
+}
+
+// serve handles a single Bot API request and records it.
+func (m *mockTelegram) serve(w http.ResponseWriter, r *http.Request) {
+	method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	if method == "getUpdates" {
+		m.mu.Lock()
+		var batch []telegram.Update
+		if len(m.updates) > 0 {
+			batch, m.updates = m.updates[0], m.updates[1:]
+		}
+		m.mu.Unlock()
+		if batch == nil {
+			<-r.Context().Done()
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"ok": true, "result": batch})
+		return
+	}
+
+	var body struct {
+		Text      string `json:"text"`
+		MessageID int    `json:"message_id"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	m.mu.Lock()
+	switch method {
+	case "sendMessage":
+		m.nextID++
+		m.calls = append(m.calls, fmt.Sprintf("sendMessage %d %s", m.nextID, body.Text))
+	case "deleteMessage":
+		m.calls = append(m.calls, fmt.Sprintf("deleteMessage %d", body.MessageID))
+	default:
+		m.calls = append(m.calls, method)
+	}
+	id := m.nextID
+	m.mu.Unlock()
+	select {
+	case m.changed <- struct{}{}:
+	default:
+	}
+	json.NewEncoder(w).Encode(map[string]any{"ok": true, "result": map[string]any{"message_id": id}})
+}
+
+// waitCalls waits until n calls were recorded and returns them.
+func (m *mockTelegram) waitCalls(t *testing.T, n int) []string {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		m.mu.Lock()
+		calls := append([]string(nil), m.calls...)
+		m.mu.Unlock()
+		if len(calls) >= n {
+			return calls
+		}
+		select {
+		case <-m.changed:
+		case <-timeout:
+			t.Fatalf("timed out waiting for %d calls, got %q", n, calls)
+		}
+	}
+}
+
+// TestRun_StartOverMockTelegram drives the whole update→handle→send loop over
+// HTTP: the bot registers its commands and profile texts, looks up its
+// username, answers /start
+// with the welcome message and, after "Продолжить", cleans up and asks for the
+// category count.
+func TestRun_StartOverMockTelegram(t *testing.T) {
+	a, _ := newTestApp(t, &countingAI{})
+	a.ui().messages["start"] = "welcome"
+	a.ui().messages["prompt_choose_count"] = "how many (max %d)?"
+	a.ui().messages["bot_description"] = "about the bot"
+	a.ui().messages["bot_short_description"] = "about"
+	chat := telegram.Chat{ID: 42, Username: "user"}
+	mock, client := newMockTelegram(t,
+		[]telegram.Update{{UpdateID: 1, Message: &telegram.Message{MessageID: 10, Chat: chat, Text: "/start"}}},
+		[]telegram.Update{{UpdateID: 2, Message: &telegram.Message{MessageID: 11, Chat: chat, Text: "Продолжить"}}},
+	)
+	a.tgClient = client
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- a.Run(ctx) }()
+
+	calls := mock.waitCalls(t, 8)
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not stop after cancellation")
+	}
+
+	want := []string{
+		"setMyCommands",
+		"setMyDescription",
+		"setMyShortDescription",
+		"getMe",
+		"sendMessage 1001 welcome",
+		"deleteMessage 11",
+		"deleteMessage 1001",
+		"sendMessage 1002 how many (max 2)?",
+	}
+	if fmt.Sprint(calls) != fmt.Sprint(want) {
+		t.Fatalf("unexpected Bot API calls:\n got %q\nwant %q", calls, want)
+	}
+}
+
+// TestPollUpdates_Conflict verifies that a 409 from getUpdates is logged as a
+// second polling instance and the next poll waits for the conflict backoff.
+func TestPollUpdates_Conflict(t *testing.T) {
+	var polls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls.Add(1)
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"ok":false,"error_code":409,"description":"Conflict: terminated by other getUpdates request"}`))
+	}))
+	t.Cleanup(srv.Close)
+	var buf syncBuffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	a, _ := newTestApp(t, &countingAI{})
+	a.tgClient = telegram.NewClientWithBaseURL("token", srv.URL)
+	a.cfg.ConflictBackoff = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.pollUpdates(ctx, newUpdateQueue(1))
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("polling did not stop after cancellation")
+	}
+	if n := polls.Load(); n != 1 {
+		t.Fatalf("expected a single poll during the backoff, got %d", n)
+	}
+	if out := buf.String(); !strings.Contains(out, "another instance is polling") || !strings.Contains(out, "retrying in 1h0m0s") {
+		t.Fatalf("expected conflict warning, got %q", out)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for the logger and the test to share.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+// Write appends p to the buffer.
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// String returns the buffered text.
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,119 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ilinovom/summary-tasks-bot/internal/model"
+	"github.com/ilinovom/summary-tasks-bot/internal/service"
+	"github.com/ilinovom/summary-tasks-bot/pkg/telegram"
+)
+
+const (
+	// outboxBatchSize is how many queued digests are delivered per pass.
+	outboxBatchSize = 50
+	// outboxMaxAttempts is how many times a digest is tried before it is
+	// given up.
+	outboxMaxAttempts = 5
+	// outboxRetryDelay is the pause after the first failed attempt; it
+	// grows linearly with every further one.
+	outboxRetryDelay = time.Minute
+	// outboxRetention is how long delivered digests are kept so that their
+	// slot is not queued again; it is far longer than any schedule interval.
+	outboxRetention = 48 * time.Hour
+	// outboxPruneInterval is how often delivered digests are cleaned up.
+	outboxPruneInterval = time.Hour
+)
+
+// outboxPollInterval is how often the outbox is checked for due digests.
+var outboxPollInterval = 5 * time.Second
+
+// deliverOutbox periodically delivers queued digests until ctx is done. Like
+// the scheduler's, its sends are bulk traffic that leaves room for replies.
+func (a *App) deliverOutbox(ctx context.Context) {
+	ctx = service.WithScheduled(withBulk(ctx))
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+	var pruned time.Time
+	for {
+		a.flushOutbox(ctx)
+		if now := a.clock.Now(); now.Sub(pruned) >= outboxPruneInterval {
+			a.pruneOutbox(ctx, now)
+			pruned = now
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pruneOutbox deletes the digests delivered more than outboxRetention ago,
+// keeping the outbox from growing with every slot.
+func (a *App) pruneOutbox(ctx context.Context, now time.Time) {
+	n, err := a.outbox.PruneSent(ctx, now.Add(-outboxRetention).Unix())
+	if err != nil {
+		log.Println("prune outbox:", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("pruned %d delivered digests from the outbox", n)
+	}
+}
+
+// flushOutbox sends the due queued digests. A digest is marked sent only
+// after delivery, so one interrupted by a restart is sent again. Failed
+// digests are retried later; those of users who blocked the bot are dropped.
+// Nothing is sent in maintenance mode; the digests wait in the outbox.
+func (a *App) flushOutbox(ctx context.Context) {
+	if a.maintenance.Load() {
+		return
+	}
+	now := a.clock.Now()
+	msgs, err := a.outbox.Pending(ctx, now.Unix(), outboxBatchSize)
+	if err != nil {
+		log.Println("list outbox:", err)
+		return
+	}
+	for _, m := range msgs {
+		if ctx.Err() != nil {
+			return
+		}
+		err := a.sendBulkDigest(ctx, m.UserID, m.Texts)
+		switch {
+		case err == nil:
+			log.Printf("user %d got scheduled news", m.UserID)
+			a.rememberDigest(m.UserID, strings.Join(m.Texts, "\n\n"))
+		case errors.Is(err, telegram.ErrBlocked):
+			a.blockUser(ctx, m.UserID)
+		default:
+			a.retryOutbox(ctx, m, now, err)
+			continue
+		}
+		if err := a.outbox.MarkSent(ctx, m.ID, now.Unix()); err != nil {
+			log.Println("mark digest sent:", err)
+		}
+	}
+}
+
+// retryOutbox schedules another attempt for a digest that failed to send,
+// giving it up after outboxMaxAttempts.
+func (a *App) retryOutbox(ctx context.Context, m *model.OutboxMessage, now time.Time, sendErr error) {
+	attempts := m.Attempts + 1
+	if attempts >= outboxMaxAttempts {
+		log.Printf("user %d: giving up scheduled digest after %d attempts: %v", m.UserID, attempts, sendErr)
+		if err := a.outbox.MarkSent(ctx, m.ID, now.Unix()); err != nil {
+			log.Println("mark digest sent:", err)
+		}
+		return
+	}
+	log.Printf("user %d: scheduled digest not sent (attempt %d): %v", m.UserID, attempts, sendErr)
+	next := now.Add(time.Duration(attempts) * outboxRetryDelay)
+	if err := a.outbox.Retry(ctx, m.ID, attempts, next.Unix()); err != nil {
+		log.Println("retry digest:", err)
+	}
+}
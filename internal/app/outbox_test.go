@@ -0,0 +1,93 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ilinovom/summary-tasks-bot/internal/model"
+	"github.com/ilinovom/summary-tasks-bot/internal/repository"
+)
+
+// TestOutbox_RetryAfterRestart verifies the scheduler queues a digest once
+// per slot, a failed send is retried later, and a digest left in the outbox by
+// a crashed instance is delivered and marked sent after a restart.
+func TestOutbox_RetryAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.json")
+	outbox, err := repository.NewFileOutboxRepository(path)
+	if err != nil {
+		t.Fatalf("new outbox: %v", err)
+	}
+	clock := &fakeClock{now: time.Date(2024, 5, 10, 12, 5, 0, 0, time.Local)}
+	a, tg := newTestApp(t, &countingAI{reply: "digest"})
+	a.clock = clock
+	a.SetOutbox(outbox)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		u := &model.UserSettings{UserID: 1, Tariff: "base", Active: true, Topics: map[string][]string{"Наука": {"Факты"}}}
+		a.sendScheduled(ctx, u, clock.Now())
+	}
+	if len(tg.texts()) != 0 {
+		t.Fatalf("queued digests must not be sent directly, got %q", tg.texts())
+	}
+	pending, _ := outbox.Pending(ctx, clock.Now().Unix(), 10)
+	if len(pending) != 1 {
+		t.Fatalf("expected one queued digest for the slot, got %d", len(pending))
+	}
+
+	tg.sendErr = errors.New("network down")
+	a.flushOutbox(ctx)
+	if pending, _ := outbox.Pending(ctx, clock.Now().Unix(), 10); len(pending) != 0 {
+		t.Fatalf("failed digest must wait for its retry, got %+v", pending)
+	}
+
+	// The first instance goes away; a new one starts on the same outbox.
+	restarted, err := repository.NewFileOutboxRepository(path)
+	if err != nil {
+		t.Fatalf("reopen outbox: %v", err)
+	}
+	b, tg2 := newTestApp(t, nil)
+	clock.Advance(outboxRetryDelay)
+	b.clock = clock
+	b.SetOutbox(restarted)
+	b.flushOutbox(ctx)
+	b.flushOutbox(ctx)
+	texts := tg2.texts()
+	if len(texts) != 1 || !strings.Contains(texts[0], "digest") {
+		t.Fatalf("expected the digest delivered once after restart, got %q", texts)
+	}
+	if pending, _ := restarted.Pending(ctx, clock.Now().Add(time.Hour).Unix(), 10); len(pending) != 0 {
+		t.Fatalf("delivered digest must be marked sent, got %+v", pending)
+	}
+}
+
+// TestOutbox_PausedInMaintenance verifies queued digests stay in the outbox
+// while maintenance mode is on and go out once it is turned off.
+func TestOutbox_PausedInMaintenance(t *testing.T) {
+	outbox, err := repository.NewFileOutboxRepository(filepath.Join(t.TempDir(), "outbox.json"))
+	if err != nil {
+		t.Fatalf("new outbox: %v", err)
+	}
+	a, tg := newTestApp(t, nil)
+	a.SetOutbox(outbox)
+	ctx := context.Background()
+	if _, err := outbox.Enqueue(ctx, &model.OutboxMessage{UserID: 1, Slot: 1, Texts: []string{"digest"}}); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+
+	a.maintenance.Store(true)
+	a.flushOutbox(ctx)
+	if texts := tg.texts(); len(texts) != 0 {
+		t.Fatalf("digests must not be sent in maintenance mode, got %q", texts)
+	}
+
+	a.maintenance.Store(false)
+	a.flushOutbox(ctx)
+	if texts := tg.texts(); len(texts) != 1 || texts[0] != "digest" {
+		t.Fatalf("expected the queued digest after maintenance, got %q", texts)
+	}
+}
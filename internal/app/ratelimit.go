@@ -0,0 +1,92 @@
+package app
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket shared by every outbound message so that
+// interactive replies, scheduled digests and any other bulk sends together
+// stay within Telegram's global limit. Bulk senders only take a token when no
+// interactive sender is waiting for one.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	tokens  float64
+	last    time.Time
+	waiting int
+}
+
+// newRateLimiter allows perSecond messages per second with bursts of the same
+// size. A non-positive rate disables limiting and yields nil.
+func newRateLimiter(perSecond int) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(perSecond), burst: float64(perSecond), tokens: float64(perSecond), last: time.Now()}
+}
+
+// Wait blocks until a message may be sent or the context is done. A nil
+// limiter never blocks.
+func (l *rateLimiter) Wait(ctx context.Context, bulk bool) error {
+	if l == nil {
+		return nil
+	}
+	if !bulk {
+		l.mu.Lock()
+		l.waiting++
+		l.mu.Unlock()
+		defer func() {
+			l.mu.Lock()
+			l.waiting--
+			l.mu.Unlock()
+		}()
+	}
+	for {
+		delay, ok := l.take(bulk)
+		if ok {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// take refills the bucket and consumes a token if the caller may have one;
+// otherwise it returns how long to wait before trying again.
+func (l *rateLimiter) take(bulk bool) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	interval := time.Duration(float64(time.Second) / l.rate)
+	if bulk && l.waiting > 0 {
+		return interval, false
+	}
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - l.tokens) * float64(interval)), false
+}
+
+// bulkKey marks contexts of bulk sends such as scheduled digests.
+type bulkKey struct{}
+
+// withBulk marks messages sent with the returned context as bulk, giving
+// interactive replies priority over them.
+func withBulk(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bulkKey{}, true)
+}
+
+// isBulk reports whether ctx was marked by withBulk.
+func isBulk(ctx context.Context) bool {
+	b, _ := ctx.Value(bulkKey{}).(bool)
+	return b
+}
@@ -0,0 +1,86 @@
+package app
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestSendLimiter_CombinedRate verifies interactive replies and bulk sends
+// running concurrently share one budget and stay under the configured rate.
+func TestSendLimiter_CombinedRate(t *testing.T) {
+	const rate, senders, perSender = 20, 3, 10
+	a, tg := newTestApp(t, &countingAI{})
+	a.sendLimiter = newRateLimiter(rate)
+	ctx := context.Background()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		sendCtx := ctx
+		if i > 0 {
+			sendCtx = withBulk(ctx)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perSender; j++ {
+				a.sendMessage(sendCtx, int64(i+1), "hi", nil)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	total := senders * perSender
+	if got := len(tg.texts()); got != total {
+		t.Fatalf("expected %d messages, got %d", total, got)
+	}
+	// The first `rate` messages use the initial burst, the rest are paced.
+	if floor := time.Duration(total-rate) * time.Second / rate; elapsed < floor*9/10 {
+		t.Fatalf("%d messages sent in %v, faster than %d per second", total, elapsed, rate)
+	}
+}
+
+// TestSendLimiter_InteractiveFirst verifies a waiting interactive reply gets
+// the next token before a bulk send that has been waiting longer.
+func TestSendLimiter_InteractiveFirst(t *testing.T) {
+	l := newRateLimiter(10)
+	l.tokens = 0
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	wait := func(name string, bulk bool) {
+		defer wg.Done()
+		if err := l.Wait(ctx, bulk); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		mu.Lock()
+		order = append(order, name)
+		mu.Unlock()
+	}
+	wg.Add(2)
+	go wait("bulk", true)
+	time.Sleep(20 * time.Millisecond)
+	go wait("interactive", false)
+	wg.Wait()
+
+	if len(order) != 2 || order[0] != "interactive" {
+		t.Fatalf("interactive reply must go first, got %v", order)
+	}
+}
+
+// TestSendLimiter_ContextCancelled verifies a waiting sender gives up when its
+// context is done.
+func TestSendLimiter_ContextCancelled(t *testing.T) {
+	l := newRateLimiter(1)
+	l.tokens = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx, true); err == nil {
+		t.Fatalf("expected an error after the context is done")
+	}
+}
@@ -0,0 +1,220 @@
+package app
+
+import (
+	"context"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ilinovom/summary-tasks-bot/internal/model"
+	"github.com/ilinovom/summary-tasks-bot/internal/service"
+	"github.com/ilinovom/summary-tasks-bot/pkg/telegram"
+)
+
+// regenPrefix starts the callback data of a "🔁 <info type>" button; the rest
+// is the index of the info type in the digest.
+const regenPrefix = "regen:"
+
+// regensPerCharge is how many single info type regenerations share one unit of
+// the daily /get_news_now quota: every third one is charged.
+const regensPerCharge = 3
+
+// newsDigest is the latest /get_news_now result of a user, kept so that its
+// regenerate buttons can replace a single info type.
+type newsDigest struct {
+	Digest *service.InfoDigest
+	// MsgIDs are the messages the digest was sent as: a single one for a
+	// combined digest, one per info type with separate messages. An ID of 0
+	// marks a message too long to carry buttons.
+	MsgIDs []int
+	// Regens counts the regenerations made so far.
+	Regens int
+}
+
+// rememberNews caches the latest /get_news_now result of the user.
+func (a *App) rememberNews(userID int64, d newsDigest) {
+	a.digestMu.Lock()
+	defer a.digestMu.Unlock()
+	if a.newsCache == nil {
+		a.newsCache = map[int64]newsDigest{}
+	}
+	a.newsCache[userID] = d
+}
+
+// lastNews returns the cached /get_news_now result for the user.
+func (a *App) lastNews(userID int64) (newsDigest, bool) {
+	a.digestMu.Lock()
+	defer a.digestMu.Unlock()
+	d, ok := a.newsCache[userID]
+	return d, ok
+}
+
+// regenButtons returns the regenerate buttons of the i-th of n digest
+// messages: one per info type for a combined digest, or the one of its own
+// info type for a separate message.
+func regenButtons(d *service.InfoDigest, n, i int) [][]telegram.InlineButton {
+	button := func(j int) []telegram.InlineButton {
+		return []telegram.InlineButton{{Text: "🔁 " + d.Infos[j], CallbackData: regenPrefix + strconv.Itoa(j)}}
+	}
+	if n > 1 {
+		return [][]telegram.InlineButton{button(i)}
+	}
+	rows := make([][]telegram.InlineButton, len(d.Infos))
+	for j := range d.Infos {
+		rows[j] = button(j)
+	}
+	return rows
+}
+
+// sendNewsDigest sends the /get_news_now digest with its regenerate buttons,
+// editing the placeholder into the first message, and caches it for the
+// buttons.
+func (a *App) sendNewsDigest(ctx context.Context, chatID int64, placeholderID int, d *service.InfoDigest, msgs []string) error {
+	ids := make([]int, len(msgs))
+	for i, msg := range msgs {
+		id, err := a.sendInline(ctx, chatID, placeholderID, msg, regenButtons(d, len(msgs), i))
+		if err != nil {
+			return err
+		}
+		placeholderID = 0
+		ids[i] = id
+	}
+	a.rememberNews(chatID, newsDigest{Digest: d, MsgIDs: ids})
+	return nil
+}
+
+// sendInline sends model output as a MarkdownV2 message with inline buttons,
+// editing the placeholder into it when there is one. Text that does not fit
+// into a single message goes through replaceMessage without buttons and
+// yields the ID 0.
+func (a *App) sendInline(ctx context.Context, chatID int64, placeholderID int, text string, buttons [][]telegram.InlineButton) (int, error) {
+	v2 := markdownToV2(text)
+	if len([]rune(v2)) > 4096 {
+		return 0, a.replaceMessage(ctx, chatID, placeholderID, text, telegram.ParseModeMarkdownV2)
+	}
+	if placeholderID != 0 {
+		err := a.tgClient.EditInlineMessage(ctx, chatID, placeholderID, v2, buttons, telegram.ParseModeMarkdownV2)
+		if err == nil {
+			return placeholderID, nil
+		}
+		log.Printf("telegram edit message: %v", err)
+		defer a.deleteMessage(ctx, chatID, placeholderID)
+	}
+	if err := a.sendLimiter.Wait(ctx, isBulk(ctx)); err != nil {
+		return 0, err
+	}
+	msgID, err := a.tgClient.SendInlineMessage(ctx, chatID, v2, buttons, telegram.ParseModeMarkdownV2)
+	if err != nil {
+		log.Printf("telegram send message: %v\ntext: %s", err, v2)
+		a.noteBlocked(ctx, chatID, err)
+	}
+	return msgID, err
+}
+
+// answerCallback acknowledges a button press, optionally with a short notice
+// shown on top of the chat.
+func (a *App) answerCallback(ctx context.Context, queryID, text string) {
+	if err := a.tgClient.AnswerCallbackQuery(ctx, queryID, text); err != nil {
+		log.Printf("telegram answer callback: %v", err)
+	}
+}
+
+// handleCallback handles a press of an inline button. The only buttons are
+// the "🔁 <info type>" ones under a /get_news_now digest: they regenerate that
+// info type of the user's latest digest in the background and edit it into
+// the message. Buttons of older digests are answered with regen_stale.
+func (a *App) handleCallback(ctx context.Context, q *telegram.CallbackQuery) {
+	arg, ok := strings.CutPrefix(q.Data, regenPrefix)
+	if !ok || q.Message == nil {
+		a.answerCallback(ctx, q.ID, "")
+		return
+	}
+	chatID, msgID := q.Message.Chat.ID, q.Message.MessageID
+	log.Printf("user %d(@%s) pressed %s", chatID, q.From.Username, q.Data)
+	if a.inMaintenance(q.Message) {
+		a.answerCallback(ctx, q.ID, "")
+		a.sendMessage(ctx, chatID, a.ui().messages["maintenance"], nil)
+		return
+	}
+	i, err := strconv.Atoi(arg)
+	nd, ok := a.lastNews(chatID)
+	pos := slices.Index(nd.MsgIDs, msgID)
+	if err != nil || !ok || pos < 0 || i < 0 || i >= len(nd.Digest.Infos) || (len(nd.MsgIDs) > 1 && pos != i) {
+		a.answerCallback(ctx, q.ID, a.ui().messages["regen_stale"])
+		return
+	}
+	settings, err := a.repo.Get(ctx, chatID)
+	if err != nil {
+		log.Println("get settings:", err)
+		a.answerCallback(ctx, q.ID, "")
+		a.reportFailure(ctx, chatID, 0)
+		return
+	}
+	if settings == nil || len(nd.Digest.Messages(settings)) != len(nd.MsgIDs) {
+		a.answerCallback(ctx, q.ID, a.ui().messages["regen_stale"])
+		return
+	}
+
+	now := settings.LocalTime(a.clock.Now())
+	charge := (nd.Regens+1)%regensPerCharge == 0
+	if charge {
+		limit := a.tariffFor(settings.Tariff).Limits.GetNewsNowPerDay
+		if !service.SameDay(now, time.Unix(settings.LastGetNewsNow, 0)) {
+			settings.GetNewsNowCount = 0
+		}
+		if settings.GetNewsNowCount >= limit {
+			a.answerCallback(ctx, q.ID, "")
+			a.sendMessage(ctx, chatID, a.limitMessage(settings.GetNewsNowCount, limit, now), nil)
+			return
+		}
+	}
+	a.answerCallback(ctx, q.ID, a.ui().messages["regen_wait"])
+
+	gctx, done := a.startGeneration(ctx, chatID)
+	a.generating.Add(1)
+	go func() {
+		defer a.generating.Done()
+		defer done()
+		a.regenerateInfo(gctx, chatID, settings, nd, i, pos, charge, now)
+	}()
+}
+
+// regenerateInfo generates the i-th info type of the cached digest again on a
+// copy and edits the pos-th digest message into the new text. The quota is
+// only advanced for a charged regeneration once the message was updated.
+func (a *App) regenerateInfo(ctx context.Context, chatID int64, settings *model.UserSettings, nd newsDigest, i, pos int, charge bool, now time.Time) {
+	d := *nd.Digest
+	d.Parts = slices.Clone(d.Parts)
+	err := a.userService.RegenerateInfo(ctx, settings, &d, i)
+	if ctx.Err() != nil {
+		log.Printf("user %d: info regeneration cancelled", chatID)
+		return
+	}
+	if err != nil {
+		log.Println("regenerate info:", err)
+		a.reportFailure(ctx, chatID, 0)
+		return
+	}
+	text := d.Messages(settings)[pos]
+	v2 := markdownToV2(text)
+	if len([]rune(v2)) > 4096 {
+		err = a.replaceMessage(ctx, chatID, nd.MsgIDs[pos], text, telegram.ParseModeMarkdownV2)
+	} else {
+		buttons := regenButtons(&d, len(nd.MsgIDs), pos)
+		err = a.tgClient.EditInlineMessage(ctx, chatID, nd.MsgIDs[pos], v2, buttons, telegram.ParseModeMarkdownV2)
+	}
+	if err != nil {
+		log.Println("send msg err: ", err)
+		return
+	}
+	nd.Digest = &d
+	nd.Regens++
+	a.rememberNews(chatID, nd)
+	if charge {
+		a.updateSettings(ctx, chatID, func(u *model.UserSettings) {
+			chargeNewsNow(u, now)
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package app
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ilinovom/summary-tasks-bot/internal/model"
+	"github.com/ilinovom/summary-tasks-bot/pkg/telegram"
+)
+
+// press returns the update of a button press on the given message.
+func press(chatID int64, msgID int, data string) telegram.Update {
+	return telegram.Update{CallbackQuery: &telegram.CallbackQuery{
+		ID:      "q",
+		From:    telegram.User{ID: chatID},
+		Message: &telegram.Message{MessageID: msgID, Chat: telegram.Chat{ID: chatID}},
+		Data:    data,
+	}}
+}
+
+// TestRegenerateInfo_OnlyTargetedPart verifies a "🔁" button regenerates just
+// its info type, edits the digest in place keeping the other part, answers
+// presses on other messages as stale and charges every third regeneration.
+func TestRegenerateInfo_OnlyTargetedPart(t *testing.T) {
+	ai := &countingAI{reply: "old news"}
+	a, tg := newTestApp(t, ai)
+	ctx := context.Background()
+	a.ui().messages["prompt_choose_news_cat"] = "choose %s"
+	a.ui().messages["generating"] = "Генерирую…"
+	a.ui().messages["regen_stale"] = "stale"
+	if err := a.repo.Save(ctx, &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты", "Идеи"}}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	a.handleMessage(ctx, message(1, "/get_news_now"))
+	a.handleMessage(ctx, message(1, "1"))
+	a.generating.Wait()
+	buttons := tg.buttons[2]
+	if len(buttons) != 2 || buttons[1][0].Text != "🔁 Идеи" || buttons[1][0].CallbackData != "regen:1" {
+		t.Fatalf("unexpected buttons %+v", buttons)
+	}
+
+	ai.reply = "fresh news"
+	a.handleUpdate(ctx, press(1, 2, "regen:1"))
+	a.generating.Wait()
+	if ai.calls != 3 {
+		t.Fatalf("expected a single extra AI call, got %d calls", ai.calls)
+	}
+	edited := tg.edited[2]
+	first, second := strings.Index(edited, "old news"), strings.Index(edited, "fresh news")
+	if strings.Count(edited, "old news") != 1 || first < 0 || second < first {
+		t.Fatalf("expected only the second part regenerated, got %q", edited)
+	}
+	if len(tg.buttons[2]) != 2 {
+		t.Fatalf("buttons lost after regeneration: %+v", tg.buttons[2])
+	}
+
+	a.handleUpdate(ctx, press(1, 1, "regen:0"))
+	if ai.calls != 3 || tg.answers[len(tg.answers)-1] != "stale" {
+		t.Fatalf("expected a stale answer without generation, got %d calls, answers %q", ai.calls, tg.answers)
+	}
+
+	for range 2 {
+		a.handleUpdate(ctx, press(1, 2, "regen:0"))
+		a.generating.Wait()
+	}
+	u, _ := a.repo.Get(ctx, 1)
+	if u.GetNewsNowCount != 2 {
+		t.Fatalf("expected the third regeneration to use a quota unit, count %d", u.GetNewsNowCount)
+	}
+}
@@ -0,0 +1,107 @@
+package app
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ilinovom/summary-tasks-bot/internal/model"
+	"github.com/ilinovom/summary-tasks-bot/pkg/telegram"
+)
+
+// scriptStep is one inbound message of a scripted conversation together with
+// the outbound calls it must produce, in order. Expected sends match by
+// prefix, e.g. "send choose" matches "send choose 1. Наука".
+type scriptStep struct {
+	In   string
+	Want []string
+}
+
+// runScript feeds the steps to the app as messages from chatID and compares
+// the outbound calls recorded by tg after each step. Inbound messages get IDs
+// starting from 100 so their deletion is distinguishable from bot messages.
+func runScript(t *testing.T, a *App, tg *fakeTelegram, chatID int64, steps []scriptStep) {
+	t.Helper()
+	ctx := context.Background()
+	tg.takeEvents()
+	for i, step := range steps {
+		m := &telegram.Message{MessageID: 100 + i, Chat: telegram.Chat{ID: chatID, Username: "user"}, Text: step.In}
+		a.handleMessage(ctx, m)
+		got := tg.takeEvents()
+		if len(got) != len(step.Want) {
+			t.Fatalf("step %d (%q): expected %d calls %q, got %q", i, step.In, len(step.Want), step.Want, got)
+		}
+		for j, want := range step.Want {
+			if !strings.HasPrefix(got[j], want) {
+				t.Fatalf("step %d (%q) call %d: expected %q, got %q", i, step.In, j, want, got[j])
+			}
+		}
+	}
+}
+
+// scriptMessages are compact templates that keep scripted expectations short.
+var scriptMessages = map[string]string{
+	"choose_action":                "action",
+	"choose_delete_action":         "delete action",
+	"prompt_choose_existing_multi": "existing %s",
+	"prompt_choose_delete_multi":   "delete which %s",
+	"already_selected":             "selected: %s",
+	"prompt_choose_new":            "replace '%s' %s",
+	"prompt_choose_info":           "info '%s' max %d %s",
+	"settings_updated":             "updated:\n%s",
+}
+
+// newScriptApp prepares an app with compact messages and a user with two topics.
+func newScriptApp(t *testing.T) (*App, *fakeTelegram) {
+	t.Helper()
+	a, tg := newTestApp(t, nil)
+	for k, v := range scriptMessages {
+		a.ui().messages[k] = v
+	}
+	u := &model.UserSettings{UserID: 1, Tariff: "base", Active: true, Topics: map[string][]string{
+		"Наука": {"Факты"},
+		"Спорт": {"Тренды"},
+	}}
+	if err := a.repo.Save(context.Background(), u); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	return a, tg
+}
+
+// TestScript_UpdateSeveralTopics walks the "обновить несколько" path of
+// /update_topics: one existing category is replaced by a new one.
+func TestScript_UpdateSeveralTopics(t *testing.T) {
+	a, tg := newScriptApp(t)
+	runScript(t, a, tg, 1, []scriptStep{
+		{In: "/update_topics", Want: []string{"send action"}},
+		{In: "2", Want: []string{"delete 101", "delete 1", "send existing 1. Наука\n2. Спорт"}},
+		{In: "1", Want: []string{"delete 102", "delete 2", "send existing 1. Наука\n2. Спорт\n\nselected: Наука"}},
+		{In: "Готово", Want: []string{"delete 103", "delete 3", "send replace 'Наука'"}},
+		{In: "3", Want: []string{"delete 104", "delete 4", "send info 'Финансы' max 2"}},
+		{In: "2", Want: []string{"delete 105", "delete 5", "send info 'Финансы' max 2"}},
+		{In: "Готово", Want: []string{"delete 106", "delete 6", "send updated:\nСпорт: Тренды\nФинансы: Тренды"}},
+	})
+	if _, ok := a.convs.get(1); ok {
+		t.Fatalf("conversation should be finished")
+	}
+	u, _ := a.repo.Get(context.Background(), 1)
+	if _, ok := u.Topics["Наука"]; ok || len(u.Topics) != 2 {
+		t.Fatalf("unexpected topics: %#v", u.Topics)
+	}
+}
+
+// TestScript_DeleteSeveralTopics walks the "удалить несколько" path of
+// /delete_topics.
+func TestScript_DeleteSeveralTopics(t *testing.T) {
+	a, tg := newScriptApp(t)
+	runScript(t, a, tg, 1, []scriptStep{
+		{In: "/delete_topics", Want: []string{"send delete action"}},
+		{In: "2", Want: []string{"delete 101", "delete 1", "send delete which 1. Наука\n2. Спорт"}},
+		{In: "2", Want: []string{"delete 102", "delete 2", "send delete which 1. Наука\n2. Спорт\n\nselected: Спорт"}},
+		{In: "Готово", Want: []string{"delete 103", "delete 3", "send updated:\nНаука: Факты"}},
+	})
+	u, _ := a.repo.Get(context.Background(), 1)
+	if len(u.Topics) != 1 || len(u.Topics["Наука"]) != 1 {
+		t.Fatalf("unexpected topics: %#v", u.Topics)
+	}
+}
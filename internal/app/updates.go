@@ -0,0 +1,209 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/ilinovom/summary-tasks-bot/pkg/telegram"
+)
+
+// defaultUpdateQueueSize is used when UPDATE_QUEUE_SIZE is not set.
+const defaultUpdateQueueSize = 1000
+
+// updateQueue buffers polled updates until they are handled. Updates of one
+// chat keep their order while chats take turns, so a large backlog, e.g.
+// after downtime, or a flooding chat does not hold back everyone else. At
+// most size updates are buffered; push blocks while the queue is full.
+//
+// A popped update keeps its chat busy until done is called, so with several
+// workers a chat is handled by one of them at a time and its updates still
+// run in order.
+type updateQueue struct {
+	slots chan struct{}
+	ready chan struct{}
+
+	mu      sync.Mutex
+	pending map[int64][]telegram.Update
+	chats   []int64
+	busy    map[int64]bool
+	closed  bool
+}
+
+// errQueueClosed is returned by pop once the queue is closed and drained.
+var errQueueClosed = errors.New("update queue closed")
+
+// newUpdateQueue returns an empty queue holding up to size updates.
+func newUpdateQueue(size int) *updateQueue {
+	if size <= 0 {
+		size = defaultUpdateQueueSize
+	}
+	return &updateQueue{
+		slots:   make(chan struct{}, size),
+		ready:   make(chan struct{}, 1),
+		pending: map[int64][]telegram.Update{},
+		busy:    map[int64]bool{},
+	}
+}
+
+// push appends the update to its chat's queue, waiting for free space.
+func (q *updateQueue) push(ctx context.Context, u telegram.Update) error {
+	select {
+	case q.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	chat := updateChat(u)
+	q.mu.Lock()
+	if len(q.pending[chat]) == 0 && !q.busy[chat] {
+		q.chats = append(q.chats, chat)
+	}
+	q.pending[chat] = append(q.pending[chat], u)
+	q.mu.Unlock()
+	q.signal()
+	return nil
+}
+
+// pop waits for an update and returns the oldest one of the next chat in
+// turn that is not busy. The chat stays busy until done is called. After
+// close it returns errQueueClosed once no update is left.
+func (q *updateQueue) pop(ctx context.Context) (telegram.Update, error) {
+	for {
+		q.mu.Lock()
+		if q.closed && len(q.pending) == 0 {
+			q.mu.Unlock()
+			// Wake the next waiting worker so that it stops too.
+			q.signal()
+			return telegram.Update{}, errQueueClosed
+		}
+		if len(q.chats) > 0 {
+			chat := q.chats[0]
+			q.chats = q.chats[1:]
+			list := q.pending[chat]
+			u := list[0]
+			if len(list) > 1 {
+				q.pending[chat] = list[1:]
+			} else {
+				delete(q.pending, chat)
+			}
+			q.busy[chat] = true
+			more := len(q.chats) > 0
+			q.mu.Unlock()
+			<-q.slots
+			if more {
+				q.signal()
+			}
+			return u, nil
+		}
+		q.mu.Unlock()
+		select {
+		case <-q.ready:
+		case <-ctx.Done():
+			return telegram.Update{}, ctx.Err()
+		}
+	}
+}
+
+// done releases the chat of an update returned by pop, letting its next
+// update be handled.
+func (q *updateQueue) done(u telegram.Update) {
+	chat := updateChat(u)
+	q.mu.Lock()
+	delete(q.busy, chat)
+	queued := len(q.pending[chat]) > 0
+	if queued {
+		q.chats = append(q.chats, chat)
+	}
+	q.mu.Unlock()
+	if queued {
+		q.signal()
+	}
+}
+
+// close marks the end of the input: the updates still queued are handed out,
+// then pop reports errQueueClosed.
+func (q *updateQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.signal()
+}
+
+// signal wakes a waiting pop.
+func (q *updateQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// chatLocks keeps what is sent to one chat in order across senders: a worker
+// holds the chat's lock while it handles an update and bulk senders, such as
+// scheduled digests, take it for a whole digest, so a digest never lands in
+// the middle of an interactive reply. Locks of idle chats are dropped.
+type chatLocks struct {
+	mu    sync.Mutex
+	locks map[int64]*chatLock
+}
+
+// chatLock is the lock of a single chat and the number of its holders and
+// waiters.
+type chatLock struct {
+	ch    chan struct{}
+	users int
+}
+
+// newChatLocks returns an empty set of chat locks.
+func newChatLocks() *chatLocks {
+	return &chatLocks{locks: map[int64]*chatLock{}}
+}
+
+// lock waits until the chat is free or ctx is done and returns the function
+// releasing it.
+func (l *chatLocks) lock(ctx context.Context, chatID int64) (func(), error) {
+	l.mu.Lock()
+	cl, ok := l.locks[chatID]
+	if !ok {
+		cl = &chatLock{ch: make(chan struct{}, 1)}
+		l.locks[chatID] = cl
+	}
+	cl.users++
+	l.mu.Unlock()
+
+	select {
+	case cl.ch <- struct{}{}:
+		return func() {
+			<-cl.ch
+			l.leave(chatID, cl)
+		}, nil
+	case <-ctx.Done():
+		l.leave(chatID, cl)
+		return nil, ctx.Err()
+	}
+}
+
+// leave forgets a holder or waiter of the chat's lock, dropping the lock
+// once nobody uses it.
+func (l *chatLocks) leave(chatID int64, cl *chatLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cl.users--
+	if cl.users == 0 {
+		delete(l.locks, chatID)
+	}
+}
+
+// updateChat returns the chat an update belongs to, or 0 if it has none.
+func updateChat(u telegram.Update) int64 {
+	switch {
+	case u.Message != nil:
+		return u.Message.Chat.ID
+	case u.EditedMessage != nil:
+		return u.EditedMessage.Chat.ID
+	case u.CallbackQuery != nil && u.CallbackQuery.Message != nil:
+		return u.CallbackQuery.Message.Chat.ID
+	case u.CallbackQuery != nil:
+		return u.CallbackQuery.From.ID
+	}
+	return 0
+}
@@ -0,0 +1,281 @@
+package app
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ilinovom/summary-tasks-bot/internal/model"
+	"github.com/ilinovom/summary-tasks-bot/pkg/telegram"
+)
+
+// update builds a text update from the chat.
+func update(id int, chatID int64) telegram.Update {
+	return telegram.Update{UpdateID: id, Message: &telegram.Message{MessageID: id, Chat: telegram.Chat{ID: chatID}, Text: "hello"}}
+}
+
+// TestUpdateQueue_FairAndBounded verifies chats take turns while each keeps
+// its order, and that pushing into a full queue blocks.
+func TestUpdateQueue_FairAndBounded(t *testing.T) {
+	q := newUpdateQueue(3)
+	ctx := context.Background()
+	for id := 1; id <= 3; id++ {
+		if err := q.push(ctx, update(id, 1)); err != nil {
+			t.Fatalf("push %d: %v", id, err)
+		}
+	}
+	full, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := q.push(full, update(4, 2)); err == nil {
+		t.Fatalf("push into a full queue must block")
+	}
+
+	var got []int
+	pop := func() {
+		u, err := q.pop(ctx)
+		if err != nil {
+			t.Fatalf("pop: %v", err)
+		}
+		q.done(u)
+		got = append(got, u.UpdateID)
+	}
+	pop()
+	if err := q.push(ctx, update(4, 2)); err != nil {
+		t.Fatalf("push after pop: %v", err)
+	}
+	pop()
+	pop()
+	pop()
+	if want := []int{1, 2, 4, 3}; !slices.Equal(got, want) {
+		t.Fatalf("unexpected order %v, want %v", got, want)
+	}
+}
+
+// batchTelegram serves the queued update batches once each and then blocks
+// like an idle long poll, recording the requested offsets. Every sent message
+// takes a millisecond, like a real round trip.
+type batchTelegram struct {
+	*fakeTelegram
+	mu      sync.Mutex
+	batches [][]telegram.Update
+	offsets []int
+}
+
+// SendMessage records the message after a short delay.
+func (b *batchTelegram) SendMessage(ctx context.Context, chatID int64, text string, keyboard [][]string, mode telegram.ParseMode) (int, error) {
+	time.Sleep(time.Millisecond)
+	return b.fakeTelegram.SendMessage(ctx, chatID, text, keyboard, mode)
+}
+
+// GetUpdates returns the next batch or waits for the context to end.
+func (b *batchTelegram) GetUpdates(ctx context.Context, offset int) ([]telegram.Update, error) {
+	b.mu.Lock()
+	b.offsets = append(b.offsets, offset)
+	var batch []telegram.Update
+	if len(b.batches) > 0 {
+		batch, b.batches = b.batches[0], b.batches[1:]
+	}
+	b.mu.Unlock()
+	if batch == nil {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return batch, nil
+}
+
+// TestHandleUpdates_LargeBatch feeds a large backlog of one chat followed by
+// a live message from another and checks that the offset advances past every
+// update, the queue keeps polling while the backlog is handled and the live
+// chat does not wait for the whole backlog.
+func TestHandleUpdates_LargeBatch(t *testing.T) {
+	const backlog = 200
+	a, tg := newTestApp(t, &countingAI{})
+	a.cfg.UpdateQueueSize = 20
+	var first []telegram.Update
+	for id := 1; id <= backlog; id++ {
+		first = append(first, update(id, 1))
+	}
+	bt := &batchTelegram{fakeTelegram: tg, batches: [][]telegram.Update{first, {update(backlog+1, 2)}}}
+	a.tgClient = bt
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.handleUpdates(ctx)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(tg.texts()) < backlog+1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("handled %d of %d updates", len(tg.texts()), backlog+1)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	bt.mu.Lock()
+	offsets := bt.offsets
+	bt.mu.Unlock()
+	if want := []int{0, backlog + 1, backlog + 2}; !slices.Equal(offsets, want) {
+		t.Fatalf("unexpected offsets %v, want %v", offsets, want)
+	}
+	tg.mu.Lock()
+	live := slices.IndexFunc(tg.sent, func(s sentMessage) bool { return s.ChatID == 2 })
+	tg.mu.Unlock()
+	if live < 0 || live > backlog-a.cfg.UpdateQueueSize/2 {
+		t.Fatalf("live chat answered at position %d of %d", live, backlog+1)
+	}
+}
+
+// TestHandleUpdates_DrainsQueueOnShutdown verifies the updates already polled
+// when the bot is stopped are still answered before handleUpdates returns.
+func TestHandleUpdates_DrainsQueueOnShutdown(t *testing.T) {
+	const backlog = 30
+	a, tg := newTestApp(t, &countingAI{})
+	a.cfg.ShutdownGrace = 5 * time.Second
+	var batch []telegram.Update
+	for id := 1; id <= backlog; id++ {
+		batch = append(batch, update(id, int64(id%3)+1))
+	}
+	a.tgClient = &batchTelegram{fakeTelegram: tg, batches: [][]telegram.Update{batch}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.handleUpdates(ctx)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(tg.texts()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("no update was handled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("handleUpdates did not return after the queue was drained")
+	}
+	if n := len(tg.texts()); n != backlog {
+		t.Fatalf("expected all %d queued updates answered, got %d", backlog, n)
+	}
+}
+
+// slowTelegram blocks replies to chat 1 until release is closed and counts
+// the replies started for it.
+type slowTelegram struct {
+	*batchTelegram
+	release chan struct{}
+	started atomic.Int32
+}
+
+// SendMessage waits for the release before replying to chat 1.
+func (s *slowTelegram) SendMessage(ctx context.Context, chatID int64, text string, keyboard [][]string, mode telegram.ParseMode) (int, error) {
+	if chatID == 1 {
+		s.started.Add(1)
+		<-s.release
+	}
+	return s.batchTelegram.SendMessage(ctx, chatID, text, keyboard, mode)
+}
+
+// TestHandleUpdates_SlowChatDoesNotBlockOthers verifies a second chat is
+// answered while the reply to the first one hangs, and that the first chat's
+// next message waits for its previous one.
+func TestHandleUpdates_SlowChatDoesNotBlockOthers(t *testing.T) {
+	a, tg := newTestApp(t, &countingAI{})
+	a.cfg.UpdateWorkers = 2
+	st := &slowTelegram{
+		batchTelegram: &batchTelegram{fakeTelegram: tg, batches: [][]telegram.Update{{update(1, 1), update(2, 1), update(3, 2)}}},
+		release:       make(chan struct{}),
+	}
+	a.tgClient = st
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.handleUpdates(ctx)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(tg.texts()) < 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("chat 2 was not answered while chat 1 is slow")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := st.started.Load(); n != 1 {
+		t.Fatalf("chat 1 must be handled one message at a time, %d replies started", n)
+	}
+	close(st.release)
+	for len(tg.texts()) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("handled %d of 3 updates", len(tg.texts()))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	if tg.sent[0].ChatID != 2 {
+		t.Fatalf("expected chat 2 to be answered first, got %+v", tg.sent)
+	}
+}
+
+// TestSendScheduled_WaitsForInFlightReply verifies a scheduled digest to a
+// chat whose update is being handled is sent after the handler's reply, not
+// in the middle of it.
+func TestSendScheduled_WaitsForInFlightReply(t *testing.T) {
+	a, tg := newTestApp(t, &countingAI{reply: "digest"})
+	st := &slowTelegram{
+		batchTelegram: &batchTelegram{fakeTelegram: tg, batches: [][]telegram.Update{{update(1, 1)}}},
+		release:       make(chan struct{}),
+	}
+	a.tgClient = st
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.handleUpdates(ctx)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for st.started.Load() < 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the reply to chat 1 was not started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	sent := make(chan struct{})
+	go func() {
+		u := &model.UserSettings{UserID: 1, Active: true, Tariff: "base", Topics: map[string][]string{"Наука": {"Факты"}}}
+		a.sendScheduled(withBulk(ctx), u, time.Now())
+		close(sent)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if n := st.started.Load(); n != 1 {
+		t.Fatalf("the digest must wait for the in-flight reply, %d sends started", n)
+	}
+	close(st.release)
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the digest was not sent after the reply")
+	}
+	cancel()
+	<-done
+
+	texts := tg.texts()
+	if len(texts) != 2 || strings.Contains(texts[0], "digest") || !strings.Contains(texts[1], "digest") {
+		t.Fatalf("expected the reply before the digest, got %q", texts)
+	}
+}
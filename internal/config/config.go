@@ -3,41 +3,114 @@ package config
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Config holds runtime configuration loaded from the environment.
 type Options struct {
-	InfoOptions     []string `json:"info_options"`
-	CategoryOptions []string `json:"category_options"`
+	InfoOptions      []string      `json:"info_options"`
+	CategoryOptions  []string      `json:"category_options"`
+	KeyboardPageSize int           `json:"keyboard_page_size"`
+	SafeModePrompt   string        `json:"safe_mode_prompt"`
+	BannedWords      []string      `json:"banned_words"`
+	OptOutKeywords   []string      `json:"opt_out_keywords"`
+	InfoGroups       []OptionGroup `json:"info_groups"`
+	// InfoAliases maps former info option names to their current ones, so
+	// topics stored before a rename keep working.
+	InfoAliases map[string]string `json:"info_aliases"`
+	// CustomCategoryMinWords, CustomCategoryMaxWords and
+	// CustomCategoryWordLen bound the name of a custom category: how many
+	// words it may have and how many characters each word may have. Zero
+	// keeps the default.
+	CustomCategoryMinWords int `json:"custom_category_min_words"`
+	CustomCategoryMaxWords int `json:"custom_category_max_words"`
+	CustomCategoryWordLen  int `json:"custom_category_word_len"`
+}
+
+// OptionGroup is a titled section of options shown together in a prompt.
+type OptionGroup struct {
+	Title   string   `json:"title"`
+	Options []string `json:"options"`
+}
+
+// groupedInfoOptions flattens InfoGroups in display order.
+func (o Options) groupedInfoOptions() []string {
+	var out []string
+	for _, g := range o.InfoGroups {
+		out = append(out, g.Options...)
+	}
+	return out
 }
 
 type Schedule struct {
-	FrequencyMinutes int    `json:"frequency_minutes"`
-	TimeRange        string `json:"time_range"`
+	FrequencyMinutes    int    `json:"frequency_minutes"`
+	TimeRange           string `json:"time_range"`
+	RotationWindowHours int    `json:"rotation_window_hours"`
+	JitterMinutes       int    `json:"jitter_minutes"`
+	// MinFrequencyMinutes is the interval used while a user's /boost is
+	// active; zero or a value not below FrequencyMinutes disables boosting.
+	MinFrequencyMinutes int `json:"min_frequency_minutes"`
 }
 
 type Limits struct {
 	GetNewsNowPerDay    int `json:"get_news_now_per_day"`
 	GetLast24hNewPerDay int `json:"get_last_24h_new_per_day"`
+	// TrialLast24hPerDay is the daily last-24h limit of users on a
+	// last-24h trial; zero allows one request a day.
+	TrialLast24hPerDay  int `json:"trial_last_24h_per_day"`
 	CategoryLimit       int `json:"category_limit"`
 	InfoTypeLimit       int `json:"info_type_limit"`
+	MaxCustomCategories int `json:"max_custom_categories"`
+	TotalInfoTypeLimit  int `json:"total_info_type_limit"`
 }
 
 type GPTConfig struct {
-	Model         string `json:"model"`
-	PromptMain    string `json:"prompt_main"`
-	PromptLast24h string `json:"prompt_last_24h"`
-	MaxTokens     int    `json:"max_tokens"`
-	Style         string `json:"style"`
-	Volume        string `json:"volume"`
+	Model                string   `json:"model"`
+	PromptMain           string   `json:"prompt_main"`
+	PromptLast24h        string   `json:"prompt_last_24h"`
+	PromptLast24hSources string   `json:"prompt_last_24h_sources"`
+	MaxTokens            int      `json:"max_tokens"`
+	MaxPromptChars       int      `json:"max_prompt_chars"`
+	Style                string   `json:"style"`
+	Volume               string   `json:"volume"`
+	StylePresets         []string `json:"style_presets"`
+	VolumePresets        []string `json:"volume_presets"`
+	// PromptTemplates are named alternatives to PromptMain, e.g. "analytical"
+	// or "casual", that users pick with /style.
+	PromptTemplates map[string]string `json:"prompt_templates,omitempty"`
+	// OnTruncate selects how a completion cut at MaxTokens is retried once:
+	// TruncateConcise asks the model to fit the limit, TruncateMoreTokens
+	// doubles the limit up to MaxTokensCap. Empty keeps the partial reply.
+	OnTruncate   string `json:"on_truncate"`
+	MaxTokensCap int    `json:"max_tokens_cap"`
+	// MinTokens is the lowest token limit a user may pick with /length;
+	// MaxTokens is the highest.
+	MinTokens int `json:"min_tokens"`
+	// TemperatureScheduled applies to scheduled digests and
+	// TemperatureOnDemand to requests made by the user. When only one is
+	// set it is used for both; with neither the model default applies.
+	TemperatureScheduled *float64 `json:"temperature_scheduled,omitempty"`
+	TemperatureOnDemand  *float64 `json:"temperature_on_demand,omitempty"`
 }
 
+// Strategies for GPTConfig.OnTruncate.
+const (
+	TruncateConcise    = "concise"
+	TruncateMoreTokens = "more_tokens"
+)
+
 type Tariff struct {
 	Schedule            Schedule  `json:"schedule"`
 	Limits              Limits    `json:"limits"`
 	GPT                 GPTConfig `json:"gpt"`
 	AllowCustomCategory bool      `json:"allow_custom_category"`
+	// Tier orders tariffs from the cheapest up, e.g. in /compare.
+	Tier int `json:"tier"`
 }
 
 type Config struct {
@@ -51,6 +124,59 @@ type Config struct {
 	PromptFile    string
 	TariffFile    string
 	MessagesFile  string
+	Admins        []string
+	BatchSize     int
+	Workers       int
+	NoFirstDigest bool
+	// PruneInterval, PruneRetention and PruneDryRun configure the job that
+	// deletes users who blocked the bot; a zero interval or retention
+	// disables it.
+	PruneInterval  time.Duration
+	PruneRetention time.Duration
+	PruneDryRun    bool
+	// HandleEdits feeds edited messages into the active conversation.
+	HandleEdits bool
+	// SendRate is the global limit of outgoing messages per second shared
+	// by interactive replies and scheduled digests; zero disables it.
+	SendRate int
+	// Maintenance starts the bot in maintenance mode: no scheduled digests
+	// and a notice instead of command replies for everyone but admins.
+	Maintenance bool
+	// UpdateQueueSize bounds the number of polled updates waiting to be
+	// handled.
+	UpdateQueueSize int
+	// UpdateWorkers is how many chats are handled at the same time.
+	UpdateWorkers int
+	// ChargeFailedNews counts /get_news_now requests that produced no news
+	// against the daily quota; by default the unit is given back.
+	ChargeFailedNews bool
+	// HealthAddr is the listen address of the /healthz and /readyz
+	// endpoints; empty disables them.
+	HealthAddr string
+	// OpenAIChatBaseURL and OpenAIResponsesBaseURL route chat completions
+	// and the responses endpoint to separate gateways; both default to
+	// OpenAIBaseURL.
+	OpenAIChatBaseURL      string
+	OpenAIResponsesBaseURL string
+	// DebugPrompts logs every prompt sent to the model with the beginning
+	// of the reply.
+	DebugPrompts bool
+	// ConflictBackoff is how long to wait before polling again after
+	// Telegram reported another instance polling with the same token.
+	ConflictBackoff time.Duration
+	// OpenAIMaxRetries and OpenAIRetryBase configure how failed OpenAI
+	// requests are repeated.
+	OpenAIMaxRetries int
+	OpenAIRetryBase  time.Duration
+	// SearchConcurrency is how many web-search requests for last-24h
+	// digests run at the same time; further ones wait.
+	SearchConcurrency int
+	// WelcomeRetries is how many times a failed welcome message of /start is
+	// sent again before the user is left to repeat the command.
+	WelcomeRetries int
+	// ShutdownGrace is how long work accepted before a shutdown, such as
+	// queued updates and scheduled digests under way, may still run.
+	ShutdownGrace time.Duration
 
 	Options  Options
 	Tariffs  map[string]Tariff
@@ -72,7 +198,30 @@ func FromEnv() (*Config, error) {
 		OptionsFile:   os.Getenv("OPTIONS_FILE"),
 		TariffFile:    os.Getenv("TARIFF_FILE"),
 		MessagesFile:  os.Getenv("MESSAGES_FILE"),
+		Admins:        splitList(os.Getenv("ADMIN_USERNAMES")),
+		BatchSize:     envInt("SCHEDULER_BATCH_SIZE", 100),
+		Workers:       envInt("SCHEDULER_WORKERS", 1),
+		SendRate:      envNonNegInt("TELEGRAM_SEND_RATE", 25),
 	}
+	c.NoFirstDigest, _ = strconv.ParseBool(os.Getenv("DISABLE_FIRST_DIGEST"))
+	c.PruneInterval = time.Duration(envInt("PRUNE_INTERVAL_HOURS", 0)) * time.Hour
+	c.PruneRetention = time.Duration(envInt("PRUNE_RETENTION_DAYS", 0)) * 24 * time.Hour
+	c.PruneDryRun, _ = strconv.ParseBool(os.Getenv("PRUNE_DRY_RUN"))
+	c.HandleEdits = envBool("HANDLE_EDITED_MESSAGES", true)
+	c.UpdateQueueSize = envInt("UPDATE_QUEUE_SIZE", 1000)
+	c.UpdateWorkers = envInt("UPDATE_WORKERS", 4)
+	c.ChargeFailedNews = envBool("CHARGE_FAILED_NEWS", false)
+	c.HealthAddr = os.Getenv("HEALTH_ADDR")
+	c.Maintenance = envBool("MAINTENANCE", false)
+	c.OpenAIChatBaseURL = os.Getenv("OPENAI_CHAT_BASE_URL")
+	c.OpenAIResponsesBaseURL = os.Getenv("OPENAI_RESPONSES_BASE_URL")
+	c.DebugPrompts = envBool("DEBUG_PROMPTS", false)
+	c.ConflictBackoff = time.Duration(envInt("TELEGRAM_CONFLICT_BACKOFF_SECONDS", 30)) * time.Second
+	c.OpenAIMaxRetries = envNonNegInt("OPENAI_MAX_RETRIES", 2)
+	c.OpenAIRetryBase = time.Duration(envInt("OPENAI_RETRY_BASE_MS", 500)) * time.Millisecond
+	c.SearchConcurrency = envInt("OPENAI_SEARCH_CONCURRENCY", 2)
+	c.WelcomeRetries = envNonNegInt("WELCOME_SEND_RETRIES", 1)
+	c.ShutdownGrace = time.Duration(envInt("SHUTDOWN_GRACE_SECONDS", 20)) * time.Second
 	if c.TelegramToken == "" {
 		return nil, errors.New("TELEGRAM_TOKEN is not set")
 	}
@@ -85,6 +234,12 @@ func FromEnv() (*Config, error) {
 	if c.OpenAIBaseURL == "" {
 		c.OpenAIBaseURL = "https://api.openai.com/v1"
 	}
+	if c.OpenAIChatBaseURL == "" {
+		c.OpenAIChatBaseURL = c.OpenAIBaseURL
+	}
+	if c.OpenAIResponsesBaseURL == "" {
+		c.OpenAIResponsesBaseURL = c.OpenAIBaseURL
+	}
 	if c.OptionsFile == "" {
 		c.OptionsFile = "options.json"
 	}
@@ -94,18 +249,141 @@ func FromEnv() (*Config, error) {
 	if c.MessagesFile == "" {
 		c.MessagesFile = "messages.json"
 	}
-	if err := c.loadOptions(); err != nil {
-		return nil, err
+	if len(c.Admins) == 0 {
+		c.Admins = []string{"omilinov"}
 	}
-	if err := c.loadTariffs(); err != nil {
+	if err := c.loadFiles(); err != nil {
 		return nil, err
 	}
-	if err := c.loadMessages(); err != nil {
+	if err := c.Validate(); err != nil {
 		return nil, err
 	}
 	return c, nil
 }
 
+// Reload reads options, tariffs and messages from the configured files into a
+// copy of the configuration and validates it. The receiver is not modified.
+func (c *Config) Reload() (*Config, error) {
+	next := *c
+	next.Options = Options{}
+	next.Tariffs = nil
+	next.Messages = nil
+	if err := next.loadFiles(); err != nil {
+		return nil, err
+	}
+	if err := next.Validate(); err != nil {
+		return nil, err
+	}
+	return &next, nil
+}
+
+// Validate checks that the loaded configuration is usable by the bot.
+func (c *Config) Validate() error {
+	if len(c.Options.CategoryOptions) == 0 {
+		return errors.New("config: category_options is empty")
+	}
+	if len(c.Options.InfoOptions) == 0 {
+		return errors.New("config: info_options is empty")
+	}
+	if len(c.Options.InfoGroups) > 0 && !slices.Equal(c.Options.groupedInfoOptions(), c.Options.InfoOptions) {
+		return errors.New("config: info_groups do not match info_options")
+	}
+	for from, to := range c.Options.InfoAliases {
+		if !slices.Contains(c.Options.InfoOptions, to) {
+			return fmt.Errorf("config: info alias %q points to unknown info option %q", from, to)
+		}
+	}
+	if _, ok := c.Tariffs["base"]; !ok {
+		return errors.New("config: base tariff is not defined")
+	}
+	names := make([]string, 0, len(c.Tariffs))
+	for name := range c.Tariffs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if rng := c.Tariffs[name].Schedule.TimeRange; rng != "" {
+			if _, _, err := ParseTimeRange(rng); err != nil {
+				return fmt.Errorf("config: tariff %q: %w", name, err)
+			}
+		}
+	}
+	if len(c.Messages) == 0 {
+		return errors.New("config: no messages loaded")
+	}
+	return checkMessages(c.Messages)
+}
+
+// ParseTimeRange parses a schedule time_range of the form "HH:MM-HH:MM" and
+// returns its start and end as clock times on the zero date.
+func ParseTimeRange(rng string) (start, end time.Time, err error) {
+	parts := strings.Split(rng, "-")
+	if len(parts) != 2 {
+		return start, end, fmt.Errorf("invalid time_range %q: want HH:MM-HH:MM", rng)
+	}
+	start, err = time.Parse("15:04", parts[0])
+	if err == nil {
+		end, err = time.Parse("15:04", parts[1])
+	}
+	if err != nil {
+		return start, end, fmt.Errorf("invalid time_range %q: want HH:MM-HH:MM", rng)
+	}
+	return start, end, nil
+}
+
+// loadFiles reads all file-based configuration parts.
+func (c *Config) loadFiles() error {
+	if err := c.loadOptions(); err != nil {
+		return err
+	}
+	if err := c.loadTariffs(); err != nil {
+		return err
+	}
+	return c.loadMessages()
+}
+
+// envInt reads a positive integer from the environment, falling back to def
+// when the variable is unset or invalid.
+func envInt(name string, def int) int {
+	n, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || n <= 0 {
+		return def
+	}
+	return n
+}
+
+// envNonNegInt reads a non-negative integer from the environment, so that 0
+// can switch a feature off, falling back to def when the variable is unset or
+// invalid.
+func envNonNegInt(name string, def int) int {
+	n, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || n < 0 {
+		return def
+	}
+	return n
+}
+
+// envBool reads a boolean environment variable, returning def when it is
+// unset or invalid.
+func envBool(name string, def bool) bool {
+	b, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return b
+}
+
+// splitList parses a comma separated list, dropping empty items.
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
 // loadOptions reads info and category options from disk.
 func (c *Config) loadOptions() error {
 	file, err := os.Open(c.OptionsFile)
@@ -113,7 +391,13 @@ func (c *Config) loadOptions() error {
 		return err
 	}
 	defer file.Close()
-	return json.NewDecoder(file).Decode(&c.Options)
+	if err := json.NewDecoder(file).Decode(&c.Options); err != nil {
+		return err
+	}
+	if len(c.Options.InfoOptions) == 0 {
+		c.Options.InfoOptions = c.Options.groupedInfoOptions()
+	}
+	return nil
 }
 
 // loadTariffs loads tariff definitions from the configured file.
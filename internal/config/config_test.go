@@ -0,0 +1,103 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+// validConfig returns a minimal configuration that passes Validate.
+func validConfig(timeRange string) *Config {
+	return &Config{
+		Options: Options{InfoOptions: []string{"Факты"}, CategoryOptions: []string{"Наука"}},
+		Tariffs: map[string]Tariff{
+			"base": {},
+			"plus": {Schedule: Schedule{TimeRange: timeRange}},
+		},
+		Messages: map[string]string{"start": "hi"},
+	}
+}
+
+// TestValidate_TimeRange verifies that well-formed or empty time ranges are
+// accepted and malformed ones are rejected with the tariff named.
+func TestValidate_TimeRange(t *testing.T) {
+	for _, rng := range []string{"", "05:00-19:00", "22:00-06:00", "8:30-9:45", "00:00-23:59"} {
+		if err := validConfig(rng).Validate(); err != nil {
+			t.Errorf("%q: unexpected error %v", rng, err)
+		}
+	}
+	for _, rng := range []string{"05:00", "05:00-19:00-20:00", "5-19", "05:00–19:00", "25:00-26:00", "05:60-19:00", "05:00-", " 05:00-19:00", "утро-вечер"} {
+		err := validConfig(rng).Validate()
+		if err == nil || !strings.Contains(err.Error(), `tariff "plus"`) {
+			t.Errorf("%q: expected an error naming the tariff, got %v", rng, err)
+		}
+	}
+}
+
+// TestValidate_InfoAliases verifies aliases must point to an existing info
+// option.
+func TestValidate_InfoAliases(t *testing.T) {
+	c := validConfig("")
+	c.Options.InfoAliases = map[string]string{"Старые факты": "Факты"}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	c.Options.InfoAliases = map[string]string{"Факты": "Новые факты"}
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), `"Новые факты"`) {
+		t.Fatalf("expected an error naming the unknown option, got %v", err)
+	}
+}
+
+// TestValidate_MessageArgs verifies a template whose verbs do not match the
+// arguments the bot passes is rejected with its name and the formatting error.
+func TestValidate_MessageArgs(t *testing.T) {
+	c := validConfig("")
+	c.Messages["prompt_choose_category"] = "Категория %d:\n%s"
+	c.Messages["limit_today"] = "Лимит исчерпан"
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	c.Messages["prompt_choose_category"] = "Категория %s:\n%s"
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "%!s(int=1)") {
+		t.Fatalf("expected a wrong verb to be rejected, got %v", err)
+	}
+	c.Messages["prompt_choose_category"] = "Категория %d, выберите из списка"
+	err := c.Validate()
+	if err == nil || !strings.Contains(err.Error(), `"prompt_choose_category"`) || !strings.Contains(err.Error(), "%!(EXTRA string=1. Наука)") {
+		t.Fatalf("expected an error naming the template, got %v", err)
+	}
+}
+
+// TestValidate_RepoMessages verifies the shipped messages.json matches the
+// arguments of every template.
+func TestValidate_RepoMessages(t *testing.T) {
+	c := validConfig("")
+	c.MessagesFile = "../../messages.json"
+	if err := c.loadMessages(); err != nil {
+		t.Fatalf("load messages: %v", err)
+	}
+	if err := checkMessages(c.Messages); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestParseTimeRange checks the parsed bounds of a valid range.
+func TestParseTimeRange(t *testing.T) {
+	start, end, err := ParseTimeRange("22:15-06:05")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if start.Hour() != 22 || start.Minute() != 15 || end.Hour() != 6 || end.Minute() != 5 {
+		t.Fatalf("unexpected bounds %s - %s", start.Format("15:04"), end.Format("15:04"))
+	}
+}
+
+// TestEnvNonNegInt verifies 0 is kept while unset, invalid and negative
+// values fall back to the default.
+func TestEnvNonNegInt(t *testing.T) {
+	for value, want := range map[string]int{"": 2, "0": 0, "3": 3, "-1": 2, "x": 2} {
+		t.Setenv("TEST_NON_NEG", value)
+		if got := envNonNegInt("TEST_NON_NEG", 2); got != want {
+			t.Fatalf("%q: got %d, want %d", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// messageArgs lists the message templates the bot renders with fmt.Sprintf
+// together with sample arguments of the types it passes, in order. Keep it in
+// sync when a template gains or loses an argument.
+var messageArgs = map[string][]any{
+	"already_selected":              {"Наука"},
+	"boost_on":                      {60, "01.01.2025 10:00"},
+	"categories_merged":             {"Наука", "Спорт"},
+	"category_tone_choose":          {"Наука", "%s"},
+	"category_tone_choose_category": {"1. Наука"},
+	"category_tone_saved":           {"Наука", "живо"},
+	"clone_choose_category":         {"1. Наука"},
+	"clone_enter_name":              {"Наука", 1, 3},
+	"clone_exists":                  {"Наука"},
+	"empty_category":                {"Наука"},
+	"enter_custom_category":         {1, 3},
+	"enter_words":                   {1, 3},
+	"format_choose":                 {"текст"},
+	"format_saved":                  {"текст"},
+	"history_more":                  {2},
+	"history_page":                  {1, 2, "подборка"},
+	"interests_suggested":           {"1. Наука"},
+	"length_choose":                 {"средняя"},
+	"length_saved":                  {"средняя", 500},
+	"limit_custom_categories":       {1},
+	"limit_today":                   {1, 5, "01.01.2025 00:00"},
+	"limit_total_infos":             {4, 1},
+	"per_send_choose":               {1},
+	"per_send_saved":                {2},
+	"next_outside_hours":            {"01.01.2025 10:00"},
+	"next_send":                     {"01.01.2025 10:00"},
+	"profile_limit":                 {5},
+	"profile_loaded":                {"работа", "Наука: Факты"},
+	"profile_not_found":             {"работа"},
+	"profile_over_limit":            {"работа"},
+	"profile_save_usage":            {30},
+	"profile_saved":                 {"работа"},
+	"profiles_list":                 {"работа"},
+	"prompt_choose_category":        {1, "1. Наука"},
+	"prompt_choose_count":           {2},
+	"prompt_choose_delete_multi":    {"1. Наука"},
+	"prompt_choose_existing_multi":  {"1. Наука"},
+	"prompt_choose_info":            {"Наука", 2, "1. Факты"},
+	"prompt_choose_info_all":        {"Наука", 2, "1. Факты"},
+	"prompt_choose_last24_cat":      {"1. Наука"},
+	"prompt_choose_new":             {"Наука", "1. Спорт"},
+	"prompt_choose_new_multi":       {2, "1. Наука"},
+	"prompt_choose_news_cat":        {"1. Наука"},
+	"quota_left":                    {4, 5},
+	"rate_prompt":                   {"Наука"},
+	"reading_list_caption":          {"Наука", "01.01.2025"},
+	"settings_saved":                {"Наука: Факты"},
+	"settings_updated":              {"Наука: Факты"},
+	"snooze_choose_category":        {"1. Наука"},
+	"snooze_choose_duration":        {"Наука"},
+	"snooze_resumed":                {"Наука"},
+	"snooze_set":                    {"Наука", "01.01.2025 10:00"},
+	"style_choose_template":         {"аналитический"},
+	"style_choose_tone":             {"живо"},
+	"style_choose_volume":           {"кратко"},
+	"style_saved":                   {"живо", "кратко"},
+	"timezone_current":              {"Europe/Moscow"},
+	"timezone_invalid":              {"Foo/Bar"},
+	"timezone_saved":                {"Europe/Moscow", "10:00"},
+	"topic_snoozed":                 {"01.01.2025 10:00"},
+	"trial_granted":                 {"01.01.2025 10:00"},
+	"undo_confirm":                  {"Наука: Факты", "Спорт: Идеи"},
+	"undo_done":                     {"Наука: Факты"},
+	"word_too_long":                 {"слово", 30},
+	"your_topics":                   {"Наука: Факты"},
+}
+
+// plainAllowed lists templates the bot sends unchanged when they contain no
+// format verbs at all.
+var plainAllowed = map[string]bool{"limit_today": true}
+
+// checkMessages renders every known template with sample arguments and
+// reports the first one whose verbs do not match them, e.g. a missing %d that
+// would reach users as "%!d(MISSING)". Templates absent from msgs are skipped.
+func checkMessages(msgs map[string]string) error {
+	keys := make([]string, 0, len(messageArgs))
+	for key := range messageArgs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		tmpl, ok := msgs[key]
+		if !ok || (plainAllowed[key] && !strings.Contains(tmpl, "%")) {
+			continue
+		}
+		out := fmt.Sprintf(tmpl, messageArgs[key]...)
+		if i := strings.Index(out, "%!"); i >= 0 {
+			bad := out[i:]
+			if end := strings.IndexByte(bad, ')'); end >= 0 {
+				bad = bad[:end+1]
+			}
+			return fmt.Errorf("config: message %q does not match its %d arguments: %s", key, len(messageArgs[key]), bad)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package model
+
+// OutboxMessage is a scheduled digest waiting to be delivered. UserID and
+// Slot identify it, so a digest for the same schedule slot is queued once.
+type OutboxMessage struct {
+	ID          int64    `json:"id"`
+	UserID      int64    `json:"user_id"`
+	Slot        int64    `json:"slot"`
+	Texts       []string `json:"texts"`
+	Attempts    int      `json:"attempts,omitempty"`
+	NextAttempt int64    `json:"next_attempt,omitempty"`
+	SentAt      int64    `json:"sent_at,omitempty"`
+}
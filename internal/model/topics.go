@@ -0,0 +1,219 @@
+package model
+
+import (
+	"encoding/json"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Category is a user's category with the selected info types and its weight
+// in category selection.
+type Category struct {
+	Name   string   `json:"name"`
+	Infos  []string `json:"infos"`
+	Weight int      `json:"weight,omitempty"`
+}
+
+// CategoryCount is the number of users who selected a category.
+type CategoryCount struct {
+	Name  string
+	Users int
+}
+
+// Categories is the structured form of the user's topics. It is stored as a
+// JSON list but can also be decoded from the legacy {"category": [infos]} map.
+type Categories []Category
+
+// NewCategories builds the structured form from a topics map and optional
+// weights. Categories are ordered by name so the encoding is stable.
+func NewCategories(topics map[string][]string, weights map[string]int) Categories {
+	out := make(Categories, 0, len(topics))
+	for name, infos := range topics {
+		out = append(out, Category{Name: name, Infos: infos, Weight: weights[name]})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// NormalizeTopics returns a cleaned copy of topics for storage: category
+// names and info types are trimmed, blank and duplicate info types are
+// dropped, categories whose names collide after trimming are merged and
+// categories left without info types are removed.
+func NormalizeTopics(topics map[string][]string) map[string][]string {
+	if topics == nil {
+		return nil
+	}
+	names := make([]string, 0, len(topics))
+	for name := range topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := make(map[string][]string, len(topics))
+	for _, name := range names {
+		key := strings.TrimSpace(name)
+		if key == "" {
+			continue
+		}
+		for _, info := range topics[name] {
+			info = strings.TrimSpace(info)
+			if info != "" && !slices.Contains(out[key], info) {
+				out[key] = append(out[key], info)
+			}
+		}
+	}
+	return out
+}
+
+// CategoryKey folds a category name for duplicate detection: case, emoji and
+// punctuation are ignored, so "🫆Технологии" and "технологии" share a key.
+func CategoryKey(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(words, " ")
+}
+
+// CategoryMerge describes categories folded into Into by
+// MergeDuplicateCategories.
+type CategoryMerge struct {
+	Into string
+	From []string
+}
+
+// MergeDuplicateCategories merges categories whose names share a CategoryKey
+// and combines their info types without repeats. The kept name is the one
+// preferred reports true for (a preset category), then one without the custom
+// 🫆 prefix, then the alphabetically first. Names without letters or digits
+// are never merged.
+func MergeDuplicateCategories(topics map[string][]string, preferred func(string) bool) (map[string][]string, []CategoryMerge) {
+	groups := make(map[string][]string)
+	for name := range topics {
+		if key := CategoryKey(name); key != "" {
+			groups[key] = append(groups[key], name)
+		}
+	}
+	var merges []CategoryMerge
+	for _, names := range groups {
+		if len(names) < 2 {
+			continue
+		}
+		rank := func(name string) int {
+			switch {
+			case preferred != nil && preferred(name):
+				return 0
+			case !strings.HasPrefix(name, "🫆"):
+				return 1
+			}
+			return 2
+		}
+		sort.Slice(names, func(i, j int) bool {
+			if ri, rj := rank(names[i]), rank(names[j]); ri != rj {
+				return ri < rj
+			}
+			return names[i] < names[j]
+		})
+		merges = append(merges, CategoryMerge{Into: names[0], From: names[1:]})
+	}
+	if len(merges) == 0 {
+		return topics, nil
+	}
+	sort.Slice(merges, func(i, j int) bool { return merges[i].Into < merges[j].Into })
+	out := maps.Clone(topics)
+	for _, m := range merges {
+		infos := slices.Clone(out[m.Into])
+		for _, name := range m.From {
+			for _, info := range out[name] {
+				if !slices.Contains(infos, info) {
+					infos = append(infos, info)
+				}
+			}
+			delete(out, name)
+		}
+		out[m.Into] = infos
+	}
+	return out, merges
+}
+
+// RenameInfos replaces info types found in aliases with their new names and
+// reports whether anything changed. An info type renamed into one the
+// category already has is merged with it.
+func RenameInfos(topics map[string][]string, aliases map[string]string) (map[string][]string, bool) {
+	changed := false
+	out := make(map[string][]string, len(topics))
+	for name, infos := range topics {
+		renamed := make([]string, 0, len(infos))
+		for _, info := range infos {
+			if to, ok := aliases[info]; ok && to != info {
+				info = to
+				changed = true
+			}
+			if !slices.Contains(renamed, info) {
+				renamed = append(renamed, info)
+			}
+		}
+		out[name] = renamed
+	}
+	if !changed {
+		return topics, false
+	}
+	return out, true
+}
+
+// UnmarshalJSON accepts both the list form and the legacy map form.
+func (cs *Categories) UnmarshalJSON(data []byte) error {
+	var legacy map[string][]string
+	if err := json.Unmarshal(data, &legacy); err == nil {
+		*cs = NewCategories(legacy, nil)
+		return nil
+	}
+	var list []Category
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*cs = list
+	return nil
+}
+
+// Topics returns the category to info types map used by the conversation flows.
+func (cs Categories) Topics() map[string][]string {
+	if cs == nil {
+		return nil
+	}
+	out := make(map[string][]string, len(cs))
+	for _, c := range cs {
+		out[c.Name] = c.Infos
+	}
+	return out
+}
+
+// Weights returns the explicitly set category weights.
+func (cs Categories) Weights() map[string]int {
+	var out map[string]int
+	for _, c := range cs {
+		if c.Weight > 0 {
+			if out == nil {
+				out = map[string]int{}
+			}
+			out[c.Name] = c.Weight
+		}
+	}
+	return out
+}
+
+// CategoryWeight returns the selection weight of a category; categories
+// without an explicit weight count once.
+func (u *UserSettings) CategoryWeight(category string) int {
+	if w := u.Weights[category]; w > 0 {
+		return w
+	}
+	return 1
+}
+
+// CategorySnoozed reports whether the category is muted at the given moment.
+func (u *UserSettings) CategorySnoozed(category string, now time.Time) bool {
+	return u.SnoozedUntil[category] > now.Unix()
+}
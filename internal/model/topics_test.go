@@ -0,0 +1,67 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// TestCategories_UnmarshalLegacyMap decodes the old map form of topics.
+func TestCategories_UnmarshalLegacyMap(t *testing.T) {
+	var cs Categories
+	if err := json.Unmarshal([]byte(`{"b":["x"],"a":["y","z"]}`), &cs); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if len(cs) != 2 || cs[0].Name != "a" || len(cs[0].Infos) != 2 || cs[1].Name != "b" {
+		t.Fatalf("unexpected categories: %#v", cs)
+	}
+	if cs.Weights() != nil {
+		t.Fatalf("legacy form must not carry weights")
+	}
+}
+
+// TestCategories_UnmarshalList decodes the structured form and round-trips it.
+func TestCategories_UnmarshalList(t *testing.T) {
+	data := `[{"name":"a","infos":["x"],"weight":3},{"name":"b","infos":["y"]}]`
+	var cs Categories
+	if err := json.Unmarshal([]byte(data), &cs); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	topics, weights := cs.Topics(), cs.Weights()
+	if len(topics) != 2 || topics["a"][0] != "x" || weights["a"] != 3 || weights["b"] != 0 {
+		t.Fatalf("unexpected topics %#v weights %#v", topics, weights)
+	}
+	out, err := json.Marshal(NewCategories(topics, weights))
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if string(out) != data {
+		t.Fatalf("round trip mismatch: %s", out)
+	}
+}
+
+// TestMergeDuplicateCategories merges case and emoji variants of a category
+// into the preset name and leaves distinct categories alone.
+func TestMergeDuplicateCategories(t *testing.T) {
+	topics := map[string][]string{
+		"Технологии":  {"Новости", "Факты"},
+		"технологии":  {"Факты", "Тренды"},
+		"🫆ТЕХНОЛОГИИ": {"Мнения"},
+		"Спорт":       {"Новости"},
+		"🫆Мои котики": {"Факты"},
+	}
+	preset := func(name string) bool { return name == "Технологии" || name == "Спорт" }
+	out, merges := MergeDuplicateCategories(topics, preset)
+	if got := fmt.Sprint(merges); got != "[{Технологии [технологии 🫆ТЕХНОЛОГИИ]}]" {
+		t.Fatalf("unexpected merges: %s", got)
+	}
+	if got := fmt.Sprint(out["Технологии"]); got != "[Новости Факты Тренды Мнения]" {
+		t.Fatalf("unexpected merged infos: %s", got)
+	}
+	if len(out) != 3 || len(out["Спорт"]) != 1 || len(out["🫆Мои котики"]) != 1 {
+		t.Fatalf("unexpected topics: %v", out)
+	}
+	if len(topics) != 5 {
+		t.Fatalf("input must not be modified: %v", topics)
+	}
+}
@@ -1,11 +1,17 @@
 package model
 
+import (
+	"sync"
+	"time"
+)
+
 // UserSettings stores preferences for a Telegram user.
 type UserSettings struct {
 	UserID            int64               `json:"user_id"`
 	UserName          string              `json:"username"`
 	Active            bool                `json:"active"`
 	Topics            map[string][]string `json:"topics,omitempty"`
+	Weights           map[string]int      `json:"weights,omitempty"`
 	Frequency         int                 `json:"frequency,omitempty"`
 	Tariff            string              `json:"tariff,omitempty"`
 	LastScheduledSent int64               `json:"last_scheduled_sent,omitempty"`
@@ -13,8 +19,173 @@ type UserSettings struct {
 	GetNewsNowCount   int                 `json:"get_news_now_count,omitempty"`
 	LastGetLast24h    int64               `json:"last_get_last_24h,omitempty"`
 	GetLast24hCount   int                 `json:"get_last_24h_count,omitempty"`
+	RotationOrder     []string            `json:"rotation_order,omitempty"`
+	RotationPos       int                 `json:"rotation_pos,omitempty"`
+	RotationStarted   int64               `json:"rotation_started,omitempty"`
+	SafeMode          bool                `json:"safe_mode,omitempty"`
+	Blocked           bool                `json:"blocked,omitempty"`
+	BlockedAt         int64               `json:"blocked_at,omitempty"`
+	Tone              string              `json:"tone,omitempty"`
+	Volume            string              `json:"volume,omitempty"`
+	SeparateMessages  bool                `json:"separate_messages,omitempty"`
+	SnoozedUntil      map[string]int64    `json:"snoozed_until,omitempty"`
+	Format            string              `json:"format,omitempty"`
+	// Profiles are named snapshots of Topics the user can switch between.
+	Profiles map[string]map[string][]string `json:"profiles,omitempty"`
+	// PrevTopics are the topics replaced by the latest change, kept for /undo.
+	PrevTopics map[string][]string `json:"prev_topics,omitempty"`
+	// ShortDigest limits scheduled digests to the first info type of each
+	// category; on-demand requests stay complete.
+	ShortDigest bool `json:"short_digest,omitempty"`
+	// History lists the latest delivered digests, oldest first.
+	History []HistoryEntry `json:"history,omitempty"`
+	// CategoryTones overrides Tone for single categories.
+	CategoryTones map[string]string `json:"category_tones,omitempty"`
+	// MaxTokens is the digest length chosen with /length; zero keeps the
+	// tariff's limit.
+	MaxTokens int `json:"max_tokens,omitempty"`
+	// ShuffleInfos lists the info types of a digest in a new random order
+	// on every send instead of the stored one.
+	ShuffleInfos bool `json:"shuffle_infos,omitempty"`
+	// BoostUntil is the Unix time until which scheduled digests come at the
+	// tariff's minimum interval; zero or a past time means no boost.
+	BoostUntil int64 `json:"boost_until,omitempty"`
+	// HideLabels drops the "Категория:" and "Тип:" lines from digests; it is
+	// stored inverted so that labels stay on for existing users.
+	HideLabels bool `json:"hide_labels,omitempty"`
+	// TrialFeatures maps features outside the user's tariff, such as
+	// FeatureLast24h, to the Unix time their trial ends.
+	TrialFeatures map[string]int64 `json:"trial_features,omitempty"`
+	// PromptTemplate is the key of the tariff's prompt template picked with
+	// /style; empty uses the tariff's prompt_main.
+	PromptTemplate string `json:"prompt_template,omitempty"`
+	// InfoRatings collects the feedback given with /rate per info type.
+	InfoRatings map[string]InfoRating `json:"info_ratings,omitempty"`
+	// ScheduledCategoriesPerSend is how many categories of the rotation each
+	// scheduled digest covers; zero means one.
+	ScheduledCategoriesPerSend int `json:"scheduled_categories_per_send,omitempty"`
+	// Timezone is the IANA name of the user's timezone, e.g. "Europe/Moscow";
+	// empty means the bot's timezone.
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// locations caches the timezones loaded by LocalTime by name.
+var locations sync.Map
+
+// LocalTime returns t in the user's timezone, or t unchanged when none is
+// set or it is unknown. Days and active hours of the user are counted in it.
+func (u *UserSettings) LocalTime(t time.Time) time.Time {
+	if u.Timezone == "" {
+		return t
+	}
+	if loc, ok := locations.Load(u.Timezone); ok {
+		return t.In(loc.(*time.Location))
+	}
+	loc, err := time.LoadLocation(u.Timezone)
+	if err != nil {
+		return t
+	}
+	locations.Store(u.Timezone, loc)
+	return t.In(loc)
+}
+
+// InfoRating counts the 👍 and 👎 a user gave to digests of an info type.
+type InfoRating struct {
+	Likes    int `json:"likes,omitempty"`
+	Dislikes int `json:"dislikes,omitempty"`
+}
+
+// RateInfos records a 👍, or a 👎 when liked is false, for each info type.
+func (u *UserSettings) RateInfos(infos []string, liked bool) {
+	if u.InfoRatings == nil {
+		u.InfoRatings = map[string]InfoRating{}
+	}
+	for _, info := range infos {
+		r := u.InfoRatings[info]
+		if liked {
+			r.Likes++
+		} else {
+			r.Dislikes++
+		}
+		u.InfoRatings[info] = r
+	}
+}
+
+// FeatureLast24h is the last-24h digest feature of /get_last_24h_news and
+// /get_last_24h_links.
+const FeatureLast24h = "last_24h"
+
+// HasTrial reports whether the user's trial of feature is still running at
+// the Unix time now.
+func (u *UserSettings) HasTrial(feature string, now int64) bool {
+	return now < u.TrialFeatures[feature]
+}
+
+// ShowLabels reports whether digests start with the category and info type
+// lines.
+func (u *UserSettings) ShowLabels() bool {
+	return !u.HideLabels
+}
+
+// DefaultTariff is the tariff of new users and of legacy ones stored without
+// a tariff.
+const DefaultTariff = "base"
+
+// RepairTariff assigns DefaultTariff to settings stored without a tariff and
+// reports whether it did.
+func (u *UserSettings) RepairTariff() bool {
+	if u.Tariff != "" {
+		return false
+	}
+	u.Tariff = DefaultTariff
+	return true
+}
+
+// MaxHistory is how many delivered digests are kept per user.
+const MaxHistory = 20
+
+// HistoryEntry is a short record of a delivered digest.
+type HistoryEntry struct {
+	Category string `json:"category"`
+	At       int64  `json:"at"`
+	Summary  string `json:"summary"`
+	// Infos are the info types the digest was generated for.
+	Infos []string `json:"infos,omitempty"`
+	// Rated is set once the digest was rated with /rate.
+	Rated bool `json:"rated,omitempty"`
+}
+
+// RenameInfos applies info type aliases to the topics, profiles and the
+// topics kept for /undo, reporting whether anything changed.
+func (u *UserSettings) RenameInfos(aliases map[string]string) bool {
+	var changed, c bool
+	u.Topics, changed = RenameInfos(u.Topics, aliases)
+	u.PrevTopics, c = RenameInfos(u.PrevTopics, aliases)
+	changed = changed || c
+	for name, topics := range u.Profiles {
+		if u.Profiles[name], c = RenameInfos(topics, aliases); c {
+			changed = true
+		}
+	}
+	return changed
 }
 
+// AddHistory records a delivered digest, dropping the oldest entries beyond
+// MaxHistory.
+func (u *UserSettings) AddHistory(e HistoryEntry) {
+	u.History = append(u.History, e)
+	if n := len(u.History) - MaxHistory; n > 0 {
+		u.History = append([]HistoryEntry(nil), u.History[n:]...)
+	}
+}
+
+// Digest formats a user can ask for; an empty Format leaves the shape to the
+// prompt.
+const (
+	FormatProse   = "prose"
+	FormatBullets = "bullets"
+)
+
 // Subscription represents a scheduled message subscription.
 type Subscription struct {
 	UserID int64 `json:"user_id"`
@@ -0,0 +1,152 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/ilinovom/summary-tasks-bot/internal/model"
+)
+
+// OutboxRepository stores scheduled digests until they are delivered.
+type OutboxRepository interface {
+	// Enqueue stores the message and assigns its ID unless one for the same
+	// user and slot already exists. It reports whether the message was added.
+	Enqueue(ctx context.Context, m *model.OutboxMessage) (bool, error)
+	// Pending returns up to limit undelivered messages whose next attempt is
+	// due at or before now, oldest first.
+	Pending(ctx context.Context, now int64, limit int) ([]*model.OutboxMessage, error)
+	// MarkSent removes the message from the pending ones.
+	MarkSent(ctx context.Context, id, at int64) error
+	// Retry records a failed attempt and when to try again.
+	Retry(ctx context.Context, id int64, attempts int, next int64) error
+	// PruneSent deletes the messages sent before the given time and returns
+	// how many were removed. Until then a sent message keeps its slot from
+	// being queued again.
+	PruneSent(ctx context.Context, before int64) (int, error)
+}
+
+// FileOutboxRepository keeps the outbox in a JSON file.
+type FileOutboxRepository struct {
+	path string
+	mu   sync.Mutex
+	data struct {
+		NextID   int64                  `json:"next_id"`
+		Messages []*model.OutboxMessage `json:"messages"`
+	}
+}
+
+// NewFileOutboxRepository loads the outbox from the given JSON file or starts
+// an empty one if the file is missing.
+func NewFileOutboxRepository(path string) (*FileOutboxRepository, error) {
+	r := &FileOutboxRepository{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &r.data); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// saveLocked writes the outbox back to disk.
+func (r *FileOutboxRepository) saveLocked() error {
+	data, err := json.MarshalIndent(r.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(r.path, data, 0o644)
+}
+
+// find returns the stored message with the ID.
+func (r *FileOutboxRepository) find(id int64) (*model.OutboxMessage, error) {
+	for _, m := range r.data.Messages {
+		if m.ID == id {
+			return m, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// Enqueue stores the message unless the user's slot is already queued.
+func (r *FileOutboxRepository) Enqueue(ctx context.Context, m *model.OutboxMessage) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, old := range r.data.Messages {
+		if old.UserID == m.UserID && old.Slot == m.Slot {
+			return false, nil
+		}
+	}
+	r.data.NextID++
+	m.ID = r.data.NextID
+	copy := *m
+	r.data.Messages = append(r.data.Messages, &copy)
+	return true, r.saveLocked()
+}
+
+// Pending returns the due undelivered messages in the order they were queued.
+func (r *FileOutboxRepository) Pending(ctx context.Context, now int64, limit int) ([]*model.OutboxMessage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var res []*model.OutboxMessage
+	for _, m := range r.data.Messages {
+		if len(res) == limit {
+			break
+		}
+		if m.SentAt == 0 && m.NextAttempt <= now {
+			copy := *m
+			res = append(res, &copy)
+		}
+	}
+	return res, nil
+}
+
+// MarkSent records the delivery time of the message.
+func (r *FileOutboxRepository) MarkSent(ctx context.Context, id, at int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, err := r.find(id)
+	if err != nil {
+		return err
+	}
+	m.SentAt = at
+	return r.saveLocked()
+}
+
+// Retry stores the attempt count and the time of the next attempt.
+func (r *FileOutboxRepository) Retry(ctx context.Context, id int64, attempts int, next int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, err := r.find(id)
+	if err != nil {
+		return err
+	}
+	m.Attempts = attempts
+	m.NextAttempt = next
+	return r.saveLocked()
+}
+
+// PruneSent drops the messages delivered before the given time.
+func (r *FileOutboxRepository) PruneSent(ctx context.Context, before int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	kept := r.data.Messages[:0]
+	for _, m := range r.data.Messages {
+		if m.SentAt == 0 || m.SentAt >= before {
+			kept = append(kept, m)
+		}
+	}
+	n := len(r.data.Messages) - len(kept)
+	clear(r.data.Messages[len(kept):])
+	r.data.Messages = kept
+	if n == 0 {
+		return 0, nil
+	}
+	return n, r.saveLocked()
+}
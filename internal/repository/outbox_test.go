@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/ilinovom/summary-tasks-bot/internal/model"
+)
+
+// TestFileOutboxRepository verifies de-duplication by user and slot, that
+// sent and not yet due messages are not pending, and that the state survives
+// reopening the file.
+func TestFileOutboxRepository(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.json")
+	repo, err := NewFileOutboxRepository(path)
+	if err != nil {
+		t.Fatalf("new repo: %v", err)
+	}
+	ctx := context.Background()
+	for i, m := range []*model.OutboxMessage{
+		{UserID: 1, Slot: 100, Texts: []string{"a"}},
+		{UserID: 1, Slot: 100, Texts: []string{"again"}},
+		{UserID: 2, Slot: 100, Texts: []string{"b"}},
+		{UserID: 1, Slot: 200, Texts: []string{"c"}},
+	} {
+		added, err := repo.Enqueue(ctx, m)
+		if err != nil {
+			t.Fatalf("enqueue %d: %v", i, err)
+		}
+		if added != (i != 1) {
+			t.Fatalf("enqueue %d: added=%v", i, added)
+		}
+	}
+	if err := repo.MarkSent(ctx, 1, 150); err != nil {
+		t.Fatalf("mark sent: %v", err)
+	}
+	if err := repo.Retry(ctx, 2, 1, 500); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+
+	repo, err = NewFileOutboxRepository(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	pending, _ := repo.Pending(ctx, 300, 10)
+	if len(pending) != 1 || pending[0].Texts[0] != "c" {
+		t.Fatalf("unexpected pending before retry is due: %+v", pending)
+	}
+	pending, _ = repo.Pending(ctx, 500, 10)
+	if len(pending) != 2 || pending[0].Texts[0] != "b" || pending[0].Attempts != 1 {
+		t.Fatalf("unexpected pending after retry is due: %+v", pending)
+	}
+	if added, _ := repo.Enqueue(ctx, &model.OutboxMessage{UserID: 1, Slot: 100}); added {
+		t.Fatalf("a sent slot must not be queued again")
+	}
+}
+
+// TestFileOutboxRepository_PruneSent verifies only messages delivered before
+// the cut-off are removed, pending ones stay, and the pruning is persisted.
+func TestFileOutboxRepository_PruneSent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.json")
+	repo, err := NewFileOutboxRepository(path)
+	if err != nil {
+		t.Fatalf("new repo: %v", err)
+	}
+	ctx := context.Background()
+	for slot := int64(100); slot <= 300; slot += 100 {
+		if _, err := repo.Enqueue(ctx, &model.OutboxMessage{UserID: 1, Slot: slot}); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+	repo.MarkSent(ctx, 1, 150)
+	repo.MarkSent(ctx, 2, 250)
+
+	n, err := repo.PruneSent(ctx, 200)
+	if err != nil || n != 1 {
+		t.Fatalf("expected one pruned message, got %d, %v", n, err)
+	}
+	repo, err = NewFileOutboxRepository(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if added, _ := repo.Enqueue(ctx, &model.OutboxMessage{UserID: 1, Slot: 200}); added {
+		t.Fatalf("a recently sent slot must still block a new message")
+	}
+	if pending, _ := repo.Pending(ctx, 1000, 10); len(pending) != 1 || pending[0].Slot != 300 {
+		t.Fatalf("pending message must survive pruning, got %+v", pending)
+	}
+	if added, _ := repo.Enqueue(ctx, &model.OutboxMessage{UserID: 1, Slot: 100}); !added {
+		t.Fatalf("pruned slot must be gone from the file")
+	}
+}
@@ -0,0 +1,97 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/ilinovom/summary-tasks-bot/internal/model"
+)
+
+// PostgresOutboxRepository stores the outbox in the outbox table.
+type PostgresOutboxRepository struct {
+	db *sql.DB
+}
+
+// Outbox returns the outbox stored in the same database.
+func (r *PostgresUserSettingsRepository) Outbox() *PostgresOutboxRepository {
+	return &PostgresOutboxRepository{db: r.db}
+}
+
+// Enqueue inserts the message unless the user's slot is already queued.
+func (r *PostgresOutboxRepository) Enqueue(ctx context.Context, m *model.OutboxMessage) (bool, error) {
+	texts, err := json.Marshal(m.Texts)
+	if err != nil {
+		return false, err
+	}
+	added := false
+	err = withRetry(ctx, "enqueue digest", func() error {
+		added = false
+		err := r.db.QueryRowContext(ctx, `
+        INSERT INTO outbox (user_id, slot, texts, attempts, next_attempt)
+        VALUES ($1,$2,$3,$4,$5)
+        ON CONFLICT (user_id, slot) DO NOTHING
+        RETURNING id`, m.UserID, m.Slot, string(texts), m.Attempts, m.NextAttempt).Scan(&m.ID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		added = err == nil
+		return err
+	})
+	return added, err
+}
+
+// Pending returns the due undelivered messages in the order they were queued.
+func (r *PostgresOutboxRepository) Pending(ctx context.Context, now int64, limit int) ([]*model.OutboxMessage, error) {
+	var res []*model.OutboxMessage
+	err := withRetry(ctx, "list outbox", func() error {
+		res = nil
+		rows, err := r.db.QueryContext(ctx, `SELECT id, user_id, slot, texts, attempts, next_attempt FROM outbox WHERE sent_at = 0 AND next_attempt <= $1 ORDER BY id LIMIT $2`, now, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var m model.OutboxMessage
+			var texts []byte
+			if err := rows.Scan(&m.ID, &m.UserID, &m.Slot, &texts, &m.Attempts, &m.NextAttempt); err != nil {
+				return err
+			}
+			json.Unmarshal(texts, &m.Texts)
+			res = append(res, &m)
+		}
+		return rows.Err()
+	})
+	return res, err
+}
+
+// MarkSent records the delivery time of the message.
+func (r *PostgresOutboxRepository) MarkSent(ctx context.Context, id, at int64) error {
+	return withRetry(ctx, "mark digest sent", func() error {
+		_, err := r.db.ExecContext(ctx, `UPDATE outbox SET sent_at=$2 WHERE id=$1`, id, at)
+		return err
+	})
+}
+
+// Retry stores the attempt count and the time of the next attempt.
+func (r *PostgresOutboxRepository) Retry(ctx context.Context, id int64, attempts int, next int64) error {
+	return withRetry(ctx, "retry digest", func() error {
+		_, err := r.db.ExecContext(ctx, `UPDATE outbox SET attempts=$2, next_attempt=$3 WHERE id=$1`, id, attempts, next)
+		return err
+	})
+}
+
+// PruneSent deletes the messages delivered before the given time.
+func (r *PostgresOutboxRepository) PruneSent(ctx context.Context, before int64) (int, error) {
+	var n int64
+	err := withRetry(ctx, "prune outbox", func() error {
+		res, err := r.db.ExecContext(ctx, `DELETE FROM outbox WHERE sent_at > 0 AND sent_at < $1`, before)
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	return int(n), err
+}
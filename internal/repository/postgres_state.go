@@ -0,0 +1,41 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// PostgresStateRepository stores the state in the bot_state table.
+type PostgresStateRepository struct {
+	db *sql.DB
+}
+
+// State returns the bot state stored in the same database.
+func (r *PostgresUserSettingsRepository) State() *PostgresStateRepository {
+	return &PostgresStateRepository{db: r.db}
+}
+
+// Time returns the stored timestamp.
+func (r *PostgresStateRepository) Time(ctx context.Context, key string) (int64, error) {
+	var at int64
+	err := withRetry(ctx, "get state", func() error {
+		err := r.db.QueryRowContext(ctx, `SELECT value FROM bot_state WHERE key=$1`, key).Scan(&at)
+		if errors.Is(err, sql.ErrNoRows) {
+			at = 0
+			return nil
+		}
+		return err
+	})
+	return at, err
+}
+
+// SetTime inserts or updates the timestamp.
+func (r *PostgresStateRepository) SetTime(ctx context.Context, key string, at int64) error {
+	return withRetry(ctx, "save state", func() error {
+		_, err := r.db.ExecContext(ctx, `
+        INSERT INTO bot_state (key, value) VALUES ($1,$2)
+        ON CONFLICT (key) DO UPDATE SET value=EXCLUDED.value`, key, at)
+		return err
+	})
+}
@@ -3,13 +3,31 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/ilinovom/summary-tasks-bot/internal/model"
+	"github.com/jackc/pgx/v5/pgconn"
 	_ "github.com/jackc/pgx/v5/stdlib"
 )
 
+// dbAttempts is how many times an operation is tried when it keeps failing
+// with transient errors.
+const dbAttempts = 3
+
+// dbRetryDelay is the pause before the first retry; it grows linearly.
+var dbRetryDelay = 200 * time.Millisecond
+
 // PostgresUserSettingsRepository stores settings in a Postgres database.
 type PostgresUserSettingsRepository struct {
 	db *sql.DB
@@ -55,42 +73,287 @@ func (r *PostgresUserSettingsRepository) init() error {
 	if _, err = r.db.Exec(`ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS last_get_last_24h BIGINT`); err != nil {
 		return err
 	}
-	_, err = r.db.Exec(`ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS get_last_24h_count INTEGER`)
+	if _, err = r.db.Exec(`ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS get_last_24h_count INTEGER`); err != nil {
+		return err
+	}
+	_, err = r.db.Exec(`ALTER TABLE user_settings
+        ADD COLUMN IF NOT EXISTS rotation_order JSONB,
+        ADD COLUMN IF NOT EXISTS rotation_pos INTEGER,
+        ADD COLUMN IF NOT EXISTS rotation_started BIGINT`)
+	if err != nil {
+		return err
+	}
+	if _, err = r.db.Exec(`ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS safe_mode BOOLEAN NOT NULL DEFAULT FALSE`); err != nil {
+		return err
+	}
+	if _, err = r.db.Exec(`ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS blocked BOOLEAN NOT NULL DEFAULT FALSE`); err != nil {
+		return err
+	}
+	if _, err = r.db.Exec(`ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS tone TEXT NOT NULL DEFAULT '', ADD COLUMN IF NOT EXISTS volume TEXT NOT NULL DEFAULT ''`); err != nil {
+		return err
+	}
+	if _, err = r.db.Exec(`ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS separate_messages BOOLEAN NOT NULL DEFAULT FALSE`); err != nil {
+		return err
+	}
+	if _, err = r.db.Exec(`ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS blocked_at BIGINT NOT NULL DEFAULT 0`); err != nil {
+		return err
+	}
+	if _, err = r.db.Exec(`ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS snoozed_until JSONB NOT NULL DEFAULT '{}'::jsonb`); err != nil {
+		return err
+	}
+	if _, err = r.db.Exec(`ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS format TEXT NOT NULL DEFAULT ''`); err != nil {
+		return err
+	}
+	if _, err = r.db.Exec(`ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS profiles JSONB NOT NULL DEFAULT '{}'::jsonb`); err != nil {
+		return err
+	}
+	if _, err = r.db.Exec(`ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS prev_topics JSONB`); err != nil {
+		return err
+	}
+	if _, err = r.db.Exec(`ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS short_digest BOOLEAN NOT NULL DEFAULT FALSE`); err != nil {
+		return err
+	}
+	if _, err = r.db.Exec(`ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS history JSONB`); err != nil {
+		return err
+	}
+	if _, err = r.db.Exec(`ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS category_tones JSONB NOT NULL DEFAULT '{}'::jsonb`); err != nil {
+		return err
+	}
+	if _, err = r.db.Exec(`ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS max_tokens INTEGER NOT NULL DEFAULT 0`); err != nil {
+		return err
+	}
+	if _, err = r.db.Exec(`ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS shuffle_infos BOOLEAN NOT NULL DEFAULT FALSE`); err != nil {
+		return err
+	}
+	if _, err = r.db.Exec(`ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS boost_until BIGINT NOT NULL DEFAULT 0`); err != nil {
+		return err
+	}
+	if _, err = r.db.Exec(`ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS hide_labels BOOLEAN NOT NULL DEFAULT FALSE`); err != nil {
+		return err
+	}
+	if _, err = r.db.Exec(`ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS trial_features JSONB NOT NULL DEFAULT '{}'::jsonb`); err != nil {
+		return err
+	}
+	if _, err = r.db.Exec(`ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS prompt_template TEXT NOT NULL DEFAULT ''`); err != nil {
+		return err
+	}
+	if _, err = r.db.Exec(`ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS info_ratings JSONB NOT NULL DEFAULT '{}'::jsonb`); err != nil {
+		return err
+	}
+	if _, err = r.db.Exec(`ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS scheduled_categories_per_send INTEGER NOT NULL DEFAULT 0`); err != nil {
+		return err
+	}
+	if _, err = r.db.Exec(`ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS timezone TEXT NOT NULL DEFAULT ''`); err != nil {
+		return err
+	}
+	if _, err = r.db.Exec(`UPDATE user_settings SET tariff = $1 WHERE tariff IS NULL OR tariff = ''`, model.DefaultTariff); err != nil {
+		return err
+	}
+	if _, err = r.db.Exec(`
+        CREATE TABLE IF NOT EXISTS outbox (
+            id BIGSERIAL PRIMARY KEY,
+            user_id BIGINT NOT NULL,
+            slot BIGINT NOT NULL,
+            texts JSONB NOT NULL,
+            attempts INTEGER NOT NULL DEFAULT 0,
+            next_attempt BIGINT NOT NULL DEFAULT 0,
+            sent_at BIGINT NOT NULL DEFAULT 0,
+            UNIQUE (user_id, slot)
+        )`); err != nil {
+		return err
+	}
+	if _, err = r.db.Exec(`CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (id) WHERE sent_at = 0`); err != nil {
+		return err
+	}
+	if _, err = r.db.Exec(`CREATE INDEX IF NOT EXISTS outbox_sent_idx ON outbox (sent_at) WHERE sent_at > 0`); err != nil {
+		return err
+	}
+	if _, err = r.db.Exec(`
+        CREATE TABLE IF NOT EXISTS bot_state (
+            key TEXT PRIMARY KEY,
+            value BIGINT NOT NULL
+        )`); err != nil {
+		return err
+	}
+	_, err = r.db.Exec(`CREATE INDEX IF NOT EXISTS user_settings_due_idx ON user_settings (user_id, last_scheduled_sent) WHERE active AND NOT blocked`)
 	return err
 }
 
-// Get retrieves a user's settings by ID.
-func (r *PostgresUserSettingsRepository) Get(ctx context.Context, userID int64) (*model.UserSettings, error) {
-	row := r.db.QueryRowContext(ctx, `SELECT user_id, username, active, info_types, categories, frequency, tariff, last_scheduled_sent, last_get_news_now, get_news_now_count, last_get_last_24h, get_last_24h_count FROM user_settings WHERE user_id=$1`, userID)
+// userColumns lists the user_settings columns in the order expected by scanUser.
+const userColumns = `user_id, username, active, info_types, categories, frequency, tariff, last_scheduled_sent, last_get_news_now, get_news_now_count, last_get_last_24h, get_last_24h_count, rotation_order, rotation_pos, rotation_started, safe_mode, blocked, tone, volume, separate_messages, blocked_at, snoozed_until, format, profiles, prev_topics, short_digest, history, category_tones, max_tokens, shuffle_infos, boost_until, hide_labels, trial_features, prompt_template, info_ratings, scheduled_categories_per_send, timezone`
+
+// unchangedRow is the condition of the upsert in Save that skips the update
+// when the stored row already holds the new values. Comparing with the row
+// at write time rather than a cached copy keeps concurrent updates intact.
+var unchangedRow = "(" + qualifiedColumns("user_settings") + ") IS DISTINCT FROM (" + qualifiedColumns("EXCLUDED") + ")"
+
+// qualifiedColumns returns userColumns prefixed with the table name.
+func qualifiedColumns(table string) string {
+	cols := strings.Split(userColumns, ", ")
+	for i, c := range cols {
+		cols[i] = table + "." + c
+	}
+	return strings.Join(cols, ", ")
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanUser reads a single user_settings row selected with userColumns. A JSON
+// column that does not decode yields ErrCorruptSettings naming the user and
+// the column instead of a user with the value silently missing.
+func scanUser(row rowScanner) (*model.UserSettings, error) {
 	var s model.UserSettings
-	var topics, categories []byte
-	if err := row.Scan(&s.UserID, &s.UserName, &s.Active, &topics, &categories, &s.Frequency, &s.Tariff, &s.LastScheduledSent, &s.LastGetNewsNow, &s.GetNewsNowCount, &s.LastGetLast24h, &s.GetLast24hCount); err != nil {
+	var topics, categories, rotation, snoozed, profiles, prevTopics, history, tones, trials, ratings []byte
+	var rotationPos, rotationStarted sql.NullInt64
+	if err := row.Scan(&s.UserID, &s.UserName, &s.Active, &topics, &categories, &s.Frequency, &s.Tariff, &s.LastScheduledSent, &s.LastGetNewsNow, &s.GetNewsNowCount, &s.LastGetLast24h, &s.GetLast24hCount, &rotation, &rotationPos, &rotationStarted, &s.SafeMode, &s.Blocked, &s.Tone, &s.Volume, &s.SeparateMessages, &s.BlockedAt, &snoozed, &s.Format, &profiles, &prevTopics, &s.ShortDigest, &history, &tones, &s.MaxTokens, &s.ShuffleInfos, &s.BoostUntil, &s.HideLabels, &trials, &s.PromptTemplate, &ratings, &s.ScheduledCategoriesPerSend, &s.Timezone); err != nil {
+		return nil, err
+	}
+	var cats model.Categories
+	columns := []struct {
+		name string
+		data []byte
+		dest any
+	}{
+		{"info_types", topics, &cats},
+		{"rotation_order", rotation, &s.RotationOrder},
+		{"snoozed_until", snoozed, &s.SnoozedUntil},
+		{"profiles", profiles, &s.Profiles},
+		{"prev_topics", prevTopics, &s.PrevTopics},
+		{"history", history, &s.History},
+		{"category_tones", tones, &s.CategoryTones},
+		{"trial_features", trials, &s.TrialFeatures},
+		{"info_ratings", ratings, &s.InfoRatings},
+	}
+	for _, c := range columns {
+		if len(c.data) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(c.data, c.dest); err != nil {
+			return nil, fmt.Errorf("%w: user %d: %s: %w", ErrCorruptSettings, s.UserID, c.name, err)
+		}
+	}
+	s.Topics = cats.Topics()
+	s.Weights = cats.Weights()
+	s.RotationPos = int(rotationPos.Int64)
+	s.RotationStarted = rotationStarted.Int64
+	// Rows written without a tariff get the default one; the next Save
+	// stores it.
+	s.RepairTariff()
+	return &s, nil
+}
+
+// isTransient reports whether err is likely to disappear when the operation
+// is repeated: dropped connections, timeouts, serialization failures and
+// deadlocks. Constraint violations and other query errors are permanent.
+func isTransient(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch {
+		case pgErr.Code == "40001", pgErr.Code == "40P01":
+			return true
+		case strings.HasPrefix(pgErr.Code, "08"), pgErr.Code == "57P01", pgErr.Code == "57P03":
+			return true
+		}
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// withRetry runs op and repeats it while it fails with a transient error.
+func withRetry(ctx context.Context, name string, op func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt == dbAttempts || !isTransient(err) {
+			return err
+		}
+		log.Printf("%s: transient error, retrying: %v", name, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt) * dbRetryDelay):
+		}
+	}
+}
+
+// Get retrieves a user's settings by ID. A row that cannot be decoded yields
+// ErrCorruptSettings.
+func (r *PostgresUserSettingsRepository) Get(ctx context.Context, userID int64) (*model.UserSettings, error) {
+	var s *model.UserSettings
+	err := withRetry(ctx, "get settings", func() error {
+		var err error
+		row := r.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM user_settings WHERE user_id=$1`, userID)
+		s, err = scanUser(row)
+		return err
+	})
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, errors.New("not found")
+			return nil, os.ErrNotExist
 		}
 		return nil, err
 	}
-	json.Unmarshal(topics, &s.Topics)
-	return &s, nil
+	return s, nil
 }
 
-// Save inserts or updates a user's settings.
+// Save inserts or updates a user's settings. A row that already holds the
+// same values is left untouched.
 func (r *PostgresUserSettingsRepository) Save(ctx context.Context, settings *model.UserSettings) error {
-	topics, err := json.Marshal(settings.Topics)
+	normalized := model.NormalizeTopics(settings.Topics)
+	topics, err := json.Marshal(model.NewCategories(normalized, settings.Weights))
 	if err != nil {
 		return err
 	}
 	cats := []string{}
-	for c := range settings.Topics {
+	for c := range normalized {
 		cats = append(cats, c)
 	}
+	sort.Strings(cats)
 	categories, err := json.Marshal(cats)
 	if err != nil {
 		return err
 	}
-	_, err = r.db.ExecContext(ctx, `
-        INSERT INTO user_settings (user_id, username, active, info_types, categories, frequency, tariff, last_scheduled_sent, last_get_news_now, get_news_now_count, last_get_last_24h, get_last_24h_count)
-        VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)
+	rotation, err := json.Marshal(settings.RotationOrder)
+	if err != nil {
+		return err
+	}
+	snoozed, err := json.Marshal(settings.SnoozedUntil)
+	if err != nil {
+		return err
+	}
+	profiles, err := json.Marshal(settings.Profiles)
+	if err != nil {
+		return err
+	}
+	prevTopics, err := json.Marshal(settings.PrevTopics)
+	if err != nil {
+		return err
+	}
+	history, err := json.Marshal(settings.History)
+	if err != nil {
+		return err
+	}
+	tones, err := json.Marshal(settings.CategoryTones)
+	if err != nil {
+		return err
+	}
+	trials, err := json.Marshal(settings.TrialFeatures)
+	if err != nil {
+		return err
+	}
+	ratings, err := json.Marshal(settings.InfoRatings)
+	if err != nil {
+		return err
+	}
+	query := `
+        INSERT INTO user_settings (user_id, username, active, info_types, categories, frequency, tariff, last_scheduled_sent, last_get_news_now, get_news_now_count, last_get_last_24h, get_last_24h_count, rotation_order, rotation_pos, rotation_started, safe_mode, blocked, tone, volume, separate_messages, blocked_at, snoozed_until, format, profiles, prev_topics, short_digest, history, category_tones, max_tokens, shuffle_infos, boost_until, hide_labels, trial_features, prompt_template, info_ratings, scheduled_categories_per_send, timezone)
+        VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18,$19,$20,$21,$22,$23,$24,$25,$26,$27,$28,$29,$30,$31,$32,$33,$34,$35,$36,$37)
         ON CONFLICT (user_id) DO UPDATE SET
             username=EXCLUDED.username,
             active=EXCLUDED.active,
@@ -102,9 +365,38 @@ func (r *PostgresUserSettingsRepository) Save(ctx context.Context, settings *mod
             last_get_news_now=EXCLUDED.last_get_news_now,
             get_news_now_count=EXCLUDED.get_news_now_count,
             last_get_last_24h=EXCLUDED.last_get_last_24h,
-            get_last_24h_count=EXCLUDED.get_last_24h_count
-   `, settings.UserID, settings.UserName, settings.Active, string(topics), string(categories), settings.Frequency, settings.Tariff, settings.LastScheduledSent, settings.LastGetNewsNow, settings.GetNewsNowCount, settings.LastGetLast24h, settings.GetLast24hCount)
-	return err
+            get_last_24h_count=EXCLUDED.get_last_24h_count,
+            rotation_order=EXCLUDED.rotation_order,
+            rotation_pos=EXCLUDED.rotation_pos,
+            rotation_started=EXCLUDED.rotation_started,
+            safe_mode=EXCLUDED.safe_mode,
+            blocked=EXCLUDED.blocked,
+            tone=EXCLUDED.tone,
+            volume=EXCLUDED.volume,
+            separate_messages=EXCLUDED.separate_messages,
+            blocked_at=EXCLUDED.blocked_at,
+            snoozed_until=EXCLUDED.snoozed_until,
+            format=EXCLUDED.format,
+            profiles=EXCLUDED.profiles,
+            prev_topics=EXCLUDED.prev_topics,
+            short_digest=EXCLUDED.short_digest,
+            history=EXCLUDED.history,
+            category_tones=EXCLUDED.category_tones,
+            max_tokens=EXCLUDED.max_tokens,
+            shuffle_infos=EXCLUDED.shuffle_infos,
+            boost_until=EXCLUDED.boost_until,
+            hide_labels=EXCLUDED.hide_labels,
+            trial_features=EXCLUDED.trial_features,
+            prompt_template=EXCLUDED.prompt_template,
+            info_ratings=EXCLUDED.info_ratings,
+            scheduled_categories_per_send=EXCLUDED.scheduled_categories_per_send,
+            timezone=EXCLUDED.timezone
+        WHERE ` + unchangedRow + `
+   `
+	return withRetry(ctx, "save settings", func() error {
+		_, err := r.db.ExecContext(ctx, query, settings.UserID, settings.UserName, settings.Active, string(topics), string(categories), settings.Frequency, settings.Tariff, settings.LastScheduledSent, settings.LastGetNewsNow, settings.GetNewsNowCount, settings.LastGetLast24h, settings.GetLast24hCount, string(rotation), settings.RotationPos, settings.RotationStarted, settings.SafeMode, settings.Blocked, settings.Tone, settings.Volume, settings.SeparateMessages, settings.BlockedAt, string(snoozed), settings.Format, string(profiles), string(prevTopics), settings.ShortDigest, string(history), string(tones), settings.MaxTokens, settings.ShuffleInfos, settings.BoostUntil, settings.HideLabels, string(trials), settings.PromptTemplate, string(ratings), settings.ScheduledCategoriesPerSend, settings.Timezone)
+		return err
+	})
 }
 
 // Delete removes settings for a user.
@@ -113,22 +405,94 @@ func (r *PostgresUserSettingsRepository) Delete(ctx context.Context, userID int6
 	return err
 }
 
-// List returns settings for all users.
+// List returns settings for all users. Rows that cannot be decoded are
+// logged and skipped.
 func (r *PostgresUserSettingsRepository) List(ctx context.Context) ([]*model.UserSettings, error) {
-	rows, err := r.db.QueryContext(ctx, `SELECT user_id, username, active, info_types, categories, frequency, tariff, last_scheduled_sent, last_get_news_now, get_news_now_count, last_get_last_24h, get_last_24h_count FROM user_settings`)
+	rows, err := r.db.QueryContext(ctx, `SELECT `+userColumns+` FROM user_settings`)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	var result []*model.UserSettings
 	for rows.Next() {
-		var s model.UserSettings
-		var topics, categories []byte
-		if err := rows.Scan(&s.UserID, &s.UserName, &s.Active, &topics, &categories, &s.Frequency, &s.Tariff, &s.LastScheduledSent, &s.LastGetNewsNow, &s.GetNewsNowCount, &s.LastGetLast24h, &s.GetLast24hCount); err != nil {
+		s, err := scanUser(rows)
+		if errors.Is(err, ErrCorruptSettings) {
+			log.Println("skip user:", err)
+			continue
+		}
+		if err != nil {
 			return nil, err
 		}
-		json.Unmarshal(topics, &s.Topics)
-		result = append(result, &s)
+		result = append(result, s)
 	}
 	return result, rows.Err()
 }
+
+// ListDue returns a page of active users due for a scheduled send. Rows
+// that cannot be decoded are logged and skipped.
+func (r *PostgresUserSettingsRepository) ListDue(ctx context.Context, sentBefore, afterID int64, limit int) ([]*model.UserSettings, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT `+userColumns+` FROM user_settings
+        WHERE active AND NOT blocked AND COALESCE(last_scheduled_sent, 0) <= $1 AND user_id > $2
+        ORDER BY user_id LIMIT $3`, sentBefore, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []*model.UserSettings
+	for rows.Next() {
+		s, err := scanUser(rows)
+		if errors.Is(err, ErrCorruptSettings) {
+			log.Println("skip user:", err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+	return result, rows.Err()
+}
+
+// CategoryCounts counts users per category directly in the database from the
+// categories JSONB array.
+func (r *PostgresUserSettingsRepository) CategoryCounts(ctx context.Context, limit int) ([]model.CategoryCount, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT c, COUNT(*) FROM user_settings
+        CROSS JOIN LATERAL jsonb_array_elements_text(categories) AS c
+        WHERE jsonb_typeof(categories) = 'array'
+        GROUP BY c ORDER BY COUNT(*) DESC, c LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []model.CategoryCount
+	for rows.Next() {
+		var c model.CategoryCount
+		if err := rows.Scan(&c.Name, &c.Users); err != nil {
+			return nil, err
+		}
+		result = append(result, c)
+	}
+	return result, rows.Err()
+}
+
+// CountByTariff counts users per tariff with a single GROUP BY query instead
+// of loading every row.
+func (r *PostgresUserSettingsRepository) CountByTariff(ctx context.Context) (map[string]int, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT COALESCE(tariff, ''), COUNT(*) FROM user_settings GROUP BY tariff`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[string]int{}
+	for rows.Next() {
+		var (
+			tariff string
+			n      int
+		)
+		if err := rows.Scan(&tariff, &n); err != nil {
+			return nil, err
+		}
+		counts[tariffKey(tariff)] += n
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,290 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ilinovom/summary-tasks-bot/internal/model"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// flakyDriver is a database/sql driver whose statements fail with the queued
+// errors before succeeding. It records how many executions were attempted
+// and the query and arguments of the last one.
+type flakyDriver struct {
+	mu    sync.Mutex
+	errs  []error
+	execs int
+	args  []driver.Value
+	query string
+	// rows are returned by the next successful query.
+	rows [][]driver.Value
+}
+
+var flaky = &flakyDriver{}
+
+func init() {
+	sql.Register("flaky", flaky)
+}
+
+// reset queues errors for the next executions and clears the counter.
+func (d *flakyDriver) reset(errs ...error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.errs = errs
+	d.execs = 0
+	d.rows = nil
+}
+
+// attempts returns the number of executions since the last reset.
+func (d *flakyDriver) attempts() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.execs
+}
+
+// next counts an execution and returns the queued error for it, if any.
+func (d *flakyDriver) next() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.execs++
+	if len(d.errs) == 0 {
+		return nil
+	}
+	err := d.errs[0]
+	d.errs = d.errs[1:]
+	return err
+}
+
+// Open returns a connection backed by the driver.
+func (d *flakyDriver) Open(name string) (driver.Conn, error) { return flakyConn{d}, nil }
+
+type flakyConn struct{ d *flakyDriver }
+
+func (c flakyConn) Close() error              { return nil }
+func (c flakyConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+// Prepare records the query.
+func (c flakyConn) Prepare(query string) (driver.Stmt, error) {
+	c.d.mu.Lock()
+	c.d.query = query
+	c.d.mu.Unlock()
+	return flakyStmt{c.d}, nil
+}
+
+type flakyStmt struct{ d *flakyDriver }
+
+func (s flakyStmt) Close() error  { return nil }
+func (s flakyStmt) NumInput() int { return -1 }
+
+// Exec fails with the next queued error or reports one affected row.
+func (s flakyStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.mu.Lock()
+	s.d.args = args
+	s.d.mu.Unlock()
+	if err := s.d.next(); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+// Query fails with the next queued error or returns the queued rows.
+func (s flakyStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if err := s.d.next(); err != nil {
+		return nil, err
+	}
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	if s.d.rows == nil {
+		return emptyRows{}, nil
+	}
+	rows := &valueRows{rows: s.d.rows}
+	s.d.rows = nil
+	return rows, nil
+}
+
+type emptyRows struct{}
+
+func (emptyRows) Columns() []string              { return nil }
+func (emptyRows) Close() error                   { return nil }
+func (emptyRows) Next(dest []driver.Value) error { return io.EOF }
+
+// valueRows returns fixed rows of values.
+type valueRows struct{ rows [][]driver.Value }
+
+// Columns names as many columns as the first row has.
+func (r *valueRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	return make([]string, len(r.rows[0]))
+}
+
+func (r *valueRows) Close() error { return nil }
+
+// Next copies the next row into dest.
+func (r *valueRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// newFlakyRepo returns a Postgres repository talking to the flaky driver.
+func newFlakyRepo(t *testing.T) *PostgresUserSettingsRepository {
+	t.Helper()
+	db, err := sql.Open("flaky", "")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	delay := dbRetryDelay
+	dbRetryDelay = 0
+	t.Cleanup(func() { dbRetryDelay = delay })
+	return &PostgresUserSettingsRepository{db: db}
+}
+
+// TestPostgresSave_RetriesTransientErrors verifies that Save is repeated after
+// a serialization failure and eventually succeeds.
+func TestPostgresSave_RetriesTransientErrors(t *testing.T) {
+	repo := newFlakyRepo(t)
+	flaky.reset(&pgconn.PgError{Code: "40001"}, &pgconn.PgError{Code: "08006"})
+	if err := repo.Save(context.Background(), &model.UserSettings{UserID: 1}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if n := flaky.attempts(); n != 3 {
+		t.Fatalf("expected 3 attempts, got %d", n)
+	}
+}
+
+// TestPostgresSave_PermanentErrorNotRetried checks that a constraint
+// violation is returned right away.
+func TestPostgresSave_PermanentErrorNotRetried(t *testing.T) {
+	repo := newFlakyRepo(t)
+	flaky.reset(&pgconn.PgError{Code: "23505"})
+	err := repo.Save(context.Background(), &model.UserSettings{UserID: 1})
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != "23505" {
+		t.Fatalf("expected constraint violation, got %v", err)
+	}
+	if n := flaky.attempts(); n != 1 {
+		t.Fatalf("expected a single attempt, got %d", n)
+	}
+}
+
+// TestPostgresGet_RetriesTransientErrors verifies Get retries transient
+// failures and gives up after dbAttempts.
+func TestPostgresGet_RetriesTransientErrors(t *testing.T) {
+	repo := newFlakyRepo(t)
+	transient := &pgconn.PgError{Code: "40P01"}
+	flaky.reset(transient, transient, transient, transient)
+	if _, err := repo.Get(context.Background(), 1); !errors.Is(err, transient) {
+		t.Fatalf("expected transient error after retries, got %v", err)
+	}
+	if n := flaky.attempts(); n != dbAttempts {
+		t.Fatalf("expected %d attempts, got %d", dbAttempts, n)
+	}
+}
+
+// TestPostgresSave_NormalizesTopics verifies that the stored topics JSON is
+// trimmed, free of blank entries, ordered by category and minified.
+func TestPostgresSave_NormalizesTopics(t *testing.T) {
+	repo := newFlakyRepo(t)
+	flaky.reset()
+	settings := &model.UserSettings{UserID: 1, Topics: map[string][]string{
+		" Спорт ": {" Факты", "", "Факты "},
+		"Наука":   {"Идеи", "  "},
+		"Спорт":   {"Тренды"},
+		"Пусто":   {" "},
+		"  ":      {"Факты"},
+	}}
+	if err := repo.Save(context.Background(), settings); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	flaky.mu.Lock()
+	topics, categories := flaky.args[3], flaky.args[4]
+	flaky.mu.Unlock()
+	wantTopics := `[{"name":"Наука","infos":["Идеи"]},{"name":"Спорт","infos":["Факты","Тренды"]}]`
+	if topics != wantTopics {
+		t.Fatalf("stored topics %v, want %s", topics, wantTopics)
+	}
+	if want := `["Наука","Спорт"]`; categories != want {
+		t.Fatalf("stored categories %v, want %s", categories, want)
+	}
+	if len(settings.Topics) != 5 {
+		t.Fatalf("caller's settings must not be modified: %q", settings.Topics)
+	}
+}
+
+// TestPostgresSave_SkipsUnchangedRow verifies the upsert only updates a row
+// whose stored values differ from the saved ones.
+func TestPostgresSave_SkipsUnchangedRow(t *testing.T) {
+	repo := newFlakyRepo(t)
+	flaky.reset()
+	if err := repo.Save(context.Background(), &model.UserSettings{UserID: 1}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	want := "WHERE (user_settings.user_id, user_settings.username, "
+	if !strings.Contains(flaky.query, want) || !strings.Contains(flaky.query, ") IS DISTINCT FROM (EXCLUDED.user_id, EXCLUDED.username, ") ||
+		!strings.Contains(flaky.query, "EXCLUDED.timezone)") {
+		t.Fatalf("upsert does not skip unchanged rows:\n%s", flaky.query)
+	}
+}
+
+// TestPostgresCountByTariff verifies tariffs are counted with a GROUP BY
+// query and users without a tariff are counted on the default one.
+func TestPostgresCountByTariff(t *testing.T) {
+	repo := newFlakyRepo(t)
+	flaky.reset()
+	flaky.rows = [][]driver.Value{{"base", int64(3)}, {"plus", int64(2)}, {"", int64(1)}}
+	counts, err := repo.CountByTariff(context.Background())
+	if err != nil {
+		t.Fatalf("count by tariff: %v", err)
+	}
+	if fmt.Sprint(counts) != "map[base:4 plus:2]" {
+		t.Fatalf("unexpected counts %v", counts)
+	}
+	if !strings.Contains(flaky.query, "GROUP BY tariff") {
+		t.Fatalf("counts must be grouped in the database:\n%s", flaky.query)
+	}
+}
+
+// corruptRow is a user_settings row whose info_types column holds the given
+// bytes and every other column its zero value.
+type corruptRow struct {
+	userID int64
+	topics []byte
+}
+
+// Scan fills the user ID and info_types destinations.
+func (r corruptRow) Scan(dest ...any) error {
+	*dest[0].(*int64) = r.userID
+	*dest[3].(*[]byte) = r.topics
+	return nil
+}
+
+// TestScanUser_MalformedJSON verifies a malformed JSONB column is reported as
+// ErrCorruptSettings naming the user and column, while NULL columns decode
+// to empty values.
+func TestScanUser_MalformedJSON(t *testing.T) {
+	_, err := scanUser(corruptRow{userID: 7, topics: []byte(`[{"name":`)})
+	if !errors.Is(err, ErrCorruptSettings) {
+		t.Fatalf("expected ErrCorruptSettings, got %v", err)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "user 7") || !strings.Contains(msg, "info_types") {
+		t.Fatalf("error must name the user and column: %q", msg)
+	}
+	u, err := scanUser(corruptRow{userID: 8})
+	if err != nil || u.UserID != 8 || u.Topics != nil {
+		t.Fatalf("NULL columns must decode to empty values, got %+v, %v", u, err)
+	}
+}
@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+)
+
+// SchedulerLastTick is the state key holding when the scheduler last ran.
+const SchedulerLastTick = "scheduler_last_tick"
+
+// StateRepository keeps bot-wide timestamps, such as the scheduler's last
+// tick, as Unix seconds by key.
+type StateRepository interface {
+	// Time returns the timestamp stored under key, or 0 if there is none.
+	Time(ctx context.Context, key string) (int64, error)
+	// SetTime stores the timestamp under key.
+	SetTime(ctx context.Context, key string, at int64) error
+}
+
+// FileStateRepository keeps the state in a JSON file.
+type FileStateRepository struct {
+	path string
+	mu   sync.Mutex
+	data map[string]int64
+}
+
+// NewFileStateRepository loads the state from the given JSON file or starts
+// empty if the file is missing.
+func NewFileStateRepository(path string) (*FileStateRepository, error) {
+	r := &FileStateRepository{path: path, data: map[string]int64{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &r.data); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Time returns the stored timestamp.
+func (r *FileStateRepository) Time(ctx context.Context, key string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.data[key], nil
+}
+
+// SetTime stores the timestamp and writes the file.
+func (r *FileStateRepository) SetTime(ctx context.Context, key string, at int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.data[key] = at
+	data, err := json.MarshalIndent(r.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(r.path, data, 0o644)
+}
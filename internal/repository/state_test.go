@@ -0,0 +1,31 @@
+package repository
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+// TestFileStateRepository verifies a stored timestamp survives reopening the
+// file and missing keys read as zero.
+func TestFileStateRepository(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	ctx := context.Background()
+	repo, err := NewFileStateRepository(path)
+	if err != nil {
+		t.Fatalf("new repo: %v", err)
+	}
+	if at, err := repo.Time(ctx, SchedulerLastTick); err != nil || at != 0 {
+		t.Fatalf("expected no tick, got %d, %v", at, err)
+	}
+	if err := repo.SetTime(ctx, SchedulerLastTick, 1700000000); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	reopened, err := NewFileStateRepository(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if at, _ := reopened.Time(ctx, SchedulerLastTick); at != 1700000000 {
+		t.Fatalf("tick not persisted, got %d", at)
+	}
+}
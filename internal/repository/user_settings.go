@@ -1,21 +1,37 @@
 package repository
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
 	"os"
+	"sort"
 	"sync"
 
 	"github.com/ilinovom/summary-tasks-bot/internal/model"
 )
 
+// ErrCorruptSettings is returned for stored settings that cannot be decoded.
+var ErrCorruptSettings = errors.New("corrupt user settings")
+
 // UserSettingsRepository abstracts persistence of user settings.
 type UserSettingsRepository interface {
 	Get(ctx context.Context, userID int64) (*model.UserSettings, error)
 	Save(ctx context.Context, settings *model.UserSettings) error
 	Delete(ctx context.Context, userID int64) error
 	List(ctx context.Context) ([]*model.UserSettings, error)
+	// ListDue returns up to limit active users with IDs greater than afterID
+	// whose last scheduled send happened at or before sentBefore, ordered by ID.
+	ListDue(ctx context.Context, sentBefore, afterID int64, limit int) ([]*model.UserSettings, error)
+	// CategoryCounts returns up to limit categories ordered by the number of
+	// users who selected them, most popular first and ties by name.
+	CategoryCounts(ctx context.Context, limit int) ([]model.CategoryCount, error)
+	// CountByTariff returns the number of users on each tariff; users without
+	// a tariff count as model.DefaultTariff.
+	CountByTariff(ctx context.Context) (map[string]int, error)
 }
 
 // FileUserSettingsRepository stores settings in a JSON file.
@@ -23,11 +39,14 @@ type FileUserSettingsRepository struct {
 	path string
 	mu   sync.Mutex
 	data map[int64]*model.UserSettings
+	// saved holds the JSON of each user's settings as last written, used to
+	// skip rewriting the file when nothing changed.
+	saved map[int64][]byte
 }
 
 // NewFileUserSettingsRepository loads settings from the given JSON file or creates it if missing.
 func NewFileUserSettingsRepository(path string) (*FileUserSettingsRepository, error) {
-	r := &FileUserSettingsRepository{path: path, data: map[int64]*model.UserSettings{}}
+	r := &FileUserSettingsRepository{path: path, data: map[int64]*model.UserSettings{}, saved: map[int64][]byte{}}
 	if err := r.load(); err != nil {
 		return nil, err
 	}
@@ -47,7 +66,27 @@ func (r *FileUserSettingsRepository) load() error {
 		return err
 	}
 	defer file.Close()
-	return json.NewDecoder(file).Decode(&r.data)
+	if err := json.NewDecoder(file).Decode(&r.data); err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrCorruptSettings, r.path, err)
+	}
+	repaired := 0
+	for _, s := range r.data {
+		if s.RepairTariff() {
+			repaired++
+		}
+	}
+	if repaired > 0 {
+		log.Printf("assigned the %s tariff to %d users without one", model.DefaultTariff, repaired)
+		if err := r.saveLocked(); err != nil {
+			return err
+		}
+	}
+	for id, s := range r.data {
+		if encoded, err := json.Marshal(s); err == nil {
+			r.saved[id] = encoded
+		}
+	}
+	return nil
 }
 
 // saveLocked writes the in-memory data back to disk.
@@ -67,19 +106,55 @@ func (r *FileUserSettingsRepository) Get(ctx context.Context, userID int64) (*mo
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	if s, ok := r.data[userID]; ok {
-		copy := *s
-		return &copy, nil
+		return cloneSettings(s)
 	}
 	return nil, os.ErrNotExist
 }
 
-// Save persists new settings for a user.
+// cloneSettings returns a deep copy of s made through its JSON form, so that
+// callers never share maps or slices with the stored settings.
+func cloneSettings(s *model.UserSettings) (*model.UserSettings, error) {
+	encoded, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSettings(encoded)
+}
+
+// decodeSettings decodes settings encoded by json.Marshal.
+func decodeSettings(encoded []byte) (*model.UserSettings, error) {
+	var s model.UserSettings
+	if err := json.Unmarshal(encoded, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Save persists new settings for a user. Topics are stored normalized. The
+// file is not rewritten when the settings equal the stored ones.
 func (r *FileUserSettingsRepository) Save(ctx context.Context, settings *model.UserSettings) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	copy := *settings
-	r.data[settings.UserID] = &copy
-	return r.saveLocked()
+	copy.Topics = model.NormalizeTopics(copy.Topics)
+	encoded, err := json.Marshal(&copy)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(r.saved[settings.UserID], encoded) {
+		return nil
+	}
+	// Store a deep copy so the caller's maps and slices stay its own.
+	stored, err := decodeSettings(encoded)
+	if err != nil {
+		return err
+	}
+	r.data[settings.UserID] = stored
+	if err := r.saveLocked(); err != nil {
+		return err
+	}
+	r.saved[settings.UserID] = encoded
+	return nil
 }
 
 // Delete removes settings for a user.
@@ -87,6 +162,7 @@ func (r *FileUserSettingsRepository) Delete(ctx context.Context, userID int64) e
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	delete(r.data, userID)
+	delete(r.saved, userID)
 	return r.saveLocked()
 }
 
@@ -96,8 +172,82 @@ func (r *FileUserSettingsRepository) List(ctx context.Context) ([]*model.UserSet
 	defer r.mu.Unlock()
 	res := make([]*model.UserSettings, 0, len(r.data))
 	for _, s := range r.data {
-		copy := *s
-		res = append(res, &copy)
+		c, err := cloneSettings(s)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, c)
 	}
 	return res, nil
 }
+
+// ListDue returns a page of active users due for a scheduled send.
+func (r *FileUserSettingsRepository) ListDue(ctx context.Context, sentBefore, afterID int64, limit int) ([]*model.UserSettings, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := []*model.UserSettings{}
+	for _, s := range r.data {
+		if s.Active && !s.Blocked && s.UserID > afterID && s.LastScheduledSent <= sentBefore {
+			c, err := cloneSettings(s)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, c)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].UserID < res[j].UserID })
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	return res, nil
+}
+
+// CategoryCounts aggregates the selected categories over all users.
+func (r *FileUserSettingsRepository) CategoryCounts(ctx context.Context, limit int) ([]model.CategoryCount, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	counts := map[string]int{}
+	for _, s := range r.data {
+		for c := range s.Topics {
+			counts[c]++
+		}
+	}
+	return topCategories(counts, limit), nil
+}
+
+// CountByTariff counts the stored users per tariff.
+func (r *FileUserSettingsRepository) CountByTariff(ctx context.Context) (map[string]int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	counts := map[string]int{}
+	for _, s := range r.data {
+		counts[tariffKey(s.Tariff)]++
+	}
+	return counts, nil
+}
+
+// tariffKey returns the tariff a user with the stored tariff name is on.
+func tariffKey(name string) string {
+	if name == "" {
+		return model.DefaultTariff
+	}
+	return name
+}
+
+// topCategories orders the counts by popularity and keeps the first limit.
+func topCategories(counts map[string]int, limit int) []model.CategoryCount {
+	res := make([]model.CategoryCount, 0, len(counts))
+	for name, n := range counts {
+		res = append(res, model.CategoryCount{Name: name, Users: n})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Users != res[j].Users {
+			return res[i].Users > res[j].Users
+		}
+		return res[i].Name < res[j].Name
+	})
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	return res
+}
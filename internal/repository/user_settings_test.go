@@ -2,8 +2,11 @@ package repository
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/ilinovom/summary-tasks-bot/internal/model"
@@ -36,3 +39,205 @@ func TestFileUserSettingsRepository_CRUD(t *testing.T) {
 		t.Fatalf("expected not exist error, got %v", err)
 	}
 }
+
+// TestFileUserSettingsRepository_CorruptFile verifies a settings file that
+// does not decode is reported as ErrCorruptSettings naming the file.
+func TestFileUserSettingsRepository_CorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settings.json")
+	if err := os.WriteFile(path, []byte(`{"1": {"topics": [`), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_, err := NewFileUserSettingsRepository(path)
+	if !errors.Is(err, ErrCorruptSettings) || !strings.Contains(err.Error(), path) {
+		t.Fatalf("expected ErrCorruptSettings naming %s, got %v", path, err)
+	}
+}
+
+// TestFileUserSettingsRepository_SkipsUnchangedSave verifies that saving the
+// stored settings again does not rewrite the file while a change, including
+// one made in place on a map returned by Get, does.
+func TestFileUserSettingsRepository_SkipsUnchangedSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settings.json")
+	repo, err := NewFileUserSettingsRepository(path)
+	if err != nil {
+		t.Fatalf("new repo: %v", err)
+	}
+	ctx := context.Background()
+	if err := repo.Save(ctx, &model.UserSettings{UserID: 1, Topics: map[string][]string{"go": {"tips"}}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	os.Remove(path)
+
+	got, _ := repo.Get(ctx, 1)
+	if err := repo.Save(ctx, got); err != nil {
+		t.Fatalf("save unchanged: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("unchanged save must not write the file, stat: %v", err)
+	}
+
+	got.Topics["go"] = append(got.Topics["go"], "news")
+	if err := repo.Save(ctx, got); err != nil {
+		t.Fatalf("save changed: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("changed save must write the file: %v", err)
+	}
+}
+
+// TestFileUserSettingsRepository_CopiesSettings verifies that neither the
+// saved settings nor those returned by Get share maps or slices with the
+// stored ones, so changing them in place does not touch the repository.
+func TestFileUserSettingsRepository_CopiesSettings(t *testing.T) {
+	repo, err := NewFileUserSettingsRepository(filepath.Join(t.TempDir(), "settings.json"))
+	if err != nil {
+		t.Fatalf("new repo: %v", err)
+	}
+	ctx := context.Background()
+	s := &model.UserSettings{UserID: 1, Topics: map[string][]string{"go": {"tips"}}, History: []model.HistoryEntry{{Category: "go"}}}
+	if err := repo.Save(ctx, s); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	s.History[0].Rated = true
+
+	got, _ := repo.Get(ctx, 1)
+	got.Topics["rust"] = []string{"news"}
+	list, _ := repo.List(ctx)
+	list[0].Topics["zig"] = []string{"news"}
+
+	got, _ = repo.Get(ctx, 1)
+	if len(got.Topics) != 1 || got.History[0].Rated {
+		t.Fatalf("stored settings changed without a save: %+v", got)
+	}
+}
+
+// TestFileUserSettingsRepository_RepairsEmptyTariff verifies that a legacy
+// user stored without a tariff is loaded with the default one and that the
+// repair is written back to the file at startup.
+func TestFileUserSettingsRepository_RepairsEmptyTariff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settings.json")
+	if err := os.WriteFile(path, []byte(`{"1": {"user_id": 1, "active": true}, "2": {"user_id": 2, "tariff": "plus"}}`), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	repo, err := NewFileUserSettingsRepository(path)
+	if err != nil {
+		t.Fatalf("new repo: %v", err)
+	}
+	ctx := context.Background()
+	if got, _ := repo.Get(ctx, 1); got == nil || got.Tariff != model.DefaultTariff {
+		t.Fatalf("expected the %s tariff, got %#v", model.DefaultTariff, got)
+	}
+	if got, _ := repo.Get(ctx, 2); got == nil || got.Tariff != "plus" {
+		t.Fatalf("a set tariff must be kept, got %#v", got)
+	}
+
+	reloaded, err := NewFileUserSettingsRepository(path)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	if got, _ := reloaded.Get(ctx, 1); got == nil || got.Tariff != model.DefaultTariff || !strings.Contains(string(data), `"tariff": "base"`) {
+		t.Fatalf("the repaired tariff must be persisted, file: %s", data)
+	}
+}
+
+// TestFileUserSettingsRepository_ListDue verifies that only active users whose
+// last scheduled send is old enough are returned, page by page.
+func TestFileUserSettingsRepository_ListDue(t *testing.T) {
+	repo, err := NewFileUserSettingsRepository(filepath.Join(t.TempDir(), "settings.json"))
+	if err != nil {
+		t.Fatalf("new repo: %v", err)
+	}
+	ctx := context.Background()
+	users := []*model.UserSettings{
+		{UserID: 1, Active: true, LastScheduledSent: 100},
+		{UserID: 2, Active: true, LastScheduledSent: 500},
+		{UserID: 3, Active: false, LastScheduledSent: 100},
+		{UserID: 4, Active: true, LastScheduledSent: 200},
+		{UserID: 5, Active: true, LastScheduledSent: 300},
+		{UserID: 6, Active: false, Blocked: true, LastScheduledSent: 0},
+	}
+	for _, u := range users {
+		if err := repo.Save(ctx, u); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	ids := func(us []*model.UserSettings) []int64 {
+		out := []int64{}
+		for _, u := range us {
+			out = append(out, u.UserID)
+		}
+		return out
+	}
+	page, err := repo.ListDue(ctx, 300, 0, 2)
+	if err != nil {
+		t.Fatalf("list due: %v", err)
+	}
+	if got := ids(page); len(got) != 2 || got[0] != 1 || got[1] != 4 {
+		t.Fatalf("unexpected first page: %v", got)
+	}
+	page, _ = repo.ListDue(ctx, 300, 4, 2)
+	if got := ids(page); len(got) != 1 || got[0] != 5 {
+		t.Fatalf("unexpected second page: %v", got)
+	}
+}
+
+// TestFileUserSettingsRepository_CategoryCounts verifies categories are
+// counted per user and ordered by popularity, then by name.
+func TestFileUserSettingsRepository_CategoryCounts(t *testing.T) {
+	repo, err := NewFileUserSettingsRepository(filepath.Join(t.TempDir(), "settings.json"))
+	if err != nil {
+		t.Fatalf("new repo: %v", err)
+	}
+	ctx := context.Background()
+	users := []*model.UserSettings{
+		{UserID: 1, Topics: map[string][]string{"Наука": {"Факты"}, "Спорт": {"Тренды"}}},
+		{UserID: 2, Topics: map[string][]string{"Наука": {"Идеи"}, "Финансы": {"Факты"}}},
+		{UserID: 3, Topics: map[string][]string{"Наука": {"Факты"}, "Спорт": {"Факты"}}},
+		{UserID: 4, Topics: map[string][]string{"Кино": {"Факты"}}},
+		{UserID: 5},
+	}
+	for _, u := range users {
+		if err := repo.Save(ctx, u); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	counts, err := repo.CategoryCounts(ctx, 3)
+	if err != nil {
+		t.Fatalf("category counts: %v", err)
+	}
+	want := []model.CategoryCount{{Name: "Наука", Users: 3}, {Name: "Спорт", Users: 2}, {Name: "Кино", Users: 1}}
+	if len(counts) != len(want) {
+		t.Fatalf("expected %v, got %v", want, counts)
+	}
+	for i := range want {
+		if counts[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, counts)
+		}
+	}
+}
+
+// TestFileUserSettingsRepository_CountByTariff verifies users are counted per
+// tariff, those without one on the default tariff.
+func TestFileUserSettingsRepository_CountByTariff(t *testing.T) {
+	repo, err := NewFileUserSettingsRepository(filepath.Join(t.TempDir(), "settings.json"))
+	if err != nil {
+		t.Fatalf("new repo: %v", err)
+	}
+	ctx := context.Background()
+	for id, tariff := range map[int64]string{1: "base", 2: "plus", 3: "plus", 4: "", 5: "premium"} {
+		if err := repo.Save(ctx, &model.UserSettings{UserID: id, Tariff: tariff}); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	counts, err := repo.CountByTariff(ctx)
+	if err != nil {
+		t.Fatalf("count by tariff: %v", err)
+	}
+	if fmt.Sprint(counts) != "map[base:2 plus:2 premium:1]" {
+		t.Fatalf("unexpected counts %v", counts)
+	}
+}
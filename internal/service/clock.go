@@ -0,0 +1,23 @@
+package service
+
+import "time"
+
+// Clock tells the current time. Time-dependent logic (quota resets,
+// scheduling, rotation) asks the clock instead of calling time.Now directly,
+// so tests can move time forward deterministically.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the Clock backed by the system time.
+type SystemClock struct{}
+
+// Now returns the current system time.
+func (SystemClock) Now() time.Time { return time.Now() }
+
+// SameDay reports whether a and b fall on the same calendar day in a's
+// location; daily counters restart when it does not.
+func SameDay(a, b time.Time) bool {
+	b = b.In(a.Location())
+	return a.YearDay() == b.YearDay() && a.Year() == b.Year()
+}
@@ -0,0 +1,34 @@
+package service
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// lockedSource makes a rand.Source safe for concurrent use, so a single
+// *rand.Rand can be shared by the scheduler workers.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+// Int63 returns the next value of the underlying source.
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+// Seed reseeds the underlying source.
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+// newTimeSeededRand returns a concurrency-safe generator seeded with the
+// current time.
+func newTimeSeededRand() *rand.Rand {
+	return rand.New(&lockedSource{src: rand.NewSource(time.Now().UnixNano())})
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"math/rand"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/ilinovom/summary-tasks-bot/internal/model"
+)
+
+// nextRotationCategory returns the next category from the user's shuffled
+// rotation queue and advances the queue position. Every category is returned
+// once per cycle (or as many times as its weight) before the cycle repeats; a
+// new shuffled cycle starts when the queue is exhausted, the user's categories
+// change or the window elapses. Snoozed categories are left out until their
+// pause expires; an empty string means there is nothing to send.
+func nextRotationCategory(u *model.UserSettings, window time.Duration, now time.Time, rnd *rand.Rand) string {
+	topics := activeTopics(u, now)
+	if len(topics) == 0 {
+		return ""
+	}
+	expired := window > 0 && now.Sub(time.Unix(u.RotationStarted, 0)) >= window
+	if expired || u.RotationPos >= len(u.RotationOrder) || !sameCategories(u.RotationOrder, topics) {
+		u.RotationOrder = shuffledCategories(u, topics, rnd)
+		u.RotationPos = 0
+		u.RotationStarted = now.Unix()
+	}
+	cat := u.RotationOrder[u.RotationPos]
+	u.RotationPos++
+	return cat
+}
+
+// nextRotationCategories takes up to n distinct categories from the user's
+// rotation queue, one when n is below 1 and never more than there are active
+// categories. Repeats of a weighted category are skipped; the queue always
+// yields every active category within two cycles, which bounds the draws.
+func nextRotationCategories(u *model.UserSettings, n int, window time.Duration, now time.Time, rnd *rand.Rand) []string {
+	topics := activeTopics(u, now)
+	n = min(max(n, 1), len(topics))
+	draws := 0
+	for c := range topics {
+		draws += 2 * u.CategoryWeight(c)
+	}
+	var cats []string
+	for ; len(cats) < n && draws > 0; draws-- {
+		c := nextRotationCategory(u, window, now, rnd)
+		if c == "" {
+			break
+		}
+		if !slices.Contains(cats, c) {
+			cats = append(cats, c)
+		}
+	}
+	return cats
+}
+
+// activeTopics returns the user's topics without the categories snoozed at now.
+func activeTopics(u *model.UserSettings, now time.Time) map[string][]string {
+	if len(u.SnoozedUntil) == 0 {
+		return u.Topics
+	}
+	out := make(map[string][]string, len(u.Topics))
+	for c, infos := range u.Topics {
+		if !u.CategorySnoozed(c, now) {
+			out[c] = infos
+		}
+	}
+	return out
+}
+
+// shuffledCategories returns the given categories of the user in random
+// order, each repeated according to its weight.
+func shuffledCategories(u *model.UserSettings, topics map[string][]string, rnd *rand.Rand) []string {
+	names := make([]string, 0, len(topics))
+	for c := range topics {
+		names = append(names, c)
+	}
+	sort.Strings(names)
+	cats := make([]string, 0, len(names))
+	for _, c := range names {
+		for i := 0; i < u.CategoryWeight(c); i++ {
+			cats = append(cats, c)
+		}
+	}
+	rnd.Shuffle(len(cats), func(i, j int) { cats[i], cats[j] = cats[j], cats[i] })
+	return cats
+}
+
+// sameCategories reports whether order contains exactly the topic categories.
+func sameCategories(order []string, topics map[string][]string) bool {
+	seen := make(map[string]bool, len(topics))
+	for _, c := range order {
+		if _, ok := topics[c]; !ok {
+			return false
+		}
+		seen[c] = true
+	}
+	return len(seen) == len(topics)
+}
+
+// weightedCategory picks a random category with probability proportional to
+// its weight.
+func weightedCategory(u *model.UserSettings, rnd *rand.Rand) string {
+	cats := shuffledCategories(u, u.Topics, rnd)
+	if len(cats) == 0 {
+		return ""
+	}
+	return cats[rnd.Intn(len(cats))]
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/ilinovom/summary-tasks-bot/internal/model"
+)
+
+// TestNextRotationCategory_FullCoverage checks that every category is sent once
+// per cycle before any category repeats.
+func TestNextRotationCategory_FullCoverage(t *testing.T) {
+	u := &model.UserSettings{Topics: map[string][]string{"a": {"x"}, "b": {"x"}, "c": {"x"}}}
+	now := time.Now()
+	for cycle := 0; cycle < 3; cycle++ {
+		seen := map[string]bool{}
+		for i := 0; i < len(u.Topics); i++ {
+			cat := nextRotationCategory(u, 24*time.Hour, now, testRand())
+			if seen[cat] {
+				t.Fatalf("cycle %d: category %q repeated before full coverage", cycle, cat)
+			}
+			seen[cat] = true
+		}
+		if len(seen) != len(u.Topics) {
+			t.Fatalf("cycle %d: covered %d of %d categories", cycle, len(seen), len(u.Topics))
+		}
+	}
+}
+
+// TestNextRotationCategory_Reshuffle verifies a new cycle starts when the
+// window elapses or the categories change.
+func TestNextRotationCategory_Reshuffle(t *testing.T) {
+	u := &model.UserSettings{Topics: map[string][]string{"a": {"x"}, "b": {"x"}}}
+	now := time.Now()
+	nextRotationCategory(u, time.Hour, now, testRand())
+	if u.RotationPos != 1 {
+		t.Fatalf("expected position 1, got %d", u.RotationPos)
+	}
+	nextRotationCategory(u, time.Hour, now.Add(2*time.Hour), testRand())
+	if u.RotationPos != 1 || u.RotationStarted != now.Add(2*time.Hour).Unix() {
+		t.Fatalf("expected new cycle after window, got pos %d", u.RotationPos)
+	}
+	u.Topics["c"] = []string{"x"}
+	nextRotationCategory(u, 0, now, testRand())
+	if len(u.RotationOrder) != 3 || u.RotationPos != 1 {
+		t.Fatalf("expected reshuffle after categories change: %#v", u.RotationOrder)
+	}
+}
+
+// TestNextRotationCategory_Weights checks that weighted categories appear as
+// often as their weight within a cycle.
+func TestNextRotationCategory_Weights(t *testing.T) {
+	u := &model.UserSettings{
+		Topics:  map[string][]string{"a": {"x"}, "b": {"x"}},
+		Weights: map[string]int{"a": 3},
+	}
+	counts := map[string]int{}
+	for i := 0; i < 4; i++ {
+		counts[nextRotationCategory(u, 0, time.Now(), testRand())]++
+	}
+	if counts["a"] != 3 || counts["b"] != 1 {
+		t.Fatalf("unexpected distribution: %v", counts)
+	}
+}
+
+// testRand returns a generator with a fixed seed so selections are repeatable.
+func testRand() *rand.Rand {
+	return rand.New(rand.NewSource(1))
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/ilinovom/summary-tasks-bot/internal/model"
+	"github.com/ilinovom/summary-tasks-bot/pkg/openai"
+)
+
+// ErrNoSuggestions is returned by SuggestCategories when the model named no
+// usable category.
+var ErrNoSuggestions = errors.New("no category suggestions")
+
+// suggestMaxTokens bounds the reply of a category suggestion; a few short
+// lines are all that is needed.
+const suggestMaxTokens = 200
+
+// customSuggestionPrefix marks a proposed category that is not in the list.
+const customSuggestionPrefix = "Своя:"
+
+// suggestPrompt asks the model to map free-text interests onto the category
+// list: the interests, the maximum number of categories, the list and the
+// optional custom category instruction.
+const suggestPrompt = "Пользователь описал свои интересы: «%s».\n" +
+	"Выбери не больше %d категорий из списка, которые лучше всего подходят к этим интересам. " +
+	"Пиши по одной категории на строку точно так же, как в списке, без пояснений.\n\nСписок:\n%s%s"
+
+// suggestCustomPrompt lets the model propose up to the given number of own
+// categories when the list does not cover the interests.
+const suggestCustomPrompt = "\n\nЕсли в списке нет подходящего, можешь предложить до %d своих категорий " +
+	"из 1-3 слов, каждую на отдельной строке с префиксом «" + customSuggestionPrefix + "»."
+
+// SuggestCategories asks the base tariff's model which of options match the
+// user's free-text interests. It returns at most limit names: preset ones
+// exactly as in options and, when custom is positive, up to custom proposed
+// names with the 🫆 prefix of custom categories. Lines naming no option are
+// skipped, so the result only holds valid choices. A reply cut by the token
+// limit is still used: the lines it holds are complete suggestions.
+func (s *UserService) SuggestCategories(ctx context.Context, interests string, options []string, limit, custom int) ([]string, error) {
+	interests = SanitizeTopic(interests)
+	if interests == "" {
+		return nil, ErrEmptyTopic
+	}
+	if s.openai == nil || limit <= 0 {
+		return nil, ErrNoSuggestions
+	}
+	t, _ := s.tariff("base")
+	list := make([]string, len(options))
+	for i, o := range options {
+		list[i] = "- " + o
+	}
+	extra := ""
+	if custom > 0 {
+		extra = fmt.Sprintf(suggestCustomPrompt, custom)
+	}
+	prompt := fmt.Sprintf(suggestPrompt, interests, limit, strings.Join(list, "\n"), extra)
+	resp, err := s.openai.ChatCompletion(ctx, t.GPT.Model, prompt, suggestMaxTokens, nil)
+	if err != nil && !errors.Is(err, openai.ErrTruncated) {
+		return nil, err
+	}
+	out := parseSuggestions(resp, options, limit, custom)
+	if len(out) == 0 {
+		return nil, ErrNoSuggestions
+	}
+	return out, nil
+}
+
+// reListMarker matches the bullet or number a model may put before a line.
+var reListMarker = regexp.MustCompile(`^\s*(?:[-*•]|\d+[.)])?\s*`)
+
+// parseSuggestions maps the lines of a suggestion reply onto options,
+// ignoring list markers, case and emoji. Custom proposals become 🫆 names.
+// Repeats are dropped and the result is cut to limit names, at most custom of
+// them custom.
+func parseSuggestions(resp string, options []string, limit, custom int) []string {
+	byKey := make(map[string]string, len(options))
+	for _, o := range options {
+		byKey[model.CategoryKey(o)] = o
+	}
+	var out []string
+	seen := map[string]bool{}
+	customs := 0
+	for _, line := range strings.Split(resp, "\n") {
+		if len(out) >= limit {
+			break
+		}
+		line = reListMarker.ReplaceAllString(line, "")
+		name, own := "", false
+		if rest, ok := strings.CutPrefix(line, customSuggestionPrefix); ok {
+			rest = strings.Join(strings.Fields(strings.Trim(rest, " «»\"'.")), " ")
+			if o, ok := byKey[model.CategoryKey(rest)]; ok {
+				name = o
+			} else if model.CategoryKey(rest) != "" {
+				name, own = "🫆"+rest, true
+			}
+		} else if o, ok := byKey[model.CategoryKey(line)]; ok {
+			name = o
+		}
+		key := model.CategoryKey(name)
+		if key == "" || seen[key] || (own && customs >= custom) {
+			continue
+		}
+		if own {
+			customs++
+		}
+		seen[key] = true
+		out = append(out, name)
+	}
+	return out
+}
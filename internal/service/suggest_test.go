@@ -0,0 +1,55 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ilinovom/summary-tasks-bot/pkg/openai"
+)
+
+// TestUserService_SuggestCategories verifies the model's reply is mapped onto
+// the preset options regardless of markers, case and emoji, unknown names are
+// dropped and custom proposals are only kept when allowed.
+func TestUserService_SuggestCategories(t *testing.T) {
+	options := []string{"🧪 Наука", "🏃 Спорт", "💰 Финансы"}
+	reply := "1. наука\n- Спорт\nКино\nСвоя: Космос\n2) 🧪 Наука\n💰 финансы"
+	for _, tc := range []struct {
+		limit, custom int
+		want          []string
+	}{
+		{limit: 2, custom: 0, want: []string{"🧪 Наука", "🏃 Спорт"}},
+		{limit: 3, custom: 0, want: []string{"🧪 Наука", "🏃 Спорт", "💰 Финансы"}},
+		{limit: 3, custom: 1, want: []string{"🧪 Наука", "🏃 Спорт", "🫆Космос"}},
+	} {
+		ai := newFakeAI(fakeAIResult{reply: reply})
+		svc := NewUserService(newMemRepo(), ai, fakeAITariffs)
+		got, err := svc.SuggestCategories(context.Background(), "люблю науку, бег и {тип} деньги", options, tc.limit, tc.custom)
+		if err != nil {
+			t.Fatalf("limit %d custom %d: %v", tc.limit, tc.custom, err)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Fatalf("limit %d custom %d: got %q, want %q", tc.limit, tc.custom, got, tc.want)
+		}
+		prompt := ai.prompts[0]
+		if !strings.Contains(prompt, "люблю науку, бег и тип деньги") || !strings.Contains(prompt, "- 🏃 Спорт") {
+			t.Fatalf("prompt must hold the sanitized interests and the options: %q", prompt)
+		}
+		if strings.Contains(prompt, customSuggestionPrefix) != (tc.custom > 0) {
+			t.Fatalf("custom %d: unexpected custom instruction in %q", tc.custom, prompt)
+		}
+	}
+
+	svc := NewUserService(newMemRepo(), newFakeAI(fakeAIResult{reply: "наука\nСпо", err: openai.ErrTruncated}), fakeAITariffs)
+	got, err := svc.SuggestCategories(context.Background(), "наука", options, 2, 0)
+	if err != nil || !slices.Equal(got, []string{"🧪 Наука"}) {
+		t.Fatalf("a truncated reply must still be used, got %q, %v", got, err)
+	}
+
+	svc = NewUserService(newMemRepo(), newFakeAI(fakeAIResult{reply: "Кино\nМузыка"}), fakeAITariffs)
+	if _, err := svc.SuggestCategories(context.Background(), "кино", options, 2, 0); !errors.Is(err, ErrNoSuggestions) {
+		t.Fatalf("expected ErrNoSuggestions, got %v", err)
+	}
+}
@@ -3,31 +3,450 @@ package service
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
+	"maps"
 	"math/rand"
 	"os"
+	"regexp"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/ilinovom/summary-tasks-bot/internal/config"
 	"github.com/ilinovom/summary-tasks-bot/internal/model"
 	"github.com/ilinovom/summary-tasks-bot/internal/repository"
+	"github.com/ilinovom/summary-tasks-bot/pkg/openai"
 )
 
 // AIClient describes the part of the OpenAI client used by the service.
 type AIClient interface {
-	ChatCompletion(ctx context.Context, model, prompt string, maxTokens int) (string, error)
-	ChatResponses(ctx context.Context, model, prompt string, maxTokens int) (string, error)
+	ChatCompletion(ctx context.Context, model, prompt string, maxTokens int, temperature *float64) (string, error)
+	ChatResponses(ctx context.Context, model, prompt string, maxTokens int, temperature *float64) (string, error)
 }
 
+// defaultEmptyReply is returned instead of a blank completion when no other
+// fallback text is configured.
+const defaultEmptyReply = "Не удалось сгенерировать ответ, попробуйте позже"
+
+// defaultSafetyInstruction is added to the prompts of users with safe mode
+// enabled when no other instruction is configured.
+const defaultSafetyInstruction = "Пиши корректно: без ненормативной лексики, оскорблений, сцен насилия и контента для взрослых."
+
+// formatInstructions are appended to the digest prompts of users who chose a
+// digest format.
+var formatInstructions = map[string]string{
+	model.FormatProse:   "Пиши связным текстом из нескольких абзацев, без списков.",
+	model.FormatBullets: "Оформи ответ краткими тезисами в виде маркированного списка, по одному факту в пункте.",
+}
+
+// defaultSourcesPrompt is used for the sources-only last-24h digest when the
+// tariff does not define prompt_last_24h_sources.
+const defaultSourcesPrompt = "Составь маркированный список главных новостей за последние 24 часа по теме {категория}. Для каждой новости — короткий заголовок и ссылка на источник в формате [источник](url). Без вступлений и пояснений."
+
+// defaultMaxPromptChars limits the prompt size when the tariff does not set
+// max_prompt_chars. Roughly 2-4k tokens for Russian text.
+const defaultMaxPromptChars = 8000
+
+// ErrPromptTooLong is returned when the prompt template cannot be shortened
+// enough to fit into the configured limit.
+var ErrPromptTooLong = errors.New("prompt is too long")
+
+// defaultSearchConcurrency is how many web-search requests run at the same
+// time when SetSearchConcurrency was not called.
+const defaultSearchConcurrency = 2
+
+// ErrAllSnoozed is returned for a scheduled digest when every category of the
+// user is snoozed.
+var ErrAllSnoozed = errors.New("all categories are snoozed")
+
+// ErrCategorySnoozed is returned for an on-demand digest of a category the
+// user snoozed.
+var ErrCategorySnoozed = errors.New("category is snoozed")
+
 type UserService struct {
-	repo    repository.UserSettingsRepository
-	openai  AIClient
-	tariffs map[string]config.Tariff
+	repo       repository.UserSettingsRepository
+	openai     AIClient
+	mu         sync.RWMutex
+	tariffs    map[string]config.Tariff
+	emptyReply string
+	safety     string
+	banned     *regexp.Regexp
+	clock      Clock
+	rnd        *rand.Rand
+	debug      atomic.Bool
+	// searchSlots bounds the web-search requests in flight; further ones
+	// wait for a free slot.
+	searchSlots chan struct{}
 }
 
 // NewUserService assembles a service with the provided repository, AI client and tariff map.
 func NewUserService(repo repository.UserSettingsRepository, ai AIClient, tariffs map[string]config.Tariff) *UserService {
-	return &UserService{repo: repo, openai: ai, tariffs: tariffs}
+	return &UserService{repo: repo, openai: ai, tariffs: tariffs, emptyReply: defaultEmptyReply, safety: defaultSafetyInstruction, clock: SystemClock{}, rnd: newTimeSeededRand(), searchSlots: make(chan struct{}, defaultSearchConcurrency)}
+}
+
+// SetSearchConcurrency limits how many web-search requests, which are slower
+// and more expensive than completions, run at the same time. Values below one
+// keep the default. Requests already waiting keep the previous limit.
+func (s *UserService) SetSearchConcurrency(n int) {
+	if n <= 0 {
+		n = defaultSearchConcurrency
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cap(s.searchSlots) != n {
+		s.searchSlots = make(chan struct{}, n)
+	}
+}
+
+// SetClock replaces the time source, e.g. with a fake clock in tests.
+func (s *UserService) SetClock(c Clock) {
+	s.clock = c
+}
+
+// SetRand replaces the random source used to pick categories and info types,
+// e.g. with a seeded one in tests. r is used from several goroutines by the
+// scheduler, so outside tests it must be safe for concurrent use.
+func (s *UserService) SetRand(r *rand.Rand) {
+	s.rnd = r
+}
+
+// SetDebug switches logging of every prompt sent to the model together with
+// the beginning of the reply.
+func (s *UserService) SetDebug(on bool) {
+	s.debug.Store(on)
+}
+
+// debugReplyChars is how much of a reply is logged in debug mode.
+const debugReplyChars = 300
+
+// logExchange logs the prompt and the truncated reply of a model request
+// made for u when debug mode is on.
+func (s *UserService) logExchange(u *model.UserSettings, prompt, resp string) {
+	if !s.debug.Load() {
+		return
+	}
+	if r := []rune(resp); len(r) > debugReplyChars {
+		resp = string(r[:debugReplyChars]) + "…"
+	}
+	log.Printf("debug: user %d prompt: %q reply: %q", u.UserID, prompt, resp)
+}
+
+// SetTariffs replaces the tariff definitions, e.g. after a config reload.
+func (s *UserService) SetTariffs(tariffs map[string]config.Tariff) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tariffs = tariffs
+}
+
+// tariff returns the named tariff definition. An empty name, left by legacy
+// settings, means the default tariff.
+func (s *UserService) tariff(name string) (config.Tariff, bool) {
+	if name == "" {
+		name = model.DefaultTariff
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.tariffs[name]
+	return t, ok
+}
+
+// SetEmptyReply configures the notice returned when the model replies with
+// empty or whitespace-only content. An empty text keeps the default notice.
+func (s *UserService) SetEmptyReply(text string) {
+	if text != "" {
+		s.mu.Lock()
+		s.emptyReply = text
+		s.mu.Unlock()
+	}
+}
+
+// SetSafety configures safe mode: the instruction appended to prompts and the
+// words redacted from replies. An empty instruction keeps the default one.
+func (s *UserService) SetSafety(instruction string, bannedWords []string) {
+	var banned *regexp.Regexp
+	parts := []string{}
+	for _, w := range bannedWords {
+		if w = strings.TrimSpace(w); w != "" {
+			parts = append(parts, regexp.QuoteMeta(w))
+		}
+	}
+	// Longer words first, so that a word is not cut short by its own prefix
+	// and then rejected as part of a longer word.
+	slices.SortStableFunc(parts, func(a, b string) int { return len(b) - len(a) })
+	if len(parts) > 0 {
+		banned = regexp.MustCompile("(?i)" + strings.Join(parts, "|"))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if instruction != "" {
+		s.safety = instruction
+	}
+	s.banned = banned
+}
+
+// safePrompt appends the safety instruction for users in safe mode.
+func (s *UserService) safePrompt(u *model.UserSettings, prompt string) string {
+	if !u.SafeMode {
+		return prompt
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return prompt + "\n\n" + s.safety
+}
+
+// formatPrompt appends the instruction for the user's digest format.
+func formatPrompt(u *model.UserSettings, prompt string) string {
+	if instruction, ok := formatInstructions[u.Format]; ok {
+		return prompt + "\n\n" + instruction
+	}
+	return prompt
+}
+
+// redact masks banned words in the reply for users in safe mode. Only whole
+// words are masked, a banned word inside a longer one is left intact.
+func (s *UserService) redact(u *model.UserSettings, resp string) string {
+	s.mu.RLock()
+	banned := s.banned
+	s.mu.RUnlock()
+	if !u.SafeMode || banned == nil {
+		return resp
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range banned.FindAllStringIndex(resp, -1) {
+		if !wholeWord(resp, m[0], m[1]) {
+			continue
+		}
+		b.WriteString(resp[last:m[0]])
+		b.WriteString(strings.Repeat("*", utf8.RuneCountInString(resp[m[0]:m[1]])))
+		last = m[1]
+	}
+	b.WriteString(resp[last:])
+	return b.String()
+}
+
+// wholeWord reports whether s[i:j] is not preceded or followed by a letter,
+// digit or underscore. It stands in for \b, which in Go regexps only knows
+// ASCII letters and so fails for Cyrillic words.
+func wholeWord(s string, i, j int) bool {
+	isWord := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' }
+	if r, _ := utf8.DecodeLastRuneInString(s[:i]); i > 0 && isWord(r) {
+		return false
+	}
+	if r, _ := utf8.DecodeRuneInString(s[j:]); j < len(s) && isWord(r) {
+		return false
+	}
+	return true
+}
+
+// UserStyle returns t with the prompt template, tone, volume and token limit
+// replaced by the user's choice. Only templates and presets offered by the
+// tariff are honoured, so a downgrade silently falls back to the tariff
+// defaults.
+func UserStyle(u *model.UserSettings, t config.Tariff) config.Tariff {
+	if tmpl := t.GPT.PromptTemplates[u.PromptTemplate]; tmpl != "" {
+		t.GPT.PromptMain = tmpl
+	}
+	if u.Tone != "" && slices.Contains(t.GPT.StylePresets, u.Tone) {
+		t.GPT.Style = u.Tone
+	}
+	if u.Volume != "" && slices.Contains(t.GPT.VolumePresets, u.Volume) {
+		t.GPT.Volume = u.Volume
+	}
+	t.GPT.MaxTokens = UserMaxTokens(u, t)
+	return t
+}
+
+// UserMaxTokens returns the token limit for u's requests: the length picked
+// with /length clamped to the tariff's min_tokens and max_tokens, or the
+// tariff's limit when the user has not picked one.
+func UserMaxTokens(u *model.UserSettings, t config.Tariff) int {
+	n := u.MaxTokens
+	if n <= 0 {
+		return t.GPT.MaxTokens
+	}
+	if t.GPT.MinTokens > 0 && n < t.GPT.MinTokens {
+		n = t.GPT.MinTokens
+	}
+	if t.GPT.MaxTokens > 0 && n > t.GPT.MaxTokens {
+		n = t.GPT.MaxTokens
+	}
+	return n
+}
+
+// CategoryStyle is UserStyle with the tone the user picked for the category,
+// as long as the tariff still offers it.
+func CategoryStyle(u *model.UserSettings, t config.Tariff, category string) config.Tariff {
+	t = UserStyle(u, t)
+	if tone := u.CategoryTones[category]; tone != "" && slices.Contains(t.GPT.StylePresets, tone) {
+		t.GPT.Style = tone
+	}
+	return t
+}
+
+// buildPrompt fills the template placeholders for the given category and info type.
+func buildPrompt(template string, t config.Tariff, category, info string) string {
+	prompt := strings.ReplaceAll(template, "{тип}", info)
+	prompt = strings.ReplaceAll(prompt, "{категория}", category)
+	prompt = strings.ReplaceAll(prompt, "{тон}", t.GPT.Style)
+	prompt = strings.ReplaceAll(prompt, "{объём}", t.GPT.Volume)
+	return prompt
+}
+
+// fitPrompt builds the prompt and keeps it within the tariff's
+// max_prompt_chars. When the limit is exceeded the variable parts (category and
+// info type) are shortened; if the template alone is too long an error wrapping
+// ErrPromptTooLong is returned instead of calling the model.
+func fitPrompt(template string, t config.Tariff, category, info string) (string, error) {
+	limit := t.GPT.MaxPromptChars
+	if limit <= 0 {
+		limit = defaultMaxPromptChars
+	}
+	prompt := buildPrompt(template, t, category, info)
+	size := utf8.RuneCountInString(prompt)
+	if size <= limit {
+		return prompt, nil
+	}
+	base := utf8.RuneCountInString(buildPrompt(template, t, "", ""))
+	if base > limit {
+		return "", fmt.Errorf("%w: %d > %d characters", ErrPromptTooLong, base, limit)
+	}
+	budget := limit - base
+	nc := strings.Count(template, "{категория}")
+	ni := strings.Count(template, "{тип}")
+	cat, inf := []rune(category), []rune(info)
+	for nc*len(cat)+ni*len(inf) > budget {
+		if ni == 0 || (nc > 0 && len(cat) >= len(inf)) {
+			cat = cat[:len(cat)-1]
+		} else {
+			inf = inf[:len(inf)-1]
+		}
+	}
+	log.Printf("prompt truncated from %d to %d characters (category %q)", size, limit, string(cat))
+	return buildPrompt(template, t, string(cat), string(inf)), nil
+}
+
+// scheduledKey marks contexts of scheduled digest generation.
+type scheduledKey struct{}
+
+// WithScheduled marks ctx as generating a scheduled digest, so requests use
+// the tariff's scheduled temperature instead of the on-demand one.
+func WithScheduled(ctx context.Context) context.Context {
+	return context.WithValue(ctx, scheduledKey{}, true)
+}
+
+// isScheduled reports whether ctx was marked by WithScheduled.
+func isScheduled(ctx context.Context) bool {
+	scheduled, _ := ctx.Value(scheduledKey{}).(bool)
+	return scheduled
+}
+
+// temperature picks the tariff temperature for the call path of ctx. When
+// only one of the two values is set it is used for both paths; nil leaves the
+// model default.
+func temperature(ctx context.Context, t config.Tariff) *float64 {
+	primary, fallback := t.GPT.TemperatureOnDemand, t.GPT.TemperatureScheduled
+	if isScheduled(ctx) {
+		primary, fallback = fallback, primary
+	}
+	if primary != nil {
+		return primary
+	}
+	return fallback
+}
+
+// complete runs a chat completion for the prompt on behalf of u, shaped by
+// the user's digest format. Without an AI client the prompt itself is
+// returned.
+func (s *UserService) complete(ctx context.Context, u *model.UserSettings, t config.Tariff, prompt string) (string, error) {
+	prompt = s.safePrompt(u, formatPrompt(u, prompt))
+	if s.openai == nil {
+		return prompt, nil
+	}
+	resp, err := s.openai.ChatCompletion(ctx, t.GPT.Model, prompt, t.GPT.MaxTokens, temperature(ctx, t))
+	if errors.Is(err, openai.ErrTruncated) {
+		resp, err = s.retryTruncated(ctx, t, prompt, resp), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	s.logExchange(u, prompt, resp)
+	return s.redact(u, s.nonEmpty(resp)), nil
+}
+
+// conciseInstruction is appended to the prompt when a truncated completion is
+// retried with the TruncateConcise strategy.
+const conciseInstruction = "Будь краток и обязательно закончи ответ в пределах лимита."
+
+// retryTruncated makes one more attempt for a completion cut at the token
+// limit using the tariff's OnTruncate strategy. The partial reply is kept
+// when no strategy applies or the retry fails.
+func (s *UserService) retryTruncated(ctx context.Context, t config.Tariff, prompt, partial string) string {
+	maxTokens := t.GPT.MaxTokens
+	switch t.GPT.OnTruncate {
+	case config.TruncateConcise:
+		prompt += "\n\n" + conciseInstruction
+	case config.TruncateMoreTokens:
+		maxTokens *= 2
+		if limit := t.GPT.MaxTokensCap; limit > 0 && maxTokens > limit {
+			maxTokens = limit
+		}
+		if maxTokens <= t.GPT.MaxTokens {
+			return partial
+		}
+	default:
+		return partial
+	}
+	resp, err := s.openai.ChatCompletion(ctx, t.GPT.Model, prompt, maxTokens, temperature(ctx, t))
+	if errors.Is(err, openai.ErrTruncated) {
+		log.Println("retry truncated completion: reply still truncated")
+		return resp
+	}
+	if err != nil {
+		log.Println("retry truncated completion:", err)
+		return partial
+	}
+	return resp
+}
+
+// search runs a web-search backed request for the prompt on behalf of u,
+// waiting for one of the search slots first. Without an AI client the prompt
+// itself is returned.
+func (s *UserService) search(ctx context.Context, u *model.UserSettings, t config.Tariff, prompt string) (string, error) {
+	prompt = s.safePrompt(u, prompt)
+	if s.openai == nil {
+		return prompt, nil
+	}
+	s.mu.RLock()
+	slots := s.searchSlots
+	s.mu.RUnlock()
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	resp, err := s.openai.ChatResponses(ctx, t.GPT.Model, prompt, t.GPT.MaxTokens, temperature(ctx, t))
+	<-slots
+	if err != nil {
+		return "", err
+	}
+	s.logExchange(u, prompt, resp)
+	return s.redact(u, s.nonEmpty(resp)), nil
+}
+
+// nonEmpty replaces blank model output with the configured fallback notice.
+func (s *UserService) nonEmpty(resp string) string {
+	if strings.TrimSpace(resp) == "" {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return s.emptyReply
+	}
+	return resp
 }
 
 // Start activates a user with default settings.
@@ -39,10 +458,10 @@ func (s *UserService) Start(ctx context.Context, userID int64, userName string)
 		}
 		settings = &model.UserSettings{UserID: userID, UserName: userName}
 	}
-	if settings.Tariff == "" {
-		settings.Tariff = "base"
-	}
+	settings.RepairTariff()
 	settings.Active = true
+	settings.Blocked = false
+	settings.BlockedAt = 0
 	return s.repo.Save(ctx, settings)
 }
 
@@ -61,180 +480,384 @@ func (s *UserService) GetNews(ctx context.Context, u *model.UserSettings) (strin
 	info := ""
 	category := ""
 	if len(u.Topics) > 0 {
-		cats := make([]string, 0, len(u.Topics))
-		for c := range u.Topics {
-			cats = append(cats, c)
-		}
-		category = cats[rand.Intn(len(cats))]
+		category = weightedCategory(u, s.rnd)
 		infos := u.Topics[category]
 		if len(infos) > 0 {
-			info = infos[rand.Intn(len(infos))]
+			info = infos[s.rnd.Intn(len(infos))]
 		}
 	}
-	t, ok := s.tariffs[u.Tariff]
+	t, ok := s.tariff(u.Tariff)
 	if !ok {
 		log.Fatal("tariff for user is not set", u.UserID)
 	}
-	prompt := t.GPT.PromptMain
-	prompt = strings.ReplaceAll(prompt, "{тип}", info)
-	prompt = strings.ReplaceAll(prompt, "{категория}", category)
-	prompt = strings.ReplaceAll(prompt, "{тон}", t.GPT.Style)
-	prompt = strings.ReplaceAll(prompt, "{объём}", t.GPT.Volume)
-	var resp string
-	var err error
-	if s.openai == nil {
-		resp = prompt
-	} else {
-		resp, err = s.openai.ChatCompletion(ctx, t.GPT.Model, prompt, t.GPT.MaxTokens)
-		if err != nil {
-			return "", err
-		}
+	t = CategoryStyle(u, t, category)
+	prompt, err := fitPrompt(t.GPT.PromptMain, t, category, info)
+	if err != nil {
+		return "", err
+	}
+	resp, err := s.complete(ctx, u, t, prompt)
+	if err != nil {
+		return "", err
 	}
-	prefixParts := []string{}
+	return newsHeader(u, category, info) + resp, nil
+}
+
+// newsHeader returns the "Тип:" and "Категория:" lines put before a single
+// piece of news, or "" when there is nothing to name or u hides the labels.
+func newsHeader(u *model.UserSettings, category, info string) string {
+	if !u.ShowLabels() {
+		return ""
+	}
+	var lines []string
 	if info != "" {
-		prefixParts = append(prefixParts, "Тип: "+info)
+		lines = append(lines, "Тип: "+info)
 	}
 	if category != "" {
-		prefixParts = append(prefixParts, "Категория: "+category)
+		lines = append(lines, "Категория: "+category)
 	}
-	prefix := strings.Join(prefixParts, "\n")
-	if prefix != "" {
-		prefix += "\n\n"
+	if len(lines) == 0 {
+		return ""
 	}
-	return prefix + resp, nil
+	return strings.Join(lines, "\n") + "\n\n"
 }
 
-// GetNewsMultiInfo returns news for one random category with all selected info types.
+// GetNewsMultiInfo returns news for the next categories in the user's
+// rotation with all selected info types, one category per send unless the
+// user set ScheduledCategoriesPerSend. The rotation state in u is advanced, so
+// the caller is expected to persist u afterwards.
 func (s *UserService) GetNewsMultiInfo(ctx context.Context, u *model.UserSettings) (string, error) {
+	ds, err := s.GetNewsMultiInfoDigests(ctx, u)
+	if err != nil {
+		return "", err
+	}
+	texts := make([]string, len(ds))
+	for i, d := range ds {
+		texts[i] = joinInfoParts(u, d.Category, d.Parts)
+	}
+	return strings.Join(texts, "\n\n"), nil
+}
+
+// GetNewsMultiInfoMessages is GetNewsMultiInfo split into the messages to
+// send: a single combined one, or one per info type if the user asked for
+// separate messages.
+func (s *UserService) GetNewsMultiInfoMessages(ctx context.Context, u *model.UserSettings) ([]string, error) {
+	ds, err := s.GetNewsMultiInfoDigests(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []string
+	for _, d := range ds {
+		msgs = append(msgs, d.Messages(u)...)
+	}
+	return msgs, nil
+}
+
+// GetNewsMultiInfoDigests advances the user's rotation by the categories of
+// one scheduled send and generates every info type of each of them, in
+// rotation order.
+func (s *UserService) GetNewsMultiInfoDigests(ctx context.Context, u *model.UserSettings) ([]*InfoDigest, error) {
 	if len(u.Topics) == 0 {
-		return "", errors.New("no topics")
+		return nil, errors.New("no topics")
+	}
+	t := s.userTariff(u)
+	window := time.Duration(t.Schedule.RotationWindowHours) * time.Hour
+	cats := nextRotationCategories(u, u.ScheduledCategoriesPerSend, window, s.clock.Now(), s.rnd)
+	if len(cats) == 0 {
+		return nil, ErrAllSnoozed
 	}
-	cats := make([]string, 0, len(u.Topics))
-	for c := range u.Topics {
-		cats = append(cats, c)
+	ds := make([]*InfoDigest, 0, len(cats))
+	for _, category := range cats {
+		infos, parts, err := s.infoParts(ctx, u, t, category)
+		if err != nil {
+			return nil, err
+		}
+		ds = append(ds, &InfoDigest{Category: category, Infos: infos, Parts: parts})
 	}
-	category := cats[rand.Intn(len(cats))]
+	return ds, nil
+}
+
+// infoParts generates one "Тип: ..." section per info type of the category
+// and returns the info types in the order of the sections. Scheduled digests
+// of users who asked for short ones only cover the first info type; users who
+// turned on shuffling get the types in a new order on every send.
+func (s *UserService) infoParts(ctx context.Context, u *model.UserSettings, t config.Tariff, category string) ([]string, []string, error) {
+	t = CategoryStyle(u, t, category)
 	infos := u.Topics[category]
-	t, ok := s.tariffs[u.Tariff]
-	if !ok {
-		log.Fatal("tariff for user is not set", u.UserID)
+	if u.ShortDigest && isScheduled(ctx) && len(infos) > 1 {
+		infos = infos[:1]
+	}
+	if u.ShuffleInfos && len(infos) > 1 {
+		infos = slices.Clone(infos)
+		s.rnd.Shuffle(len(infos), func(i, j int) { infos[i], infos[j] = infos[j], infos[i] })
 	}
 	var parts []string
-	parts = append(parts, "Категория: "+category)
 	for _, info := range infos {
-		prompt := t.GPT.PromptMain
-		prompt = strings.ReplaceAll(prompt, "{тип}", info)
-		prompt = strings.ReplaceAll(prompt, "{категория}", category)
-		prompt = strings.ReplaceAll(prompt, "{тон}", t.GPT.Style)
-		prompt = strings.ReplaceAll(prompt, "{объём}", t.GPT.Volume)
-		var resp string
-		var err error
-		if s.openai == nil {
-			resp = prompt
-		} else {
-			resp, err = s.openai.ChatCompletion(ctx, t.GPT.Model, prompt, t.GPT.MaxTokens)
-			if err != nil {
-				return "", err
-			}
+		part, err := s.infoPart(ctx, u, t, category, info)
+		if err != nil {
+			return nil, nil, err
 		}
-		parts = append(parts, "\nТип: "+info+"\n"+resp)
+		parts = append(parts, part)
 	}
-	return strings.Join(parts, "\n"), nil
+	return infos, parts, nil
+}
+
+// infoPart generates the section of a single info type with the already
+// styled tariff t.
+func (s *UserService) infoPart(ctx context.Context, u *model.UserSettings, t config.Tariff, category, info string) (string, error) {
+	prompt, err := fitPrompt(t.GPT.PromptMain, t, category, info)
+	if err != nil {
+		return "", err
+	}
+	resp, err := s.complete(ctx, u, t, prompt)
+	if err != nil {
+		return "", err
+	}
+	if u.ShowLabels() {
+		resp = "Тип: " + info + "\n" + resp
+	}
+	return resp, nil
+}
+
+// joinInfoParts assembles the combined digest under a single category
+// header, which is left out when u hides the labels.
+func joinInfoParts(u *model.UserSettings, category string, parts []string) string {
+	body := strings.Join(parts, "\n\n")
+	if !u.ShowLabels() {
+		return body
+	}
+	return "Категория: " + category + "\n\n" + body
+}
+
+// RotationCategory returns the category of the digest last produced by the
+// user's rotation, or "" if the rotation has not started. It also works for
+// digests sent without labels.
+func RotationCategory(u *model.UserSettings) string {
+	if u.RotationPos <= 0 || u.RotationPos > len(u.RotationOrder) {
+		return ""
+	}
+	return u.RotationOrder[u.RotationPos-1]
+}
+
+// infoMessages returns the digest as one message, or one message per info
+// type with its own category header when u.SeparateMessages is set.
+func infoMessages(u *model.UserSettings, category string, parts []string) []string {
+	if !u.SeparateMessages {
+		return []string{joinInfoParts(u, category, parts)}
+	}
+	msgs := make([]string, len(parts))
+	for i, p := range parts {
+		if u.ShowLabels() {
+			p = "Категория: " + category + "\n" + p
+		}
+		msgs[i] = p
+	}
+	return msgs
 }
 
 // GetNewsForCategory returns news for a specific category.
 func (s *UserService) GetNewsForCategory(ctx context.Context, u *model.UserSettings, category string) (string, error) {
 	info := ""
 	if infos, ok := u.Topics[category]; ok && len(infos) > 0 {
-		info = infos[rand.Intn(len(infos))]
+		info = infos[s.rnd.Intn(len(infos))]
 	}
-	t, ok := s.tariffs[u.Tariff]
-	if !ok {
-		log.Fatal("tariff for user is not set", u.UserID)
+	return s.newsFor(ctx, u, category, info)
+}
+
+// ErrUnknownInfo is returned by GetNewsForCategoryInfo when the info type is
+// not one of those the user chose for the category.
+var ErrUnknownInfo = errors.New("info type is not selected for the category")
+
+// GetNewsForCategoryInfo returns news of a single chosen info type for a
+// category; the info type must be one of the category's selected types.
+func (s *UserService) GetNewsForCategoryInfo(ctx context.Context, u *model.UserSettings, category, info string) (string, error) {
+	if !slices.Contains(u.Topics[category], info) {
+		return "", fmt.Errorf("%w: %q in %q", ErrUnknownInfo, info, category)
 	}
-	prompt := t.GPT.PromptMain
-	prompt = strings.ReplaceAll(prompt, "{тип}", info)
-	prompt = strings.ReplaceAll(prompt, "{категория}", category)
-	prompt = strings.ReplaceAll(prompt, "{тон}", t.GPT.Style)
-	prompt = strings.ReplaceAll(prompt, "{объём}", t.GPT.Volume)
-	var resp string
-	var err error
-	if s.openai == nil {
-		resp = prompt
-	} else {
-		resp, err = s.openai.ChatCompletion(ctx, t.GPT.Model, prompt, t.GPT.MaxTokens)
-		if err != nil {
-			return "", err
+	return s.newsFor(ctx, u, category, info)
+}
+
+// maxSearchTopic caps the length of a /search topic in characters.
+const maxSearchTopic = 100
+
+// ErrEmptyTopic is returned by SearchTopic when nothing is left of the topic
+// after sanitizing.
+var ErrEmptyTopic = errors.New("empty topic")
+
+// SanitizeTopic cleans a free-text topic for the {категория} placeholder:
+// control characters and the braces of template placeholders are dropped,
+// whitespace is collapsed and the result is cut to maxSearchTopic characters.
+func SanitizeTopic(topic string) string {
+	topic = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '{' || r == '}' {
+			return ' '
 		}
+		return r
+	}, topic)
+	topic = strings.Join(strings.Fields(topic), " ")
+	if r := []rune(topic); len(r) > maxSearchTopic {
+		topic = strings.TrimSpace(string(r[:maxSearchTopic]))
 	}
-	prefixParts := []string{}
-	if info != "" {
-		prefixParts = append(prefixParts, "Тип: "+info)
+	return topic
+}
+
+// SearchTopic generates news for an ad-hoc topic that is not one of the
+// user's categories, with the tariff prompt and the user's tone. The info
+// type is picked from those the user selected for any category.
+func (s *UserService) SearchTopic(ctx context.Context, u *model.UserSettings, topic string) (string, error) {
+	topic = SanitizeTopic(topic)
+	if topic == "" {
+		return "", ErrEmptyTopic
 	}
-	if category != "" {
-		prefixParts = append(prefixParts, "Категория: "+category)
+	var infos []string
+	for _, cat := range slices.Sorted(maps.Keys(u.Topics)) {
+		for _, info := range u.Topics[cat] {
+			if !slices.Contains(infos, info) {
+				infos = append(infos, info)
+			}
+		}
+	}
+	info := ""
+	if len(infos) > 0 {
+		info = infos[s.rnd.Intn(len(infos))]
+	}
+	return s.newsFor(ctx, u, topic, info)
+}
+
+// newsFor generates a single digest for the category and info type, headed
+// by both. A snoozed category yields ErrCategorySnoozed.
+func (s *UserService) newsFor(ctx context.Context, u *model.UserSettings, category, info string) (string, error) {
+	if u.CategorySnoozed(category, s.clock.Now()) {
+		return "", ErrCategorySnoozed
+	}
+	t, ok := s.tariff(u.Tariff)
+	if !ok {
+		log.Fatal("tariff for user is not set", u.UserID)
+	}
+	t = CategoryStyle(u, t, category)
+	prompt, err := fitPrompt(t.GPT.PromptMain, t, category, info)
+	if err != nil {
+		return "", err
 	}
-	prefix := strings.Join(prefixParts, "\n")
-	if prefix != "" {
-		prefix += "\n\n"
+	resp, err := s.complete(ctx, u, t, prompt)
+	if err != nil {
+		return "", err
 	}
-	return prefix + resp, nil
+	return newsHeader(u, category, info) + resp, nil
 }
 
 // GetNewsForCategoryMultiInfo returns news for a specific category with all selected info types.
 func (s *UserService) GetNewsForCategoryMultiInfo(ctx context.Context, u *model.UserSettings, category string) (string, error) {
-	infos, ok := u.Topics[category]
-	if !ok || len(infos) == 0 {
-		return "", errors.New("no infos for category")
+	d, err := s.GetNewsForCategoryDigest(ctx, u, category)
+	if err != nil {
+		return "", err
+	}
+	return joinInfoParts(u, category, d.Parts), nil
+}
+
+// GetNewsForCategoryMultiInfoMessages is GetNewsForCategoryMultiInfo split
+// into the messages to send according to u.SeparateMessages.
+func (s *UserService) GetNewsForCategoryMultiInfoMessages(ctx context.Context, u *model.UserSettings, category string) ([]string, error) {
+	d, err := s.GetNewsForCategoryDigest(ctx, u, category)
+	if err != nil {
+		return nil, err
+	}
+	return d.Messages(u), nil
+}
+
+// InfoDigest is a multi-info digest of one category kept as its sections, so
+// that a single info type can be generated again with RegenerateInfo.
+type InfoDigest struct {
+	Category string
+	// Infos are the info types of Parts, in the same order.
+	Infos []string
+	Parts []string
+}
+
+// Messages returns the digest as the messages to send according to
+// u.SeparateMessages.
+func (d *InfoDigest) Messages(u *model.UserSettings) []string {
+	return infoMessages(u, d.Category, d.Parts)
+}
+
+// GetNewsForCategoryDigest generates every info type of the given category.
+func (s *UserService) GetNewsForCategoryDigest(ctx context.Context, u *model.UserSettings, category string) (*InfoDigest, error) {
+	if len(u.Topics[category]) == 0 {
+		return nil, errors.New("no infos for category")
+	}
+	if u.CategorySnoozed(category, s.clock.Now()) {
+		return nil, ErrCategorySnoozed
+	}
+	infos, parts, err := s.infoParts(ctx, u, s.userTariff(u), category)
+	if err != nil {
+		return nil, err
 	}
-	t, ok := s.tariffs[u.Tariff]
+	return &InfoDigest{Category: category, Infos: infos, Parts: parts}, nil
+}
+
+// RegenerateInfo generates the i-th info type of the digest again and
+// replaces its section, leaving the other sections as they are.
+func (s *UserService) RegenerateInfo(ctx context.Context, u *model.UserSettings, d *InfoDigest, i int) error {
+	if i < 0 || i >= len(d.Parts) || i >= len(d.Infos) {
+		return ErrUnknownInfo
+	}
+	t := CategoryStyle(u, s.userTariff(u), d.Category)
+	part, err := s.infoPart(ctx, u, t, d.Category, d.Infos[i])
+	if err != nil {
+		return err
+	}
+	d.Parts[i] = part
+	return nil
+}
+
+// userTariff returns u's tariff with the user's tone and volume applied.
+func (s *UserService) userTariff(u *model.UserSettings) config.Tariff {
+	t, ok := s.tariff(u.Tariff)
 	if !ok {
 		log.Fatal("tariff for user is not set", u.UserID)
 	}
-	var parts []string
-	parts = append(parts, "Категория: "+category)
-	for _, info := range infos {
-		prompt := t.GPT.PromptMain
-		prompt = strings.ReplaceAll(prompt, "{тип}", info)
-		prompt = strings.ReplaceAll(prompt, "{категория}", category)
-		prompt = strings.ReplaceAll(prompt, "{тон}", t.GPT.Style)
-		prompt = strings.ReplaceAll(prompt, "{объём}", t.GPT.Volume)
-		var resp string
-		var err error
-		if s.openai == nil {
-			resp = prompt
-		} else {
-			resp, err = s.openai.ChatCompletion(ctx, t.GPT.Model, prompt, t.GPT.MaxTokens)
-			if err != nil {
-				return "", err
-			}
-		}
-		parts = append(parts, "\nТип: "+info+"\n"+resp)
-	}
-	return strings.Join(parts, "\n"), nil
+	return UserStyle(u, t)
 }
 
 // GetLast24hNewsForCategory returns news for a category from the last 24 hours.
 func (s *UserService) GetLast24hNewsForCategory(ctx context.Context, u *model.UserSettings, category string) (string, error) {
-	t, ok := s.tariffs[u.Tariff]
+	t, ok := s.tariff(u.Tariff)
 	if !ok {
 		log.Fatal("tariff for user is not set", u.UserID)
 	}
-	prompt := t.GPT.PromptLast24h
-	prompt = strings.ReplaceAll(prompt, "{категория}", category)
-	prompt = strings.ReplaceAll(prompt, "{тон}", t.GPT.Style)
-	prompt = strings.ReplaceAll(prompt, "{объём}", t.GPT.Volume)
-	var resp string
-	var err error
-	if s.openai == nil {
-		resp = prompt
-	} else {
-		resp, err = s.openai.ChatResponses(ctx, t.GPT.Model, prompt, t.GPT.MaxTokens)
-		if err != nil {
-			return "", err
-		}
+	t = UserStyle(u, t)
+	return s.last24h(ctx, u, t, t.GPT.PromptLast24h, category)
+}
+
+// GetLast24hSourcesForCategory returns headlines with source links for a
+// category from the last 24 hours.
+func (s *UserService) GetLast24hSourcesForCategory(ctx context.Context, u *model.UserSettings, category string) (string, error) {
+	t, ok := s.tariff(u.Tariff)
+	if !ok {
+		log.Fatal("tariff for user is not set", u.UserID)
 	}
-	if category != "" {
+	t = UserStyle(u, t)
+	template := t.GPT.PromptLast24hSources
+	if template == "" {
+		template = defaultSourcesPrompt
+	}
+	return s.last24h(ctx, u, t, template, category)
+}
+
+// last24h runs a web search with the given prompt template for the category.
+func (s *UserService) last24h(ctx context.Context, u *model.UserSettings, t config.Tariff, template, category string) (string, error) {
+	if u.CategorySnoozed(category, s.clock.Now()) {
+		return "", ErrCategorySnoozed
+	}
+	t = CategoryStyle(u, t, category)
+	prompt, err := fitPrompt(template, t, category, "")
+	if err != nil {
+		return "", err
+	}
+	resp, err := s.search(ctx, u, t, prompt)
+	if err != nil {
+		return "", err
+	}
+	if category != "" && u.ShowLabels() {
 		resp = "Категория: " + category + "\n\n" + resp
 	}
 	return resp, nil
@@ -255,6 +878,45 @@ func (s *UserService) ActiveUsers(ctx context.Context) ([]*model.UserSettings, e
 	return out, nil
 }
 
+// RenameUserInfos applies info type aliases to the user's current settings
+// and saves them only if something changed, reporting whether it did.
+func (s *UserService) RenameUserInfos(ctx context.Context, userID int64, aliases map[string]string) (bool, error) {
+	u, err := s.repo.Get(ctx, userID)
+	if err != nil || !u.RenameInfos(aliases) {
+		return false, err
+	}
+	return true, s.repo.Save(ctx, u)
+}
+
+// DueUsers returns a page of active users whose last scheduled send happened
+// at or before sentBefore, continuing after the user with ID afterID.
+func (s *UserService) DueUsers(ctx context.Context, sentBefore time.Time, afterID int64, limit int) ([]*model.UserSettings, error) {
+	return s.repo.ListDue(ctx, sentBefore.Unix(), afterID, limit)
+}
+
+// PruneBlocked deletes inactive users who blocked the bot before the given
+// moment and returns how many were (or, in dry-run mode, would be) removed.
+// Users blocked before BlockedAt was tracked have it unset and count as old.
+func (s *UserService) PruneBlocked(ctx context.Context, blockedBefore time.Time, dryRun bool) (int, error) {
+	all, err := s.repo.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	pruned := 0
+	for _, u := range all {
+		if !u.Blocked || u.Active || u.BlockedAt > blockedBefore.Unix() {
+			continue
+		}
+		if !dryRun {
+			if err := s.repo.Delete(ctx, u.UserID); err != nil {
+				return pruned, err
+			}
+		}
+		pruned++
+	}
+	return pruned, nil
+}
+
 // GetByUsername fetches settings for a user by their Telegram username.
 func (s *UserService) GetByUsername(ctx context.Context, username string) (*model.UserSettings, error) {
 	all, err := s.repo.List(ctx)
@@ -271,7 +933,7 @@ func (s *UserService) GetByUsername(ctx context.Context, username string) (*mode
 
 // SetTariff assigns a new tariff to the given user.
 func (s *UserService) SetTariff(ctx context.Context, userID int64, tariff string) error {
-	if _, ok := s.tariffs[tariff]; !ok {
+	if _, ok := s.tariff(tariff); !ok {
 		return errors.New("unknown tariff")
 	}
 	u, err := s.repo.Get(ctx, userID)
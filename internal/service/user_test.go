@@ -1,13 +1,23 @@
 package service
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"log"
+	"math/rand"
 	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/ilinovom/summary-tasks-bot/internal/config"
 	"github.com/ilinovom/summary-tasks-bot/internal/model"
 	"github.com/ilinovom/summary-tasks-bot/internal/repository"
+	"github.com/ilinovom/summary-tasks-bot/pkg/openai"
 )
 
 // memRepo is an in-memory implementation of UserSettingsRepository for tests.
@@ -54,6 +64,32 @@ func (m *memRepo) List(ctx context.Context) ([]*model.UserSettings, error) {
 	return out, nil
 }
 
+// CategoryCounts is not needed by the service tests.
+func (m *memRepo) CategoryCounts(ctx context.Context, limit int) ([]model.CategoryCount, error) {
+	return nil, nil
+}
+
+// CountByTariff is not needed by the service tests.
+func (m *memRepo) CountByTariff(ctx context.Context) (map[string]int, error) {
+	return nil, nil
+}
+
+// ListDue returns active users due for a send, ordered by ID.
+func (m *memRepo) ListDue(ctx context.Context, sentBefore, afterID int64, limit int) ([]*model.UserSettings, error) {
+	out := []*model.UserSettings{}
+	for _, s := range m.data {
+		if s.Active && s.UserID > afterID && s.LastScheduledSent <= sentBefore {
+			c := *s
+			out = append(out, &c)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].UserID < out[j].UserID })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
 // TestUserService_StartStop verifies that Start and Stop toggle the Active flag.
 func TestUserService_StartStop(t *testing.T) {
 	repo := newMemRepo()
@@ -95,3 +131,878 @@ func TestUserService_GetByUsername_SetTariff(t *testing.T) {
 		t.Fatalf("tariff not updated")
 	}
 }
+
+// stubAI returns the same reply for every request.
+type stubAI struct {
+	reply string
+}
+
+// ChatCompletion returns the stubbed reply.
+func (s stubAI) ChatCompletion(ctx context.Context, model, prompt string, maxTokens int, temperature *float64) (string, error) {
+	return s.reply, nil
+}
+
+// ChatResponses returns the stubbed reply.
+func (s stubAI) ChatResponses(ctx context.Context, model, prompt string, maxTokens int, temperature *float64) (string, error) {
+	return s.reply, nil
+}
+
+// TestUserService_EmptyCompletionFallback verifies that blank model output is
+// replaced with the configured fallback notice.
+func TestUserService_EmptyCompletionFallback(t *testing.T) {
+	u := &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"go": {"tips"}}}
+	for _, reply := range []string{"", "  \n\t "} {
+		svc := NewUserService(newMemRepo(), stubAI{reply: reply}, map[string]config.Tariff{"base": {}})
+		svc.SetEmptyReply("fallback")
+		got, err := svc.GetNewsForCategory(context.Background(), u, "go")
+		if err != nil {
+			t.Fatalf("get news: %v", err)
+		}
+		if !strings.HasSuffix(got, "fallback") {
+			t.Fatalf("reply %q: expected fallback, got %q", reply, got)
+		}
+		got, err = svc.GetLast24hNewsForCategory(context.Background(), u, "go")
+		if err != nil || !strings.HasSuffix(got, "fallback") {
+			t.Fatalf("reply %q: expected fallback for last 24h, got %q (%v)", reply, got, err)
+		}
+	}
+}
+
+// promptAI records the last prompt and replies with a fixed text.
+type promptAI struct {
+	reply  string
+	prompt string
+}
+
+// ChatCompletion stores the prompt and returns the reply.
+func (p *promptAI) ChatCompletion(ctx context.Context, model, prompt string, maxTokens int, temperature *float64) (string, error) {
+	p.prompt = prompt
+	return p.reply, nil
+}
+
+// ChatResponses stores the prompt and returns the reply.
+func (p *promptAI) ChatResponses(ctx context.Context, model, prompt string, maxTokens int, temperature *float64) (string, error) {
+	p.prompt = prompt
+	return p.reply, nil
+}
+
+// TestUserService_SafeModePrompt verifies the safety instruction is added to
+// the prompt only for users with safe mode enabled.
+func TestUserService_SafeModePrompt(t *testing.T) {
+	ai := &promptAI{reply: "ok"}
+	svc := NewUserService(newMemRepo(), ai, map[string]config.Tariff{"base": {GPT: config.GPTConfig{PromptMain: "про {категория}"}}})
+	svc.SetSafety("БЕЗ ГРУБОСТЕЙ", nil)
+	u := &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"go": {"tips"}}}
+
+	if _, err := svc.GetNewsForCategory(context.Background(), u, "go"); err != nil {
+		t.Fatalf("get news: %v", err)
+	}
+	if strings.Contains(ai.prompt, "БЕЗ ГРУБОСТЕЙ") {
+		t.Fatalf("instruction added without safe mode: %q", ai.prompt)
+	}
+	u.SafeMode = true
+	if _, err := svc.GetNewsForCategory(context.Background(), u, "go"); err != nil {
+		t.Fatalf("get news: %v", err)
+	}
+	if !strings.HasPrefix(ai.prompt, "про go") || !strings.HasSuffix(ai.prompt, "БЕЗ ГРУБОСТЕЙ") {
+		t.Fatalf("expected safety instruction in prompt, got %q", ai.prompt)
+	}
+}
+
+// TestUserService_SafeModeRedaction checks that banned words are masked
+// case-insensitively in safe mode and left intact otherwise.
+func TestUserService_SafeModeRedaction(t *testing.T) {
+	svc := NewUserService(newMemRepo(), stubAI{reply: "Это Хрень и хрень"}, map[string]config.Tariff{"base": {}})
+	svc.SetSafety("", []string{"хрень", " "})
+	u := &model.UserSettings{UserID: 1, Tariff: "base", SafeMode: true, Topics: map[string][]string{"go": {"tips"}}}
+
+	got, err := svc.GetNewsForCategory(context.Background(), u, "go")
+	if err != nil {
+		t.Fatalf("get news: %v", err)
+	}
+	if !strings.HasSuffix(got, "Это ***** и *****") {
+		t.Fatalf("banned word not redacted: %q", got)
+	}
+	u.SafeMode = false
+	got, _ = svc.GetNewsForCategory(context.Background(), u, "go")
+	if !strings.HasSuffix(got, "Это Хрень и хрень") {
+		t.Fatalf("reply changed without safe mode: %q", got)
+	}
+}
+
+// TestUserService_SafeModeRedactsWholeWords checks that a banned word inside
+// a longer word is kept, while standalone ones next to punctuation are masked.
+func TestUserService_SafeModeRedactsWholeWords(t *testing.T) {
+	svc := NewUserService(newMemRepo(), stubAI{reply: "Скрипка, скрип! Class ass; ass-класс"}, map[string]config.Tariff{"base": {}})
+	svc.SetSafety("", []string{"скрип", "ass"})
+	u := &model.UserSettings{UserID: 1, Tariff: "base", SafeMode: true, Topics: map[string][]string{"go": {"tips"}}}
+
+	got, err := svc.GetNewsForCategory(context.Background(), u, "go")
+	if err != nil {
+		t.Fatalf("get news: %v", err)
+	}
+	if !strings.HasSuffix(got, "Скрипка, *****! Class ***; ***-класс") {
+		t.Fatalf("unexpected redaction: %q", got)
+	}
+}
+
+// TestUserService_Last24hSourcesPrompt verifies the sources-only digest uses
+// its dedicated prompt and falls back to the built-in one.
+func TestUserService_Last24hSourcesPrompt(t *testing.T) {
+	ai := &promptAI{reply: "ok"}
+	tariffs := map[string]config.Tariff{"base": {GPT: config.GPTConfig{PromptLast24h: "проза {категория}", PromptLast24hSources: "ссылки {категория}"}}}
+	svc := NewUserService(newMemRepo(), ai, tariffs)
+	u := &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"go": {"tips"}}}
+
+	if _, err := svc.GetLast24hSourcesForCategory(context.Background(), u, "go"); err != nil {
+		t.Fatalf("get sources: %v", err)
+	}
+	if ai.prompt != "ссылки go" {
+		t.Fatalf("expected sources prompt, got %q", ai.prompt)
+	}
+	if _, err := svc.GetLast24hNewsForCategory(context.Background(), u, "go"); err != nil || ai.prompt != "проза go" {
+		t.Fatalf("regular digest must keep its prompt, got %q (%v)", ai.prompt, err)
+	}
+
+	svc.SetTariffs(map[string]config.Tariff{"base": {}})
+	if _, err := svc.GetLast24hSourcesForCategory(context.Background(), u, "go"); err != nil {
+		t.Fatalf("get sources: %v", err)
+	}
+	if !strings.Contains(ai.prompt, "ссылка на источник") {
+		t.Fatalf("expected default sources prompt, got %q", ai.prompt)
+	}
+}
+
+// fakeAIResult is a single programmed answer of fakeAI.
+type fakeAIResult struct {
+	reply string
+	err   error
+}
+
+// fakeAI is an AIClient returning programmed results in call order. It
+// records every prompt, token limit and temperature it receives.
+type fakeAI struct {
+	mu           sync.Mutex
+	results      []fakeAIResult
+	prompts      []string
+	maxTokens    []int
+	temperatures []*float64
+}
+
+// newFakeAI programs the fake with the given results.
+func newFakeAI(results ...fakeAIResult) *fakeAI {
+	return &fakeAI{results: results}
+}
+
+// next records the request parameters and pops the next programmed result.
+func (f *fakeAI) next(prompt string, maxTokens int, temperature *float64) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.prompts = append(f.prompts, prompt)
+	f.maxTokens = append(f.maxTokens, maxTokens)
+	f.temperatures = append(f.temperatures, temperature)
+	if len(f.results) == 0 {
+		return "", errors.New("fakeAI: unexpected call")
+	}
+	r := f.results[0]
+	f.results = f.results[1:]
+	return r.reply, r.err
+}
+
+// ChatCompletion returns the next programmed result.
+func (f *fakeAI) ChatCompletion(ctx context.Context, model, prompt string, maxTokens int, temperature *float64) (string, error) {
+	return f.next(prompt, maxTokens, temperature)
+}
+
+// ChatResponses returns the next programmed result.
+func (f *fakeAI) ChatResponses(ctx context.Context, model, prompt string, maxTokens int, temperature *float64) (string, error) {
+	return f.next(prompt, maxTokens, temperature)
+}
+
+// blockingAI is an AIClient whose web-search calls wait for release and
+// which records the highest number of calls in flight.
+type blockingAI struct {
+	stubAI
+	release chan struct{}
+	started chan struct{}
+	mu      sync.Mutex
+	running int
+	peak    int
+}
+
+// ChatResponses blocks until release is closed.
+func (b *blockingAI) ChatResponses(ctx context.Context, model, prompt string, maxTokens int, temperature *float64) (string, error) {
+	b.mu.Lock()
+	b.running++
+	b.peak = max(b.peak, b.running)
+	b.mu.Unlock()
+	b.started <- struct{}{}
+	<-b.release
+	b.mu.Lock()
+	b.running--
+	b.mu.Unlock()
+	return "новости", nil
+}
+
+// TestUserService_SearchConcurrency verifies that no more web-search calls
+// than configured run at once and that the rest wait instead of failing.
+func TestUserService_SearchConcurrency(t *testing.T) {
+	ai := &blockingAI{release: make(chan struct{}), started: make(chan struct{}, 5)}
+	svc := NewUserService(newMemRepo(), ai, fakeAITariffs)
+	svc.SetSearchConcurrency(2)
+	u := &model.UserSettings{UserID: 1, Tariff: "base"}
+
+	errs := make(chan error, 5)
+	for range 5 {
+		go func() {
+			_, err := svc.GetLast24hNewsForCategory(context.Background(), u, "go")
+			errs <- err
+		}()
+	}
+	for range 2 {
+		select {
+		case <-ai.started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("searches did not start")
+		}
+	}
+	select {
+	case <-ai.started:
+		t.Fatalf("a third search started while two were in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(ai.release)
+	for range 5 {
+		if err := <-errs; err != nil {
+			t.Fatalf("search: %v", err)
+		}
+	}
+	if ai.peak != 2 {
+		t.Fatalf("expected at most 2 searches at once, peak was %d", ai.peak)
+	}
+}
+
+// fakeAITariffs is a tariff map whose prompt exposes the placeholders.
+var fakeAITariffs = map[string]config.Tariff{"base": {GPT: config.GPTConfig{PromptMain: "{тип} про {категория}"}}}
+
+// TestUserService_GetNews checks the reply is wrapped with type and category.
+func TestUserService_GetNews(t *testing.T) {
+	ai := newFakeAI(fakeAIResult{reply: "новость"})
+	svc := NewUserService(newMemRepo(), ai, fakeAITariffs)
+	u := &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"go": {"tips"}}}
+
+	got, err := svc.GetNews(context.Background(), u)
+	if err != nil {
+		t.Fatalf("get news: %v", err)
+	}
+	if got != "Тип: tips\nКатегория: go\n\nновость" {
+		t.Fatalf("unexpected reply: %q", got)
+	}
+	if len(ai.prompts) != 1 || ai.prompts[0] != "tips про go" {
+		t.Fatalf("unexpected prompts: %q", ai.prompts)
+	}
+}
+
+// TestUserService_GetNewsMultiInfo checks that every info type of the rotated
+// category is requested and assembled in order.
+func TestUserService_GetNewsMultiInfo(t *testing.T) {
+	ai := newFakeAI(fakeAIResult{reply: "первое"}, fakeAIResult{reply: "второе"})
+	svc := NewUserService(newMemRepo(), ai, fakeAITariffs)
+	u := &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"go": {"tips", "news"}}}
+
+	got, err := svc.GetNewsMultiInfo(context.Background(), u)
+	if err != nil {
+		t.Fatalf("get news: %v", err)
+	}
+	want := "Категория: go\n\nТип: tips\nпервое\n\nТип: news\nвторое"
+	if got != want {
+		t.Fatalf("unexpected reply:\n%q\nwant\n%q", got, want)
+	}
+	if len(ai.prompts) != 2 || ai.prompts[1] != "news про go" {
+		t.Fatalf("unexpected prompts: %q", ai.prompts)
+	}
+	if u.RotationPos != 1 {
+		t.Fatalf("rotation was not advanced: %d", u.RotationPos)
+	}
+}
+
+// TestUserService_GetNewsMultiInfo_CategoriesPerSend checks that a scheduled
+// digest covers ScheduledCategoriesPerSend distinct categories of the rotation,
+// capped at the number of categories.
+func TestUserService_GetNewsMultiInfo_CategoriesPerSend(t *testing.T) {
+	svc := NewUserService(newMemRepo(), &promptAI{reply: "новость"}, fakeAITariffs)
+	u := &model.UserSettings{UserID: 1, Tariff: "base", ScheduledCategoriesPerSend: 3,
+		Topics:  map[string][]string{"a": {"x"}, "b": {"x"}, "c": {"x"}, "d": {"x"}},
+		Weights: map[string]int{"a": 3}}
+
+	for send := 0; send < 4; send++ {
+		got, err := svc.GetNewsMultiInfo(context.Background(), u)
+		if err != nil {
+			t.Fatalf("get news: %v", err)
+		}
+		seen := map[string]bool{}
+		for _, line := range strings.Split(got, "\n") {
+			if cat, ok := strings.CutPrefix(line, "Категория: "); ok {
+				seen[cat] = true
+			}
+		}
+		if len(seen) != 3 || strings.Count(got, "Категория: ") != 3 {
+			t.Fatalf("send %d: expected 3 distinct categories, got %q", send, got)
+		}
+	}
+
+	u.ScheduledCategoriesPerSend = 10
+	ds, err := svc.GetNewsMultiInfoDigests(context.Background(), u)
+	if err != nil {
+		t.Fatalf("get digests: %v", err)
+	}
+	if len(ds) != len(u.Topics) {
+		t.Fatalf("expected the count clamped to %d categories, got %d", len(u.Topics), len(ds))
+	}
+}
+
+// TestUserService_ErrorPropagation verifies that a failing call aborts the
+// digest, also when it is not the first of several calls.
+func TestUserService_ErrorPropagation(t *testing.T) {
+	boom := errors.New("rate limited")
+	u := &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"go": {"tips", "news", "ideas"}}}
+
+	ai := newFakeAI(fakeAIResult{reply: "первое"}, fakeAIResult{err: boom}, fakeAIResult{reply: "третье"})
+	svc := NewUserService(newMemRepo(), ai, fakeAITariffs)
+	if got, err := svc.GetNewsMultiInfo(context.Background(), u); !errors.Is(err, boom) || got != "" {
+		t.Fatalf("expected error from the second call, got %q, %v", got, err)
+	}
+	if len(ai.prompts) != 2 {
+		t.Fatalf("generation must stop at the failing call, made %d calls", len(ai.prompts))
+	}
+
+	svc = NewUserService(newMemRepo(), newFakeAI(fakeAIResult{err: boom}), fakeAITariffs)
+	if _, err := svc.GetNews(context.Background(), u); !errors.Is(err, boom) {
+		t.Fatalf("GetNews: expected %v, got %v", boom, err)
+	}
+	if _, err := svc.GetLast24hNewsForCategory(context.Background(), u, "go"); err == nil {
+		t.Fatalf("GetLast24hNewsForCategory: expected error for an unprogrammed call")
+	}
+}
+
+// TestUserService_PromptLengthGuard verifies oversized variable parts are cut
+// to the limit and an oversized template is rejected before calling the model.
+func TestUserService_PromptLengthGuard(t *testing.T) {
+	tariffs := map[string]config.Tariff{"base": {GPT: config.GPTConfig{PromptMain: "{тип} про {категория}", MaxPromptChars: 30}}}
+	ai := newFakeAI(fakeAIResult{reply: "ok"})
+	svc := NewUserService(newMemRepo(), ai, tariffs)
+	long := strings.Repeat("я", 100)
+	u := &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{long: {"факты"}}}
+
+	if _, err := svc.GetNewsForCategory(context.Background(), u, long); err != nil {
+		t.Fatalf("get news: %v", err)
+	}
+	prompt := ai.prompts[0]
+	if n := len([]rune(prompt)); n != 30 || !strings.HasPrefix(prompt, "факты про яяя") {
+		t.Fatalf("expected prompt truncated to 30 characters, got %d: %q", n, prompt)
+	}
+
+	tariffs["base"] = config.Tariff{GPT: config.GPTConfig{PromptMain: strings.Repeat("шаблон ", 10) + "{категория}", MaxPromptChars: 30}}
+	svc.SetTariffs(tariffs)
+	if _, err := svc.GetNewsForCategory(context.Background(), u, long); !errors.Is(err, ErrPromptTooLong) {
+		t.Fatalf("expected ErrPromptTooLong, got %v", err)
+	}
+	if len(ai.prompts) != 1 {
+		t.Fatalf("model must not be called for a rejected prompt")
+	}
+}
+
+// TestUserService_UserStyleOverrides verifies the user's tone and volume
+// replace the tariff defaults only when the tariff offers them as presets.
+func TestUserService_UserStyleOverrides(t *testing.T) {
+	ai := &promptAI{reply: "ok"}
+	tariffs := map[string]config.Tariff{"base": {GPT: config.GPTConfig{
+		PromptMain:    "{категория}: {тон}, {объём}",
+		Style:         "вдохновляющий",
+		Volume:        "2-3 предложения",
+		StylePresets:  []string{"вдохновляющий", "с юмором"},
+		VolumePresets: []string{"2-3 предложения", "подробно"},
+	}}}
+	svc := NewUserService(newMemRepo(), ai, tariffs)
+	ctx := context.Background()
+	u := &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"go": {"tips"}}}
+
+	cases := []struct {
+		tone, volume, want string
+	}{
+		{"", "", "go: вдохновляющий, 2-3 предложения"},
+		{"с юмором", "", "go: с юмором, 2-3 предложения"},
+		{"с юмором", "подробно", "go: с юмором, подробно"},
+		{"саркастичный", "роман", "go: вдохновляющий, 2-3 предложения"},
+	}
+	for _, tc := range cases {
+		u.Tone, u.Volume = tc.tone, tc.volume
+		if _, err := svc.GetNewsForCategory(ctx, u, "go"); err != nil {
+			t.Fatalf("get news: %v", err)
+		}
+		if ai.prompt != tc.want {
+			t.Fatalf("tone %q volume %q: expected prompt %q, got %q", tc.tone, tc.volume, tc.want, ai.prompt)
+		}
+	}
+}
+
+// TestUserService_PromptTemplate verifies the prompt template the user picked
+// replaces prompt_main, and that an unknown one falls back to it.
+func TestUserService_PromptTemplate(t *testing.T) {
+	ai := &promptAI{reply: "ok"}
+	tariffs := map[string]config.Tariff{"base": {GPT: config.GPTConfig{
+		PromptMain:      "main {категория}",
+		PromptTemplates: map[string]string{"analytical": "analyse {категория}: {тип}"},
+	}}}
+	svc := NewUserService(newMemRepo(), ai, tariffs)
+	ctx := context.Background()
+	u := &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"go": {"tips"}}}
+
+	for template, want := range map[string]string{"analytical": "analyse go: tips", "": "main go", "removed": "main go"} {
+		u.PromptTemplate = template
+		if _, err := svc.GetNewsForCategoryMultiInfo(ctx, u, "go"); err != nil {
+			t.Fatalf("get news: %v", err)
+		}
+		if ai.prompt != want {
+			t.Fatalf("template %q: expected prompt %q, got %q", template, want, ai.prompt)
+		}
+	}
+}
+
+// TestUserService_CategoryTone verifies a category's own tone replaces the
+// general one in its prompts, and that other categories and tones the tariff
+// no longer offers fall back to the user's tone.
+func TestUserService_CategoryTone(t *testing.T) {
+	ai := &promptAI{reply: "ok"}
+	tariffs := map[string]config.Tariff{"base": {GPT: config.GPTConfig{
+		PromptMain:    "{категория}: {тон}",
+		PromptLast24h: "24h {категория}: {тон}",
+		Style:         "вдохновляющий",
+		StylePresets:  []string{"вдохновляющий", "серьёзный", "с юмором"},
+	}}}
+	svc := NewUserService(newMemRepo(), ai, tariffs)
+	ctx := context.Background()
+	u := &model.UserSettings{
+		UserID:        1,
+		Tariff:        "base",
+		Tone:          "с юмором",
+		Topics:        map[string][]string{"финансы": {"тренды"}, "кино": {"факты"}, "спорт": {"идеи"}},
+		CategoryTones: map[string]string{"финансы": "серьёзный", "спорт": "саркастичный"},
+	}
+	cases := []struct {
+		get  func() error
+		want string
+	}{
+		{func() error { _, err := svc.GetNewsForCategoryMultiInfo(ctx, u, "финансы"); return err }, "финансы: серьёзный"},
+		{func() error { _, err := svc.GetNewsForCategory(ctx, u, "финансы"); return err }, "финансы: серьёзный"},
+		{func() error { _, err := svc.GetLast24hNewsForCategory(ctx, u, "финансы"); return err }, "24h финансы: серьёзный"},
+		{func() error { _, err := svc.GetNewsForCategoryMultiInfo(ctx, u, "кино"); return err }, "кино: с юмором"},
+		{func() error { _, err := svc.GetNewsForCategoryMultiInfo(ctx, u, "спорт"); return err }, "спорт: с юмором"},
+	}
+	for i, c := range cases {
+		if err := c.get(); err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		if ai.prompt != c.want {
+			t.Fatalf("case %d: expected prompt %q, got %q", i, c.want, ai.prompt)
+		}
+	}
+}
+
+// TestUserService_PruneBlocked verifies only inactive users blocked before the
+// cutoff are deleted, and that a dry run deletes nothing.
+func TestUserService_PruneBlocked(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	old := now.AddDate(0, 0, -60).Unix()
+	recent := now.AddDate(0, 0, -1).Unix()
+	repo := newMemRepo()
+	for _, u := range []*model.UserSettings{
+		{UserID: 1, Blocked: true, BlockedAt: old},
+		{UserID: 2, Blocked: true, BlockedAt: recent},
+		{UserID: 3, Blocked: true},
+		{UserID: 4, Active: true},
+		{UserID: 5, Active: true, Blocked: true, BlockedAt: old},
+	} {
+		repo.Save(context.Background(), u)
+	}
+	svc := NewUserService(repo, nil, nil)
+	cutoff := now.AddDate(0, 0, -30)
+
+	n, err := svc.PruneBlocked(context.Background(), cutoff, true)
+	if err != nil || n != 2 || len(repo.data) != 5 {
+		t.Fatalf("dry run: pruned %d (%v), %d users left", n, err, len(repo.data))
+	}
+	n, err = svc.PruneBlocked(context.Background(), cutoff, false)
+	if err != nil || n != 2 {
+		t.Fatalf("prune: pruned %d (%v)", n, err)
+	}
+	for _, id := range []int64{1, 3} {
+		if _, ok := repo.data[id]; ok {
+			t.Fatalf("user %d must be pruned", id)
+		}
+	}
+	for _, id := range []int64{2, 4, 5} {
+		if _, ok := repo.data[id]; !ok {
+			t.Fatalf("user %d must be kept", id)
+		}
+	}
+}
+
+// TestSameDay checks the day boundary used by the daily counters.
+func TestSameDay(t *testing.T) {
+	base := time.Date(2024, 5, 10, 23, 59, 0, 0, time.UTC)
+	cases := []struct {
+		other time.Time
+		want  bool
+	}{
+		{base.Add(-23 * time.Hour), true},
+		{base.Add(time.Minute), false},
+		{base.AddDate(1, 0, 0), false},
+		{base.In(time.FixedZone("UTC+3", 3*3600)), true},
+	}
+	for _, tc := range cases {
+		if got := SameDay(base, tc.other); got != tc.want {
+			t.Fatalf("SameDay(%v, %v) = %v, want %v", base, tc.other, got, tc.want)
+		}
+	}
+}
+
+// TestUserService_SeededSelection verifies that with a seeded generator the
+// categories and info types picked by GetNews and the rotation of
+// GetNewsMultiInfo are reproducible.
+func TestUserService_SeededSelection(t *testing.T) {
+	topics := map[string][]string{"go": {"tips", "news"}, "rust": {"tips", "news"}, "zig": {"tips", "news"}}
+	pick := func(seed int64) []string {
+		svc := NewUserService(newMemRepo(), nil, fakeAITariffs)
+		svc.SetRand(rand.New(rand.NewSource(seed)))
+		u := &model.UserSettings{UserID: 1, Tariff: "base", Topics: topics}
+		var got []string
+		for i := 0; i < 3; i++ {
+			news, err := svc.GetNews(context.Background(), u)
+			if err != nil {
+				t.Fatalf("get news: %v", err)
+			}
+			got = append(got, strings.SplitN(news, "\n\n", 2)[1])
+		}
+		for i := 0; i < 3; i++ {
+			if _, err := svc.GetNewsMultiInfo(context.Background(), u); err != nil {
+				t.Fatalf("get news: %v", err)
+			}
+			got = append(got, u.RotationOrder[u.RotationPos-1])
+		}
+		return got
+	}
+
+	got := pick(7)
+	want := []string{"news про rust", "tips про go", "news про go", "zig", "rust", "go"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("unexpected selection for seed 7: %q, want %q", got, want)
+	}
+	if again := pick(7); !slices.Equal(again, got) {
+		t.Fatalf("same seed gave a different selection: %q vs %q", again, got)
+	}
+}
+
+// TestUserService_FormatInstruction verifies the prompt carries the
+// instruction of the user's digest format and none without a format.
+func TestUserService_FormatInstruction(t *testing.T) {
+	for _, format := range []string{"", model.FormatProse, model.FormatBullets} {
+		ai := newFakeAI(fakeAIResult{reply: "ok"})
+		svc := NewUserService(newMemRepo(), ai, fakeAITariffs)
+		u := &model.UserSettings{UserID: 1, Tariff: "base", Format: format, Topics: map[string][]string{"go": {"tips"}}}
+		if _, err := svc.GetNewsMultiInfo(context.Background(), u); err != nil {
+			t.Fatalf("%q: get news: %v", format, err)
+		}
+		want := "tips про go"
+		if format != "" {
+			want += "\n\n" + formatInstructions[format]
+		}
+		if len(ai.prompts) != 1 || ai.prompts[0] != want {
+			t.Fatalf("%q: unexpected prompts %q, want %q", format, ai.prompts, want)
+		}
+	}
+}
+
+// TestUserService_RetryTruncated verifies that a reply cut at the token limit
+// is retried once according to the tariff's strategy and that the complete
+// retry reply replaces the partial one.
+func TestUserService_RetryTruncated(t *testing.T) {
+	cases := []struct {
+		gpt        config.GPTConfig
+		wantPrompt string
+		wantTokens int
+		want       string
+	}{
+		{config.GPTConfig{MaxTokens: 100}, "", 0, "обрыв"},
+		{config.GPTConfig{MaxTokens: 100, OnTruncate: config.TruncateConcise}, "tips про go\n\n" + conciseInstruction, 100, "целиком"},
+		{config.GPTConfig{MaxTokens: 100, OnTruncate: config.TruncateMoreTokens, MaxTokensCap: 150}, "tips про go", 150, "целиком"},
+		{config.GPTConfig{MaxTokens: 100, OnTruncate: config.TruncateMoreTokens, MaxTokensCap: 100}, "", 0, "обрыв"},
+	}
+	for i, c := range cases {
+		c.gpt.PromptMain = "{тип} про {категория}"
+		ai := newFakeAI(fakeAIResult{reply: "обрыв", err: openai.ErrTruncated}, fakeAIResult{reply: "целиком"})
+		svc := NewUserService(newMemRepo(), ai, map[string]config.Tariff{"base": {GPT: c.gpt}})
+		u := &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"go": {"tips"}}}
+		got, err := svc.GetNewsMultiInfo(context.Background(), u)
+		if err != nil {
+			t.Fatalf("case %d: get news: %v", i, err)
+		}
+		if !strings.HasSuffix(got, c.want) {
+			t.Fatalf("case %d: reply %q, want %q", i, got, c.want)
+		}
+		if c.wantPrompt == "" {
+			if len(ai.prompts) != 1 {
+				t.Fatalf("case %d: expected no retry, got prompts %q", i, ai.prompts)
+			}
+			continue
+		}
+		if len(ai.prompts) != 2 || ai.prompts[1] != c.wantPrompt || ai.maxTokens[1] != c.wantTokens {
+			t.Fatalf("case %d: retry prompts %q tokens %v, want %q/%d", i, ai.prompts, ai.maxTokens, c.wantPrompt, c.wantTokens)
+		}
+	}
+}
+
+// TestUserService_TemperaturePerPath verifies that scheduled digests use the
+// tariff's scheduled temperature and on-demand requests the on-demand one,
+// with a single configured value used for both paths.
+func TestUserService_TemperaturePerPath(t *testing.T) {
+	hot, cold := 1.2, 0.3
+	cases := []struct {
+		scheduled, onDemand *float64
+		wantScheduled       *float64
+		wantOnDemand        *float64
+	}{
+		{&hot, &cold, &hot, &cold},
+		{&hot, nil, &hot, &hot},
+		{nil, &cold, &cold, &cold},
+		{nil, nil, nil, nil},
+	}
+	for i, c := range cases {
+		ai := newFakeAI(fakeAIResult{reply: "a"}, fakeAIResult{reply: "b"}, fakeAIResult{reply: "c"})
+		gpt := config.GPTConfig{PromptMain: "{тип} про {категория}", TemperatureScheduled: c.scheduled, TemperatureOnDemand: c.onDemand}
+		svc := NewUserService(newMemRepo(), ai, map[string]config.Tariff{"base": {GPT: gpt}})
+		u := &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"go": {"tips"}}}
+		ctx := context.Background()
+		if _, err := svc.GetNewsMultiInfo(WithScheduled(ctx), u); err != nil {
+			t.Fatalf("case %d: scheduled: %v", i, err)
+		}
+		if _, err := svc.GetNewsForCategory(ctx, u, "go"); err != nil {
+			t.Fatalf("case %d: on demand: %v", i, err)
+		}
+		if _, err := svc.GetLast24hNewsForCategory(ctx, u, "go"); err != nil {
+			t.Fatalf("case %d: last 24h: %v", i, err)
+		}
+		want := []*float64{c.wantScheduled, c.wantOnDemand, c.wantOnDemand}
+		if len(ai.temperatures) != len(want) {
+			t.Fatalf("case %d: expected %d requests, got %d", i, len(want), len(ai.temperatures))
+		}
+		for j, got := range ai.temperatures {
+			if got != want[j] {
+				t.Fatalf("case %d: call %d got temperature %v, want %v", i, j, got, want[j])
+			}
+		}
+	}
+}
+
+// TestUserService_DebugLog verifies prompts are logged only in debug mode and
+// long replies are shortened.
+func TestUserService_DebugLog(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	long := strings.Repeat("x", debugReplyChars+50)
+	gpt := config.GPTConfig{PromptMain: "{тип} про {категория}"}
+	for _, debug := range []bool{false, true} {
+		buf.Reset()
+		svc := NewUserService(newMemRepo(), newFakeAI(fakeAIResult{reply: long}), map[string]config.Tariff{"base": {GPT: gpt}})
+		svc.SetDebug(debug)
+		u := &model.UserSettings{UserID: 7, Tariff: "base", Topics: map[string][]string{"go": {"tips"}}}
+		if _, err := svc.GetNewsForCategory(context.Background(), u, "go"); err != nil {
+			t.Fatalf("debug=%v: %v", debug, err)
+		}
+		out := buf.String()
+		if !debug {
+			if out != "" {
+				t.Fatalf("expected no log with debug off, got %q", out)
+			}
+			continue
+		}
+		if !strings.Contains(out, "user 7") || !strings.Contains(out, "tips про go") {
+			t.Fatalf("expected user and prompt in log, got %q", out)
+		}
+		if strings.Contains(out, long) || !strings.Contains(out, strings.Repeat("x", debugReplyChars)+"…") {
+			t.Fatalf("expected truncated reply in log, got %q", out)
+		}
+	}
+}
+
+// TestUserService_ShortDigest verifies short scheduled digests only cover the
+// first info type while on-demand requests stay complete.
+func TestUserService_ShortDigest(t *testing.T) {
+	ai := newFakeAI(fakeAIResult{reply: "a"}, fakeAIResult{reply: "b"}, fakeAIResult{reply: "c"})
+	gpt := config.GPTConfig{PromptMain: "{тип} про {категория}"}
+	svc := NewUserService(newMemRepo(), ai, map[string]config.Tariff{"base": {GPT: gpt}})
+	u := &model.UserSettings{UserID: 1, Tariff: "base", ShortDigest: true, Topics: map[string][]string{"go": {"tips", "news"}}}
+	ctx := context.Background()
+
+	got, err := svc.GetNewsMultiInfo(WithScheduled(ctx), u)
+	if err != nil {
+		t.Fatalf("scheduled: %v", err)
+	}
+	if want := "Категория: go\n\nТип: tips\na"; got != want {
+		t.Fatalf("scheduled digest = %q, want %q", got, want)
+	}
+	got, err = svc.GetNewsForCategoryMultiInfo(ctx, u, "go")
+	if err != nil {
+		t.Fatalf("on demand: %v", err)
+	}
+	if !strings.Contains(got, "Тип: tips") || !strings.Contains(got, "Тип: news") {
+		t.Fatalf("on-demand digest must keep every info type, got %q", got)
+	}
+	if len(ai.prompts) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(ai.prompts))
+	}
+}
+
+// TestUserService_ShuffleInfos verifies info types keep their stored order by
+// default and come in varying orders once the user turns shuffling on.
+func TestUserService_ShuffleInfos(t *testing.T) {
+	infos := []string{"a", "b", "c", "d"}
+	orders := func(shuffle bool) map[string]bool {
+		const sends = 10
+		results := make([]fakeAIResult, sends*len(infos))
+		for i := range results {
+			results[i] = fakeAIResult{reply: "ok"}
+		}
+		ai := newFakeAI(results...)
+		svc := NewUserService(newMemRepo(), ai, map[string]config.Tariff{"base": {GPT: config.GPTConfig{PromptMain: "{тип}"}}})
+		svc.SetRand(rand.New(rand.NewSource(1)))
+		u := &model.UserSettings{UserID: 1, Tariff: "base", ShuffleInfos: shuffle, Topics: map[string][]string{"go": slices.Clone(infos)}}
+		seen := map[string]bool{}
+		for i := 0; i < sends; i++ {
+			if _, err := svc.GetNewsForCategoryMultiInfo(context.Background(), u, "go"); err != nil {
+				t.Fatalf("send %d: %v", i, err)
+			}
+			seen[strings.Join(ai.prompts[i*len(infos):(i+1)*len(infos)], ",")] = true
+		}
+		if !slices.Equal(u.Topics["go"], infos) {
+			t.Fatalf("stored info order changed to %v", u.Topics["go"])
+		}
+		return seen
+	}
+
+	if got := orders(false); len(got) != 1 || !got["a,b,c,d"] {
+		t.Fatalf("order must stay stable without shuffling, got %v", got)
+	}
+	if got := orders(true); len(got) < 2 {
+		t.Fatalf("order must vary with shuffling on, got %v", got)
+	}
+}
+
+// TestUserService_HideLabels verifies the category and info type lines are
+// left out of single, multi-info, separate and scheduled digests once the user
+// turned labels off, and kept by default.
+func TestUserService_HideLabels(t *testing.T) {
+	results := make([]fakeAIResult, 12)
+	for i := range results {
+		results[i] = fakeAIResult{reply: "текст"}
+	}
+	svc := NewUserService(newMemRepo(), newFakeAI(results...), fakeAITariffs)
+	ctx := context.Background()
+	digests := func(u *model.UserSettings) []string {
+		var out []string
+		single, err := svc.GetNewsForCategory(ctx, u, "go")
+		if err != nil {
+			t.Fatalf("single: %v", err)
+		}
+		multi, err := svc.GetNewsForCategoryMultiInfo(ctx, u, "go")
+		if err != nil {
+			t.Fatalf("multi: %v", err)
+		}
+		u.SeparateMessages = true
+		separate, err := svc.GetNewsForCategoryMultiInfoMessages(ctx, u, "go")
+		if err != nil {
+			t.Fatalf("separate: %v", err)
+		}
+		u.SeparateMessages = false
+		scheduled, err := svc.GetNewsMultiInfo(WithScheduled(ctx), u)
+		if err != nil {
+			t.Fatalf("scheduled: %v", err)
+		}
+		out = append(out, single, multi, scheduled)
+		return append(out, separate...)
+	}
+
+	u := &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"go": {"tips"}}}
+	for _, d := range digests(u) {
+		if !strings.HasPrefix(d, "Тип: tips") && !strings.HasPrefix(d, "Категория: go") {
+			t.Fatalf("labels must be shown by default, got %q", d)
+		}
+	}
+	u.HideLabels = true
+	for _, d := range digests(u) {
+		if d != "текст" {
+			t.Fatalf("expected just the content without labels, got %q", d)
+		}
+	}
+	if got := RotationCategory(u); got != "go" {
+		t.Fatalf("rotation category = %q, want go", got)
+	}
+}
+
+// TestUserService_MaxTokens verifies the /length preference is clamped to the
+// tariff's token range before it is sent to the model.
+func TestUserService_MaxTokens(t *testing.T) {
+	gpt := config.GPTConfig{PromptMain: "{тип} про {категория}", MaxTokens: 1000, MinTokens: 200}
+	for _, tc := range []struct{ pref, want int }{{0, 1000}, {600, 600}, {5000, 1000}, {50, 200}} {
+		ai := newFakeAI(fakeAIResult{reply: "ok"})
+		svc := NewUserService(newMemRepo(), ai, map[string]config.Tariff{"base": {GPT: gpt}})
+		u := &model.UserSettings{UserID: 1, Tariff: "base", MaxTokens: tc.pref, Topics: map[string][]string{"go": {"tips"}}}
+		if _, err := svc.GetNewsForCategory(context.Background(), u, "go"); err != nil {
+			t.Fatalf("get news: %v", err)
+		}
+		if len(ai.maxTokens) != 1 || ai.maxTokens[0] != tc.want {
+			t.Fatalf("preference %d: sent max tokens %v, want %d", tc.pref, ai.maxTokens, tc.want)
+		}
+	}
+}
+
+// TestUserService_GetNewsForCategoryInfo verifies the prompt is built for the
+// requested info type and types not selected for the category are refused.
+func TestUserService_GetNewsForCategoryInfo(t *testing.T) {
+	ai := newFakeAI(fakeAIResult{reply: "новость"})
+	svc := NewUserService(newMemRepo(), ai, fakeAITariffs)
+	u := &model.UserSettings{UserID: 1, Tariff: "base", Topics: map[string][]string{"go": {"tips", "news"}, "rust": {"facts"}}}
+	ctx := context.Background()
+
+	got, err := svc.GetNewsForCategoryInfo(ctx, u, "go", "news")
+	if err != nil {
+		t.Fatalf("get news: %v", err)
+	}
+	if want := "Тип: news\nКатегория: go\n\nновость"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if len(ai.prompts) != 1 || ai.prompts[0] != "news про go" {
+		t.Fatalf("unexpected prompts %q", ai.prompts)
+	}
+	for _, info := range []string{"facts", "ideas", ""} {
+		if _, err := svc.GetNewsForCategoryInfo(ctx, u, "go", info); !errors.Is(err, ErrUnknownInfo) {
+			t.Fatalf("info %q: expected ErrUnknownInfo, got %v", info, err)
+		}
+	}
+	if len(ai.prompts) != 1 {
+		t.Fatalf("refused info types must not reach the model, got %d requests", len(ai.prompts))
+	}
+}
+
+// TestSanitizeTopic verifies placeholders, control characters and extra
+// whitespace are removed from a /search topic and long topics are cut.
+func TestSanitizeTopic(t *testing.T) {
+	if got := SanitizeTopic("  {категория}\tкосмос\x00 "); got != "категория космос" {
+		t.Fatalf("unexpected topic %q", got)
+	}
+	if got := SanitizeTopic(strings.Repeat("я", 150)); len([]rune(got)) != maxSearchTopic {
+		t.Fatalf("topic must be cut to %d characters, got %d", maxSearchTopic, len([]rune(got)))
+	}
+}
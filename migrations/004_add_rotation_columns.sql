@@ -0,0 +1,4 @@
+ALTER TABLE user_settings
+    ADD COLUMN IF NOT EXISTS rotation_order JSONB,
+    ADD COLUMN IF NOT EXISTS rotation_pos INTEGER,
+    ADD COLUMN IF NOT EXISTS rotation_started BIGINT;
@@ -0,0 +1,8 @@
+-- Convert info_types from the legacy {"category": [infos]} map into the
+-- structured [{"name", "infos", "weight"}] list.
+UPDATE user_settings
+SET info_types = (
+    SELECT COALESCE(jsonb_agg(jsonb_build_object('name', key, 'infos', value) ORDER BY key), '[]'::jsonb)
+    FROM jsonb_each(info_types)
+)
+WHERE jsonb_typeof(info_types) = 'object';
@@ -0,0 +1,3 @@
+CREATE INDEX IF NOT EXISTS user_settings_due_idx
+    ON user_settings (user_id, last_scheduled_sent)
+    WHERE active AND NOT blocked;
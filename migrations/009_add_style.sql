@@ -0,0 +1,3 @@
+ALTER TABLE user_settings
+    ADD COLUMN IF NOT EXISTS tone TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS volume TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+ALTER TABLE user_settings
+    ADD COLUMN IF NOT EXISTS separate_messages BOOLEAN NOT NULL DEFAULT FALSE;
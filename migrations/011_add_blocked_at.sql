@@ -0,0 +1,2 @@
+ALTER TABLE user_settings
+    ADD COLUMN IF NOT EXISTS blocked_at BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+ALTER TABLE user_settings
+    ADD COLUMN IF NOT EXISTS snoozed_until JSONB NOT NULL DEFAULT '{}'::jsonb;
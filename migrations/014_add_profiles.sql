@@ -0,0 +1,2 @@
+ALTER TABLE user_settings
+    ADD COLUMN IF NOT EXISTS profiles JSONB NOT NULL DEFAULT '{}'::jsonb;
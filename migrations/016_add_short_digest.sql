@@ -0,0 +1,2 @@
+ALTER TABLE user_settings
+    ADD COLUMN IF NOT EXISTS short_digest BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,2 @@
+ALTER TABLE user_settings
+    ADD COLUMN IF NOT EXISTS max_tokens INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS bot_state (
+    key TEXT PRIMARY KEY,
+    value BIGINT NOT NULL
+);
@@ -0,0 +1,2 @@
+ALTER TABLE user_settings
+    ADD COLUMN IF NOT EXISTS hide_labels BOOLEAN NOT NULL DEFAULT FALSE;
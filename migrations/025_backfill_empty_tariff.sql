@@ -0,0 +1,3 @@
+UPDATE user_settings
+    SET tariff = 'base'
+    WHERE tariff IS NULL OR tariff = '';
@@ -0,0 +1,2 @@
+ALTER TABLE user_settings
+    ADD COLUMN IF NOT EXISTS trial_features JSONB NOT NULL DEFAULT '{}'::jsonb;
@@ -0,0 +1,2 @@
+ALTER TABLE user_settings
+    ADD COLUMN IF NOT EXISTS prompt_template TEXT NOT NULL DEFAULT '';
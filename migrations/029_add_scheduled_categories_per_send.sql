@@ -0,0 +1,2 @@
+ALTER TABLE user_settings
+    ADD COLUMN IF NOT EXISTS scheduled_categories_per_send INTEGER NOT NULL DEFAULT 0;
@@ -8,59 +8,121 @@ import (
 	"fmt"
 	"html"
 	"io"
+	"log"
 	"net/http"
 	"regexp"
 	"strings"
+	"time"
 )
 
+// ErrTruncated is returned together with the partial reply when the model
+// stopped because it hit the token limit (finish_reason "length").
+var ErrTruncated = errors.New("openai: reply truncated at the token limit")
+
 type Client struct {
-	token      string
-	baseURL    string
-	httpClient *http.Client
+	token            string
+	chatBaseURL      string
+	responsesBaseURL string
+	httpClient       *http.Client
+	maxRetries       int
+	retryBase        time.Duration
 }
 
+// defaultBaseURL is the official OpenAI API endpoint.
+const defaultBaseURL = "https://api.openai.com/v1"
+
+// Default retry policy for failed requests, see SetRetry.
+const (
+	DefaultMaxRetries = 2
+	DefaultRetryBase  = 500 * time.Millisecond
+)
+
 // NewClient creates an OpenAI API client. If baseURL is empty the official
 // endpoint is used.
 func NewClient(token, baseURL string) *Client {
-	if baseURL == "" {
-		baseURL = "https://api.openai.com/v1"
+	return NewClientWithEndpoints(token, baseURL, baseURL)
+}
+
+// NewClientWithEndpoints creates a client sending chat completions and
+// responses requests to separate base URLs. An empty URL falls back to the
+// official endpoint.
+func NewClientWithEndpoints(token, chatBaseURL, responsesBaseURL string) *Client {
+	if chatBaseURL == "" {
+		chatBaseURL = defaultBaseURL
+	}
+	if responsesBaseURL == "" {
+		responsesBaseURL = defaultBaseURL
 	}
 	return &Client{
-		token:      token,
-		baseURL:    baseURL,
-		httpClient: http.DefaultClient,
+		token:            token,
+		chatBaseURL:      chatBaseURL,
+		responsesBaseURL: responsesBaseURL,
+		httpClient:       http.DefaultClient,
+		maxRetries:       DefaultMaxRetries,
+		retryBase:        DefaultRetryBase,
 	}
 }
 
-// do performs a POST request to the given endpoint and decodes the response.
-func (c *Client) do(ctx context.Context, endpoint string, body any, out any) error {
+// SetRetry sets how many times a request failing with a network error, a
+// rate limit or a server error is repeated, and the delay before the first
+// retry, which doubles for every further one.
+func (c *Client) SetRetry(maxRetries int, base time.Duration) {
+	c.maxRetries = max(maxRetries, 0)
+	c.retryBase = max(base, 0)
+}
+
+// do performs a POST request to the given URL and decodes the response,
+// retrying transient failures according to the retry policy.
+func (c *Client) do(ctx context.Context, url string, body any, out any) error {
 	b, err := json.Marshal(body)
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+endpoint, bytes.NewReader(b))
+	delay := c.retryBase
+	for attempt := 0; ; attempt++ {
+		retry, err := c.post(ctx, url, b, out)
+		if err == nil || !retry || attempt == c.maxRetries || ctx.Err() != nil {
+			return err
+		}
+		log.Printf("openai: attempt %d failed, retrying in %s: %v", attempt+1, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// post sends a single request and reports whether a failure is worth
+// retrying: network errors, rate limits and server errors are.
+func (c *Client) post(ctx context.Context, url string, body []byte, out any) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
 	if err != nil {
-		return err
+		return false, err
 	}
 	req.Header.Set("Authorization", "Bearer "+c.token)
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return err
+		return true, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		data, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("openai: unexpected status %s: %s", resp.Status, string(data))
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+		return retry, fmt.Errorf("openai: unexpected status %s: %s", resp.Status, string(data))
 	}
 
-	return json.NewDecoder(resp.Body).Decode(out)
+	return false, json.NewDecoder(resp.Body).Decode(out)
 }
 
-// ChatCompletion sends a minimal chat completion request using the configured model.
-func (c *Client) ChatCompletion(ctx context.Context, model, prompt string, maxTokens int) (string, error) {
+// ChatCompletion sends a minimal chat completion request using the configured
+// model. A nil temperature leaves the model default. A reply cut at the token
+// limit is returned with ErrTruncated.
+func (c *Client) ChatCompletion(ctx context.Context, model, prompt string, maxTokens int, temperature *float64) (string, error) {
 
 	reqBody := map[string]any{
 		"model": model,
@@ -71,25 +133,34 @@ func (c *Client) ChatCompletion(ctx context.Context, model, prompt string, maxTo
 	if maxTokens > 0 {
 		reqBody["max_tokens"] = maxTokens
 	}
+	if temperature != nil {
+		reqBody["temperature"] = *temperature
+	}
 
 	var respBody struct {
 		Choices []struct {
 			Message struct {
 				Content string `json:"content"`
 			} `json:"message"`
+			FinishReason string `json:"finish_reason"`
 		} `json:"choices"`
 	}
-	if err := c.do(ctx, "/chat/completions", reqBody, &respBody); err != nil {
+	if err := c.do(ctx, c.chatBaseURL+"/chat/completions", reqBody, &respBody); err != nil {
 		return "", err
 	}
 	if len(respBody.Choices) == 0 {
 		return "", errors.New("openai: empty response")
 	}
-	return respBody.Choices[0].Message.Content, nil
+	choice := respBody.Choices[0]
+	if choice.FinishReason == "length" {
+		return choice.Message.Content, ErrTruncated
+	}
+	return choice.Message.Content, nil
 }
 
 // ChatResponses calls the experimental /responses endpoint to get news with web search results.
-func (c *Client) ChatResponses(ctx context.Context, model, prompt string, maxTokens int) (string, error) {
+// A nil temperature leaves the model default.
+func (c *Client) ChatResponses(ctx context.Context, model, prompt string, maxTokens int, temperature *float64) (string, error) {
 
 	reqBody := map[string]any{
 		"model": model,
@@ -98,6 +169,9 @@ func (c *Client) ChatResponses(ctx context.Context, model, prompt string, maxTok
 	if maxTokens > 0 {
 		reqBody["max_output_tokens"] = maxTokens
 	}
+	if temperature != nil {
+		reqBody["temperature"] = *temperature
+	}
 
 	//// Пример добавления функции поиска
 	//reqBody["tools"] = []map[string]any{
@@ -131,7 +205,7 @@ func (c *Client) ChatResponses(ctx context.Context, model, prompt string, maxTok
 			} `json:"content"`
 		} `json:"output"`
 	}
-	if err := c.do(ctx, "/responses", reqBody, &respBody); err != nil {
+	if err := c.do(ctx, c.responsesBaseURL+"/responses", reqBody, &respBody); err != nil {
 		return "", err
 	}
 	if len(respBody.Output) < 2 || len(respBody.Output[1].Content) == 0 {
@@ -141,11 +215,23 @@ func (c *Client) ChatResponses(ctx context.Context, model, prompt string, maxTok
 	return markdownToTelegramHTML(removeDuplicateLines(respBody.Output[1].Content[0].Text)), nil
 }
 
+// reLink matches Markdown links [text](url); the URL may contain one level of
+// balanced parentheses, e.g. Wikipedia articles.
+var reLink = regexp.MustCompile(`\[([^\]]+)\]\(((?:[^()\s]|\([^()\s]*\))+)\)`)
+
 // markdownToTelegramHTML converts a subset of Markdown to HTML allowed by Telegram.
 func markdownToTelegramHTML(input string) string {
 	// Экранируем спецсимволы
 	input = html.EscapeString(input)
 
+	// Ссылки [текст](url) заменяем заглушками, чтобы звёздочки и
+	// подчёркивания в адресах не превращались в разметку
+	var links []string
+	input = reLink.ReplaceAllStringFunc(input, func(m string) string {
+		links = append(links, reLink.ReplaceAllString(m, `<a href="$2">$1</a>`))
+		return fmt.Sprintf("\x00%d\x00", len(links)-1)
+	})
+
 	// Жирный (**…**)
 	reBold := regexp.MustCompile(`\*\*(.*?)\*\*`)
 	input = reBold.ReplaceAllString(input, "<b>$1</b>")
@@ -154,11 +240,43 @@ func markdownToTelegramHTML(input string) string {
 	reItalic := regexp.MustCompile(`\*(.*?)\*`)
 	input = reItalic.ReplaceAllString(input, "<i>$1</i>")
 
-	// Ссылки [текст](url)
-	reLink := regexp.MustCompile(`\[(.*?)\]\((.*?)\)`)
-	input = reLink.ReplaceAllString(input, `<a href="$2">$1</a>`)
+	for i, link := range links {
+		input = strings.Replace(input, fmt.Sprintf("\x00%d\x00", i), link, 1)
+	}
+
+	return balancedOrPlain(removeUnclosedAnchor(input))
+}
+
+// reTag matches an opening or closing HTML tag and captures the slash and name.
+var reTag = regexp.MustCompile(`<(/?)([a-zA-Z]+)[^>]*>`)
+
+// balancedOrPlain is a safety net for the converter: if the tags in text are
+// not properly nested and closed, Telegram would reject the whole message, so
+// all tags are stripped and the escaped plain text is returned instead.
+func balancedOrPlain(text string) string {
+	if tagsBalanced(text) {
+		return text
+	}
+	log.Printf("unbalanced HTML in model reply, sending plain text")
+	return reTag.ReplaceAllString(text, "")
+}
 
-	return removeUnclosedAnchor(input)
+// tagsBalanced reports whether every tag in text is closed in the reverse
+// order it was opened.
+func tagsBalanced(text string) bool {
+	var open []string
+	for _, m := range reTag.FindAllStringSubmatch(text, -1) {
+		name := strings.ToLower(m[2])
+		if m[1] == "" {
+			open = append(open, name)
+			continue
+		}
+		if len(open) == 0 || open[len(open)-1] != name {
+			return false
+		}
+		open = open[:len(open)-1]
+	}
+	return len(open) == 0
 }
 
 func removeUnclosedAnchor(text string) string {
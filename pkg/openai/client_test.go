@@ -0,0 +1,135 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestMarkdownToTelegramHTML_Links verifies that source links survive the
+// conversion, including URLs with underscores, asterisks and parentheses.
+func TestMarkdownToTelegramHTML_Links(t *testing.T) {
+	cases := map[string]string{
+		"- **Рынки** растут [РБК](https://rbc.ru/a_b?x=1&y=2)":       `- <b>Рынки</b> растут <a href="https://rbc.ru/a_b?x=1&amp;y=2">РБК</a>`,
+		"- Язык [Wiki](https://en.wikipedia.org/wiki/Go_(language))": `- Язык <a href="https://en.wikipedia.org/wiki/Go_(language)">Wiki</a>`,
+		"- *Новость* ([site.com](https://site.com/*star*/page))":     `- <i>Новость</i> (<a href="https://site.com/*star*/page">site.com</a>)`,
+	}
+	for in, want := range cases {
+		if got := markdownToTelegramHTML(in); got != want {
+			t.Errorf("markdownToTelegramHTML(%q) =\n%q, want\n%q", in, got, want)
+		}
+	}
+}
+
+// TestMarkdownToTelegramHTML_UnbalancedFallsBackToPlain verifies that
+// overlapping or unclosed tags are stripped instead of reaching Telegram.
+func TestMarkdownToTelegramHTML_UnbalancedFallsBackToPlain(t *testing.T) {
+	cases := map[string]string{
+		"**жирный *и** курсив*":         "жирный и курсив",
+		"a & **b** [c](https://c.io/x)": `a &amp; <b>b</b> <a href="https://c.io/x">c</a>`,
+	}
+	for in, want := range cases {
+		if got := markdownToTelegramHTML(in); got != want {
+			t.Errorf("markdownToTelegramHTML(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// TestBalancedOrPlain checks the tag balance validation on broken sequences.
+func TestBalancedOrPlain(t *testing.T) {
+	cases := map[string]string{
+		"<b>ok</b> <i>fine</i>":      "<b>ok</b> <i>fine</i>",
+		"<b><i>nested</i></b>":       "<b><i>nested</i></b>",
+		"<b><i>crossed</b></i>":      "crossed",
+		"<b>never closed":            "never closed",
+		"closed</i> without opening": "closed without opening",
+		`<a href="x">link</b>`:       "link",
+		"5 &lt; 6 <b>ok</b>":         "5 &lt; 6 <b>ok</b>",
+	}
+	for in, want := range cases {
+		if got := balancedOrPlain(in); got != want {
+			t.Errorf("balancedOrPlain(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// TestChatCompletion_Truncated verifies that a reply stopped by the token
+// limit is returned together with ErrTruncated.
+func TestChatCompletion_Truncated(t *testing.T) {
+	for reason, wantErr := range map[string]error{"stop": nil, "length": ErrTruncated} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"choices":[{"message":{"content":"текст"},"finish_reason":"` + reason + `"}]}`))
+		}))
+		got, err := NewClient("token", srv.URL).ChatCompletion(context.Background(), "m", "p", 10, nil)
+		srv.Close()
+		if got != "текст" || !errors.Is(err, wantErr) {
+			t.Fatalf("%s: got %q, %v", reason, got, err)
+		}
+	}
+}
+
+// TestClient_SeparateEndpoints verifies that chat completions and responses
+// requests go to their own base URLs.
+func TestClient_SeparateEndpoints(t *testing.T) {
+	var chatPath, responsesPath string
+	chat := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chatPath = r.URL.Path
+		w.Write([]byte(`{"choices":[{"message":{"content":"chat"}}]}`))
+	}))
+	defer chat.Close()
+	responses := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		responsesPath = r.URL.Path
+		w.Write([]byte(`{"output":[{"type":"web_search_call"},{"type":"message","content":[{"type":"output_text","text":"responses"}]}]}`))
+	}))
+	defer responses.Close()
+
+	c := NewClientWithEndpoints("token", chat.URL+"/chat-gw", responses.URL+"/responses-gw")
+	if got, err := c.ChatCompletion(context.Background(), "m", "p", 0, nil); err != nil || got != "chat" {
+		t.Fatalf("chat completion: %q, %v", got, err)
+	}
+	if got, err := c.ChatResponses(context.Background(), "m", "p", 0, nil); err != nil || got != "responses" {
+		t.Fatalf("responses: %q, %v", got, err)
+	}
+	if chatPath != "/chat-gw/chat/completions" || responsesPath != "/responses-gw/responses" {
+		t.Fatalf("unexpected paths: chat %q, responses %q", chatPath, responsesPath)
+	}
+}
+
+// TestClient_Retries verifies that server errors are retried up to the
+// configured count while client errors fail at once.
+func TestClient_Retries(t *testing.T) {
+	cases := []struct {
+		retries, failures, status int
+		wantRequests              int
+		wantErr                   bool
+	}{
+		{retries: 2, failures: 2, status: http.StatusServiceUnavailable, wantRequests: 3},
+		{retries: 1, failures: 2, status: http.StatusTooManyRequests, wantRequests: 2, wantErr: true},
+		{retries: 0, failures: 1, status: http.StatusBadGateway, wantRequests: 1, wantErr: true},
+		{retries: 3, failures: 1, status: http.StatusBadRequest, wantRequests: 1, wantErr: true},
+	}
+	for i, c := range cases {
+		requests := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests <= c.failures {
+				w.WriteHeader(c.status)
+				return
+			}
+			w.Write([]byte(`{"choices":[{"message":{"content":"ok"}}]}`))
+		}))
+		client := NewClient("token", srv.URL)
+		client.SetRetry(c.retries, time.Millisecond)
+		got, err := client.ChatCompletion(context.Background(), "m", "p", 0, nil)
+		srv.Close()
+		if requests != c.wantRequests {
+			t.Errorf("case %d: %d requests, want %d", i, requests, c.wantRequests)
+		}
+		if (err != nil) != c.wantErr || (err == nil && got != "ok") {
+			t.Errorf("case %d: got %q, %v", i, got, err)
+		}
+	}
+}
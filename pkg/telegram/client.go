@@ -5,15 +5,37 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Update represents a Telegram update. Only fields we need.
 type Update struct {
-	UpdateID int      `json:"update_id"`
-	Message  *Message `json:"message,omitempty"`
+	UpdateID      int            `json:"update_id"`
+	Message       *Message       `json:"message,omitempty"`
+	EditedMessage *Message       `json:"edited_message,omitempty"`
+	CallbackQuery *CallbackQuery `json:"callback_query,omitempty"`
+}
+
+// CallbackQuery is a press on an inline button. Message is the message the
+// button belongs to.
+type CallbackQuery struct {
+	ID      string   `json:"id"`
+	From    User     `json:"from"`
+	Message *Message `json:"message,omitempty"`
+	Data    string   `json:"data"`
+}
+
+// InlineButton is a button attached to a message that sends CallbackData
+// back to the bot as a callback query instead of a chat message.
+type InlineButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callback_data"`
 }
 
 type Message struct {
@@ -28,6 +50,13 @@ type Chat struct {
 	Username  string `json:"username"`
 }
 
+// User is a Telegram account, e.g. the bot itself as returned by getMe.
+type User struct {
+	ID       int64  `json:"id"`
+	IsBot    bool   `json:"is_bot"`
+	Username string `json:"username"`
+}
+
 // Client is a minimal Telegram Bot API client.
 type Client struct {
 	token      string
@@ -35,17 +64,120 @@ type Client struct {
 	httpClient *http.Client
 }
 
+// ParseMode selects how Telegram interprets message entities in the text.
+type ParseMode string
+
+const (
+	ParseModeHTML       ParseMode = "HTML"
+	ParseModeMarkdownV2 ParseMode = "MarkdownV2"
+	ParseModeNone       ParseMode = ""
+)
+
+// markdownV2Special lists the characters that must be escaped in MarkdownV2 text.
+const markdownV2Special = "_*[]()~`>#+-=|{}.!\\"
+
+// EscapeMarkdownV2 escapes all characters that have a special meaning in
+// Telegram's MarkdownV2 so that the text is rendered literally.
+func EscapeMarkdownV2(text string) string {
+	var b strings.Builder
+	b.Grow(len(text))
+	for _, r := range text {
+		if strings.ContainsRune(markdownV2Special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
 // BotCommand describes a bot command for the Telegram menu.
 type BotCommand struct {
 	Command     string `json:"command"`
 	Description string `json:"description"`
 }
 
+// ErrBlocked is returned when Telegram refuses to deliver a message to the
+// chat, e.g. because the user blocked the bot or deleted their account.
+var ErrBlocked = errors.New("telegram: bot was blocked by the user")
+
+// ErrConflict is returned by GetUpdates when another client polls with the
+// same bot token.
+var ErrConflict = errors.New("telegram: conflict with another getUpdates request")
+
+// APIError is a request Telegram rejected, decoded from its
+// {"ok":false,"error_code":...,"description":...} response body. It matches
+// ErrBlocked for 403 and ErrConflict for 409 with errors.Is.
+type APIError struct {
+	ErrorCode   int
+	Description string
+	// RetryAfter is how long Telegram asks to wait before repeating a
+	// request that hit the flood limit; zero when it did not say.
+	RetryAfter time.Duration
+}
+
+// Error describes the rejection with Telegram's code and description.
+func (e *APIError) Error() string {
+	if e.Description == "" {
+		return fmt.Sprintf("telegram: error %d", e.ErrorCode)
+	}
+	return fmt.Sprintf("telegram: error %d: %s", e.ErrorCode, e.Description)
+}
+
+// Is reports whether the error is the sentinel for its error code.
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrBlocked:
+		return e.ErrorCode == http.StatusForbidden
+	case ErrConflict:
+		return e.ErrorCode == http.StatusConflict
+	}
+	return false
+}
+
+// decodeResponse decodes a Bot API response into result, which may be nil
+// when the method returns nothing of interest. A non-200 status or an
+// "ok":false body is returned as *APIError; when the body cannot be decoded
+// the HTTP status code stands in for Telegram's error code.
+func decodeResponse(resp *http.Response, result any) error {
+	var out struct {
+		OK          bool            `json:"ok"`
+		ErrorCode   int             `json:"error_code"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+		Parameters  struct {
+			RetryAfter int `json:"retry_after"`
+		} `json:"parameters"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return &APIError{ErrorCode: resp.StatusCode, Description: http.StatusText(resp.StatusCode)}
+		}
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || !out.OK {
+		e := &APIError{ErrorCode: out.ErrorCode, Description: out.Description, RetryAfter: time.Duration(out.Parameters.RetryAfter) * time.Second}
+		if e.ErrorCode == 0 {
+			e.ErrorCode = resp.StatusCode
+		}
+		return e
+	}
+	if result == nil || len(out.Result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(out.Result, result)
+}
+
 // NewClient constructs a Telegram API client using the provided bot token.
 func NewClient(token string) *Client {
+	return NewClientWithBaseURL(token, "https://api.telegram.org")
+}
+
+// NewClientWithBaseURL constructs a client talking to a custom Bot API server,
+// such as a local server or a test double.
+func NewClientWithBaseURL(token, baseURL string) *Client {
 	return &Client{
 		token:      token,
-		baseURL:    "https://api.telegram.org",
+		baseURL:    strings.TrimRight(baseURL, "/"),
 		httpClient: http.DefaultClient,
 	}
 }
@@ -55,12 +187,15 @@ func (c *Client) url(method string) string {
 	return c.baseURL + "/bot" + c.token + "/" + method
 }
 
-// SendMessage sends a text message with an optional custom keyboard.
-func (c *Client) SendMessage(ctx context.Context, chatID int64, text string, keyboard [][]string) (int, error) {
+// SendMessage sends a text message with an optional custom keyboard using the
+// given parse mode. ParseModeNone sends the text as is.
+func (c *Client) SendMessage(ctx context.Context, chatID int64, text string, keyboard [][]string, mode ParseMode) (int, error) {
 	body := map[string]any{
-		"chat_id":    chatID,
-		"text":       text,
-		"parse_mode": "HTML",
+		"chat_id": chatID,
+		"text":    text,
+	}
+	if mode != ParseModeNone {
+		body["parse_mode"] = string(mode)
 	}
 	if keyboard != nil {
 		body["reply_markup"] = map[string]any{
@@ -83,20 +218,47 @@ func (c *Client) SendMessage(ctx context.Context, chatID int64, text string, key
 		return 0, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return 0, errors.New("telegram: unexpected status " + resp.Status)
+	var msg Message
+	if err := decodeResponse(resp, &msg); err != nil {
+		return 0, err
 	}
-	var out struct {
-		OK     bool    `json:"ok"`
-		Result Message `json:"result"`
+	return msg.MessageID, nil
+}
+
+// SendDocument uploads data as a file with the given name and an optional
+// plain-text caption.
+func (c *Client) SendDocument(ctx context.Context, chatID int64, filename string, data []byte, caption string) (int, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	w.WriteField("chat_id", strconv.FormatInt(chatID, 10))
+	if caption != "" {
+		w.WriteField("caption", caption)
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+	part, err := w.CreateFormFile("document", filename)
+	if err != nil {
 		return 0, err
 	}
-	if !out.OK {
-		return 0, errors.New("telegram: api responded with not ok")
+	if _, err := part.Write(data); err != nil {
+		return 0, err
 	}
-	return out.Result.MessageID, nil
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url("sendDocument"), &buf)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var msg Message
+	if err := decodeResponse(resp, &msg); err != nil {
+		return 0, err
+	}
+	return msg.MessageID, nil
 }
 
 // GetUpdates fetches updates starting from the given offset.
@@ -115,21 +277,29 @@ func (c *Client) GetUpdates(ctx context.Context, offset int) ([]Update, error) {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("telegram: unexpected status " + resp.Status)
-	}
-	var wrapper struct {
-		OK     bool     `json:"ok"`
-		Result []Update `json:"result"`
+	var updates []Update
+	if err := decodeResponse(resp, &updates); err != nil {
+		return nil, err
 	}
+	return updates, nil
+}
 
-	if err := json.NewDecoder(resp.Body).Decode(&wrapper); err != nil {
-		return nil, err
+// GetMe returns the bot's own account.
+func (c *Client) GetMe(ctx context.Context) (User, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url("getMe"), nil)
+	if err != nil {
+		return User{}, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return User{}, err
 	}
-	if !wrapper.OK {
-		return nil, errors.New("telegram: api responded with not ok")
+	defer resp.Body.Close()
+	var me User
+	if err := decodeResponse(resp, &me); err != nil {
+		return User{}, err
 	}
-	return wrapper.Result, nil
+	return me, nil
 }
 
 // SetCommands registers the bot commands shown in the Telegram UI.
@@ -149,10 +319,116 @@ func (c *Client) SetCommands(ctx context.Context, commands []BotCommand) error {
 		return err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return errors.New("telegram: unexpected status " + resp.Status)
+	return decodeResponse(resp, nil)
+}
+
+// SetMyDescription sets the description shown in the bot's profile and in an
+// empty chat with the bot.
+func (c *Client) SetMyDescription(ctx context.Context, description string) error {
+	return c.setProfileText(ctx, "setMyDescription", "description", description)
+}
+
+// SetMyShortDescription sets the short "about" text shown in the bot's
+// profile and in shared links.
+func (c *Client) SetMyShortDescription(ctx context.Context, description string) error {
+	return c.setProfileText(ctx, "setMyShortDescription", "short_description", description)
+}
+
+// setProfileText calls a method taking a single profile text field.
+func (c *Client) setProfileText(ctx context.Context, method, field, text string) error {
+	return c.postJSON(ctx, method, map[string]string{field: text}, nil)
+}
+
+// postJSON calls a Bot API method with a JSON body and decodes its result
+// into result unless it is nil.
+func (c *Client) postJSON(ctx context.Context, method string, body, result any) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url(method), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return decodeResponse(resp, result)
+}
+
+// SendInlineMessage sends a text message with inline buttons under it using
+// the given parse mode.
+func (c *Client) SendInlineMessage(ctx context.Context, chatID int64, text string, buttons [][]InlineButton, mode ParseMode) (int, error) {
+	body := map[string]any{
+		"chat_id":      chatID,
+		"text":         text,
+		"reply_markup": map[string]any{"inline_keyboard": buttons},
+	}
+	if mode != ParseModeNone {
+		body["parse_mode"] = string(mode)
+	}
+	var msg Message
+	if err := c.postJSON(ctx, "sendMessage", body, &msg); err != nil {
+		return 0, err
+	}
+	return msg.MessageID, nil
+}
+
+// EditInlineMessage replaces the text of a previously sent message and sets
+// the inline buttons under it.
+func (c *Client) EditInlineMessage(ctx context.Context, chatID int64, messageID int, text string, buttons [][]InlineButton, mode ParseMode) error {
+	body := map[string]any{
+		"chat_id":      chatID,
+		"message_id":   messageID,
+		"text":         text,
+		"reply_markup": map[string]any{"inline_keyboard": buttons},
+	}
+	if mode != ParseModeNone {
+		body["parse_mode"] = string(mode)
+	}
+	return c.postJSON(ctx, "editMessageText", body, nil)
+}
+
+// AnswerCallbackQuery confirms a button press, stopping the loading
+// indicator on the button. A non-empty text is shown to the user as a short
+// notification.
+func (c *Client) AnswerCallbackQuery(ctx context.Context, queryID, text string) error {
+	body := map[string]any{"callback_query_id": queryID}
+	if text != "" {
+		body["text"] = text
 	}
-	return nil
+	return c.postJSON(ctx, "answerCallbackQuery", body, nil)
+}
+
+// EditMessageText replaces the text of a previously sent message using the
+// given parse mode.
+func (c *Client) EditMessageText(ctx context.Context, chatID int64, messageID int, text string, mode ParseMode) error {
+	body := map[string]any{
+		"chat_id":    chatID,
+		"message_id": messageID,
+		"text":       text,
+	}
+	if mode != ParseModeNone {
+		body["parse_mode"] = string(mode)
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url("editMessageText"), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return decodeResponse(resp, nil)
 }
 
 // DeleteMessage removes a previously sent message.
@@ -175,8 +451,5 @@ func (c *Client) DeleteMessage(ctx context.Context, chatID int64, messageID int)
 		return err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return errors.New("telegram: unexpected status " + resp.Status)
-	}
-	return nil
+	return decodeResponse(resp, nil)
 }
@@ -0,0 +1,216 @@
+package telegram
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestEscapeMarkdownV2 checks that every reserved character is escaped and
+// regular text, including Cyrillic and emoji, is kept intact.
+func TestEscapeMarkdownV2(t *testing.T) {
+	cases := map[string]string{
+		"plain текст 🚀":          "plain текст 🚀",
+		"1. item - x":            "1\\. item \\- x",
+		"_*[]()~`>#+-=|{}.!":     "\\_\\*\\[\\]\\(\\)\\~\\`\\>\\#\\+\\-\\=\\|\\{\\}\\.\\!",
+		`back\slash`:             `back\\slash`,
+		"[link](http://a.b/c?d)": "\\[link\\]\\(http://a\\.b/c?d\\)",
+		"":                       "",
+	}
+	for in, want := range cases {
+		if got := EscapeMarkdownV2(in); got != want {
+			t.Errorf("EscapeMarkdownV2(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// TestSendMessage_Blocked checks that a 403 response is reported as ErrBlocked.
+func TestSendMessage_Blocked(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+	c := NewClientWithBaseURL("token", srv.URL)
+	if _, err := c.SendMessage(context.Background(), 1, "hi", nil, ParseModeNone); !errors.Is(err, ErrBlocked) {
+		t.Fatalf("expected ErrBlocked, got %v", err)
+	}
+}
+
+// TestGetUpdates_Conflict checks that a 409 response is reported as
+// ErrConflict.
+func TestGetUpdates_Conflict(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"ok":false,"error_code":409,"description":"Conflict: terminated by other getUpdates request"}`))
+	}))
+	defer srv.Close()
+	c := NewClientWithBaseURL("token", srv.URL)
+	if _, err := c.GetUpdates(context.Background(), 0); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+}
+
+// TestSendDocument checks the file is uploaded as multipart form data with the
+// chat, caption and file name.
+func TestSendDocument(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/sendDocument") {
+			t.Errorf("unexpected method %s", r.URL.Path)
+		}
+		file, header, err := r.FormFile("document")
+		if err != nil {
+			t.Errorf("form file: %v", err)
+			return
+		}
+		data, _ := io.ReadAll(file)
+		if r.FormValue("chat_id") != "7" || r.FormValue("caption") != "подпись" || header.Filename != "list.md" || string(data) != "# links" {
+			t.Errorf("unexpected upload: chat %q caption %q file %q %q", r.FormValue("chat_id"), r.FormValue("caption"), header.Filename, data)
+		}
+		w.Write([]byte(`{"ok":true,"result":{"message_id":5}}`))
+	}))
+	defer srv.Close()
+	c := NewClientWithBaseURL("token", srv.URL)
+	id, err := c.SendDocument(context.Background(), 7, "list.md", []byte("# links"), "подпись")
+	if err != nil || id != 5 {
+		t.Fatalf("send document: id %d, err %v", id, err)
+	}
+}
+
+// TestGetMe checks the bot account is decoded from the getMe response.
+func TestGetMe(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/getMe") {
+			t.Errorf("unexpected method %s", r.URL.Path)
+		}
+		w.Write([]byte(`{"ok":true,"result":{"id":42,"is_bot":true,"username":"MyBot"}}`))
+	}))
+	defer srv.Close()
+	me, err := NewClientWithBaseURL("token", srv.URL).GetMe(context.Background())
+	if err != nil || me.Username != "MyBot" || me.ID != 42 || !me.IsBot {
+		t.Fatalf("unexpected account %+v, %v", me, err)
+	}
+}
+
+// TestSetMyDescription checks both profile texts are sent to their methods
+// as JSON with the field names of the Bot API.
+func TestSetMyDescription(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got = append(got, r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]+" "+r.Header.Get("Content-Type")+" "+string(body))
+		w.Write([]byte(`{"ok":true,"result":true}`))
+	}))
+	defer srv.Close()
+	c := NewClientWithBaseURL("token", srv.URL)
+	if err := c.SetMyDescription(context.Background(), "Длинное описание"); err != nil {
+		t.Fatalf("set description: %v", err)
+	}
+	if err := c.SetMyShortDescription(context.Background(), "О боте"); err != nil {
+		t.Fatalf("set short description: %v", err)
+	}
+	want := []string{
+		`setMyDescription application/json {"description":"Длинное описание"}`,
+		`setMyShortDescription application/json {"short_description":"О боте"}`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected requests:\n got %q\nwant %q", got, want)
+	}
+}
+
+// TestAPIError checks Telegram's error bodies are decoded into *APIError for
+// every kind of method, including the flood-limit retry delay.
+func TestAPIError(t *testing.T) {
+	cases := []struct {
+		name   string
+		status int
+		body   string
+		call   func(c *Client) error
+		want   APIError
+		is     error
+	}{
+		{
+			name:   "blocked",
+			status: http.StatusForbidden,
+			body:   `{"ok":false,"error_code":403,"description":"Forbidden: bot was blocked by the user"}`,
+			call: func(c *Client) error {
+				_, err := c.SendMessage(context.Background(), 1, "hi", nil, ParseModeNone)
+				return err
+			},
+			want: APIError{ErrorCode: 403, Description: "Forbidden: bot was blocked by the user"},
+			is:   ErrBlocked,
+		},
+		{
+			name:   "conflict",
+			status: http.StatusConflict,
+			body:   `{"ok":false,"error_code":409,"description":"Conflict: terminated by other getUpdates request"}`,
+			call: func(c *Client) error {
+				_, err := c.GetUpdates(context.Background(), 0)
+				return err
+			},
+			want: APIError{ErrorCode: 409, Description: "Conflict: terminated by other getUpdates request"},
+			is:   ErrConflict,
+		},
+		{
+			name:   "flood limit",
+			status: http.StatusTooManyRequests,
+			body:   `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 35","parameters":{"retry_after":35}}`,
+			call: func(c *Client) error {
+				return c.EditMessageText(context.Background(), 1, 2, "hi", ParseModeNone)
+			},
+			want: APIError{ErrorCode: 429, Description: "Too Many Requests: retry after 35", RetryAfter: 35 * time.Second},
+		},
+		{
+			name:   "bad request",
+			status: http.StatusBadRequest,
+			body:   `{"ok":false,"error_code":400,"description":"Bad Request: message to delete not found"}`,
+			call: func(c *Client) error {
+				return c.DeleteMessage(context.Background(), 1, 2)
+			},
+			want: APIError{ErrorCode: 400, Description: "Bad Request: message to delete not found"},
+		},
+		{
+			name:   "not ok with status 200",
+			status: http.StatusOK,
+			body:   `{"ok":false,"error_code":400,"description":"Bad Request: BOT_COMMANDS_TOO_MUCH"}`,
+			call: func(c *Client) error {
+				return c.SetCommands(context.Background(), nil)
+			},
+			want: APIError{ErrorCode: 400, Description: "Bad Request: BOT_COMMANDS_TOO_MUCH"},
+		},
+		{
+			name:   "no body",
+			status: http.StatusBadGateway,
+			call: func(c *Client) error {
+				_, err := c.GetMe(context.Background())
+				return err
+			},
+			want: APIError{ErrorCode: 502, Description: "Bad Gateway"},
+		},
+	}
+	for _, tc := range cases {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.status)
+			w.Write([]byte(tc.body))
+		}))
+		err := tc.call(NewClientWithBaseURL("token", srv.URL))
+		srv.Close()
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) {
+			t.Fatalf("%s: expected *APIError, got %v", tc.name, err)
+		}
+		if *apiErr != tc.want {
+			t.Fatalf("%s: decoded %+v, want %+v", tc.name, *apiErr, tc.want)
+		}
+		if tc.is != nil && !errors.Is(err, tc.is) {
+			t.Fatalf("%s: expected the error to match %v", tc.name, tc.is)
+		}
+		if tc.is == nil && (errors.Is(err, ErrBlocked) || errors.Is(err, ErrConflict)) {
+			t.Fatalf("%s: error must not match a sentinel", tc.name)
+		}
+	}
+}